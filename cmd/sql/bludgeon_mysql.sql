@@ -10,10 +10,14 @@ CREATE TABLE IF NOT EXISTS employee (
     first_name TEXT,
     last_name TEXT,
     email_address TEXT NOT NULL,
+    email_address_normalized VARCHAR(320) NOT NULL,
+    archived BOOLEAN NOT NULL DEFAULT FALSE,
+    pending_delete BOOLEAN NOT NULL DEFAULT FALSE,
     version INT NOT NULL DEFAULT 1,
     PRIMARY KEY (id),
     UNIQUE(uuid),
-    UNIQUE(email_address)
+    UNIQUE(email_address),
+    UNIQUE(email_address_normalized)
 ) ENGINE = InnoDB;
 
 -- DROP TABLE IF EXISTS timer
@@ -30,4 +34,202 @@ CREATE TABLE IF NOT EXISTS timer (
     FOREIGN KEY (employee_id) REFERENCES employee(id),
     UNIQUE(uuid(36)),
     INDEX(id)
-) ENGINE = InnoDB;
\ No newline at end of file
+) ENGINE = InnoDB;
+
+-- DROP TABLE IF EXISTS timer_history
+CREATE TABLE IF NOT EXISTS timer_history (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    timer_id BIGINT NOT NULL,
+    version INT NOT NULL,
+    previous_employee_uuid VARCHAR(36) NOT NULL,
+    employee_uuid VARCHAR(36) NOT NULL,
+    changed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (id),
+    FOREIGN KEY (timer_id) REFERENCES timer(id) ON DELETE CASCADE,
+    UNIQUE(timer_id, version)
+) ENGINE = InnoDB;
+
+-- DROP TABLE IF EXISTS employee_redirect
+CREATE TABLE IF NOT EXISTS employee_redirect (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    uuid VARCHAR(36) NOT NULL,
+    employee_id BIGINT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (id),
+    FOREIGN KEY (employee_id) REFERENCES employee(id) ON DELETE CASCADE,
+    UNIQUE(uuid)
+) ENGINE = InnoDB;
+
+-- DROP TABLE IF EXISTS employee_directory
+CREATE TABLE IF NOT EXISTS employee_directory (
+    email_address_normalized VARCHAR(320) NOT NULL,
+    uuid VARCHAR(36) NOT NULL,
+    shard INT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (email_address_normalized),
+    INDEX(uuid)
+) ENGINE = InnoDB;
+
+
+-- DROP TABLE IF EXISTS employee_tombstone
+CREATE TABLE IF NOT EXISTS employee_tombstone (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    uuid VARCHAR(36) NOT NULL,
+    version INT NOT NULL,
+    deleted_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    deleted_by VARCHAR(64) NOT NULL DEFAULT "",
+    PRIMARY KEY (id),
+    UNIQUE(uuid),
+    INDEX(deleted_at)
+) ENGINE = InnoDB;
+
+-- DROP TABLE IF EXISTS employee_reservation
+CREATE TABLE IF NOT EXISTS employee_reservation (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    uuid VARCHAR(36) NOT NULL,
+    employee_uuid VARCHAR(36) NOT NULL,
+    state VARCHAR(16) NOT NULL,
+    expires_at TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (id),
+    UNIQUE(uuid),
+    INDEX(employee_uuid, state, expires_at),
+    INDEX(state, expires_at)
+) ENGINE = InnoDB;
+
+-- DROP TABLE IF EXISTS outbox
+CREATE TABLE IF NOT EXISTS outbox (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    sequence BIGINT NOT NULL,
+    entity_type VARCHAR(32) NOT NULL,
+    entity_uuid VARCHAR(36) NOT NULL,
+    version INT NOT NULL,
+    change_type VARCHAR(16) NOT NULL,
+    payload TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    delivered_at TIMESTAMP NULL DEFAULT NULL,
+    PRIMARY KEY (id),
+    UNIQUE(sequence),
+    INDEX(delivered_at, sequence)
+) ENGINE = InnoDB;
+
+-- DROP TABLE IF EXISTS change_sequence
+CREATE TABLE IF NOT EXISTS change_sequence (
+    id INT NOT NULL,
+    sequence BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (id)
+) ENGINE = InnoDB;
+
+INSERT IGNORE INTO change_sequence (id, sequence) VALUES (1, 0);
+
+-- DROP TABLE IF EXISTS employee_event
+CREATE TABLE IF NOT EXISTS employee_event (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    stream_uuid VARCHAR(36) NOT NULL,
+    stream_version INT NOT NULL,
+    event_type VARCHAR(32) NOT NULL,
+    data TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (id),
+    UNIQUE(stream_uuid, stream_version)
+) ENGINE = InnoDB;
+
+-- DROP TABLE IF EXISTS saga
+CREATE TABLE IF NOT EXISTS saga (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    uuid VARCHAR(36) NOT NULL,
+    name VARCHAR(64) NOT NULL,
+    state VARCHAR(16) NOT NULL,
+    step INT NOT NULL DEFAULT 0,
+    data TEXT NOT NULL,
+    error TEXT NOT NULL DEFAULT "",
+    version INT NOT NULL DEFAULT 1,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    PRIMARY KEY (id),
+    UNIQUE(uuid),
+    INDEX(state)
+) ENGINE = InnoDB;
+
+-- DROP TABLE IF EXISTS saga_journal
+CREATE TABLE IF NOT EXISTS saga_journal (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    saga_id BIGINT NOT NULL,
+    step INT NOT NULL,
+    step_name VARCHAR(64) NOT NULL,
+    phase VARCHAR(16) NOT NULL,
+    state VARCHAR(16) NOT NULL,
+    error TEXT NOT NULL DEFAULT "",
+    created_at TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    PRIMARY KEY (id),
+    INDEX(saga_id, id),
+    FOREIGN KEY (saga_id) REFERENCES saga(id) ON DELETE CASCADE
+) ENGINE = InnoDB;
+
+-- DROP TABLE IF EXISTS webhook_subscription
+CREATE TABLE IF NOT EXISTS webhook_subscription (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    uuid VARCHAR(36) NOT NULL,
+    url TEXT NOT NULL,
+    event_types TEXT NOT NULL,
+    secret VARCHAR(128) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (id),
+    UNIQUE(uuid)
+) ENGINE = InnoDB;
+
+-- DROP TABLE IF EXISTS webhook_delivery
+CREATE TABLE IF NOT EXISTS webhook_delivery (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    subscription_id BIGINT NOT NULL,
+    sequence BIGINT NOT NULL,
+    event_type VARCHAR(64) NOT NULL,
+    payload TEXT NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT "",
+    next_attempt_at TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    delivered_at TIMESTAMP(6) NULL DEFAULT NULL,
+    dead_at TIMESTAMP(6) NULL DEFAULT NULL,
+    claim VARCHAR(36) NOT NULL DEFAULT "",
+    PRIMARY KEY (id),
+    FOREIGN KEY (subscription_id) REFERENCES webhook_subscription(id) ON DELETE CASCADE,
+    UNIQUE(subscription_id, sequence),
+    INDEX(delivered_at, dead_at, next_attempt_at)
+) ENGINE = InnoDB;
+
+-- DROP TABLE IF EXISTS webhook_dead_letter
+CREATE TABLE IF NOT EXISTS webhook_dead_letter (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    subscription_id BIGINT NOT NULL,
+    sequence BIGINT NOT NULL,
+    event_type VARCHAR(64) NOT NULL,
+    payload TEXT NOT NULL,
+    attempts INT NOT NULL,
+    last_error TEXT NOT NULL,
+    failed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (id),
+    FOREIGN KEY (subscription_id) REFERENCES webhook_subscription(id) ON DELETE CASCADE
+) ENGINE = InnoDB;
+
+-- DROP TABLE IF EXISTS lease
+CREATE TABLE IF NOT EXISTS lease (
+    name VARCHAR(64) NOT NULL,
+    holder VARCHAR(128) NOT NULL DEFAULT "",
+    token BIGINT NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    version INT NOT NULL DEFAULT 1,
+    PRIMARY KEY (name)
+) ENGINE = InnoDB;
+
+-- DROP TABLE IF EXISTS xa_decision
+CREATE TABLE IF NOT EXISTS xa_decision (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    gtrid VARCHAR(64) NOT NULL,
+    state VARCHAR(16) NOT NULL,
+    branches TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    PRIMARY KEY (id),
+    UNIQUE(gtrid),
+    INDEX(state, created_at)
+) ENGINE = InnoDB;
@@ -0,0 +1,20 @@
+-- converts the uuid columns of employee and timer from TEXT to BINARY(16), it's
+--  optional and should only be run once; once converted, the application must
+--  be configured with ID_BINARY=true. Existing ids must be uuids (ULIDs can't be
+--  converted with UNHEX), new ids can be generated with any generator; binary
+--  ids are always read back formatted as uuids, but can be provided as either
+USE bludgeon;
+
+ALTER TABLE employee ADD COLUMN uuid_binary BINARY(16);
+UPDATE employee SET uuid_binary=UNHEX(REPLACE(uuid, '-', ''));
+ALTER TABLE employee
+    DROP COLUMN uuid,
+    CHANGE COLUMN uuid_binary uuid BINARY(16) NOT NULL AFTER id,
+    ADD UNIQUE(uuid);
+
+ALTER TABLE timer ADD COLUMN uuid_binary BINARY(16);
+UPDATE timer SET uuid_binary=UNHEX(REPLACE(uuid, '-', ''));
+ALTER TABLE timer
+    DROP COLUMN uuid,
+    CHANGE COLUMN uuid_binary uuid BINARY(16) NOT NULL AFTER id,
+    ADD UNIQUE(uuid);
@@ -0,0 +1,20 @@
+-- adds the normalized email address (the alternate key) to an employee table
+--  created before email addresses were normalized, it should only be run once.
+--  The backfill uses the default normalization (trimmed and lower-cased), if
+--  EMAIL_LOWERCASE_LOCAL or EMAIL_FOLD_PLUS are set otherwise, run the audit
+--  command with -repair once the script has completed. If adding the unique
+--  index fails, the employees listed by the SELECT are duplicates and have to
+--  be merged (EmployeeMerge) before the index can be added
+USE bludgeon;
+
+ALTER TABLE employee ADD COLUMN email_address_normalized VARCHAR(320) AFTER email_address;
+UPDATE employee SET email_address_normalized=LOWER(TRIM(email_address));
+
+SELECT email_address_normalized, GROUP_CONCAT(uuid) AS uuids
+    FROM employee
+    GROUP BY email_address_normalized
+    HAVING COUNT(*) > 1;
+
+ALTER TABLE employee
+    MODIFY COLUMN email_address_normalized VARCHAR(320) NOT NULL,
+    ADD UNIQUE(email_address_normalized);
@@ -0,0 +1,84 @@
+-- split mode: the timer service's database, timers hold the uuid of their
+-- employee rather than a foreign key since employees are stored in a separate
+-- database (bludgeon_employees.sql)
+
+-- DROP DATABASE IF EXISTS bludgeon_timers;
+CREATE DATABASE IF NOT EXISTS bludgeon_timers;
+
+USE bludgeon_timers;
+
+-- DROP TABLE IF EXISTS timer
+CREATE TABLE IF NOT EXISTS timer (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    uuid VARCHAR(36) NOT NULL,
+    start BIGINT NOT NULL,
+    finish BIGINT DEFAULT 0,
+    comment TEXT NOT NULL DEFAULT "",
+    completed BOOLEAN NOT NULL DEFAULT FALSE,
+    version INT NOT NULL DEFAULT 1,
+    employee_uuid VARCHAR(36) NOT NULL,
+    employee_verified BOOLEAN NOT NULL DEFAULT TRUE,
+    PRIMARY KEY (id),
+    UNIQUE(uuid),
+    INDEX(employee_uuid),
+    INDEX(employee_verified)
+) ENGINE = InnoDB;
+
+-- DROP TABLE IF EXISTS employee_verification
+CREATE TABLE IF NOT EXISTS employee_verification (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    timer_id BIGINT NOT NULL,
+    employee_uuid VARCHAR(36) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (id),
+    FOREIGN KEY (timer_id) REFERENCES timer(id) ON DELETE CASCADE,
+    UNIQUE(timer_id)
+) ENGINE = InnoDB;
+
+-- DROP TABLE IF EXISTS timer_history
+CREATE TABLE IF NOT EXISTS timer_history (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    timer_id BIGINT NOT NULL,
+    version INT NOT NULL,
+    previous_employee_uuid VARCHAR(36) NOT NULL,
+    employee_uuid VARCHAR(36) NOT NULL,
+    changed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (id),
+    FOREIGN KEY (timer_id) REFERENCES timer(id) ON DELETE CASCADE,
+    UNIQUE(timer_id, version)
+) ENGINE = InnoDB;
+
+-- DROP TABLE IF EXISTS outbox
+CREATE TABLE IF NOT EXISTS outbox (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    sequence BIGINT NOT NULL,
+    entity_type VARCHAR(32) NOT NULL,
+    entity_uuid VARCHAR(36) NOT NULL,
+    version INT NOT NULL,
+    change_type VARCHAR(16) NOT NULL,
+    payload TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    delivered_at TIMESTAMP NULL DEFAULT NULL,
+    PRIMARY KEY (id),
+    UNIQUE(sequence),
+    INDEX(delivered_at, sequence)
+) ENGINE = InnoDB;
+
+-- DROP TABLE IF EXISTS change_sequence
+CREATE TABLE IF NOT EXISTS change_sequence (
+    id INT NOT NULL,
+    sequence BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (id)
+) ENGINE = InnoDB;
+
+INSERT IGNORE INTO change_sequence (id, sequence) VALUES (1, 0);
+
+-- DROP TABLE IF EXISTS lease
+CREATE TABLE IF NOT EXISTS lease (
+    name VARCHAR(64) NOT NULL,
+    holder VARCHAR(128) NOT NULL DEFAULT "",
+    token BIGINT NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    version INT NOT NULL DEFAULT 1,
+    PRIMARY KEY (name)
+) ENGINE = InnoDB;
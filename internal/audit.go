@@ -0,0 +1,399 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+//these are the checks performed by the auditor
+const (
+	AuditTimerFinishBeforeStart    string = "timer_finish_before_start"
+	AuditTimerCompletedNotFinished string = "timer_completed_not_finished"
+	AuditTimerElapsedTimeNegative  string = "timer_elapsed_time_negative"
+	AuditVersionInvalid            string = "version_invalid"
+	AuditEmailInvalid              string = "email_invalid"
+	AuditEmailNormalizationStale   string = "email_normalization_stale"
+	AuditEmailDuplicate            string = "email_duplicate"
+	AuditOrphanedTimer             string = "orphaned_timer"
+	AuditOrphanedTimerHistory      string = "orphaned_timer_history"
+	AuditOrphanedRedirect          string = "orphaned_redirect"
+	AuditTimerHistoryGap           string = "timer_history_gap"
+)
+
+//AuditViolation describes a single row that violates an invariant
+type AuditViolation struct {
+	Check      string `json:"check"`
+	Table      string `json:"table"`
+	ID         string `json:"id"`
+	Detail     string `json:"detail"`
+	Repairable bool   `json:"repairable"`
+	Repaired   bool   `json:"repaired"`
+	Error      string `json:"error,omitempty"`
+}
+
+//AuditReport describes the outcome of an audit
+type AuditReport struct {
+	Violations []*AuditViolation `json:"violations"`
+	Repaired   int               `json:"repaired"`
+}
+
+//Unrepaired returns the number of violations that weren't repaired
+func (a *AuditReport) Unrepaired() int {
+	return len(a.Violations) - a.Repaired
+}
+
+//Audit can be used to scan the database for logical inconsistencies that
+// the constraints can't express (or that exist because a constraint was
+// dropped); if repair is true, violations that can be safely repaired are
+// repaired. Each repair re-checks its condition within its own statement so
+// that rows changed since the scan aren't repaired; email addresses are
+// checked against the normalization described by options
+func Audit(db Queryer, repair bool, options EmailOptions) (*AuditReport, error) {
+	report := &AuditReport{}
+	for _, audit := range []func(db Queryer) ([]*AuditViolation, error){
+		auditTimers,
+		auditVersions,
+		func(db Queryer) ([]*AuditViolation, error) { return auditEmails(db, options) },
+		auditOrphans,
+		auditTimerHistory,
+	} {
+		violations, err := audit(db)
+		if err != nil {
+			return nil, err
+		}
+		report.Violations = append(report.Violations, violations...)
+	}
+	if !repair {
+		return report, nil
+	}
+	for _, violation := range report.Violations {
+		if !violation.Repairable {
+			continue
+		}
+		if err := auditRepair(db, violation, options); err != nil {
+			violation.Error = err.Error()
+			continue
+		}
+		violation.Repaired = true
+		report.Repaired++
+	}
+	return report, nil
+}
+
+//auditQuery will execute the query and create a violation for each row, each
+// row must have two columns, the uuid and the detail
+func auditQuery(db Queryer, check, table string, repairable bool, query string, args ...interface{}) ([]*AuditViolation, error) {
+	return auditQueryScan(db, check, table, repairable, func(rows *sql.Rows, violation *AuditViolation) error {
+		return rows.Scan(idScan(&violation.ID), &violation.Detail)
+	}, query, args...)
+}
+
+//auditQueryNumeric will execute the query and create a violation for each row,
+// each row must have two columns, the (numeric) id and the detail
+func auditQueryNumeric(db Queryer, check, table string, repairable bool, query string, args ...interface{}) ([]*AuditViolation, error) {
+	return auditQueryScan(db, check, table, repairable, func(rows *sql.Rows, violation *AuditViolation) error {
+		var id int64
+
+		if err := rows.Scan(&id, &violation.Detail); err != nil {
+			return err
+		}
+		violation.ID = strconv.FormatInt(id, 10)
+		return nil
+	}, query, args...)
+}
+
+func auditQueryScan(db Queryer, check, table string, repairable bool, scan func(rows *sql.Rows, violation *AuditViolation) error, query string, args ...interface{}) ([]*AuditViolation, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var violations []*AuditViolation
+	for rows.Next() {
+		violation := &AuditViolation{
+			Check:      check,
+			Table:      table,
+			Repairable: repairable,
+		}
+		if err := scan(rows, violation); err != nil {
+			return nil, err
+		}
+		violations = append(violations, violation)
+	}
+	return violations, rows.Err()
+}
+
+//auditTimers will verify the start, finish and elapsed time of each timer,
+// there are no time slices in this schema and elapsed time isn't stored, it's
+// derived: finish-start once finished and now-start while running, so it's
+// the derived elapsed time that's verified
+func auditTimers(db Queryer) ([]*AuditViolation, error) {
+	query := fmt.Sprintf(`SELECT uuid, CONCAT('finish (', finish, ') is before start (', start, ')')
+		FROM %s WHERE finish<>0 AND finish<start`, tableTimer)
+	violations, err := auditQuery(db, AuditTimerFinishBeforeStart, tableTimer, false, query)
+	if err != nil {
+		return nil, err
+	}
+	query = fmt.Sprintf(`SELECT uuid, 'completed, but finish is 0'
+		FROM %s WHERE completed AND (finish=0 OR finish IS NULL)`, tableTimer)
+	violationsCompleted, err := auditQuery(db, AuditTimerCompletedNotFinished, tableTimer, false, query)
+	if err != nil {
+		return nil, err
+	}
+	//KIM: start is in nanoseconds, a running timer that starts in the future
+	// (by the database's clock) has a negative elapsed time
+	query = fmt.Sprintf(`SELECT uuid, CONCAT('elapsed time (', CAST(UNIX_TIMESTAMP(NOW(6))*1000000000 AS SIGNED)-start,
+		') is negative, start (', start, ') is in the future')
+		FROM %s WHERE (finish=0 OR finish IS NULL) AND start > UNIX_TIMESTAMP(NOW(6))*1000000000`, tableTimer)
+	violationsElapsed, err := auditQuery(db, AuditTimerElapsedTimeNegative, tableTimer, false, query)
+	if err != nil {
+		return nil, err
+	}
+	violations = append(violations, violationsCompleted...)
+	return append(violations, violationsElapsed...), nil
+}
+
+func auditVersions(db Queryer) ([]*AuditViolation, error) {
+	var violations []*AuditViolation
+
+	for _, table := range []string{tableEmployee, tableTimer} {
+		query := fmt.Sprintf(`SELECT uuid, CONCAT('version is ', version)
+			FROM %s WHERE version<1`, table)
+		violationsTable, err := auditQuery(db, AuditVersionInvalid, table, true, query)
+		if err != nil {
+			return nil, err
+		}
+		violations = append(violations, violationsTable...)
+	}
+	return violations, nil
+}
+
+//auditEmails will normalize each email address with the current options,
+// duplicates can exist if the options were changed after employees were
+// created, they have to be merged rather than repaired
+func auditEmails(db Queryer, options EmailOptions) ([]*AuditViolation, error) {
+	type employeeEmail struct {
+		id         string
+		email      string
+		normalized string
+	}
+
+	var violations []*AuditViolation
+	var employees []employeeEmail
+
+	query := fmt.Sprintf("SELECT uuid, email_address, email_address_normalized FROM %s ORDER BY id", tableEmployee)
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var employee employeeEmail
+
+		if err := rows.Scan(idScan(&employee.id), &employee.email, &employee.normalized); err != nil {
+			return nil, err
+		}
+		employees = append(employees, employee)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	owners := make(map[string]string)
+	for _, employee := range employees {
+		_, normalized, err := EmailNormalize(employee.email, options)
+		if err != nil {
+			violations = append(violations, &AuditViolation{
+				Check:  AuditEmailInvalid,
+				Table:  tableEmployee,
+				ID:     employee.id,
+				Detail: err.Error(),
+			})
+			continue
+		}
+		if owner, ok := owners[normalized]; ok {
+			violations = append(violations, &AuditViolation{
+				Check:  AuditEmailDuplicate,
+				Table:  tableEmployee,
+				ID:     employee.id,
+				Detail: fmt.Sprintf("email address normalizes to \"%s\", same as employee \"%s\"", normalized, owner),
+			})
+			continue
+		}
+		owners[normalized] = employee.id
+		if normalized != employee.normalized {
+			violations = append(violations, &AuditViolation{
+				Check:      AuditEmailNormalizationStale,
+				Table:      tableEmployee,
+				ID:         employee.id,
+				Detail:     fmt.Sprintf("normalized email address is \"%s\", expected \"%s\"", employee.normalized, normalized),
+				Repairable: true,
+			})
+		}
+	}
+	return violations, nil
+}
+
+func auditOrphans(db Queryer) ([]*AuditViolation, error) {
+	query := fmt.Sprintf(`SELECT t.uuid, CONCAT('employee ', t.employee_id, ' does not exist')
+		FROM %s t LEFT JOIN %s e ON t.employee_id=e.id WHERE e.id IS NULL`, tableTimer, tableEmployee)
+	violations, err := auditQuery(db, AuditOrphanedTimer, tableTimer, false, query)
+	if err != nil {
+		return nil, err
+	}
+	query = fmt.Sprintf(`SELECT h.id, CONCAT('timer ', h.timer_id, ' does not exist')
+		FROM %s h LEFT JOIN %s t ON h.timer_id=t.id WHERE t.id IS NULL`, tableTimerHistory, tableTimer)
+	violationsHistory, err := auditQueryNumeric(db, AuditOrphanedTimerHistory, tableTimerHistory, true, query)
+	if err != nil {
+		return nil, err
+	}
+	query = fmt.Sprintf(`SELECT r.uuid, CONCAT('employee ', r.employee_id, ' does not exist')
+		FROM %s r LEFT JOIN %s e ON r.employee_id=e.id WHERE e.id IS NULL`, tableEmployeeRedirect, tableEmployee)
+	violationsRedirect, err := auditQuery(db, AuditOrphanedRedirect, tableEmployeeRedirect, true, query)
+	if err != nil {
+		return nil, err
+	}
+	violations = append(violations, violationsHistory...)
+	return append(violations, violationsRedirect...), nil
+}
+
+//auditTimerHistory will verify that each timer's history is an unbroken chain
+// of owners: each entry's previous owner is the owner of the entry before it,
+// the last entry's owner is the timer's current owner and no entry is newer
+// than the timer itself
+func auditTimerHistory(db Queryer) ([]*AuditViolation, error) {
+	var violations []*AuditViolation
+	var timerPrevious, ownerPrevious string
+
+	query := fmt.Sprintf(`SELECT t.uuid, COALESCE(e.uuid, ''), t.version, h.version, h.previous_employee_uuid, h.employee_uuid
+		FROM %s h JOIN %s t ON h.timer_id=t.id LEFT JOIN %s e ON t.employee_id=e.id
+		ORDER BY t.id, h.version`, tableTimerHistory, tableTimer, tableEmployee)
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	violation := func(timerID, detail string) {
+		violations = append(violations, &AuditViolation{
+			Check:  AuditTimerHistoryGap,
+			Table:  tableTimerHistory,
+			ID:     timerID,
+			Detail: detail,
+		})
+	}
+	var timerID, owner, ownerLast string
+	for rows.Next() {
+		var timerVersion, version int
+		var previousEmployeeID, employeeID string
+
+		if err := rows.Scan(idScan(&timerID), idScan(&owner), &timerVersion, &version,
+			&previousEmployeeID, &employeeID); err != nil {
+			return nil, err
+		}
+		if timerID != timerPrevious {
+			if timerPrevious != "" && ownerLast != ownerPrevious {
+				violation(timerPrevious, fmt.Sprintf("last owner in history is \"%s\", but the timer is owned by \"%s\"",
+					ownerPrevious, ownerLast))
+			}
+			timerPrevious, ownerPrevious = timerID, previousEmployeeID
+		}
+		ownerLast = owner
+		if version > timerVersion {
+			violation(timerID, fmt.Sprintf("history version %d is newer than the timer (version %d)", version, timerVersion))
+		}
+		if previousEmployeeID != ownerPrevious {
+			violation(timerID, fmt.Sprintf("history version %d changed owner from \"%s\", but the owner was \"%s\"",
+				version, previousEmployeeID, ownerPrevious))
+		}
+		ownerPrevious = employeeID
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if timerPrevious != "" && ownerLast != ownerPrevious {
+		violation(timerPrevious, fmt.Sprintf("last owner in history is \"%s\", but the timer is owned by \"%s\"",
+			ownerPrevious, ownerLast))
+	}
+	return violations, nil
+}
+
+//auditRepair will repair a single violation, each statement includes the
+// condition of the violation so it won't change a row that's since changed
+func auditRepair(db Queryer, violation *AuditViolation, options EmailOptions) error {
+	var query string
+	var args []interface{}
+
+	switch violation.Check {
+	default:
+		return errors.Errorf("%s can't be repaired", violation.Check)
+	case AuditVersionInvalid:
+		query = fmt.Sprintf("UPDATE %s SET version=1 WHERE uuid=? AND version<1", violation.Table)
+		args = []interface{}{idArg(violation.ID)}
+	case AuditEmailNormalizationStale:
+		var emailAddress string
+
+		//KIM: the projection of an event sourced employee is normalized when
+		// it's rebuilt, repairing it directly would get ahead of its stream
+		if err := employeesEventSourced(db, violation.ID); err != nil {
+			return err
+		}
+		query = fmt.Sprintf("SELECT email_address FROM %s WHERE uuid=?", tableEmployee)
+		if err := db.QueryRow(query, idArg(violation.ID)).Scan(&emailAddress); err != nil {
+			return err
+		}
+		_, normalized, err := EmailNormalize(emailAddress, options)
+		if err != nil {
+			return err
+		}
+		query = fmt.Sprintf(`UPDATE %s SET email_address_normalized=?, version=version+1
+			WHERE uuid=? AND email_address=?`, tableEmployee)
+		args = []interface{}{normalized, idArg(violation.ID), emailAddress}
+	case AuditOrphanedTimerHistory:
+		id, err := strconv.ParseInt(violation.ID, 10, 64)
+		if err != nil {
+			return err
+		}
+		query = fmt.Sprintf(`DELETE h FROM %s h LEFT JOIN %s t ON h.timer_id=t.id
+			WHERE h.id=? AND t.id IS NULL`, tableTimerHistory, tableTimer)
+		args = []interface{}{id}
+	case AuditOrphanedRedirect:
+		query = fmt.Sprintf(`DELETE r FROM %s r LEFT JOIN %s e ON r.employee_id=e.id
+			WHERE r.uuid=? AND e.id IS NULL`, tableEmployeeRedirect, tableEmployee)
+		args = []interface{}{violation.ID}
+	}
+	tx, err := txBegin(db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	if err := RowsAffected(result, "no rows affected, the violation no longer exists"); err != nil {
+		return err
+	}
+	//KIM: repairs to employees and timers are changes like any other,
+	// so they're written to the outbox
+	switch violation.Table {
+	case tableEmployee:
+		employee, err := employeeScan(tx.QueryRow(employeeSelect("uuid=?"), idArg(violation.ID)))
+		if err != nil {
+			return err
+		}
+		if err := outboxWrite(tx, tableEmployee, employee.ID, employee.Version, ChangeUpdated, employee); err != nil {
+			return err
+		}
+	case tableTimer:
+		timer, err := timerScan(tx.QueryRow(timerSelect("t.uuid=?"), idArg(violation.ID)))
+		if err != nil {
+			return err
+		}
+		if err := outboxWrite(tx, tableTimer, timer.ID, timer.Version, ChangeUpdated, timer); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,459 @@
+package internal
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+//Cache provides an interface for caching serialized objects by key, it
+// can be implemented by external caches (e.g. redis or memcached) and
+// implementations should treat any failure as a cache miss
+type Cache interface {
+	Read(key string) ([]byte, bool)
+	Write(key string, value []byte)
+	Delete(key string)
+}
+
+//LRU is an in-process implementation of Cache with a fixed capacity,
+// when full, the least recently used entry is evicted
+type LRU struct {
+	mutex    sync.Mutex
+	capacity int
+	items    map[string]*list.Element
+	order    *list.List
+}
+
+type lruItem struct {
+	key   string
+	value []byte
+}
+
+//NewLRU can be used to create an LRU cache with the given capacity
+func NewLRU(capacity int) *LRU {
+	if capacity <= 0 {
+		capacity = 1
+	}
+	return &LRU{
+		capacity: capacity,
+		items:    make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+//Read will return the value for the key, if found
+func (l *LRU) Read(key string) ([]byte, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	element, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(element)
+	return element.Value.(*lruItem).value, true
+}
+
+//Write will store the value for the key, evicting the least
+// recently used entry if the cache is full
+func (l *LRU) Write(key string, value []byte) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if element, ok := l.items[key]; ok {
+		element.Value.(*lruItem).value = value
+		l.order.MoveToFront(element)
+		return
+	}
+	l.items[key] = l.order.PushFront(&lruItem{key: key, value: value})
+	for l.order.Len() > l.capacity {
+		element := l.order.Back()
+		l.order.Remove(element)
+		delete(l.items, element.Value.(*lruItem).key)
+	}
+}
+
+//Delete will remove the key from the cache
+func (l *LRU) Delete(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if element, ok := l.items[key]; ok {
+		l.order.Remove(element)
+		delete(l.items, key)
+	}
+}
+
+//Len returns the number of entries in the cache
+func (l *LRU) Len() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.order.Len()
+}
+
+//defaultCachedStoreWritten is the number of entities whose last written
+// version is remembered by a cached store
+const defaultCachedStoreWritten int = 4096
+
+//CachedStore provides a read-through cache in front of the employee and timer
+// functions, entries are keyed by uuid and stamped with the version; it keeps
+// track of the last version this process wrote for the most recently written
+// entities so that it never serves a cached version older than that, once an
+// entity is forgotten, its last version is kept in the cache as a floor
+type CachedStore struct {
+	mutex    sync.Mutex
+	db       Queryer
+	email    EmailOptions
+	cache    Cache
+	written  map[string]*list.Element
+	order    *list.List
+	sequence uint64
+	forgot   uint64
+	epochs   map[string]int
+}
+
+type cachedWritten struct {
+	key      string
+	version  int
+	sequence uint64
+}
+
+//NewCachedStore can be used to create a cached store, if cache
+// is nil, an LRU with a capacity of 1024 will be used; email addresses
+// are normalized with options
+func NewCachedStore(db Queryer, cache Cache, options EmailOptions) *CachedStore {
+	if cache == nil {
+		cache = NewLRU(1024)
+	}
+	return &CachedStore{
+		db:      db,
+		email:   options,
+		cache:   cache,
+		written: make(map[string]*list.Element),
+		order:   list.New(),
+		epochs:  make(map[string]int),
+	}
+}
+
+//KIM: the epoch is part of the key so that deleting all of a given
+// type can invalidate every entry without being able to enumerate
+// the keys within the cache
+func (c *CachedStore) key(entityType, id string) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return fmt.Sprintf("%s:%d:%s", entityType, c.epochs[entityType], id)
+}
+
+//floorKey returns the key of the floor of the entity with the given key,
+// the floor is the last version written before the entity was forgotten
+func floorKey(key string) string {
+	return key + ":floor"
+}
+
+//floor returns the floor of the entity with the given key, if it doesn't
+// have one, 0 is returned
+func (c *CachedStore) floor(key string) int {
+	var floor int
+
+	bytes, ok := c.cache.Read(floorKey(key))
+	if !ok {
+		return 0
+	}
+	if err := json.Unmarshal(bytes, &floor); err != nil {
+		return 0
+	}
+	return floor
+}
+
+//version returns the last version written by this process, if it
+// hasn't been forgotten
+func (c *CachedStore) version(key string) (int, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.written[key]; ok {
+		return element.Value.(*cachedWritten).version, true
+	}
+	return 0, false
+}
+
+//minimum returns the minimum version that can be served from the cache
+func (c *CachedStore) minimum(key string) int {
+	if version, ok := c.version(key); ok {
+		return version
+	}
+	//KIM: the floor is read outside of the lock since the cache may be
+	// external (e.g., shared with other processes)
+	return c.floor(key)
+}
+
+//begin returns the sequence of the last version written, a read should
+// call it before it reads from the database and provide it to store
+func (c *CachedStore) begin() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.sequence
+}
+
+//write will record the version written and update the cache
+func (c *CachedStore) write(key string, version int, value interface{}) {
+	c.store(key, version, value, c.record(key, version, false))
+}
+
+//record will record the version written, if the entity was deleted by
+// this process, the version is always recorded since it was re-created;
+// if deleted is true, the entity is recorded as deleted. Once more than
+// defaultCachedStoreWritten entities have been written, the least recently
+// written is forgotten; it returns the sequence of the version recorded
+func (c *CachedStore) record(key string, version int, deleted bool) uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.sequence++
+	element, ok := c.written[key]
+	if !ok {
+		element = c.order.PushFront(&cachedWritten{key: key})
+		c.written[key] = element
+	}
+	written := element.Value.(*cachedWritten)
+	switch {
+	case deleted:
+		written.version = sessionDeleted
+	case version > written.version || written.version == sessionDeleted:
+		written.version = version
+	}
+	written.sequence = c.sequence
+	c.order.MoveToFront(element)
+	for c.order.Len() > defaultCachedStoreWritten {
+		element := c.order.Back()
+		forgotten := element.Value.(*cachedWritten)
+		c.order.Remove(element)
+		delete(c.written, forgotten.key)
+		c.forgot = forgotten.sequence
+		//KIM: rather than falling back to 0, the version that's forgotten
+		// is kept as the entity's floor
+		if bytes, err := json.Marshal(forgotten.version); err == nil {
+			c.cache.Write(floorKey(forgotten.key), bytes)
+		}
+	}
+	return c.sequence
+}
+
+//store will update the cache only if the version is at least as new
+// as the version last written by this process, since is the sequence
+// from when the version was read (see begin)
+func (c *CachedStore) store(key string, version int, value interface{}, since uint64) {
+	if c.stale(key, version, since) {
+		return
+	}
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		c.cache.Delete(key)
+		return
+	}
+	c.cache.Write(key, bytes)
+}
+
+//stale returns true if the version is older than the version last written
+// by this process; if the entity's version has been forgotten, it's only
+// considered fresh if it was read after the version was forgotten and isn't
+// older than its floor
+func (c *CachedStore) stale(key string, version int, since uint64) bool {
+	if written, ok := c.version(key); ok {
+		return version < written
+	}
+	c.mutex.Lock()
+	forgot := c.forgot
+	c.mutex.Unlock()
+	//KIM: a read that started before the entity's version was forgotten
+	// may have read a version older than the one forgotten
+	return since < forgot || version < c.floor(key)
+}
+
+func (c *CachedStore) evict(key string, deleted bool) {
+	if deleted {
+		c.record(key, 0, true)
+	}
+	c.cache.Delete(key)
+}
+
+func (c *CachedStore) evictAll(entityType string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.epochs[entityType]++
+}
+
+//EmployeeCreate will create the employee and update the cache
+func (c *CachedStore) EmployeeCreate(employee *Employee) (*Employee, error) {
+	employee, err := EmployeeCreate(c.db, employee, c.email)
+	if err != nil {
+		return nil, err
+	}
+	c.write(c.key(tableEmployee, employee.ID), employee.Version, employee)
+	return employee, nil
+}
+
+//EmployeeWrite will mutate the employee and update the cache, if the
+// write fails (e.g. the version is stale) the cached employee is evicted
+func (c *CachedStore) EmployeeWrite(employee *Employee) (*Employee, error) {
+	if employee == nil {
+		return nil, errors.New("employee is nil")
+	}
+	key := c.key(tableEmployee, employee.ID)
+	employeeWritten, err := EmployeeWrite(c.db, employee, c.email)
+	if err != nil {
+		c.evict(key, false)
+		return nil, err
+	}
+	c.write(key, employeeWritten.Version, employeeWritten)
+	return employeeWritten, nil
+}
+
+//EmployeeDelete will delete the employee (or all employees) and
+// invalidate the cache
+func (c *CachedStore) EmployeeDelete(employee *Employee) error {
+	if employee == nil {
+		if err := EmployeeDelete(c.db, nil, c.email); err != nil {
+			return err
+		}
+		c.evictAll(tableEmployee)
+		return nil
+	}
+	tx, err := txBegin(c.db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	//KIM: EmployeeDelete also deletes an employee with the same normalized
+	// email address (with a different uuid), the employees are locked before
+	// they're deleted so every employee that's deleted is evicted
+	where, args := employeeDeleteWhere(employee, c.email)
+	employees, err := employeesLocked(tx, where, args...)
+	if err != nil {
+		return err
+	}
+	if err := EmployeeDelete(tx, employee, c.email); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	c.evict(c.key(tableEmployee, employee.ID), true)
+	for _, employee := range employees {
+		c.evict(c.key(tableEmployee, employee.ID), true)
+	}
+	return nil
+}
+
+//EmployeeRead will attempt to read the employee from the cache, if
+// it's not found or older than what this process has written, it
+// will be read from the database and the cache updated
+func (c *CachedStore) EmployeeRead(employeeID string) (*Employee, error) {
+	since := c.begin()
+	key := c.key(tableEmployee, employeeID)
+	if bytes, ok := c.cache.Read(key); ok {
+		employee := &Employee{}
+		if err := json.Unmarshal(bytes, employee); err == nil &&
+			employee.Version >= c.minimum(key) {
+			return employee, nil
+		}
+		c.cache.Delete(key)
+	}
+	employee, err := EmployeeRead(c.db, employeeID)
+	if err != nil {
+		return nil, err
+	}
+	if employee.ID == employeeID {
+		c.store(key, employee.Version, employee, since)
+	}
+	return employee, nil
+}
+
+//EmployeeMerge will merge the duplicate into the survivor and update the
+// cache, the duplicate is evicted since its uuid now resolves to the survivor
+// and cached timers are invalidated since they may have moved
+func (c *CachedStore) EmployeeMerge(survivorID string, survivorVersion int, duplicateID string, duplicateVersion int, rules *MergeRules) (*Employee, error) {
+	key := c.key(tableEmployee, survivorID)
+	employee, err := EmployeeMerge(c.db, survivorID, survivorVersion, duplicateID, duplicateVersion, rules, c.email)
+	if err != nil {
+		c.evict(key, false)
+		return nil, err
+	}
+	c.evict(c.key(tableEmployee, duplicateID), true)
+	c.evictAll(tableTimer)
+	c.write(key, employee.Version, employee)
+	return employee, nil
+}
+
+//TimerCreate will create the timer and update the cache
+func (c *CachedStore) TimerCreate(timer *Timer) (*Timer, error) {
+	timer, err := TimerCreate(c.db, timer)
+	if err != nil {
+		return nil, err
+	}
+	c.write(c.key(tableTimer, timer.ID), timer.Version, timer)
+	return timer, nil
+}
+
+//TimerReassign will assign the timer to a different employee and
+// update the cache, if the reassign fails, the cached timer is evicted
+func (c *CachedStore) TimerReassign(timerID string, timerVersion int, employeeID string) (*Timer, error) {
+	key := c.key(tableTimer, timerID)
+	timer, err := TimerReassign(c.db, timerID, timerVersion, employeeID)
+	if err != nil {
+		c.evict(key, false)
+		return nil, err
+	}
+	c.write(key, timer.Version, timer)
+	return timer, nil
+}
+
+//TimerWrite will mutate the timer and update the cache, if the write
+// fails (e.g. the version is stale) the cached timer is evicted
+func (c *CachedStore) TimerWrite(timer *Timer) (*Timer, error) {
+	if timer == nil {
+		return nil, errors.New("timer is nil")
+	}
+	key := c.key(tableTimer, timer.ID)
+	timerWritten, err := TimerWrite(c.db, timer)
+	if err != nil {
+		c.evict(key, false)
+		return nil, err
+	}
+	c.write(key, timerWritten.Version, timerWritten)
+	return timerWritten, nil
+}
+
+//TimerDelete will delete the timer (or all timers) and invalidate
+// the cache
+func (c *CachedStore) TimerDelete(timerID string) error {
+	if err := TimerDelete(c.db, timerID); err != nil {
+		return err
+	}
+	if timerID == "" {
+		c.evictAll(tableTimer)
+		return nil
+	}
+	c.evict(c.key(tableTimer, timerID), true)
+	return nil
+}
+
+//TimerRead will attempt to read the timer from the cache, if it's not
+// found or older than what this process has written, it will be read
+// from the database and the cache updated
+func (c *CachedStore) TimerRead(timerID string) (*Timer, error) {
+	since := c.begin()
+	key := c.key(tableTimer, timerID)
+	if bytes, ok := c.cache.Read(key); ok {
+		timer := &Timer{}
+		if err := json.Unmarshal(bytes, timer); err == nil &&
+			timer.Version >= c.minimum(key) {
+			return timer, nil
+		}
+		c.cache.Delete(key)
+	}
+	timer, err := TimerRead(c.db, timerID)
+	if err != nil {
+		return nil, err
+	}
+	c.store(key, timer.Version, timer, since)
+	return timer, nil
+}
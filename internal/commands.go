@@ -0,0 +1,670 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//these are the commands that can be provided as the first argument,
+// if no command is provided, the example is run
+const (
+	commandExample      string = "example"
+	commandVerifySchema string = "verify-schema"
+	commandAudit        string = "audit"
+	commandOutboxRelay  string = "outbox-relay"
+	commandChanges      string = "changes"
+	commandRebuild      string = "rebuild-projection"
+	commandSagaDelete   string = "saga-employee-delete"
+	commandSagaMerge    string = "saga-employee-merge"
+	commandSagaReassign string = "saga-timers-reassign"
+	commandSagaResume   string = "saga-resume"
+	commandEmployees    string = "employee-service"
+	commandTimers       string = "timer-service"
+	commandVerify       string = "employee-verify"
+	commandPurge        string = "tombstone-purge"
+	commandSubscribe    string = "webhook-subscribe"
+	commandWebhooks     string = "webhook-deliver"
+	commandReplay       string = "webhook-replay"
+	commandBackground   string = "background"
+	commandXAExample    string = "xa-example"
+	commandXARecover    string = "xa-recover"
+)
+
+func verifySchema(db *sql.DB, config *Configuration, args []string) error {
+	fmt.Printf("Verifying the schema for database \"%s\"\n", config.Database)
+	violations, err := SchemaVerify(db, config.Database)
+	if err != nil {
+		return err
+	}
+	for _, violation := range violations {
+		fmt.Printf("  %s\n", violation)
+	}
+	if len(violations) > 0 {
+		return errors.Errorf("%d schema violation(s) found", len(violations))
+	}
+	fmt.Println("  No schema violations found")
+	return nil
+}
+
+func audit(db *sql.DB, config *Configuration, args []string) error {
+	var repair bool
+
+	flags := flag.NewFlagSet(commandAudit, flag.ContinueOnError)
+	flags.BoolVar(&repair, "repair", false, "repair the violations that can be safely repaired")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	report, err := Audit(db, repair, config.EmailOptions())
+	if err != nil {
+		return err
+	}
+	bytes, err := json.MarshalIndent(report, "", " ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(bytes))
+	if n := report.Unrepaired(); n > 0 {
+		return errors.Errorf("%d violation(s) found", n)
+	}
+	return nil
+}
+
+func outboxRelay(db *sql.DB, args []string, osSignal chan os.Signal) error {
+	var publisher Publisher = NewWriterPublisher(os.Stdout)
+	var path string
+	var webhooks bool
+
+	flags := flag.NewFlagSet(commandOutboxRelay, flag.ContinueOnError)
+	flags.StringVar(&path, "file", "", "file to append messages to, if empty, messages are written to stdout")
+	flags.BoolVar(&webhooks, "webhooks", false, "queue messages as webhooks for the subscriptions")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	switch {
+	case webhooks:
+		publisher = NewWebhookPublisher(db)
+	case path != "":
+		filePublisher, err := NewFilePublisher(path)
+		if err != nil {
+			return err
+		}
+		defer filePublisher.Close()
+		publisher = filePublisher
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-osSignal:
+			cancel()
+		}
+	}()
+	relay := &OutboxRelay{DB: db, Publisher: publisher}
+	if err := relay.Run(ctx); err != nil && err != context.Canceled {
+		return err
+	}
+	return nil
+}
+
+func changes(db *sql.DB, args []string) error {
+	var after int64
+	var limit int
+
+	flags := flag.NewFlagSet(commandChanges, flag.ContinueOnError)
+	flags.Int64Var(&after, "after", 0, "sequence to read changes after")
+	flags.IntVar(&limit, "limit", 100, "maximum number of changes to read")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	messages, err := ChangesSince(db, after, limit)
+	if err != nil {
+		return err
+	}
+	for _, message := range messages {
+		bytes, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(bytes))
+	}
+	return nil
+}
+
+func rebuildProjection(db *sql.DB, config *Configuration, args []string) error {
+	result, err := ProjectionRebuild(db, config.EmailOptions())
+	if err != nil {
+		return err
+	}
+	bytes, err := json.MarshalIndent(result, "", " ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(bytes))
+	return nil
+}
+
+func sagaEmployeeDelete(db *sql.DB, config *Configuration, args []string) error {
+	var employeeID, timerPolicy string
+
+	flags := flag.NewFlagSet(commandSagaDelete, flag.ContinueOnError)
+	flags.StringVar(&employeeID, "employee", "", "uuid of the employee to delete")
+	flags.StringVar(&timerPolicy, "timers", SagaTimersCascade, "what to do with the employee's timers (cascade or orphan)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if employeeID == "" {
+		return errors.New("employee is required")
+	}
+	return sagaExecute(db, config, SagaEmployeeDelete, &EmployeeDeleteSagaData{
+		EmployeeID:  employeeID,
+		TimerPolicy: timerPolicy,
+	})
+}
+
+func sagaEmployeeMerge(db *sql.DB, config *Configuration, args []string) error {
+	var employeeID, toEmployeeID string
+
+	flags := flag.NewFlagSet(commandSagaMerge, flag.ContinueOnError)
+	flags.StringVar(&employeeID, "employee", "", "uuid of the employee to merge (the duplicate)")
+	flags.StringVar(&toEmployeeID, "to", "", "uuid of the employee to merge into (the survivor)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if employeeID == "" || toEmployeeID == "" {
+		return errors.New("employee and to are required")
+	}
+	return sagaExecute(db, config, SagaEmployeeMerge, &EmployeeMergeSagaData{
+		SurvivorID:  toEmployeeID,
+		DuplicateID: employeeID,
+	})
+}
+
+func sagaTimersReassign(db *sql.DB, config *Configuration, args []string) error {
+	var employeeID, toEmployeeID, timerIDs string
+
+	flags := flag.NewFlagSet(commandSagaReassign, flag.ContinueOnError)
+	flags.StringVar(&employeeID, "employee", "", "uuid of the employee to reassign timers from")
+	flags.StringVar(&toEmployeeID, "to", "", "uuid of the employee to reassign timers to")
+	flags.StringVar(&timerIDs, "timers", "", "comma separated uuids of the timers to reassign, if empty, all timers are reassigned")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if employeeID == "" || toEmployeeID == "" {
+		return errors.New("employee and to are required")
+	}
+	return sagaExecute(db, config, SagaTimersReassign, &TimersReassignSagaData{
+		FromEmployeeID: employeeID,
+		ToEmployeeID:   toEmployeeID,
+		TimerIDs:       splitList(timerIDs),
+	})
+}
+
+//sagaStores will create the stores the sagas are executed against, if the
+// address of the employee (or timer) service is configured, the service is
+// used, otherwise they're stored in the same database as the sagas
+func sagaStores(db *sql.DB, config *Configuration) (SagaEmployeeStore, SagaTimerStore, error) {
+	var timers SagaTimerStore = NewTimerStore(db)
+
+	if config.TimerServiceAddress != "" {
+		timers = NewTimerClient(config.TimerServiceAddress, nil)
+	}
+	if config.EmployeeServiceAddress != "" {
+		return NewEmployeeClient(config.EmployeeServiceAddress, nil), timers, nil
+	}
+	store, err := NewEmployeeStore(db, config.EmployeeStorage, config.EmailOptions())
+	if err != nil {
+		return nil, nil, err
+	}
+	employees, ok := store.(SagaEmployeeStore)
+	if !ok {
+		return nil, nil, errors.Errorf("sagas aren't supported with employee storage: \"%s\"", config.EmployeeStorage)
+	}
+	return employees, timers, nil
+}
+
+//sagaOrchestrator will create an orchestrator for every saga, the sagas
+// are journaled in db
+func sagaOrchestrator(db *sql.DB, config *Configuration) (*SagaOrchestrator, error) {
+	employees, timers, err := sagaStores(db, config)
+	if err != nil {
+		return nil, err
+	}
+	return NewSagaOrchestrator(db, Sagas(employees, timers)...), nil
+}
+
+//sagaExecute will execute the named saga with the given data and print it
+func sagaExecute(db *sql.DB, config *Configuration, name string, data interface{}) error {
+	orchestrator, err := sagaOrchestrator(db, config)
+	if err != nil {
+		return err
+	}
+	saga, err := orchestrator.Execute(context.Background(), name, data)
+	if saga != nil {
+		bytes, errMarshal := json.MarshalIndent(saga, "", " ")
+		if errMarshal != nil {
+			return errMarshal
+		}
+		fmt.Println(string(bytes))
+	}
+	return err
+}
+
+func sagaResume(db *sql.DB, config *Configuration, args []string) error {
+	var list bool
+
+	flags := flag.NewFlagSet(commandSagaResume, flag.ContinueOnError)
+	flags.BoolVar(&list, "list", false, "list the incomplete sagas (and their journals) rather than resuming them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if list {
+		sagas, err := SagasIncomplete(db)
+		if err != nil {
+			return err
+		}
+		for _, saga := range sagas {
+			fmt.Printf("  saga %s (%s): %s at step %d\n", saga.ID, saga.Name, saga.State, saga.Step)
+			entries, err := SagaJournalRead(db, saga.ID)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				fmt.Printf("    %d %s %s: %s\n", entry.Step, entry.StepName, entry.Phase, entry.State)
+			}
+		}
+		return nil
+	}
+	orchestrator, err := sagaOrchestrator(db, config)
+	if err != nil {
+		return err
+	}
+	sagas, err := orchestrator.Resume(context.Background())
+	for _, saga := range sagas {
+		fmt.Printf("  saga %s (%s): %s\n", saga.ID, saga.Name, saga.State)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("  %d saga(s) resumed\n", len(sagas))
+	return nil
+}
+
+//serve will serve the handler at the address until a signal is received,
+// requests in progress are allowed to complete before it returns
+func serve(address string, handler http.Handler, osSignal chan os.Signal) error {
+	server := &http.Server{
+		Addr:    address,
+		Handler: handler,
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+	fmt.Printf("Listening on \"%s\"\n", address)
+	select {
+	case err := <-errs:
+		return err
+	case <-osSignal:
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultHTTPTimeout)
+	defer cancel()
+	return server.Shutdown(ctx)
+}
+
+func employeeService(db *sql.DB, config *Configuration, osSignal chan os.Signal) error {
+	store, err := NewEmployeeStore(db, config.EmployeeStorage, config.EmailOptions())
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	service := NewEmployeeService(store)
+	mux.Handle(routeEmployees, service)
+	mux.Handle(routeEmployees+"/", service)
+	return serve(config.HTTPAddress, mux, osSignal)
+}
+
+//splitTimerStore will create the timer store for the timer service, if
+// the address of the employee service is configured, it's used (with a
+// cache) to verify employees
+func splitTimerStore(db *sql.DB, config *Configuration) (*SplitTimerStore, error) {
+	var lookup EmployeeLookup
+
+	policy, err := NewEmployeeLookupPolicy(config.EmployeeLookupPolicy)
+	if err != nil {
+		return nil, err
+	}
+	if config.EmployeeServiceAddress != "" {
+		lookup = NewCachedEmployeeLookup(NewHTTPEmployeeLookup(
+			NewEmployeeClient(config.EmployeeServiceAddress, nil)), nil, 0)
+	}
+	return NewSplitTimerStore(db, lookup, policy), nil
+}
+
+func employeeVerify(db *sql.DB, config *Configuration) error {
+	store, err := splitTimerStore(db, config)
+	if err != nil {
+		return err
+	}
+	verification, err := store.EmployeesVerify(context.Background())
+	if err != nil {
+		return err
+	}
+	bytes, err := json.MarshalIndent(verification, "", " ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(bytes))
+	return nil
+}
+
+func timerService(db *sql.DB, config *Configuration, osSignal chan os.Signal) error {
+	store, err := splitTimerStore(db, config)
+	if err != nil {
+		return err
+	}
+	var timerStore TimerStore = store
+	if config.EmployeeServiceAddress != "" && config.EmployeeReservationTTL > 0 {
+		timerStore = NewReservedTimerStore(store, NewEmployeeClient(config.EmployeeServiceAddress, nil),
+			config.EmployeeReservationTTL)
+	}
+	mux := http.NewServeMux()
+	service := NewTimerService(timerStore)
+	mux.Handle(routeTimers, service)
+	mux.Handle(routeTimers+"/", service)
+	return serve(config.HTTPAddress, mux, osSignal)
+}
+
+func tombstonePurge(db *sql.DB, config *Configuration, args []string) error {
+	var retention time.Duration
+
+	flags := flag.NewFlagSet(commandPurge, flag.ContinueOnError)
+	flags.DurationVar(&retention, "retention", config.TombstoneRetention, "purge tombstones older than the retention")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	purged, err := EmployeeTombstonesPurge(db, retention)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Purged %d tombstone(s) older than %s\n", purged, retention)
+	return nil
+}
+
+func webhookSubscribe(db *sql.DB, args []string) error {
+	var url, eventTypes, secret string
+
+	flags := flag.NewFlagSet(commandSubscribe, flag.ContinueOnError)
+	flags.StringVar(&url, "url", "", "url to send webhooks to")
+	flags.StringVar(&eventTypes, "events", "employee.created,employee.updated,employee.deleted", "comma separated event types to subscribe to")
+	flags.StringVar(&secret, "secret", "", "secret used to sign webhooks, if empty, one is generated")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	subscription, err := WebhookSubscriptionCreate(db, &WebhookSubscription{
+		URL:        url,
+		EventTypes: splitList(eventTypes),
+		Secret:     secret,
+	})
+	if err != nil {
+		return err
+	}
+	bytes, err := json.MarshalIndent(subscription, "", " ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(bytes))
+	return nil
+}
+
+func webhookDeliver(db *sql.DB, args []string, osSignal chan os.Signal) error {
+	var maxAttempts int
+
+	flags := flag.NewFlagSet(commandWebhooks, flag.ContinueOnError)
+	flags.IntVar(&maxAttempts, "max-attempts", defaultWebhookMaxAttempts, "maximum number of attempts before a webhook is dead lettered")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-osSignal:
+			cancel()
+		}
+	}()
+	worker := &WebhookWorker{DB: db, MaxAttempts: maxAttempts}
+	if err := worker.Run(ctx); err != nil && err != context.Canceled {
+		return err
+	}
+	return nil
+}
+
+func webhookReplay(db *sql.DB, args []string) error {
+	var list bool
+	var id int64
+
+	flags := flag.NewFlagSet(commandReplay, flag.ContinueOnError)
+	flags.BoolVar(&list, "list", false, "list the dead letters rather than replaying them")
+	flags.Int64Var(&id, "id", 0, "dead letter to replay, if zero, all dead letters are replayed")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if list {
+		deadLetters, err := WebhookDeadLettersRead(db, "")
+		if err != nil {
+			return err
+		}
+		bytes, err := json.MarshalIndent(deadLetters, "", " ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(bytes))
+		return nil
+	}
+	var ids []int64
+	if id > 0 {
+		ids = append(ids, id)
+	}
+	replayed, err := WebhookReplay(db, ids...)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Replayed %d dead letter(s)\n", replayed)
+	return nil
+}
+
+//backgroundJobs will run the background jobs (outbox relay, audit, tombstone
+// and webhook purge) until the context is done, the writes are guarded by the fence; it
+// doesn't return until the relay has stopped, so nothing is still running
+// once demoted
+func backgroundJobs(ctx context.Context, db *sql.DB, config *Configuration, fence *Fence, publisher Publisher, interval time.Duration) {
+	var wg sync.WaitGroup
+
+	relay := &OutboxRelay{DB: db, Publisher: publisher, Fence: fence}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		relay.Run(ctx)
+	}()
+	defer wg.Wait()
+	for {
+		if report, err := Audit(db, false, config.EmailOptions()); err != nil {
+			fmt.Printf("  Error occured while auditing: \"%s\"\n", err)
+		} else if n := report.Unrepaired(); n > 0 {
+			fmt.Printf("  %d violation(s) found\n", n)
+		}
+		if err := WithFence(ctx, db, fence, func(tx Tx) error {
+			purged, err := EmployeeTombstonesPurge(tx, config.TombstoneRetention)
+			if err == nil && purged > 0 {
+				fmt.Printf("  Purged %d tombstone(s)\n", purged)
+			}
+			return err
+		}); err != nil {
+			fmt.Printf("  Error occured while purging tombstones: \"%s\"\n", err)
+		}
+		if err := WithFence(ctx, db, fence, func(tx Tx) error {
+			purged, err := WebhookDeliveriesPurge(tx, config.WebhookRetention)
+			if err == nil && purged > 0 {
+				fmt.Printf("  Purged %d webhook deliveries\n", purged)
+			}
+			return err
+		}); err != nil {
+			fmt.Printf("  Error occured while purging webhook deliveries: \"%s\"\n", err)
+		}
+		if expired, err := ReservationsExpire(db); err != nil {
+			fmt.Printf("  Error occured while expiring reservations: \"%s\"\n", err)
+		} else if expired > 0 {
+			fmt.Printf("  Expired %d reservation(s)\n", expired)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func background(db *sql.DB, config *Configuration, args []string, osSignal chan os.Signal) error {
+	var holder string
+	var ttl, interval time.Duration
+	var webhooks bool
+
+	hostname, _ := os.Hostname()
+	flags := flag.NewFlagSet(commandBackground, flag.ContinueOnError)
+	flags.StringVar(&holder, "holder", fmt.Sprintf("%s:%d", hostname, os.Getpid()), "unique id of this instance")
+	flags.DurationVar(&ttl, "ttl", defaultLeaseTTL, "how long the lease is valid for without being renewed")
+	flags.DurationVar(&interval, "interval", time.Hour, "interval to audit and purge tombstones and webhook deliveries")
+	flags.BoolVar(&webhooks, "webhooks", false, "queue messages as webhooks for the subscriptions")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	var publisher Publisher = NewWriterPublisher(os.Stdout)
+	if webhooks {
+		publisher = NewWebhookPublisher(db)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-osSignal:
+			cancel()
+		}
+	}()
+	election := &LeaderElection{
+		DB:     db,
+		Name:   LeaseBackground,
+		Holder: holder,
+		TTL:    ttl,
+		OnElected: func(ctx context.Context, fence *Fence) {
+			fmt.Printf("  %s elected with token %d\n", holder, fence.Token)
+			backgroundJobs(ctx, db, config, fence, publisher, interval)
+		},
+		OnDemoted: func(fence *Fence) {
+			fmt.Printf("  %s demoted from token %d\n", holder, fence.Token)
+		},
+	}
+	if err := election.Run(ctx); err != nil && err != context.Canceled {
+		return err
+	}
+	return nil
+}
+
+//xaDatabases will initialize the database for each branch of the xa example,
+// the addresses have the format host[:port][/database]
+func xaDatabases(config *Configuration, employees, timers string) (map[string]*sql.DB, error) {
+	databases := make(map[string]*sql.DB)
+	configs := configsFromAddresses(config, []string{employees, timers})
+	for i, name := range []string{"employees", "timers"} {
+		db, err := Initialize(configs[i])
+		if err != nil {
+			xaDatabasesClose(databases)
+			return nil, err
+		}
+		databases[name] = db
+	}
+	return databases, nil
+}
+
+func xaDatabasesClose(databases map[string]*sql.DB) {
+	for _, db := range databases {
+		db.Close()
+	}
+}
+
+func xaExample(db *sql.DB, config *Configuration, args []string) error {
+	var employees, timers, crashAfter string
+
+	address := config.Hostname + ":" + config.Port
+	flags := flag.NewFlagSet(commandXAExample, flag.ContinueOnError)
+	flags.StringVar(&employees, "employees", address+"/bludgeon_employees", "address of the employees database")
+	flags.StringVar(&timers, "timers", address+"/bludgeon_timers", "address of the timers database")
+	flags.StringVar(&crashAfter, "crash-after", "", "crash after \"prepare\" or \"decision\" to leave the transaction in doubt")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	databases, err := xaDatabases(config, employees, timers)
+	if err != nil {
+		return err
+	}
+	defer xaDatabasesClose(databases)
+	coordinator := NewXACoordinator(db)
+	coordinator.CrashAfter = crashAfter
+	employee := &Employee{
+		ID:           GenerateID(),
+		FirstName:    "Antonio",
+		LastName:     "Alexander",
+		EmailAddress: fmt.Sprintf("antonio.alexander+%d@mistersoftwaredeveloper.com", time.Now().UnixNano()),
+	}
+	timer := &Timer{ID: GenerateID(), Start: time.Now().UnixNano(), Comment: "xa example"}
+	gtrid, err := coordinator.XAEmployeeTimerCreate(context.Background(), databases["employees"],
+		databases["timers"], employee, timer, config.EmailOptions())
+	if err != nil {
+		return errors.Wrapf(err, "global transaction \"%s\"", gtrid)
+	}
+	fmt.Printf("Created employee \"%s\" and timer \"%s\" with global transaction \"%s\"\n",
+		employee.ID, timer.ID, gtrid)
+	return nil
+}
+
+func xaRecover(db *sql.DB, config *Configuration, args []string) error {
+	var employees, timers string
+	var list bool
+	var age time.Duration
+
+	address := config.Hostname + ":" + config.Port
+	flags := flag.NewFlagSet(commandXARecover, flag.ContinueOnError)
+	flags.StringVar(&employees, "employees", address+"/bludgeon_employees", "address of the employees database")
+	flags.StringVar(&timers, "timers", address+"/bludgeon_timers", "address of the timers database")
+	flags.BoolVar(&list, "list", false, "list the in-doubt transactions rather than resolving them")
+	flags.DurationVar(&age, "older-than", defaultXARecoverAge, "only recover transactions older than this")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	databases, err := xaDatabases(config, employees, timers)
+	if err != nil {
+		return err
+	}
+	defer xaDatabasesClose(databases)
+	inDoubt, err := NewXACoordinator(db).Recover(context.Background(), databases, age, !list)
+	if err != nil {
+		return err
+	}
+	bytes, err := json.MarshalIndent(inDoubt, "", " ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(bytes))
+	return nil
+}
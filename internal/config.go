@@ -1,5 +1,11 @@
 package internal
 
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
 //Configuration provides the different items we can use to
 // configure how we connect to the database
 type Configuration struct {
@@ -9,6 +15,28 @@ type Configuration struct {
 	Password  string `json:"password"`   //password to authenticate with
 	Database  string `json:"database"`   //database to connect to
 	ParseTime bool   `json:"parse_time"` //whether or not to parse time
+
+	EmailLowercaseLocal bool `json:"email_lowercase_local"` //whether or not to lower-case the local part of email addresses
+	EmailFoldPlus       bool `json:"email_fold_plus"`       //whether or not to remove +tag from email addresses
+
+	Replicas []string `json:"replicas"` //addresses (host:port) of read replicas
+	Shards   []string `json:"shards"`   //addresses (host:port/database) of shards
+
+	EmployeeStorage string `json:"employee_storage"` //how employees are stored (version or event)
+
+	IDGenerator string `json:"id_generator"` //generator used for new ids (uuidv4, uuidv7 or ulid)
+	IDBinary    bool   `json:"id_binary"`    //whether or not uuid columns are stored as BINARY(16)
+
+	HTTPAddress string `json:"http_address"` //address (host:port) the employee/timer services listen on
+
+	EmployeeServiceAddress string `json:"employee_service_address"` //address (host:port) of the employee service used by the timer service (and the sagas)
+	TimerServiceAddress    string `json:"timer_service_address"`    //address (host:port) of the timer service used by the sagas
+	EmployeeLookupPolicy   string `json:"employee_lookup_policy"`   //what to do if the employee service is unreachable (reject, accept-and-flag or queue)
+
+	EmployeeReservationTTL time.Duration `json:"employee_reservation_ttl"` //if non-zero, timers are created with a reservation on their employee held for up to the ttl
+
+	TombstoneRetention time.Duration `json:"tombstone_retention"` //how long the tombstones of deleted employees are kept
+	WebhookRetention   time.Duration `json:"webhook_retention"`   //how long delivered webhooks are kept
 }
 
 //ConfigFromEnv can be used to generate a configuration pointer
@@ -22,6 +50,21 @@ func ConfigFromEnv(envs map[string]string) *Configuration {
 		Password:  "mysql",
 		Database:  "bludgeon",
 		ParseTime: false,
+
+		EmailLowercaseLocal: true,
+		EmailFoldPlus:       false,
+
+		EmployeeStorage: EmployeeStorageVersion,
+
+		IDGenerator: IDGeneratorUUIDv4,
+		IDBinary:    false,
+
+		HTTPAddress: ":8080",
+
+		EmployeeLookupPolicy: EmployeeLookupReject,
+
+		TombstoneRetention: defaultTombstoneRetention,
+		WebhookRetention:   defaultWebhookRetention,
 	}
 	if hostname, ok := envs["HOSTNAME"]; ok {
 		c.Hostname = hostname
@@ -38,5 +81,105 @@ func ConfigFromEnv(envs map[string]string) *Configuration {
 	if database, ok := envs["DATABASE"]; ok {
 		c.Database = database
 	}
+	if emailLowercaseLocal, ok := envs["EMAIL_LOWERCASE_LOCAL"]; ok {
+		c.EmailLowercaseLocal, _ = strconv.ParseBool(emailLowercaseLocal)
+	}
+	if emailFoldPlus, ok := envs["EMAIL_FOLD_PLUS"]; ok {
+		c.EmailFoldPlus, _ = strconv.ParseBool(emailFoldPlus)
+	}
+	if replicas, ok := envs["REPLICAS"]; ok {
+		c.Replicas = splitList(replicas)
+	}
+	if shards, ok := envs["SHARDS"]; ok {
+		c.Shards = splitList(shards)
+	}
+	if employeeStorage, ok := envs["EMPLOYEE_STORAGE"]; ok {
+		c.EmployeeStorage = employeeStorage
+	}
+	if idGenerator, ok := envs["ID_GENERATOR"]; ok {
+		c.IDGenerator = idGenerator
+	}
+	if idBinary, ok := envs["ID_BINARY"]; ok {
+		c.IDBinary, _ = strconv.ParseBool(idBinary)
+	}
+	if httpAddress, ok := envs["HTTP_ADDRESS"]; ok {
+		c.HTTPAddress = httpAddress
+	}
+	if employeeServiceAddress, ok := envs["EMPLOYEE_SERVICE_ADDRESS"]; ok {
+		c.EmployeeServiceAddress = employeeServiceAddress
+	}
+	if timerServiceAddress, ok := envs["TIMER_SERVICE_ADDRESS"]; ok {
+		c.TimerServiceAddress = timerServiceAddress
+	}
+	if employeeLookupPolicy, ok := envs["EMPLOYEE_LOOKUP_POLICY"]; ok {
+		c.EmployeeLookupPolicy = employeeLookupPolicy
+	}
+	if employeeReservationTTL, ok := envs["EMPLOYEE_RESERVATION_TTL"]; ok {
+		if ttl, err := time.ParseDuration(employeeReservationTTL); err == nil {
+			c.EmployeeReservationTTL = ttl
+		}
+	}
+	if tombstoneRetention, ok := envs["TOMBSTONE_RETENTION"]; ok {
+		if retention, err := time.ParseDuration(tombstoneRetention); err == nil {
+			c.TombstoneRetention = retention
+		}
+	}
+	if webhookRetention, ok := envs["WEBHOOK_RETENTION"]; ok {
+		if retention, err := time.ParseDuration(webhookRetention); err == nil {
+			c.WebhookRetention = retention
+		}
+	}
 	return c
 }
+
+//EmailOptions can be used to generate the options used to normalize
+// email addresses
+func (c *Configuration) EmailOptions() EmailOptions {
+	return EmailOptions{
+		LowercaseLocal: c.EmailLowercaseLocal,
+		FoldPlus:       c.EmailFoldPlus,
+	}
+}
+
+//ReplicaConfigs can be used to generate a configuration for each
+// replica, they share everything except the host and port
+func (c *Configuration) ReplicaConfigs() []*Configuration {
+	return configsFromAddresses(c, c.Replicas)
+}
+
+//ShardConfigs can be used to generate a configuration for each
+// shard, they share everything except the host, port and database
+func (c *Configuration) ShardConfigs() []*Configuration {
+	return configsFromAddresses(c, c.Shards)
+}
+
+//configsFromAddresses will copy the configuration for each address
+// with the format host[:port][/database]
+func configsFromAddresses(c *Configuration, addresses []string) []*Configuration {
+	var configs []*Configuration
+
+	for _, address := range addresses {
+		config := *c
+		config.Replicas, config.Shards = nil, nil
+		if i := strings.Index(address, "/"); i >= 0 {
+			address, config.Database = address[:i], address[i+1:]
+		}
+		if i := strings.LastIndex(address, ":"); i >= 0 {
+			address, config.Port = address[:i], address[i+1:]
+		}
+		config.Hostname = address
+		configs = append(configs, &config)
+	}
+	return configs
+}
+
+func splitList(list string) []string {
+	var items []string
+
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+//EmailOptions describes how email addresses are normalized, the domain
+// is always lower-cased and surrounding whitespace is always trimmed; the
+// options should be the same for every process using a database since
+// changing them will change what's considered a duplicate
+type EmailOptions struct {
+	LowercaseLocal bool `json:"lowercase_local"` //whether or not to lower-case the local part
+	FoldPlus       bool `json:"fold_plus"`       //whether or not to remove +tag from the local part
+}
+
+//EmailNormalize can be used to validate and normalize an email address,
+// it returns the trimmed email address as well as its normalized form
+func EmailNormalize(emailAddress string, options EmailOptions) (string, string, error) {
+	emailAddress = strings.TrimSpace(emailAddress)
+	if err := EmailValidate(emailAddress); err != nil {
+		return "", "", err
+	}
+	i := strings.LastIndex(emailAddress, "@")
+	local, domain := emailAddress[:i], strings.ToLower(emailAddress[i+1:])
+	if options.FoldPlus {
+		if j := strings.Index(local, "+"); j > 0 {
+			local = local[:j]
+		}
+	}
+	if options.LowercaseLocal {
+		local = strings.ToLower(local)
+	}
+	return emailAddress, local + "@" + domain, nil
+}
+
+//EmailValidate can be used to perform a reasonable (but not exhaustive)
+// validation of an email address
+func EmailValidate(emailAddress string) error {
+	if emailAddress == "" {
+		return errors.New("email address is empty")
+	}
+	if len(emailAddress) > 320 {
+		return errors.Errorf("email address, \"%s\", is longer than 320 characters", emailAddress)
+	}
+	if strings.Count(emailAddress, "@") != 1 {
+		return errors.Errorf("email address, \"%s\", must contain exactly one @", emailAddress)
+	}
+	for _, r := range emailAddress {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return errors.Errorf("email address, \"%s\", contains whitespace or control characters", emailAddress)
+		}
+	}
+	i := strings.Index(emailAddress, "@")
+	local, domain := emailAddress[:i], emailAddress[i+1:]
+	switch {
+	case local == "":
+		return errors.Errorf("email address, \"%s\", has an empty local part", emailAddress)
+	case len(local) > 64:
+		return errors.Errorf("email address, \"%s\", has a local part longer than 64 characters", emailAddress)
+	case strings.HasPrefix(local, ".") || strings.HasSuffix(local, ".") || strings.Contains(local, ".."):
+		return errors.Errorf("email address, \"%s\", has a malformed local part", emailAddress)
+	case len(domain) > 253:
+		return errors.Errorf("email address, \"%s\", has a domain longer than 253 characters", emailAddress)
+	}
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return errors.Errorf("email address, \"%s\", has a malformed domain", emailAddress)
+	}
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return errors.Errorf("email address, \"%s\", has a malformed domain", emailAddress)
+		}
+		for _, r := range label {
+			if r != '-' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+				return errors.Errorf("email address, \"%s\", has a malformed domain", emailAddress)
+			}
+		}
+	}
+	return nil
+}
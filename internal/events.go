@@ -0,0 +1,609 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+)
+
+//mysqlErrDuplicateEntry is the mysql error number for a duplicate
+// entry for a unique key
+const mysqlErrDuplicateEntry uint16 = 1062
+
+//errDuplicate returns true if the error indicates that a row with the
+// same unique key already exists
+func errDuplicate(err error) bool {
+	var mysqlErr *mysql.MySQLError
+
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDuplicateEntry
+}
+
+//these are the supported employee storage modes
+const (
+	EmployeeStorageVersion string = "version"
+	EmployeeStorageEvent   string = "event"
+)
+
+//ErrEmployeeEventSourced is returned when an event sourced employee would be
+// changed without appending an event to its stream
+var ErrEmployeeEventSourced = errors.New("employee is event sourced")
+
+//these are the types of events within an employee's stream
+const (
+	EventEmployeeCreated      string = "EmployeeCreated"
+	EventEmployeeNameChanged  string = "NameChanged"
+	EventEmployeeEmailChanged string = "EmailChanged"
+	EventEmployeeDeleted      string = "Deleted"
+)
+
+//EmployeeEvent describes a single event within an employee's stream, the
+// stream version of the last event is the version of the employee
+type EmployeeEvent struct {
+	StreamID      string          `json:"stream_id"`
+	StreamVersion int             `json:"stream_version"`
+	Type          string          `json:"type"`
+	Data          json.RawMessage `json:"data"`
+	CreatedAt     int64           `json:"created_at"`
+}
+
+//employeeEventData is the data for all employee events, only the
+// fields that changed are populated
+type employeeEventData struct {
+	FirstName    *string `json:"first_name,omitempty"`
+	LastName     *string `json:"last_name,omitempty"`
+	EmailAddress *string `json:"email_address,omitempty"`
+}
+
+//employeeVersionStore stores employees using the version column
+type employeeVersionStore struct {
+	db    Queryer
+	email EmailOptions
+}
+
+func (e *employeeVersionStore) EmployeeCreate(employee *Employee) (*Employee, error) {
+	return EmployeeCreate(e.db, employee, e.email)
+}
+
+func (e *employeeVersionStore) EmployeeWrite(employee *Employee) (*Employee, error) {
+	return EmployeeWrite(e.db, employee, e.email)
+}
+
+func (e *employeeVersionStore) EmployeeDelete(employee *Employee) error {
+	return EmployeeDelete(e.db, employee, e.email)
+}
+
+func (e *employeeVersionStore) EmployeeRead(employeeID string) (*Employee, error) {
+	return EmployeeRead(e.db, employeeID)
+}
+
+func (e *employeeVersionStore) EmployeeReserve(employeeID, reservationID string, ttl time.Duration) (*EmployeeReservation, error) {
+	return EmployeeReserve(e.db, employeeID, reservationID, ttl)
+}
+
+func (e *employeeVersionStore) ReservationConfirm(employeeID, reservationID string) (*EmployeeReservation, error) {
+	return ReservationConfirm(e.db, employeeID, reservationID)
+}
+
+func (e *employeeVersionStore) ReservationCancel(employeeID, reservationID string) (*EmployeeReservation, error) {
+	return ReservationCancel(e.db, employeeID, reservationID)
+}
+
+func (e *employeeVersionStore) EmployeePendingDelete(employeeID string, pendingDelete bool) error {
+	return EmployeePendingDelete(e.db, employeeID, pendingDelete)
+}
+
+func (e *employeeVersionStore) EmployeeDeleteBy(employee *Employee, actor string) error {
+	return EmployeeDeleteBy(e.db, employee, actor, e.email)
+}
+
+func (e *employeeVersionStore) EmployeeMerge(survivorID string, survivorVersion int, duplicateID string, duplicateVersion int, rules *MergeRules) (*Employee, error) {
+	return EmployeeMerge(e.db, survivorID, survivorVersion, duplicateID, duplicateVersion, rules, e.email)
+}
+
+//NewEmployeeStore can be used to create an employee store for the given
+// storage mode (configured with EMPLOYEE_STORAGE), if storage is empty, the
+// version column is used; email addresses are normalized with options
+func NewEmployeeStore(db Queryer, storage string, options EmailOptions) (EmployeeStore, error) {
+	switch strings.ToLower(storage) {
+	default:
+		return nil, errors.Errorf("unsupported employee storage: \"%s\"", storage)
+	case EmployeeStorageVersion, "":
+		return &employeeVersionStore{db: db, email: options}, nil
+	case EmployeeStorageEvent:
+		return NewEventSourcedStore(db, options), nil
+	}
+}
+
+//EventSourcedStore stores employees as an append-only stream of events per
+// employee, the employee table is a projection of the streams that's updated
+// within the same transaction as the events are appended; concurrency is
+// handled by appending at the expected version, the unique index on the
+// stream's uuid and version only allows one writer to append a given version
+type EventSourcedStore struct {
+	db    Queryer
+	email EmailOptions
+}
+
+func (e *EventSourcedStore) EmployeeReserve(employeeID, reservationID string, ttl time.Duration) (*EmployeeReservation, error) {
+	return EmployeeReserve(e.db, employeeID, reservationID, ttl)
+}
+
+func (e *EventSourcedStore) ReservationConfirm(employeeID, reservationID string) (*EmployeeReservation, error) {
+	return ReservationConfirm(e.db, employeeID, reservationID)
+}
+
+func (e *EventSourcedStore) ReservationCancel(employeeID, reservationID string) (*EmployeeReservation, error) {
+	return ReservationCancel(e.db, employeeID, reservationID)
+}
+
+//NewEventSourcedStore can be used to create an event sourced store, email
+// addresses are normalized with options
+func NewEventSourcedStore(db Queryer, options EmailOptions) *EventSourcedStore {
+	return &EventSourcedStore{db: db, email: options}
+}
+
+//EmployeeEventsRead can be used to read the events of an employee's
+// stream, ordered by version
+func EmployeeEventsRead(db Queryer, employeeID string) ([]*EmployeeEvent, error) {
+	query := fmt.Sprintf(`SELECT stream_uuid, stream_version, event_type, data, UNIX_TIMESTAMP(created_at)
+		FROM %s WHERE stream_uuid=? ORDER BY stream_version`, tableEmployeeEvent)
+	rows, err := db.Query(query, employeeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []*EmployeeEvent
+	for rows.Next() {
+		var data []byte
+
+		event := &EmployeeEvent{}
+		if err := rows.Scan(&event.StreamID, &event.StreamVersion, &event.Type,
+			&data, &event.CreatedAt); err != nil {
+			return nil, err
+		}
+		event.Data = data
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+//employeeEventsFold will apply the events in order, it returns nil if
+// the stream is empty and deleted is true if the last event is a delete
+func employeeEventsFold(events []*EmployeeEvent) (employee *Employee, deleted bool, err error) {
+	for _, event := range events {
+		data := &employeeEventData{}
+		if len(event.Data) > 0 {
+			if err := json.Unmarshal(event.Data, data); err != nil {
+				return nil, false, err
+			}
+		}
+		switch event.Type {
+		default:
+			return nil, false, errors.Errorf("unsupported event type: \"%s\"", event.Type)
+		case EventEmployeeCreated:
+			employee, deleted = &Employee{ID: event.StreamID}, false
+		case EventEmployeeNameChanged, EventEmployeeEmailChanged:
+		case EventEmployeeDeleted:
+			deleted = true
+		}
+		if employee == nil {
+			return nil, false, errors.Errorf("stream \"%s\" doesn't start with %s", event.StreamID, EventEmployeeCreated)
+		}
+		if data.FirstName != nil {
+			employee.FirstName = *data.FirstName
+		}
+		if data.LastName != nil {
+			employee.LastName = *data.LastName
+		}
+		if data.EmailAddress != nil {
+			employee.EmailAddress = *data.EmailAddress
+		}
+		employee.Version = event.StreamVersion
+	}
+	return employee, deleted, nil
+}
+
+//employeeEventAppend will append an event to the stream at the expected version,
+// if another event has already been appended at that version, it'll return an error
+func employeeEventAppend(db Queryer, employeeID string, expectedVersion int, eventType string, data *employeeEventData) error {
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf(`INSERT INTO %s (stream_uuid, stream_version, event_type, data)
+		VALUES (?, ?, ?, ?)`, tableEmployeeEvent)
+	if _, err := db.Exec(query, employeeID, expectedVersion+1, eventType, bytes); err != nil {
+		if errDuplicate(err) {
+			return errors.Wrapf(err, "version mismatch, employee \"%s\" is no longer at version %d",
+				employeeID, expectedVersion)
+		}
+		return err
+	}
+	return nil
+}
+
+//employeesEventSourced returns ErrEmployeeEventSourced if any of the employees
+// have a stream, it's used by the operations that change the employee table
+// without appending an event (e.g., archiving or merging); the projection's
+// version would no longer match its stream and the change would be reverted
+// when the projection is rebuilt
+func employeesEventSourced(db Queryer, employeeIDs ...string) error {
+	var streamID string
+
+	args := make([]interface{}, 0, len(employeeIDs))
+	for _, employeeID := range employeeIDs {
+		args = append(args, employeeID)
+	}
+	query := fmt.Sprintf("SELECT stream_uuid FROM %s WHERE stream_uuid IN (?%s) LIMIT 1",
+		tableEmployeeEvent, strings.Repeat(", ?", len(employeeIDs)-1))
+	switch err := db.QueryRow(query, args...).Scan(&streamID); {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		return err
+	}
+	return errors.Wrapf(ErrEmployeeEventSourced, "employee with id, \"%s\"", streamID)
+}
+
+//employeeProject will update the employee table with the state of the stream,
+// it's inserted when created, updated when changed and deleted when deleted
+func employeeProject(db Queryer, employee *Employee, deleted bool, options EmailOptions) error {
+	if deleted {
+		query := fmt.Sprintf("DELETE FROM %s WHERE uuid=?", tableEmployee)
+		_, err := db.Exec(query, idArg(employee.ID))
+		return err
+	}
+	emailAddress, emailAddressNormalized, err := EmailNormalize(employee.EmailAddress, options)
+	if err != nil {
+		return err
+	}
+	if employee.Version == 1 {
+		query := fmt.Sprintf(`INSERT INTO %s (uuid, first_name, last_name, email_address, email_address_normalized, version)
+			VALUES (?, ?, ?, ?, ?, ?)`, tableEmployee)
+		_, err := db.Exec(query, idArg(employee.ID), employee.FirstName, employee.LastName,
+			emailAddress, emailAddressNormalized, employee.Version)
+		return err
+	}
+	query := fmt.Sprintf(`UPDATE %s SET first_name=?, last_name=?, email_address=?, email_address_normalized=?, version=?
+		WHERE uuid=?`, tableEmployee)
+	_, err = db.Exec(query, employee.FirstName, employee.LastName, emailAddress, emailAddressNormalized,
+		employee.Version, idArg(employee.ID))
+	return err
+}
+
+//employeeAppend will append the events, project the resulting state and write
+// it to the outbox, it returns the projected employee
+func (e *EventSourcedStore) employeeAppend(tx Queryer, employeeID string, version int, events []*EmployeeEvent, appended map[string]*employeeEventData) (*Employee, error) {
+	for _, eventType := range []string{EventEmployeeCreated, EventEmployeeNameChanged,
+		EventEmployeeEmailChanged, EventEmployeeDeleted} {
+		data, ok := appended[eventType]
+		if !ok {
+			continue
+		}
+		if err := employeeEventAppend(tx, employeeID, version, eventType, data); err != nil {
+			return nil, err
+		}
+		version++
+		bytes, _ := json.Marshal(data)
+		events = append(events, &EmployeeEvent{
+			StreamID:      employeeID,
+			StreamVersion: version,
+			Type:          eventType,
+			Data:          bytes,
+		})
+	}
+	employee, deleted, err := employeeEventsFold(events)
+	if err != nil {
+		return nil, err
+	}
+	if err := employeeProject(tx, employee, deleted, e.email); err != nil {
+		return nil, err
+	}
+	changeType := outboxChangeType(employee.Version)
+	if deleted {
+		changeType = ChangeDeleted
+	}
+	if err := outboxWrite(tx, tableEmployee, employee.ID, employee.Version, changeType, employee); err != nil {
+		return nil, err
+	}
+	return employee, nil
+}
+
+//EmployeeCreate will append an EmployeeCreated event to a new stream, like
+// EmployeeCreate, if an employee with the same uuid or email address exists,
+// its name is changed (if different) and it's returned instead
+func (e *EventSourcedStore) EmployeeCreate(employee *Employee) (*Employee, error) {
+	if employee == nil {
+		return nil, errors.New("employee is nil")
+	}
+	emailAddress, emailAddressNormalized, err := EmailNormalize(employee.EmailAddress, e.email)
+	if err != nil {
+		return nil, err
+	}
+	//KIM: the existing employee is read without a lock (a locking read of a
+	// row that doesn't exist would have two creates deadlock on the gap), so two
+	// creates of the same employee can both miss it; the one that appends (or
+	// projects) second fails with a duplicate and is retried, at which point it
+	// finds the employee created by the other. If the store is within a
+	// transaction, the transaction can't be retried, so the error is returned
+	employeeCreated, err := e.employeeCreate(employee, emailAddress, emailAddressNormalized)
+	if err != nil && errDuplicate(err) && txOwned(e.db) {
+		return e.employeeCreate(employee, emailAddress, emailAddressNormalized)
+	}
+	return employeeCreated, err
+}
+
+//employeeCreate will create the employee (or change the name of the existing
+// employee) within a single transaction
+func (e *EventSourcedStore) employeeCreate(employee *Employee, emailAddress, emailAddressNormalized string) (*Employee, error) {
+	tx, err := txBegin(e.db)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	existing, err := employeeScan(tx.QueryRow(employeeSelect("uuid=? OR email_address_normalized=? LIMIT 1"),
+		idArg(employee.ID), emailAddressNormalized))
+	switch {
+	case err == nil:
+		events, err := EmployeeEventsRead(tx, existing.ID)
+		if err != nil {
+			return nil, err
+		}
+		if existing.FirstName != employee.FirstName || existing.LastName != employee.LastName {
+			if existing, err = e.employeeAppend(tx, existing.ID, existing.Version, events, map[string]*employeeEventData{
+				EventEmployeeNameChanged: {FirstName: &employee.FirstName, LastName: &employee.LastName},
+			}); err != nil {
+				return nil, err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return existing, nil
+	case err != sql.ErrNoRows:
+		return nil, err
+	}
+	//KIM: the uuid is the stream's identity, so one is generated if
+	// it isn't provided rather than appending to an empty stream
+	employeeID := employee.ID
+	if employeeID == "" {
+		employeeID = GenerateID()
+	}
+	employeeCreated, err := e.employeeAppend(tx, employeeID, 0, nil, map[string]*employeeEventData{
+		EventEmployeeCreated: {
+			FirstName:    &employee.FirstName,
+			LastName:     &employee.LastName,
+			EmailAddress: &emailAddress,
+		},
+	})
+	if err != nil && !errDuplicate(err) {
+		return nil, err
+	}
+	//KIM: like EmployeeCreate, the tombstone is checked after the append, the
+	// stream of a deleted employee still exists so the append fails with a
+	// duplicate (rather than waiting on the delete's lock)
+	switch tombstone, err := employeeTombstoneRead(tx, employeeID, "LOCK IN SHARE MODE"); {
+	case err == nil:
+		return nil, &EmployeeDeletedError{*tombstone}
+	case err != sql.ErrNoRows:
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return employeeCreated, nil
+}
+
+//EmployeeWrite will append NameChanged and/or EmailChanged events at the
+// provided version, it will return an error if the provided version isn't
+// the current version; the version is incremented once per event
+func (e *EventSourcedStore) EmployeeWrite(employee *Employee) (*Employee, error) {
+	if employee == nil {
+		return nil, errors.New("employee is nil")
+	}
+	emailAddress, _, err := EmailNormalize(employee.EmailAddress, e.email)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := txBegin(e.db)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	events, err := EmployeeEventsRead(tx, employee.ID)
+	if err != nil {
+		return nil, err
+	}
+	current, deleted, err := employeeEventsFold(events)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil || deleted {
+		return nil, errors.Errorf("employee with id, \"%s\", not found locally", employee.ID)
+	}
+	if current.Version != employee.Version {
+		return nil, errors.Errorf("version mismatch, employee \"%s\" is at version %d not %d",
+			employee.ID, current.Version, employee.Version)
+	}
+	appended := make(map[string]*employeeEventData)
+	if current.FirstName != employee.FirstName || current.LastName != employee.LastName {
+		appended[EventEmployeeNameChanged] = &employeeEventData{
+			FirstName: &employee.FirstName,
+			LastName:  &employee.LastName,
+		}
+	}
+	if current.EmailAddress != emailAddress {
+		appended[EventEmployeeEmailChanged] = &employeeEventData{EmailAddress: &emailAddress}
+	}
+	if len(appended) == 0 {
+		return employeeScan(tx.QueryRow(employeeSelect("uuid=?"), idArg(employee.ID)))
+	}
+	if _, err := e.employeeAppend(tx, employee.ID, current.Version, events, appended); err != nil {
+		return nil, err
+	}
+	employee, err = employeeScan(tx.QueryRow(employeeSelect("uuid=?"), idArg(employee.ID)))
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return employee, nil
+}
+
+//EmployeeDelete will append a Deleted event to the stream of the employee
+// (or every employee if nil), like EmployeeDelete, an employee with the
+// same email address is also deleted
+func (e *EventSourcedStore) EmployeeDelete(employee *Employee) error {
+	var employees []*Employee
+	var args []interface{}
+
+	where := "1=1"
+	if employee != nil {
+		where, args = "uuid=?", []interface{}{idArg(employee.ID)}
+		if _, emailAddressNormalized, err := EmailNormalize(employee.EmailAddress, e.email); err == nil {
+			where, args = "uuid=? OR email_address_normalized=?", []interface{}{idArg(employee.ID), emailAddressNormalized}
+		}
+	}
+	tx, err := txBegin(e.db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(employeeSelect(where+" FOR UPDATE"), args...)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		employee, err := employeeScan(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		employees = append(employees, employee)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	//KIM: the employees are locked, so a reservation can't be placed until
+	// this transaction commits (or rolls back)
+	if len(employees) > 0 {
+		if err := employeesReserved(tx, employeeIDs(employees)...); err != nil {
+			return err
+		}
+	}
+	for _, employee := range employees {
+		events, err := EmployeeEventsRead(tx, employee.ID)
+		if err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return errors.Errorf("employee with id, \"%s\", has no events", employee.ID)
+		}
+		if _, err := e.employeeAppend(tx, employee.ID, events[len(events)-1].StreamVersion, events,
+			map[string]*employeeEventData{EventEmployeeDeleted: {}}); err != nil {
+			return err
+		}
+		if err := employeeTombstoneWrite(tx, employee, ""); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+//EmployeeRead will read the employee from the projection
+func (e *EventSourcedStore) EmployeeRead(employeeID string) (*Employee, error) {
+	return EmployeeRead(e.db, employeeID)
+}
+
+//ProjectionRebuildResult describes the outcome of rebuilding the projection
+type ProjectionRebuildResult struct {
+	Streams  int `json:"streams"`
+	Upserted int `json:"upserted"`
+	Deleted  int `json:"deleted"`
+}
+
+//ProjectionRebuild can be used to rebuild the employee table from the event
+// streams within a single transaction, every employee is set to the state of
+// its stream (or deleted if its stream was deleted); employees without a
+// stream (e.g., created with the version column) are left as is; email
+// addresses are normalized with options
+func ProjectionRebuild(db Queryer, options EmailOptions) (*ProjectionRebuildResult, error) {
+	var streamIDs []string
+
+	result := &ProjectionRebuildResult{}
+	tx, err := txBegin(db)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	query := fmt.Sprintf("SELECT DISTINCT stream_uuid FROM %s ORDER BY stream_uuid", tableEmployeeEvent)
+	rows, err := tx.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var streamID string
+
+		if err := rows.Scan(&streamID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		streamIDs = append(streamIDs, streamID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, streamID := range streamIDs {
+		var exists int
+
+		events, err := EmployeeEventsRead(tx, streamID)
+		if err != nil {
+			return nil, err
+		}
+		employee, deleted, err := employeeEventsFold(events)
+		if err != nil {
+			return nil, err
+		}
+		result.Streams++
+		if deleted {
+			query := fmt.Sprintf("DELETE FROM %s WHERE uuid=?", tableEmployee)
+			if _, err := tx.Exec(query, idArg(streamID)); err != nil {
+				return nil, err
+			}
+			result.Deleted++
+			continue
+		}
+		//KIM: the projection inserts when the version is 1, so whether
+		// or not the employee exists is used to decide instead
+		query := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE uuid=?", tableEmployee)
+		if err := tx.QueryRow(query, idArg(streamID)).Scan(&exists); err != nil {
+			return nil, err
+		}
+		if exists == 0 {
+			employeeCreated := *employee
+			employeeCreated.Version = 1
+			if err := employeeProject(tx, &employeeCreated, false, options); err != nil {
+				return nil, err
+			}
+		}
+		if err := employeeProject(tx, employee, false, options); err != nil {
+			return nil, err
+		}
+		result.Upserted++
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
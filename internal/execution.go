@@ -3,8 +3,6 @@ package internal
 import (
 	"database/sql"
 	"errors"
-
-	"github.com/google/uuid"
 )
 
 //RowsAffected can be used to return a pre-determined error via errorString in the event
@@ -20,9 +18,3 @@ func RowsAffected(result sql.Result, errorString string) error {
 	}
 	return nil
 }
-
-//GenerateID can be used to generate a v4 uuid and return
-// it as a string, if it's unable to, it'll panic
-func GenerateID() string {
-	return uuid.Must(uuid.NewRandom()).String()
-}
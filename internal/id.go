@@ -0,0 +1,275 @@
+package internal
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+//these are the supported id generators
+const (
+	IDGeneratorUUIDv4 string = "uuidv4"
+	IDGeneratorUUIDv7 string = "uuidv7"
+	IDGeneratorULID   string = "ulid"
+)
+
+//crockford is the base32 alphabet used by ULIDs, it excludes
+// I, L, O and U to avoid confusion
+const crockford string = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+//IDGenerator describes how ids are generated and how they're
+// converted to and from their 16 byte binary representation, the
+// representation stored in BINARY(16) columns doesn't depend on the
+// generator (see IDBinaryParse)
+type IDGenerator interface {
+	Generate() string
+	Parse(id string) ([]byte, error)
+	Format(id []byte) (string, error)
+}
+
+//IDOptions describes how ids are generated and stored
+type IDOptions struct {
+	Generator IDGenerator //generator used by GenerateID
+	Binary    bool        //whether or not uuid columns are stored as BINARY(16)
+}
+
+//IDGeneration are the options used to generate and store ids, it should be
+// set once at startup (e.g., from the configuration)
+var IDGeneration = IDOptions{
+	Generator: UUIDv4Generator{},
+}
+
+//NewIDGenerator can be used to create one of the supported generators
+// by name, if name is empty, a v4 uuid generator is returned
+func NewIDGenerator(name string) (IDGenerator, error) {
+	switch strings.ToLower(name) {
+	default:
+		return nil, errors.Errorf("unsupported id generator: \"%s\"", name)
+	case IDGeneratorUUIDv4, "":
+		return UUIDv4Generator{}, nil
+	case IDGeneratorUUIDv7:
+		return UUIDv7Generator{}, nil
+	case IDGeneratorULID:
+		return ULIDGenerator{}, nil
+	}
+}
+
+//UUIDv4Generator generates random (v4) uuids
+type UUIDv4Generator struct{}
+
+//Generate will generate a v4 uuid, if it's unable to, it'll panic
+func (UUIDv4Generator) Generate() string {
+	return uuid.Must(uuid.NewRandom()).String()
+}
+
+//Parse will convert the uuid to its binary representation
+func (UUIDv4Generator) Parse(id string) ([]byte, error) {
+	return uuidParse(id)
+}
+
+//Format will convert the binary representation to a uuid
+func (UUIDv4Generator) Format(id []byte) (string, error) {
+	return uuidFormat(id)
+}
+
+//UUIDv7Generator generates time-ordered (v7) uuids, the first 48 bits are
+// the unix time in milliseconds so ids generated later sort later and are
+// inserted at the end of the index rather than at random
+type UUIDv7Generator struct{}
+
+//Generate will generate a v7 uuid, if it's unable to, it'll panic
+func (UUIDv7Generator) Generate() string {
+	id := idTimeOrdered(time.Now())
+	id[6] = (id[6] & 0x0f) | 0x70 //version 7
+	id[8] = (id[8] & 0x3f) | 0x80 //variant RFC 4122
+	return uuid.UUID(id).String()
+}
+
+//Parse will convert the uuid to its binary representation
+func (UUIDv7Generator) Parse(id string) ([]byte, error) {
+	return uuidParse(id)
+}
+
+//Format will convert the binary representation to a uuid
+func (UUIDv7Generator) Format(id []byte) (string, error) {
+	return uuidFormat(id)
+}
+
+//ULIDGenerator generates ULIDs, like v7 uuids the first 48 bits are the
+// unix time in milliseconds, but they're encoded as 26 characters of
+// Crockford's base32 such that they also sort lexically
+type ULIDGenerator struct{}
+
+//Generate will generate a ULID, if it's unable to, it'll panic
+func (ULIDGenerator) Generate() string {
+	id := idTimeOrdered(time.Now())
+	s, _ := ULIDGenerator{}.Format(id[:])
+	return s
+}
+
+//Parse will convert the ULID to its binary representation
+func (ULIDGenerator) Parse(id string) ([]byte, error) {
+	var hi, lo uint64
+
+	if len(id) != 26 {
+		return nil, errors.Errorf("invalid ulid: \"%s\"", id)
+	}
+	for i, c := range strings.ToUpper(id) {
+		n := strings.IndexRune(crockford, c)
+		if n < 0 || (i == 0 && n > 7) {
+			return nil, errors.Errorf("invalid ulid: \"%s\"", id)
+		}
+		hi = hi<<5 | lo>>59
+		lo = lo<<5 | uint64(n)
+	}
+	bytes := make([]byte, 16)
+	binary.BigEndian.PutUint64(bytes[:8], hi)
+	binary.BigEndian.PutUint64(bytes[8:], lo)
+	return bytes, nil
+}
+
+//Format will convert the binary representation to a ULID
+func (ULIDGenerator) Format(id []byte) (string, error) {
+	var encoded [26]byte
+
+	if len(id) != 16 {
+		return "", errors.Errorf("invalid ulid, expected 16 bytes, found %d", len(id))
+	}
+	hi, lo := binary.BigEndian.Uint64(id[:8]), binary.BigEndian.Uint64(id[8:])
+	for i := len(encoded) - 1; i >= 0; i-- {
+		encoded[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(encoded[:]), nil
+}
+
+//idTimeOrdered returns 16 bytes, the first 6 are the unix time in
+// milliseconds and the remainder are random, if it's unable to read
+// random bytes, it'll panic
+func idTimeOrdered(t time.Time) [16]byte {
+	var id [16]byte
+
+	if _, err := rand.Read(id[6:]); err != nil {
+		panic(err)
+	}
+	milliseconds := uint64(t.UnixNano() / int64(time.Millisecond))
+	id[0] = byte(milliseconds >> 40)
+	id[1] = byte(milliseconds >> 32)
+	id[2] = byte(milliseconds >> 24)
+	id[3] = byte(milliseconds >> 16)
+	id[4] = byte(milliseconds >> 8)
+	id[5] = byte(milliseconds)
+	return id
+}
+
+func uuidParse(id string) ([]byte, error) {
+	u, err := uuid.Parse(id)
+	if err != nil {
+		return nil, err
+	}
+	return u[:], nil
+}
+
+func uuidFormat(id []byte) (string, error) {
+	u, err := uuid.FromBytes(id)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+//GenerateID can be used to generate an id using the configured
+// generator and return it as a string, if it's unable to, it'll panic; if
+// ids are stored as binary, the id is formatted as it'll be read back
+func GenerateID() string {
+	id := idGenerator().Generate()
+	if !IDGeneration.Binary {
+		return id
+	}
+	bytes, err := IDBinaryParse(id)
+	if err != nil {
+		panic(err)
+	}
+	id, err = IDBinaryFormat(bytes)
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
+//IDBinaryParse can be used to convert an id (a uuid or a ULID) to the 16
+// bytes stored in BINARY(16) columns, it's independent of the configured
+// generator so ids written with one generator can be read with another
+func IDBinaryParse(id string) ([]byte, error) {
+	if len(id) == 26 {
+		return ULIDGenerator{}.Parse(id)
+	}
+	return uuidParse(id)
+}
+
+//IDBinaryFormat can be used to convert the 16 bytes stored in BINARY(16)
+// columns to an id, it's always formatted as a uuid regardless of the
+// configured generator (a ULID and a uuid with the same bytes are the same id)
+func IDBinaryFormat(id []byte) (string, error) {
+	return uuidFormat(id)
+}
+
+//idGenerator returns the configured generator
+func idGenerator() IDGenerator {
+	if IDGeneration.Generator == nil {
+		return UUIDv4Generator{}
+	}
+	return IDGeneration.Generator
+}
+
+//idArg converts an id to the value stored in uuid columns, if ids are
+// stored as binary and the id can't be parsed, it's returned as is so
+// that it simply won't match anything
+func idArg(id string) interface{} {
+	if !IDGeneration.Binary {
+		return id
+	}
+	bytes, err := IDBinaryParse(id)
+	if err != nil {
+		return id
+	}
+	return bytes
+}
+
+//idScan can be used to scan a uuid column into a string, converting
+// it from binary if ids are stored as binary
+func idScan(id *string) sql.Scanner {
+	return &idScanner{id: id}
+}
+
+type idScanner struct {
+	id *string
+}
+
+func (i *idScanner) Scan(value interface{}) error {
+	switch v := value.(type) {
+	default:
+		return errors.Errorf("unsupported id type: %T", value)
+	case nil:
+		*i.id = ""
+	case string:
+		*i.id = v
+	case []byte:
+		if !IDGeneration.Binary || len(v) != 16 {
+			*i.id = string(v)
+			return nil
+		}
+		id, err := IDBinaryFormat(v)
+		if err != nil {
+			return err
+		}
+		*i.id = id
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+//defaultImportLockTimeout is how long an import waits for another
+// import to complete
+const defaultImportLockTimeout time.Duration = time.Minute
+
+//ImportError describes a single row that couldn't be imported
+type ImportError struct {
+	Type  string `json:"type"`
+	Index int    `json:"index"`
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
+
+//ImportResult describes the outcome of an import, it contains the
+// employees and timers that were imported and the rows that were skipped
+type ImportResult struct {
+	Employees []*Employee   `json:"employees"`
+	Timers    []*Timer      `json:"timers"`
+	Errors    []ImportError `json:"errors"`
+}
+
+//Import can be used to create employees and timers within a single transaction,
+// each row is created within its own savepoint such that rows that fail (e.g. a
+// timer whose employee doesn't exist) are skipped without aborting the import;
+// only one import runs at a time, an import waits for the one in progress; email
+// addresses are normalized with options
+func Import(ctx context.Context, db *sql.DB, employees []*Employee, timers []*Timer, options EmailOptions) (*ImportResult, error) {
+	var result *ImportResult
+
+	//KIM: a large import holds a lot of row locks for a long time, two
+	// imports at once are likely to deadlock with each other and be
+	// attempted again, so they're serialized with a named lock instead
+	if err := NewLocker(db).WithLock(ctx, LockImport, defaultImportLockTimeout, func(ctx context.Context) (err error) {
+		result, err = importTx(ctx, db, employees, timers, options)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+//importTx will import the employees and timers within a single unit of work
+func importTx(ctx context.Context, db *sql.DB, employees []*Employee, timers []*Timer, options EmailOptions) (*ImportResult, error) {
+	var result *ImportResult
+
+	if err := WithTx(ctx, db, func(tx Tx) error {
+		//KIM: the result is re-created because the unit of work
+		// may be attempted more than once
+		result = &ImportResult{}
+		for i, employee := range employees {
+			if err := tx.Savepoint(func(tx Tx) error {
+				employee, err := EmployeeCreate(tx, employee, options)
+				if err != nil {
+					return err
+				}
+				result.Employees = append(result.Employees, employee)
+				return nil
+			}); err != nil {
+				if errRetryable(err) {
+					return err
+				}
+				importError := ImportError{
+					Type:  tableEmployee,
+					Index: i,
+					Error: err.Error(),
+				}
+				if employee != nil {
+					importError.ID = employee.ID
+				}
+				result.Errors = append(result.Errors, importError)
+			}
+		}
+		for i, timer := range timers {
+			if err := tx.Savepoint(func(tx Tx) error {
+				timer, err := TimerCreate(tx, timer)
+				if err != nil {
+					return err
+				}
+				result.Timers = append(result.Timers, timer)
+				return nil
+			}); err != nil {
+				if errRetryable(err) {
+					return err
+				}
+				importError := ImportError{
+					Type:  tableTimer,
+					Index: i,
+					Error: err.Error(),
+				}
+				if timer != nil {
+					importError.ID = timer.ID
+				}
+				result.Errors = append(result.Errors, importError)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
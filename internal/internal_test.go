@@ -1,9 +1,21 @@
 package internal_test
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -15,6 +27,7 @@ import (
 )
 
 var configuration *internal.Configuration
+var emailOptions internal.EmailOptions
 
 func init() {
 	envs := make(map[string]string)
@@ -24,12 +37,29 @@ func init() {
 		}
 	}
 	configuration = internal.ConfigFromEnv(envs)
+	emailOptions = configuration.EmailOptions()
+	if idGenerator, err := internal.NewIDGenerator(configuration.IDGenerator); err == nil {
+		internal.IDGeneration = internal.IDOptions{
+			Generator: idGenerator,
+			Binary:    configuration.IDBinary,
+		}
+	}
 }
 
 func initDatabase() (*sql.DB, error) {
 	return internal.Initialize(configuration)
 }
 
+//initSagaStores returns the stores the sagas are executed against when the
+// employees and timers are stored in db
+func initSagaStores(db *sql.DB) (internal.SagaEmployeeStore, internal.SagaTimerStore, error) {
+	store, err := internal.NewEmployeeStore(db, internal.EmployeeStorageVersion, emailOptions)
+	if err != nil {
+		return nil, nil, err
+	}
+	return store.(internal.SagaEmployeeStore), internal.NewTimerStore(db), nil
+}
+
 func TestConcurrentCreate(t *testing.T) {
 	db, err := initDatabase()
 	assert.Nil(t, err)
@@ -46,17 +76,17 @@ func TestConcurrentCreate(t *testing.T) {
 	firstUUID := internal.GenerateID()
 	employee.ID = firstUUID
 	//delete the employee
-	err = internal.EmployeeDelete(db, employee)
+	err = internal.EmployeeDelete(db, employee, emailOptions)
 	assert.Nil(t, err)
 	//attempt to create employee
-	employeeCreated, err := internal.EmployeeCreate(db, employee)
+	employeeCreated, err := internal.EmployeeCreate(db, employee, emailOptions)
 	assert.Nil(t, err)
 	assert.Equal(t, 1, employeeCreated.Version)
 	employee.Version = employeeCreated.Version
 	assert.Equal(t, employee, employeeCreated)
 	//attempt to create again, but with an alternate id
 	employee.ID = internal.GenerateID()
-	employeeCreated, err = internal.EmployeeCreate(db, employee)
+	employeeCreated, err = internal.EmployeeCreate(db, employee, emailOptions)
 	assert.Nil(t, err)
 	assert.Equal(t, firstUUID, employeeCreated.ID)
 	assert.Equal(t, 2, employeeCreated.Version)
@@ -77,10 +107,10 @@ func TestConcurrentMutate(t *testing.T) {
 	}
 	employee.ID = internal.GenerateID()
 	//delete the employee
-	err = internal.EmployeeDelete(db, employee)
+	err = internal.EmployeeDelete(db, employee, emailOptions)
 	assert.Nil(t, err)
 	//attempt to create employee
-	employeeCreated, err := internal.EmployeeCreate(db, employee)
+	employeeCreated, err := internal.EmployeeCreate(db, employee, emailOptions)
 	assert.Nil(t, err)
 	//mutate employee first time
 	employeeMutated, err := internal.EmployeeWrite(db, &internal.Employee{
@@ -89,7 +119,7 @@ func TestConcurrentMutate(t *testing.T) {
 		LastName:     employeeCreated.LastName,
 		EmailAddress: employeeCreated.EmailAddress,
 		Version:      employeeCreated.Version,
-	})
+	}, emailOptions)
 	assert.Nil(t, err)
 	assert.Equal(t, employeeCreated.Version+1, employeeMutated.Version)
 	//mutate employee a second time
@@ -99,7 +129,7 @@ func TestConcurrentMutate(t *testing.T) {
 		LastName:     employeeCreated.LastName,
 		EmailAddress: employeeCreated.EmailAddress,
 		Version:      employeeCreated.Version,
-	})
+	}, emailOptions)
 	assert.NotNil(t, err)
 	assert.Nil(t, employeeMutated)
 	//clean-up
@@ -127,7 +157,7 @@ func TestConsistencyBetweenTables(t *testing.T) {
 		FirstName:    "Antonio",
 		LastName:     "Alexander",
 		EmailAddress: "antonio.alexander@mistersoftwaredeveloper.com",
-	})
+	}, emailOptions)
 	assert.Nil(t, err)
 	//create timer
 	timer.EmployeeID = employee.ID
@@ -138,3 +168,2225 @@ func TestConsistencyBetweenTables(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, timerCreated, timerRead)
 }
+
+func TestSchemaVerify(t *testing.T) {
+	db, err := initDatabase()
+	assert.Nil(t, err)
+	violations, err := internal.SchemaVerify(db, configuration.Database)
+	assert.Nil(t, err)
+	assert.Empty(t, violations)
+	//clean-up
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestEmailNormalize(t *testing.T) {
+	for _, c := range []struct {
+		emailAddress string
+		options      internal.EmailOptions
+		normalized   string
+		valid        bool
+	}{
+		{"Antonio@X.com", internal.EmailOptions{}, "Antonio@x.com", true},
+		{" antonio@x.com ", internal.EmailOptions{}, "antonio@x.com", true},
+		{"Antonio@X.com", internal.EmailOptions{LowercaseLocal: true}, "antonio@x.com", true},
+		{"Antonio+work@X.com", internal.EmailOptions{LowercaseLocal: true, FoldPlus: true}, "antonio@x.com", true},
+		{"Antonio+work@X.com", internal.EmailOptions{LowercaseLocal: true}, "antonio+work@x.com", true},
+		{"+work@x.com", internal.EmailOptions{FoldPlus: true}, "+work@x.com", true},
+		{"", internal.EmailOptions{}, "", false},
+		{"antonio", internal.EmailOptions{}, "", false},
+		{"antonio@@x.com", internal.EmailOptions{}, "", false},
+		{"anto nio@x.com", internal.EmailOptions{}, "", false},
+		{".antonio@x.com", internal.EmailOptions{}, "", false},
+		{"antonio@x", internal.EmailOptions{}, "", false},
+		{"antonio@-x.com", internal.EmailOptions{}, "", false},
+	} {
+		_, normalized, err := internal.EmailNormalize(c.emailAddress, c.options)
+		if !c.valid {
+			assert.NotNil(t, err, c.emailAddress)
+			continue
+		}
+		assert.Nil(t, err, c.emailAddress)
+		assert.Equal(t, c.normalized, normalized)
+	}
+}
+
+func TestConcurrentCreateNormalizedEmail(t *testing.T) {
+	db, err := initDatabase()
+	assert.Nil(t, err)
+	err = internal.EmployeeDelete(db, &internal.Employee{EmailAddress: "antonio@x.com"}, emailOptions)
+	assert.Nil(t, err)
+	//create the same employee concurrently with different casing
+	employees := make(chan *internal.Employee, 2)
+	for _, emailAddress := range []string{"Antonio@X.com", " antonio@x.COM "} {
+		go func(emailAddress string) {
+			employee, err := internal.EmployeeCreate(db, &internal.Employee{
+				ID:           internal.GenerateID(),
+				FirstName:    "Antonio",
+				LastName:     "Alexander",
+				EmailAddress: emailAddress,
+			}, emailOptions)
+			assert.Nil(t, err)
+			employees <- employee
+		}(emailAddress)
+	}
+	first, second := <-employees, <-employees
+	if assert.NotNil(t, first) && assert.NotNil(t, second) {
+		assert.Equal(t, first.ID, second.ID)
+	}
+	//clean-up
+	err = internal.EmployeeDelete(db, &internal.Employee{EmailAddress: "antonio@x.com"}, emailOptions)
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestReadIfChanged(t *testing.T) {
+	db, err := initDatabase()
+	assert.Nil(t, err)
+	employee := &internal.Employee{
+		ID:           internal.GenerateID(),
+		FirstName:    "Antonio",
+		LastName:     "Alexander",
+		EmailAddress: "read.if.changed@mistersoftwaredeveloper.com",
+	}
+	err = internal.EmployeeDelete(db, employee, emailOptions)
+	assert.Nil(t, err)
+	employeeCreated, err := internal.EmployeeCreate(db, employee, emailOptions)
+	assert.Nil(t, err)
+	//read with the current version
+	employeeRead, err := internal.EmployeeReadIfChanged(db, employeeCreated.ID, employeeCreated.Version)
+	assert.Equal(t, internal.ErrNotModified, err)
+	assert.Nil(t, employeeRead)
+	//mutate and read with the old version
+	employeeMutated, err := internal.EmployeeWrite(db, &internal.Employee{
+		ID:           employeeCreated.ID,
+		FirstName:    "Tony",
+		LastName:     employeeCreated.LastName,
+		EmailAddress: employeeCreated.EmailAddress,
+		Version:      employeeCreated.Version,
+	}, emailOptions)
+	assert.Nil(t, err)
+	employeeRead, err = internal.EmployeeReadIfChanged(db, employeeCreated.ID, employeeCreated.Version)
+	assert.Nil(t, err)
+	assert.Equal(t, employeeMutated, employeeRead)
+	//create a timer and read with the current version
+	timerCreated, err := internal.TimerCreate(db, &internal.Timer{
+		ID:         internal.GenerateID(),
+		Comment:    "This is a comment",
+		Start:      time.Now().UnixNano(),
+		EmployeeID: employeeCreated.ID,
+	})
+	assert.Nil(t, err)
+	timerRead, err := internal.TimerReadIfChanged(db, timerCreated.ID, timerCreated.Version)
+	assert.Equal(t, internal.ErrNotModified, err)
+	assert.Nil(t, timerRead)
+	timerRead, err = internal.TimerReadIfChanged(db, timerCreated.ID, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, timerCreated, timerRead)
+	//clean-up
+	err = internal.TimerDelete(db, timerCreated.ID)
+	assert.Nil(t, err)
+	err = internal.EmployeeDelete(db, employee, emailOptions)
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestUnitOfWork(t *testing.T) {
+	db, err := initDatabase()
+	assert.Nil(t, err)
+	ctx := context.TODO()
+	employees := []*internal.Employee{
+		{
+			ID:           internal.GenerateID(),
+			FirstName:    "Unit",
+			LastName:     "Work",
+			EmailAddress: "unit.of.work@mistersoftwaredeveloper.com",
+		},
+		{
+			ID:           internal.GenerateID(),
+			FirstName:    "Unit",
+			LastName:     "Work",
+			EmailAddress: "unit.of.work.again@mistersoftwaredeveloper.com",
+		},
+	}
+	timer := &internal.Timer{
+		ID:      internal.GenerateID(),
+		Comment: "This is a comment",
+		Start:   time.Now().UnixNano(),
+	}
+	for _, employee := range employees {
+		err = internal.EmployeeDelete(db, employee, emailOptions)
+		assert.Nil(t, err)
+	}
+	//create an employee within a unit of work that fails
+	errExpected := errors.New("rollback")
+	err = internal.WithTx(ctx, db, func(tx internal.Tx) error {
+		if _, err := internal.EmployeeCreate(tx, employees[0], emailOptions); err != nil {
+			return err
+		}
+		return errExpected
+	})
+	assert.Equal(t, errExpected, err)
+	_, err = internal.EmployeeRead(db, employees[0].ID)
+	assert.NotNil(t, err)
+	//create an employee, their first timer and mutate another employee
+	employeeCreated, err := internal.EmployeeCreate(db, employees[1], emailOptions)
+	assert.Nil(t, err)
+	err = internal.WithTx(ctx, db, func(tx internal.Tx) error {
+		employee, err := internal.EmployeeCreate(tx, employees[0], emailOptions)
+		if err != nil {
+			return err
+		}
+		timer.EmployeeID = employee.ID
+		if _, err := internal.TimerCreate(tx, timer); err != nil {
+			return err
+		}
+		employeeCreated.FirstName = "Mutated"
+		_, err = internal.EmployeeWrite(tx, employeeCreated, emailOptions)
+		return err
+	})
+	assert.Nil(t, err)
+	_, err = internal.TimerRead(db, timer.ID)
+	assert.Nil(t, err)
+	employeeRead, err := internal.EmployeeRead(db, employeeCreated.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "Mutated", employeeRead.FirstName)
+	//clean-up
+	err = internal.TimerDelete(db, timer.ID)
+	assert.Nil(t, err)
+	for _, employee := range employees {
+		err = internal.EmployeeDelete(db, employee, emailOptions)
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestUnitOfWorkDeadlock(t *testing.T) {
+	db, err := initDatabase()
+	assert.Nil(t, err)
+	ctx := context.TODO()
+	var employeeIDs []string
+	for _, emailAddress := range []string{
+		"deadlock.first@mistersoftwaredeveloper.com",
+		"deadlock.second@mistersoftwaredeveloper.com",
+	} {
+		employee := &internal.Employee{
+			ID:           internal.GenerateID(),
+			EmailAddress: emailAddress,
+		}
+		err = internal.EmployeeDelete(db, employee, emailOptions)
+		assert.Nil(t, err)
+		employee, err = internal.EmployeeCreate(db, employee, emailOptions)
+		assert.Nil(t, err)
+		employeeIDs = append(employeeIDs, employee.ID)
+	}
+	//mutate the employees in opposite orders so that one of the
+	// transactions deadlocks and has to be attempted again, the backoff
+	// is long enough that the other transaction will have committed
+	unitOfWork := &internal.UnitOfWork{
+		DB:          db,
+		MaxAttempts: 3,
+		Backoff:     500 * time.Millisecond,
+	}
+	errs := make(chan error, 2)
+	for _, order := range [][]string{
+		{employeeIDs[0], employeeIDs[1]},
+		{employeeIDs[1], employeeIDs[0]},
+	} {
+		go func(order []string) {
+			errs <- unitOfWork.WithTx(ctx, func(tx internal.Tx) error {
+				for _, employeeID := range order {
+					employee, err := internal.EmployeeRead(tx, employeeID)
+					if err != nil {
+						return err
+					}
+					employee.FirstName = "Deadlock"
+					if _, err := internal.EmployeeWrite(tx, employee, emailOptions); err != nil {
+						return err
+					}
+					time.Sleep(100 * time.Millisecond)
+				}
+				return nil
+			})
+		}(order)
+	}
+	assert.Nil(t, <-errs)
+	assert.Nil(t, <-errs)
+	for _, employeeID := range employeeIDs {
+		employee, err := internal.EmployeeRead(db, employeeID)
+		assert.Nil(t, err)
+		assert.Equal(t, 3, employee.Version)
+		err = internal.EmployeeDelete(db, employee, emailOptions)
+		assert.Nil(t, err)
+	}
+	//clean-up
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestImportSavepoints(t *testing.T) {
+	db, err := initDatabase()
+	assert.Nil(t, err)
+	employee := &internal.Employee{
+		ID:           internal.GenerateID(),
+		FirstName:    "Import",
+		LastName:     "Savepoint",
+		EmailAddress: "import.savepoint@mistersoftwaredeveloper.com",
+	}
+	err = internal.EmployeeDelete(db, employee, emailOptions)
+	assert.Nil(t, err)
+	timers := []*internal.Timer{
+		{
+			ID:         internal.GenerateID(),
+			Comment:    "This timer has an employee",
+			Start:      time.Now().UnixNano(),
+			EmployeeID: employee.ID,
+		},
+		{
+			ID:         internal.GenerateID(),
+			Comment:    "This timer doesn't have an employee",
+			Start:      time.Now().UnixNano(),
+			EmployeeID: internal.GenerateID(),
+		},
+	}
+	//import the employee and timers, the timer with the non-existent
+	// employee should be skipped without aborting the import
+	result, err := internal.Import(context.TODO(), db, []*internal.Employee{employee}, timers, emailOptions)
+	assert.Nil(t, err)
+	assert.Len(t, result.Employees, 1)
+	assert.Len(t, result.Timers, 1)
+	if assert.Len(t, result.Errors, 1) {
+		assert.Equal(t, 1, result.Errors[0].Index)
+		assert.Equal(t, timers[1].ID, result.Errors[0].ID)
+	}
+	_, err = internal.TimerRead(db, timers[0].ID)
+	assert.Nil(t, err)
+	_, err = internal.TimerRead(db, timers[1].ID)
+	assert.NotNil(t, err)
+	//clean-up
+	err = internal.TimerDelete(db, timers[0].ID)
+	assert.Nil(t, err)
+	err = internal.EmployeeDelete(db, employee, emailOptions)
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestSessionToken(t *testing.T) {
+	employeeID := internal.GenerateID()
+	session := internal.NewSession()
+	token, err := session.Token()
+	assert.Nil(t, err)
+	session, err = internal.SessionFromToken(token)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, session.Version("employee", employeeID))
+	_, err = internal.SessionFromToken("not a token")
+	assert.NotNil(t, err)
+	//an entity written after all entities of its type were deleted should
+	// use its own version rather than the wildcard
+	token = base64.RawURLEncoding.EncodeToString([]byte(`{"employee:*":2147483647,"employee:` + employeeID + `":3}`))
+	session, err = internal.SessionFromToken(token)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, session.Version("employee", employeeID))
+	assert.Equal(t, math.MaxInt32, session.Version("employee", internal.GenerateID()))
+}
+
+func TestRouterReadYourWrites(t *testing.T) {
+	db, err := initDatabase()
+	assert.Nil(t, err)
+	//KIM: the primary is also used as the replica since we
+	// only have a single database to test with
+	router := internal.NewRouter(db, emailOptions, db)
+	session := internal.NewSession()
+	employee := &internal.Employee{
+		ID:           internal.GenerateID(),
+		FirstName:    "Read",
+		LastName:     "Writes",
+		EmailAddress: "read.your.writes@mistersoftwaredeveloper.com",
+	}
+	err = router.EmployeeDelete(session, employee)
+	assert.Nil(t, err)
+	employeeCreated, err := router.EmployeeCreate(session, employee)
+	assert.Nil(t, err)
+	employeeCreated.FirstName = "Mutated"
+	employeeMutated, err := router.EmployeeWrite(session, employeeCreated)
+	assert.Nil(t, err)
+	//serialize the session and read with the deserialized session
+	token, err := session.Token()
+	assert.Nil(t, err)
+	session, err = internal.SessionFromToken(token)
+	assert.Nil(t, err)
+	assert.Equal(t, employeeMutated.Version, session.Version("employee", employeeMutated.ID))
+	employeeRead, err := router.EmployeeRead(session, employeeMutated.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, employeeMutated, employeeRead)
+	//clean-up
+	err = router.EmployeeDelete(session, employee)
+	assert.Nil(t, err)
+	_, err = router.EmployeeRead(session, employee.ID)
+	assert.NotNil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestLRU(t *testing.T) {
+	lru := internal.NewLRU(2)
+	lru.Write("a", []byte("a"))
+	lru.Write("b", []byte("b"))
+	//read a so that b is the least recently used
+	value, ok := lru.Read("a")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("a"), value)
+	lru.Write("c", []byte("c"))
+	assert.Equal(t, 2, lru.Len())
+	_, ok = lru.Read("b")
+	assert.False(t, ok)
+	_, ok = lru.Read("c")
+	assert.True(t, ok)
+	lru.Delete("c")
+	_, ok = lru.Read("c")
+	assert.False(t, ok)
+}
+
+func TestCachedStore(t *testing.T) {
+	db, err := initDatabase()
+	assert.Nil(t, err)
+	cache := internal.NewLRU(16)
+	store := internal.NewCachedStore(db, cache, emailOptions)
+	employee := &internal.Employee{
+		ID:           internal.GenerateID(),
+		FirstName:    "Cached",
+		LastName:     "Store",
+		EmailAddress: "cached.store@mistersoftwaredeveloper.com",
+	}
+	err = store.EmployeeDelete(employee)
+	assert.Nil(t, err)
+	employeeCreated, err := store.EmployeeCreate(employee)
+	assert.Nil(t, err)
+	//mutate the employee outside of the cache, the cached (older) version
+	// is served until this process writes a newer version
+	employeeMutated, err := internal.EmployeeWrite(db, &internal.Employee{
+		ID:           employeeCreated.ID,
+		FirstName:    "Mutated",
+		LastName:     employeeCreated.LastName,
+		EmailAddress: employeeCreated.EmailAddress,
+		Version:      employeeCreated.Version,
+	}, emailOptions)
+	assert.Nil(t, err)
+	employeeRead, err := store.EmployeeRead(employeeCreated.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, employeeCreated, employeeRead)
+	//attempt to write the stale version, this should fail and evict
+	// the cached employee so the next read is the mutated employee
+	_, err = store.EmployeeWrite(employeeCreated)
+	assert.NotNil(t, err)
+	employeeRead, err = store.EmployeeRead(employeeCreated.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, employeeMutated, employeeRead)
+	//deleting by the email address (with a different uuid) should evict the
+	// cached employee too
+	err = store.EmployeeDelete(&internal.Employee{
+		ID:           internal.GenerateID(),
+		EmailAddress: employee.EmailAddress,
+	})
+	assert.Nil(t, err)
+	_, err = store.EmployeeRead(employeeCreated.ID)
+	assert.True(t, internal.IsEmployeeDeleted(err))
+	//clean-up
+	err = store.EmployeeDelete(employee)
+	assert.Nil(t, err)
+	_, err = store.EmployeeRead(employee.ID)
+	assert.NotNil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestTimerReassign(t *testing.T) {
+	db, err := initDatabase()
+	assert.Nil(t, err)
+	var employees []*internal.Employee
+	for _, emailAddress := range []string{
+		"reassign.first@mistersoftwaredeveloper.com",
+		"reassign.second@mistersoftwaredeveloper.com",
+		"reassign.archived@mistersoftwaredeveloper.com",
+	} {
+		employee := &internal.Employee{
+			ID:           internal.GenerateID(),
+			EmailAddress: emailAddress,
+		}
+		err = internal.EmployeeDelete(db, employee, emailOptions)
+		assert.Nil(t, err)
+		employee, err = internal.EmployeeCreate(db, employee, emailOptions)
+		assert.Nil(t, err)
+		employees = append(employees, employee)
+	}
+	employeeArchived, err := internal.EmployeeArchive(db, employees[2].ID, employees[2].Version, true)
+	assert.Nil(t, err)
+	assert.True(t, employeeArchived.Archived)
+	timer, err := internal.TimerCreate(db, &internal.Timer{
+		ID:         internal.GenerateID(),
+		Comment:    "This is a comment",
+		Start:      time.Now().UnixNano(),
+		EmployeeID: employees[0].ID,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, employees[0].ID, timer.EmployeeID)
+	//the upsert can't change the owner of the timer or create a timer for
+	// an archived employee
+	_, err = internal.TimerCreate(db, &internal.Timer{
+		ID:         timer.ID,
+		Start:      timer.Start,
+		EmployeeID: employees[1].ID,
+	})
+	assert.NotNil(t, err)
+	_, err = internal.TimerCreate(db, &internal.Timer{
+		ID:         internal.GenerateID(),
+		Start:      time.Now().UnixNano(),
+		EmployeeID: employees[2].ID,
+	})
+	assert.NotNil(t, err)
+	//attempt to reassign with an old version, to an archived employee
+	// and to a non-existent employee
+	_, err = internal.TimerReassign(db, timer.ID, timer.Version-1, employees[1].ID)
+	assert.NotNil(t, err)
+	_, err = internal.TimerReassign(db, timer.ID, timer.Version, employees[2].ID)
+	assert.NotNil(t, err)
+	_, err = internal.TimerReassign(db, timer.ID, timer.Version, internal.GenerateID())
+	assert.NotNil(t, err)
+	//reassign the timer
+	timerReassigned, err := internal.TimerReassign(db, timer.ID, timer.Version, employees[1].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, employees[1].ID, timerReassigned.EmployeeID)
+	assert.Equal(t, timer.Version+1, timerReassigned.Version)
+	histories, err := internal.TimerHistoryRead(db, timer.ID)
+	assert.Nil(t, err)
+	if assert.Len(t, histories, 1) {
+		assert.Equal(t, employees[0].ID, histories[0].PreviousEmployeeID)
+		assert.Equal(t, employees[1].ID, histories[0].EmployeeID)
+		assert.Equal(t, timerReassigned.Version, histories[0].Version)
+	}
+	//reassign back to the first employee while concurrently deleting it,
+	// either the delete or the reassign should fail, but not both
+	errsReassign, errsDelete := make(chan error, 1), make(chan error, 1)
+	go func() {
+		_, err := internal.TimerReassign(db, timer.ID, timerReassigned.Version, employees[0].ID)
+		errsReassign <- err
+	}()
+	go func() {
+		errsDelete <- internal.EmployeeDelete(db, &internal.Employee{ID: employees[0].ID}, emailOptions)
+	}()
+	errReassign, errDelete := <-errsReassign, <-errsDelete
+	assert.True(t, (errReassign == nil) != (errDelete == nil))
+	timerRead, err := internal.TimerRead(db, timer.ID)
+	assert.Nil(t, err)
+	if _, err := internal.EmployeeRead(db, employees[0].ID); err == nil {
+		assert.Equal(t, employees[0].ID, timerRead.EmployeeID)
+	} else {
+		assert.Equal(t, employees[1].ID, timerRead.EmployeeID)
+	}
+	//clean-up
+	err = internal.TimerDelete(db, timer.ID)
+	assert.Nil(t, err)
+	for _, employee := range employees {
+		err = internal.EmployeeDelete(db, &internal.Employee{ID: employee.ID}, emailOptions)
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestEmployeeMerge(t *testing.T) {
+	db, err := initDatabase()
+	assert.Nil(t, err)
+	survivor, err := internal.EmployeeCreate(db, &internal.Employee{
+		ID:           internal.GenerateID(),
+		LastName:     "Alexander",
+		EmailAddress: "merge.survivor@mistersoftwaredeveloper.com",
+	}, emailOptions)
+	assert.Nil(t, err)
+	duplicate, err := internal.EmployeeCreate(db, &internal.Employee{
+		ID:           internal.GenerateID(),
+		FirstName:    "Antonio",
+		LastName:     "Alex",
+		EmailAddress: "merge.duplicate@mistersoftwaredeveloper.com",
+	}, emailOptions)
+	assert.Nil(t, err)
+	timer, err := internal.TimerCreate(db, &internal.Timer{
+		ID:         internal.GenerateID(),
+		Comment:    "This is a comment",
+		Start:      time.Now().UnixNano(),
+		EmployeeID: duplicate.ID,
+	})
+	assert.Nil(t, err)
+	//attempt to merge with stale versions and with itself
+	_, err = internal.EmployeeMerge(db, survivor.ID, survivor.Version-1, duplicate.ID, duplicate.Version, nil, emailOptions)
+	assert.NotNil(t, err)
+	_, err = internal.EmployeeMerge(db, survivor.ID, survivor.Version, duplicate.ID, duplicate.Version-1, nil, emailOptions)
+	assert.NotNil(t, err)
+	_, err = internal.EmployeeMerge(db, survivor.ID, survivor.Version, survivor.ID, survivor.Version, nil, emailOptions)
+	assert.NotNil(t, err)
+	//attempt to merge into an archived survivor
+	survivorArchived, err := internal.EmployeeArchive(db, survivor.ID, survivor.Version, true)
+	assert.Nil(t, err)
+	_, err = internal.EmployeeMerge(db, survivor.ID, survivorArchived.Version, duplicate.ID, duplicate.Version, nil, emailOptions)
+	assert.NotNil(t, err)
+	survivor, err = internal.EmployeeArchive(db, survivor.ID, survivorArchived.Version, false)
+	assert.Nil(t, err)
+	//merge the duplicate into the survivor
+	employeeMerged, err := internal.EmployeeMerge(db, survivor.ID, survivor.Version, duplicate.ID, duplicate.Version, nil, emailOptions)
+	assert.Nil(t, err)
+	assert.Equal(t, survivor.ID, employeeMerged.ID)
+	assert.Equal(t, "Antonio", employeeMerged.FirstName)
+	assert.Equal(t, "Alexander", employeeMerged.LastName)
+	assert.Equal(t, survivor.EmailAddress, employeeMerged.EmailAddress)
+	assert.Equal(t, survivor.Version+1, employeeMerged.Version)
+	//reads of the duplicate resolve to the survivor and its timer was moved
+	employeeRead, err := internal.EmployeeRead(db, duplicate.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, employeeMerged, employeeRead)
+	timerRead, err := internal.TimerRead(db, timer.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, survivor.ID, timerRead.EmployeeID)
+	assert.Equal(t, timer.Version+1, timerRead.Version)
+	histories, err := internal.TimerHistoryRead(db, timer.ID)
+	assert.Nil(t, err)
+	if assert.Len(t, histories, 1) {
+		assert.Equal(t, duplicate.ID, histories[0].PreviousEmployeeID)
+		assert.Equal(t, survivor.ID, histories[0].EmployeeID)
+	}
+	//the duplicate's email address is available again
+	employeeCreated, err := internal.EmployeeCreate(db, &internal.Employee{
+		ID:           internal.GenerateID(),
+		EmailAddress: duplicate.EmailAddress,
+	}, emailOptions)
+	assert.Nil(t, err)
+	assert.NotEqual(t, survivor.ID, employeeCreated.ID)
+	//clean-up
+	err = internal.TimerDelete(db, timer.ID)
+	assert.Nil(t, err)
+	for _, employee := range []*internal.Employee{employeeCreated, survivor} {
+		err = internal.EmployeeDelete(db, &internal.Employee{ID: employee.ID}, emailOptions)
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestIDGenerator(t *testing.T) {
+	for _, name := range []string{
+		internal.IDGeneratorUUIDv4,
+		internal.IDGeneratorUUIDv7,
+		internal.IDGeneratorULID,
+	} {
+		idGenerator, err := internal.NewIDGenerator(name)
+		assert.Nil(t, err)
+		id := idGenerator.Generate()
+		bytes, err := idGenerator.Parse(id)
+		assert.Nil(t, err, name)
+		assert.Len(t, bytes, 16, name)
+		idFormatted, err := idGenerator.Format(bytes)
+		assert.Nil(t, err, name)
+		assert.Equal(t, id, idFormatted, name)
+		_, err = idGenerator.Parse("not an id")
+		assert.NotNil(t, err, name)
+	}
+	_, err := internal.NewIDGenerator("uuidv1")
+	assert.NotNil(t, err)
+	//validate that time-ordered ids generated later sort later
+	for _, idGenerator := range []internal.IDGenerator{
+		internal.UUIDv7Generator{},
+		internal.ULIDGenerator{},
+	} {
+		idFirst := idGenerator.Generate()
+		time.Sleep(2 * time.Millisecond)
+		idSecond := idGenerator.Generate()
+		assert.Less(t, idFirst, idSecond)
+	}
+	id := internal.UUIDv7Generator{}.Generate()
+	assert.Equal(t, byte('7'), id[14])
+	bytes, err := internal.ULIDGenerator{}.Parse("01ARZ3NDEKTSV4RRFFQ69G5FAV")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x01, 0x56, 0x3e, 0x3a, 0xb5, 0xd3}, bytes[:6])
+	//validate that the binary representation doesn't depend on the generator,
+	// a ULID and the uuid it's formatted as are the same id
+	bytesBinary, err := internal.IDBinaryParse("01ARZ3NDEKTSV4RRFFQ69G5FAV")
+	assert.Nil(t, err)
+	assert.Equal(t, bytes, bytesBinary)
+	id, err = internal.IDBinaryFormat(bytesBinary)
+	assert.Nil(t, err)
+	bytesBinary, err = internal.IDBinaryParse(id)
+	assert.Nil(t, err)
+	assert.Equal(t, bytes, bytesBinary)
+}
+
+func TestIDGeneratorChange(t *testing.T) {
+	idGeneration := internal.IDGeneration
+	defer func() { internal.IDGeneration = idGeneration }()
+	db, err := initDatabase()
+	assert.Nil(t, err)
+	//write an employee with a ulid, then read it with a uuid generator
+	internal.IDGeneration = internal.IDOptions{
+		Generator: internal.ULIDGenerator{},
+		Binary:    configuration.IDBinary,
+	}
+	id := internal.ULIDGenerator{}.Generate()
+	employee, err := internal.EmployeeCreate(db, &internal.Employee{
+		ID:           id,
+		EmailAddress: "id.generator@mistersoftwaredeveloper.com",
+	}, emailOptions)
+	assert.Nil(t, err)
+	internal.IDGeneration = internal.IDOptions{
+		Generator: internal.UUIDv4Generator{},
+		Binary:    configuration.IDBinary,
+	}
+	for _, employeeID := range []string{id, employee.ID} {
+		employeeRead, err := internal.EmployeeRead(db, employeeID)
+		if assert.Nil(t, err) {
+			assert.Equal(t, employee.ID, employeeRead.ID)
+		}
+	}
+	//write an employee with a uuid, then read it with a ulid generator
+	employee, err = internal.EmployeeCreate(db, &internal.Employee{
+		ID:           internal.GenerateID(),
+		EmailAddress: "id.generator.uuid@mistersoftwaredeveloper.com",
+	}, emailOptions)
+	assert.Nil(t, err)
+	internal.IDGeneration = internal.IDOptions{
+		Generator: internal.ULIDGenerator{},
+		Binary:    configuration.IDBinary,
+	}
+	employeeRead, err := internal.EmployeeRead(db, employee.ID)
+	if assert.Nil(t, err) {
+		assert.Equal(t, employee.ID, employeeRead.ID)
+	}
+	//clean-up
+	for _, emailAddress := range []string{
+		"id.generator@mistersoftwaredeveloper.com",
+		"id.generator.uuid@mistersoftwaredeveloper.com",
+	} {
+		err = internal.EmployeeDelete(db, &internal.Employee{EmailAddress: emailAddress}, emailOptions)
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestShardFor(t *testing.T) {
+	counts := make([]int, 4)
+	for i := 0; i < 1000; i++ {
+		id := internal.GenerateID()
+		shard := internal.ShardFor(id, len(counts))
+		assert.Equal(t, shard, internal.ShardFor(id, len(counts)))
+		assert.Equal(t, shard, internal.ShardFor(strings.ToUpper(id), len(counts)))
+		counts[shard]++
+	}
+	for _, count := range counts {
+		assert.Greater(t, count, 0)
+	}
+	assert.Equal(t, 0, internal.ShardFor(internal.GenerateID(), 1))
+}
+
+func TestShardedStore(t *testing.T) {
+	//KIM: both shards are the same database, the routing is the same
+	// whether or not they're different databases
+	directory, err := initDatabase()
+	assert.Nil(t, err)
+	shard, err := initDatabase()
+	assert.Nil(t, err)
+	store := internal.NewShardedStore(directory, emailOptions, directory, shard)
+	defer store.Close()
+	var employees []*internal.Employee
+	for _, emailAddress := range []string{
+		"shard.first@mistersoftwaredeveloper.com",
+		"shard.second@mistersoftwaredeveloper.com",
+	} {
+		err = store.EmployeeDelete(&internal.Employee{EmailAddress: emailAddress})
+		assert.Nil(t, err)
+		employee, err := store.EmployeeCreate(&internal.Employee{
+			ID:           internal.GenerateID(),
+			EmailAddress: emailAddress,
+		})
+		assert.Nil(t, err)
+		employees = append(employees, employee)
+	}
+	//create the same employee with a different uuid and casing, the
+	// directory should converge on the original employee
+	employee, err := store.EmployeeCreate(&internal.Employee{
+		ID:           internal.GenerateID(),
+		EmailAddress: strings.ToUpper(employees[0].EmailAddress),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, employees[0].ID, employee.ID)
+	//attempt to change the second employee's email address to the first's
+	employee = employees[1]
+	employee.EmailAddress = employees[0].EmailAddress
+	_, err = store.EmployeeWrite(employee)
+	assert.NotNil(t, err)
+	employeesRead, err := store.EmployeesRead()
+	assert.Nil(t, err)
+	for _, employee := range employees {
+		found := false
+		for _, employeeRead := range employeesRead {
+			if employeeRead.ID == employee.ID {
+				found = true
+			}
+		}
+		assert.True(t, found)
+	}
+	//timers are stored on the shard of their employee
+	timer, err := store.TimerCreate(&internal.Timer{
+		ID:         internal.GenerateID(),
+		Comment:    "This is a comment",
+		Start:      time.Now().UnixNano(),
+		EmployeeID: employees[0].ID,
+	})
+	assert.Nil(t, err)
+	timerRead, err := store.TimerRead(timer.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, timer, timerRead)
+	//clean-up
+	err = store.TimerDelete(timer.ID)
+	assert.Nil(t, err)
+	for _, employee := range employees {
+		err = store.EmployeeDelete(&internal.Employee{ID: employee.ID})
+		assert.Nil(t, err)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	db, err := initDatabase()
+	assert.Nil(t, err)
+	employees := make([]*internal.Employee, 0, 2)
+	for _, emailAddress := range []string{
+		"audit.first@mistersoftwaredeveloper.com",
+		"audit.second@mistersoftwaredeveloper.com",
+	} {
+		employee := &internal.Employee{
+			ID:           internal.GenerateID(),
+			EmailAddress: emailAddress,
+		}
+		err = internal.EmployeeDelete(db, employee, emailOptions)
+		assert.Nil(t, err)
+		employee, err = internal.EmployeeCreate(db, employee, emailOptions)
+		assert.Nil(t, err)
+		employees = append(employees, employee)
+	}
+	timer, err := internal.TimerCreate(db, &internal.Timer{
+		ID:         internal.GenerateID(),
+		Comment:    "This is a comment",
+		Start:      time.Now().UnixNano(),
+		EmployeeID: employees[0].ID,
+	})
+	assert.Nil(t, err)
+	timerFuture, err := internal.TimerCreate(db, &internal.Timer{
+		ID:         internal.GenerateID(),
+		Comment:    "This timer starts in the future",
+		Start:      time.Now().Add(time.Hour).UnixNano(),
+		EmployeeID: employees[0].ID,
+	})
+	assert.Nil(t, err)
+	//introduce inconsistencies that the constraints can't prevent: a timer that
+	// finishes before it starts, a running timer with a negative elapsed time,
+	// an invalid version and a silent change in owner (an update that doesn't
+	// record history)
+	_, err = db.Exec("UPDATE timer SET finish=start-1 WHERE uuid=?", timer.ID)
+	assert.Nil(t, err)
+	_, err = db.Exec("UPDATE employee SET version=0 WHERE uuid=?", employees[1].ID)
+	assert.Nil(t, err)
+	timerRead, err := internal.TimerRead(db, timer.ID)
+	assert.Nil(t, err)
+	timerReassigned, err := internal.TimerReassign(db, timer.ID, timerRead.Version, employees[1].ID)
+	assert.Nil(t, err)
+	_, err = db.Exec("UPDATE timer SET employee_id=(SELECT id FROM employee WHERE uuid=?), version=? WHERE uuid=?",
+		employees[0].ID, timerReassigned.Version+1, timer.ID)
+	assert.Nil(t, err)
+	checks := func(report *internal.AuditReport, id string) map[string]*internal.AuditViolation {
+		violations := make(map[string]*internal.AuditViolation)
+		for _, violation := range report.Violations {
+			if violation.ID == id {
+				violations[violation.Check] = violation
+			}
+		}
+		return violations
+	}
+	report, err := internal.Audit(db, false, emailOptions)
+	assert.Nil(t, err)
+	violations := checks(report, timer.ID)
+	assert.Contains(t, violations, internal.AuditTimerFinishBeforeStart)
+	assert.Contains(t, violations, internal.AuditTimerHistoryGap)
+	violations = checks(report, timerFuture.ID)
+	assert.Contains(t, violations, internal.AuditTimerElapsedTimeNegative)
+	violations = checks(report, employees[1].ID)
+	if assert.Contains(t, violations, internal.AuditVersionInvalid) {
+		assert.True(t, violations[internal.AuditVersionInvalid].Repairable)
+	}
+	//repair the violations and validate that only the safe ones were repaired
+	report, err = internal.Audit(db, true, emailOptions)
+	assert.Nil(t, err)
+	violations = checks(report, employees[1].ID)
+	if assert.Contains(t, violations, internal.AuditVersionInvalid) {
+		assert.True(t, violations[internal.AuditVersionInvalid].Repaired)
+	}
+	violations = checks(report, timer.ID)
+	if assert.Contains(t, violations, internal.AuditTimerFinishBeforeStart) {
+		assert.False(t, violations[internal.AuditTimerFinishBeforeStart].Repaired)
+	}
+	employeeRead, err := internal.EmployeeRead(db, employees[1].ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, employeeRead.Version)
+	//clean-up
+	for _, timerID := range []string{timer.ID, timerFuture.ID} {
+		err = internal.TimerDelete(db, timerID)
+		assert.Nil(t, err)
+	}
+	for _, employee := range employees {
+		err = internal.EmployeeDelete(db, &internal.Employee{ID: employee.ID}, emailOptions)
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+type publisherFunc func(ctx context.Context, message *internal.OutboxMessage) error
+
+func (p publisherFunc) Publish(ctx context.Context, message *internal.OutboxMessage) error {
+	return p(ctx, message)
+}
+
+func TestWriterPublisher(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	publisher := internal.NewWriterPublisher(buffer)
+	message := &internal.OutboxMessage{
+		ID:         1,
+		EntityType: "employee",
+		EntityID:   internal.GenerateID(),
+		Version:    1,
+		ChangeType: internal.ChangeCreated,
+		Payload:    json.RawMessage(`{"id":"1"}`),
+	}
+	err := publisher.Publish(context.TODO(), message)
+	assert.Nil(t, err)
+	err = publisher.Publish(context.TODO(), message)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	assert.Len(t, lines, 2)
+	messagePublished := &internal.OutboxMessage{}
+	err = json.Unmarshal([]byte(lines[0]), messagePublished)
+	assert.Nil(t, err)
+	assert.Equal(t, message, messagePublished)
+}
+
+func TestOutbox(t *testing.T) {
+	db, err := initDatabase()
+	assert.Nil(t, err)
+	ctx := context.TODO()
+	//deliver anything left over from other tests
+	var messages []*internal.OutboxMessage
+	relay := &internal.OutboxRelay{
+		DB: db,
+		Publisher: publisherFunc(func(ctx context.Context, message *internal.OutboxMessage) error {
+			messages = append(messages, message)
+			return nil
+		}),
+	}
+	for delivered := 1; delivered > 0; {
+		delivered, err = relay.Deliver(ctx)
+		assert.Nil(t, err)
+	}
+	employee := &internal.Employee{
+		ID:           internal.GenerateID(),
+		EmailAddress: "outbox@mistersoftwaredeveloper.com",
+	}
+	err = internal.EmployeeDelete(db, employee, emailOptions)
+	assert.Nil(t, err)
+	employee, err = internal.EmployeeCreate(db, employee, emailOptions)
+	assert.Nil(t, err)
+	employee.FirstName = "Antonio"
+	employee, err = internal.EmployeeWrite(db, employee, emailOptions)
+	assert.Nil(t, err)
+	err = internal.EmployeeDelete(db, &internal.Employee{ID: employee.ID}, emailOptions)
+	assert.Nil(t, err)
+	//a failed write shouldn't write to the outbox
+	_, err = internal.EmployeeWrite(db, employee, emailOptions)
+	assert.NotNil(t, err)
+	//validate that a failed publish doesn't mark the message as delivered
+	errPublish := errors.New("unable to publish")
+	relayFailed := &internal.OutboxRelay{
+		DB: db,
+		Publisher: publisherFunc(func(ctx context.Context, message *internal.OutboxMessage) error {
+			return errPublish
+		}),
+	}
+	delivered, err := relayFailed.Deliver(ctx)
+	assert.Equal(t, errPublish, err)
+	assert.Equal(t, 0, delivered)
+	messages = nil
+	for delivered := 1; delivered > 0; {
+		delivered, err = relay.Deliver(ctx)
+		assert.Nil(t, err)
+	}
+	var changes []string
+	var versions []int
+	for i, message := range messages {
+		if i > 0 {
+			assert.Greater(t, message.ID, messages[i-1].ID)
+		}
+		if message.EntityID == employee.ID {
+			changes = append(changes, message.ChangeType)
+			versions = append(versions, message.Version)
+		}
+	}
+	assert.Equal(t, []string{internal.ChangeCreated, internal.ChangeUpdated, internal.ChangeDeleted}, changes)
+	assert.Equal(t, []int{1, 2, 2}, versions)
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestChangesSince(t *testing.T) {
+	db, err := initDatabase()
+	assert.Nil(t, err)
+	sequence, err := internal.ChangeSequence(db)
+	assert.Nil(t, err)
+	employee, err := internal.EmployeeCreate(db, &internal.Employee{
+		ID:           internal.GenerateID(),
+		EmailAddress: "changes.first@mistersoftwaredeveloper.com",
+	}, emailOptions)
+	assert.Nil(t, err)
+	//a rolled back transaction shouldn't leave a gap in the sequence
+	errRollback := errors.New("rollback")
+	err = internal.WithTx(context.TODO(), db, func(tx internal.Tx) error {
+		if _, err := internal.EmployeeCreate(tx, &internal.Employee{
+			ID:           internal.GenerateID(),
+			EmailAddress: "changes.rollback@mistersoftwaredeveloper.com",
+		}, emailOptions); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	assert.Equal(t, errRollback, err)
+	employeeSecond, err := internal.EmployeeCreate(db, &internal.Employee{
+		ID:           internal.GenerateID(),
+		EmailAddress: "changes.second@mistersoftwaredeveloper.com",
+	}, emailOptions)
+	assert.Nil(t, err)
+	messages, err := internal.ChangesSince(db, sequence, 10)
+	assert.Nil(t, err)
+	if assert.Len(t, messages, 2) {
+		assert.Equal(t, sequence+1, messages[0].Sequence)
+		assert.Equal(t, employee.ID, messages[0].EntityID)
+		assert.Equal(t, sequence+2, messages[1].Sequence)
+		assert.Equal(t, employeeSecond.ID, messages[1].EntityID)
+	}
+	messages, err = internal.ChangesSince(db, sequence, 1)
+	assert.Nil(t, err)
+	assert.Len(t, messages, 1)
+	//clean-up
+	for _, employee := range []*internal.Employee{employee, employeeSecond} {
+		err = internal.EmployeeDelete(db, &internal.Employee{ID: employee.ID}, emailOptions)
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestEventSourcedStore(t *testing.T) {
+	db, err := initDatabase()
+	assert.Nil(t, err)
+	var store internal.EmployeeStore = internal.NewEventSourcedStore(db, emailOptions)
+	employee, err := store.EmployeeCreate(&internal.Employee{
+		ID:           internal.GenerateID(),
+		FirstName:    "Event",
+		LastName:     "Sourced",
+		EmailAddress: "event.sourced@mistersoftwaredeveloper.com",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, employee.Version)
+	//the projection should be readable with the existing functions
+	employeeRead, err := internal.EmployeeRead(db, employee.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, employee, employeeRead)
+	//a name and email change should append two events
+	employee.FirstName = "Evented"
+	employee.EmailAddress = "evented.sourced@mistersoftwaredeveloper.com"
+	employeeWritten, err := store.EmployeeWrite(employee)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, employeeWritten.Version)
+	assert.Equal(t, "Evented", employeeWritten.FirstName)
+	//a write at a stale version should fail
+	_, err = store.EmployeeWrite(employee)
+	assert.NotNil(t, err)
+	events, err := internal.EmployeeEventsRead(db, employee.ID)
+	assert.Nil(t, err)
+	if assert.Len(t, events, 3) {
+		assert.Equal(t, internal.EventEmployeeCreated, events[0].Type)
+		assert.Equal(t, internal.EventEmployeeNameChanged, events[1].Type)
+		assert.Equal(t, internal.EventEmployeeEmailChanged, events[2].Type)
+	}
+	//rebuilding the projection should restore a mutated employee
+	_, err = db.Exec("UPDATE employee SET first_name='Drifted' WHERE uuid=?", employee.ID)
+	assert.Nil(t, err)
+	result, err := internal.ProjectionRebuild(db, emailOptions)
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, result.Streams, 1)
+	employeeRead, err = store.EmployeeRead(employee.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "Evented", employeeRead.FirstName)
+	//changing the projection without appending an event should be refused
+	_, err = internal.EmployeeArchive(db, employee.ID, employeeRead.Version, true)
+	assert.True(t, errors.Is(err, internal.ErrEmployeeEventSourced))
+	//deleting should append a deleted event and remove the projection
+	err = store.EmployeeDelete(&internal.Employee{ID: employee.ID})
+	assert.Nil(t, err)
+	_, err = store.EmployeeRead(employee.ID)
+	assert.NotNil(t, err)
+	events, err = internal.EmployeeEventsRead(db, employee.ID)
+	assert.Nil(t, err)
+	if assert.Len(t, events, 4) {
+		assert.Equal(t, internal.EventEmployeeDeleted, events[3].Type)
+	}
+	//re-creating the deleted employee should fail with its tombstone
+	_, err = store.EmployeeCreate(&internal.Employee{
+		ID:           employee.ID,
+		EmailAddress: "event.sourced@mistersoftwaredeveloper.com",
+	})
+	assert.True(t, internal.IsEmployeeDeleted(err))
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestEventSourcedConcurrentCreate(t *testing.T) {
+	db, err := initDatabase()
+	assert.Nil(t, err)
+	store := internal.NewEventSourcedStore(db, emailOptions)
+	emailAddress := "event.sourced.concurrent@mistersoftwaredeveloper.com"
+	err = store.EmployeeDelete(&internal.Employee{EmailAddress: emailAddress})
+	assert.Nil(t, err)
+	//create the same employee concurrently (with different uuids), both creates
+	// should converge on the same employee rather than fail
+	employees := make(chan *internal.Employee, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			employee, err := store.EmployeeCreate(&internal.Employee{
+				ID:           internal.GenerateID(),
+				FirstName:    "Event",
+				LastName:     "Sourced",
+				EmailAddress: emailAddress,
+			})
+			assert.Nil(t, err)
+			employees <- employee
+		}()
+	}
+	first, second := <-employees, <-employees
+	if assert.NotNil(t, first) && assert.NotNil(t, second) {
+		assert.Equal(t, first.ID, second.ID)
+		events, err := internal.EmployeeEventsRead(db, first.ID)
+		assert.Nil(t, err)
+		assert.Len(t, events, 1)
+	}
+	//clean-up
+	err = store.EmployeeDelete(&internal.Employee{EmailAddress: emailAddress})
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestEmployeeDeleteSaga(t *testing.T) {
+	db, err := initDatabase()
+	assert.Nil(t, err)
+	employees, timers, err := initSagaStores(db)
+	assert.Nil(t, err)
+	orchestrator := internal.NewSagaOrchestrator(db, internal.EmployeeDeleteSaga(employees, timers))
+	employee, err := internal.EmployeeCreate(db, &internal.Employee{
+		ID:           internal.GenerateID(),
+		EmailAddress: "saga.delete@mistersoftwaredeveloper.com",
+	}, emailOptions)
+	assert.Nil(t, err)
+	timer, err := internal.TimerCreate(db, &internal.Timer{
+		ID:         internal.GenerateID(),
+		Start:      time.Now().UnixNano(),
+		EmployeeID: employee.ID,
+	})
+	assert.Nil(t, err)
+	//orphaning the timers should fail (the timers would reference an employee
+	// that's been deleted in the same database) and the saga should be compensated
+	saga, err := orchestrator.Execute(context.TODO(), internal.SagaEmployeeDelete, &internal.EmployeeDeleteSagaData{
+		EmployeeID:  employee.ID,
+		TimerPolicy: internal.SagaTimersOrphan,
+	})
+	assert.NotNil(t, err)
+	if assert.NotNil(t, saga) {
+		assert.Equal(t, internal.SagaCompensated, saga.State)
+	}
+	timerRead, err := internal.TimerRead(db, timer.ID)
+	assert.Nil(t, err)
+	assert.False(t, timerRead.Completed)
+	_, err = internal.TimerCreate(db, &internal.Timer{
+		ID:         internal.GenerateID(),
+		Start:      time.Now().UnixNano(),
+		EmployeeID: employee.ID,
+	})
+	assert.Nil(t, err)
+	//cascading should delete the timers and the employee
+	saga, err = orchestrator.Execute(context.TODO(), internal.SagaEmployeeDelete, &internal.EmployeeDeleteSagaData{
+		EmployeeID:  employee.ID,
+		TimerPolicy: internal.SagaTimersCascade,
+	})
+	assert.Nil(t, err)
+	if assert.NotNil(t, saga) {
+		assert.Equal(t, internal.SagaCompleted, saga.State)
+		sagaRead, err := internal.SagaRead(db, saga.ID)
+		assert.Nil(t, err)
+		assert.Equal(t, saga, sagaRead)
+		//the timers should've been recorded before they were deleted
+		data := &internal.EmployeeDeleteSagaData{}
+		err = sagaRead.DataRead(data)
+		assert.Nil(t, err)
+		assert.Len(t, data.Timers, 2)
+	}
+	_, err = internal.TimerRead(db, timer.ID)
+	assert.NotNil(t, err)
+	_, err = internal.EmployeeRead(db, employee.ID)
+	assert.NotNil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestSagaResume(t *testing.T) {
+	var executed []string
+
+	db, err := initDatabase()
+	assert.Nil(t, err)
+	step := func(name string, fail bool) *internal.SagaStep {
+		return &internal.SagaStep{
+			Name: name,
+			Action: func(ctx context.Context, saga *internal.Saga) error {
+				executed = append(executed, name)
+				if fail {
+					return errors.New("failed")
+				}
+				return nil
+			},
+			Compensate: func(ctx context.Context, saga *internal.Saga) error {
+				executed = append(executed, "compensate "+name)
+				return nil
+			},
+		}
+	}
+	orchestrator := internal.NewSagaOrchestrator(db, &internal.SagaDefinition{
+		Name:  "test-resume",
+		Steps: []*internal.SagaStep{step("first", false), step("second", false), step("third", true)},
+	})
+	//a started saga (e.g., one that crashed before executing) should be resumed,
+	// the failed step should be compensated along with the completed steps
+	saga, err := orchestrator.Start(context.TODO(), "test-resume", map[string]string{})
+	assert.Nil(t, err)
+	sagas, err := orchestrator.Resume(context.TODO())
+	assert.NotNil(t, err)
+	assert.NotEmpty(t, sagas)
+	assert.Equal(t, []string{"first", "second", "third",
+		"compensate third", "compensate second", "compensate first"}, executed)
+	sagaRead, err := internal.SagaRead(db, saga.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, internal.SagaCompensated, sagaRead.State)
+	assert.Contains(t, sagaRead.Error, "third")
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+//memoryEmployeeStore is an in-memory EmployeeStore used to test the
+// employee service without a database
+type memoryEmployeeStore map[string]*internal.Employee
+
+func (m memoryEmployeeStore) EmployeeCreate(employee *internal.Employee) (*internal.Employee, error) {
+	employeeCreated := *employee
+	employeeCreated.Version = 1
+	m[employee.ID] = &employeeCreated
+	return &employeeCreated, nil
+}
+
+func (m memoryEmployeeStore) EmployeeWrite(employee *internal.Employee) (*internal.Employee, error) {
+	employeeRead, ok := m[employee.ID]
+	if !ok {
+		return nil, fmt.Errorf("employee with id, \"%s\", not found locally", employee.ID)
+	}
+	if employeeRead.Version != employee.Version {
+		return nil, errors.New("no rows affected, version mismatch or non-existent employee")
+	}
+	employeeWritten := *employee
+	employeeWritten.Version++
+	m[employee.ID] = &employeeWritten
+	return &employeeWritten, nil
+}
+
+func (m memoryEmployeeStore) EmployeeDelete(employee *internal.Employee) error {
+	delete(m, employee.ID)
+	return nil
+}
+
+func (m memoryEmployeeStore) EmployeeRead(employeeID string) (*internal.Employee, error) {
+	employee, ok := m[employeeID]
+	if !ok {
+		return nil, fmt.Errorf("employee with id, \"%s\", not found locally", employeeID)
+	}
+	return employee, nil
+}
+
+func TestEmployeeService(t *testing.T) {
+	server := httptest.NewServer(internal.NewEmployeeService(memoryEmployeeStore{}))
+	defer server.Close()
+	client := internal.NewEmployeeClient(server.URL, server.Client())
+	employee, err := client.EmployeeCreate(&internal.Employee{
+		ID:           internal.GenerateID(),
+		EmailAddress: "employee.service@mistersoftwaredeveloper.com",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, employee.Version)
+	employeeRead, err := client.EmployeeRead(employee.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, employee, employeeRead)
+	employee.FirstName = "Service"
+	employeeWritten, err := client.EmployeeWrite(employee)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, employeeWritten.Version)
+	//the errors should make it through the service
+	_, err = client.EmployeeWrite(employee)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "version mismatch")
+	}
+	err = client.EmployeeDelete(&internal.Employee{ID: employee.ID})
+	assert.Nil(t, err)
+	_, err = client.EmployeeRead(employee.ID)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "not found")
+	}
+}
+
+func TestSplitTimerStore(t *testing.T) {
+	config := *configuration
+	config.Database = "bludgeon_timers"
+	db, err := internal.Initialize(&config)
+	assert.Nil(t, err)
+	server := httptest.NewServer(internal.NewTimerService(internal.NewSplitTimerStore(db, nil, "")))
+	defer server.Close()
+	client := internal.NewTimerClient(server.URL, server.Client())
+	//timers can reference employees that don't exist, there's nothing in
+	// the timer database to prevent it
+	employeeID, employeeIDOther := internal.GenerateID(), internal.GenerateID()
+	timer, err := client.TimerCreate(&internal.Timer{
+		ID:         internal.GenerateID(),
+		Start:      time.Now().UnixNano(),
+		EmployeeID: employeeID,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, employeeID, timer.EmployeeID)
+	timers, err := client.TimersRead(employeeID)
+	assert.Nil(t, err)
+	assert.Len(t, timers, 1)
+	timer, err = client.TimerReassign(timer.ID, timer.Version, employeeIDOther)
+	assert.Nil(t, err)
+	assert.Equal(t, employeeIDOther, timer.EmployeeID)
+	timer.Comment = "split"
+	timer, err = client.TimerWrite(timer)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, timer.Version)
+	err = client.TimerDelete(timer.ID)
+	assert.Nil(t, err)
+	_, err = client.TimerRead(timer.ID)
+	assert.NotNil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+//employeeLookupFunc is a function that implements EmployeeLookup
+type employeeLookupFunc func(employeeID string) (bool, error)
+
+func (e employeeLookupFunc) EmployeeExists(employeeID string) (bool, error) {
+	return e(employeeID)
+}
+
+func TestEmployeeLookup(t *testing.T) {
+	store := memoryEmployeeStore{}
+	server := httptest.NewServer(internal.NewEmployeeService(store))
+	employee, err := store.EmployeeCreate(&internal.Employee{ID: internal.GenerateID()})
+	assert.Nil(t, err)
+	lookup := internal.NewHTTPEmployeeLookup(internal.NewEmployeeClient(server.URL, server.Client()))
+	exists, err := lookup.EmployeeExists(employee.ID)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+	exists, err = lookup.EmployeeExists(internal.GenerateID())
+	assert.Nil(t, err)
+	assert.False(t, exists)
+	//a cached lookup should find the employee even if the employee
+	// service is unreachable (within the ttl)
+	cachedLookup := internal.NewCachedEmployeeLookup(lookup, nil, time.Minute)
+	exists, err = cachedLookup.EmployeeExists(employee.ID)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+	server.Close()
+	_, err = lookup.EmployeeExists(employee.ID)
+	assert.NotNil(t, err)
+	exists, err = cachedLookup.EmployeeExists(employee.ID)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+	_, err = cachedLookup.EmployeeExists(internal.GenerateID())
+	assert.NotNil(t, err)
+	//the policy should be validated
+	policy, err := internal.NewEmployeeLookupPolicy("")
+	assert.Nil(t, err)
+	assert.Equal(t, internal.EmployeeLookupReject, policy)
+	_, err = internal.NewEmployeeLookupPolicy("ignore")
+	assert.NotNil(t, err)
+}
+
+func TestSplitTimerStoreLookup(t *testing.T) {
+	var reachable bool
+
+	config := *configuration
+	config.Database = "bludgeon_timers"
+	db, err := internal.Initialize(&config)
+	assert.Nil(t, err)
+	employeeID := internal.GenerateID()
+	lookup := employeeLookupFunc(func(id string) (bool, error) {
+		if !reachable {
+			return false, errors.New("unreachable")
+		}
+		return id == employeeID, nil
+	})
+	//reject should fail to create timers when the lookup fails
+	store := internal.NewSplitTimerStore(db, lookup, internal.EmployeeLookupReject)
+	_, err = store.TimerCreate(&internal.Timer{ID: internal.GenerateID(), EmployeeID: employeeID})
+	assert.NotNil(t, err)
+	//accept-and-flag should create the timer, but flag it
+	store = internal.NewSplitTimerStore(db, lookup, internal.EmployeeLookupAcceptAndFlag)
+	timerFlagged, err := store.TimerCreate(&internal.Timer{ID: internal.GenerateID(), EmployeeID: employeeID})
+	assert.Nil(t, err)
+	//queue should create the timer and verify it later
+	store = internal.NewSplitTimerStore(db, lookup, internal.EmployeeLookupQueue)
+	timerQueued, err := store.TimerCreate(&internal.Timer{ID: internal.GenerateID(), EmployeeID: employeeID})
+	assert.Nil(t, err)
+	timers, err := store.TimersUnverified()
+	assert.Nil(t, err)
+	unverified := make(map[string]bool)
+	for _, timer := range timers {
+		unverified[timer.ID] = true
+	}
+	assert.True(t, unverified[timerFlagged.ID])
+	assert.True(t, unverified[timerQueued.ID])
+	reachable = true
+	verification, err := store.EmployeesVerify(context.TODO())
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, verification.Verified, 1)
+	timers, err = store.TimersUnverified()
+	assert.Nil(t, err)
+	for _, timer := range timers {
+		assert.NotEqual(t, timerQueued.ID, timer.ID)
+	}
+	//timers can't be created for employees that don't exist
+	_, err = store.TimerCreate(&internal.Timer{ID: internal.GenerateID(), EmployeeID: internal.GenerateID()})
+	assert.NotNil(t, err)
+	//clean-up
+	for _, timer := range []*internal.Timer{timerFlagged, timerQueued} {
+		err = store.TimerDelete(timer.ID)
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestEmployeeTombstone(t *testing.T) {
+	db, err := initDatabase()
+	assert.Nil(t, err)
+	employee, err := internal.EmployeeCreate(db, &internal.Employee{
+		ID:           internal.GenerateID(),
+		EmailAddress: "tombstone@mistersoftwaredeveloper.com",
+	}, emailOptions)
+	assert.Nil(t, err)
+	//an employee that never existed isn't deleted
+	_, err = internal.EmployeeRead(db, internal.GenerateID())
+	assert.NotNil(t, err)
+	assert.False(t, internal.IsEmployeeDeleted(err))
+	err = internal.EmployeeDeleteBy(db, employee, "test", emailOptions)
+	assert.Nil(t, err)
+	tombstone, err := internal.EmployeeTombstoneRead(db, employee.ID)
+	assert.Nil(t, err)
+	if assert.NotNil(t, tombstone) {
+		assert.Equal(t, employee.ID, tombstone.EmployeeID)
+		assert.Equal(t, employee.Version, tombstone.Version)
+		assert.Equal(t, "test", tombstone.DeletedBy)
+	}
+	//reading or referencing the employee should fail as deleted
+	_, err = internal.EmployeeRead(db, employee.ID)
+	assert.True(t, internal.IsEmployeeDeleted(err))
+	_, err = internal.TimerCreate(db, &internal.Timer{
+		ID:         internal.GenerateID(),
+		Start:      time.Now().UnixNano(),
+		EmployeeID: employee.ID,
+	})
+	assert.True(t, internal.IsEmployeeDeleted(err))
+	_, err = internal.EmployeeCreate(db, &internal.Employee{
+		ID:           employee.ID,
+		EmailAddress: "tombstone@mistersoftwaredeveloper.com",
+	}, emailOptions)
+	assert.True(t, internal.IsEmployeeDeleted(err))
+	//tombstones within the retention aren't purged
+	_, err = internal.EmployeeTombstonesPurge(db, time.Hour)
+	assert.Nil(t, err)
+	_, err = internal.EmployeeTombstoneRead(db, employee.ID)
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestWebhookSign(t *testing.T) {
+	body := []byte(`{"event_type":"employee.deleted"}`)
+	signature := internal.WebhookSign("secret", body)
+	assert.True(t, strings.HasPrefix(signature, "sha256="))
+	assert.True(t, internal.WebhookVerify("secret", body, signature))
+	assert.False(t, internal.WebhookVerify("not-the-secret", body, signature))
+	assert.False(t, internal.WebhookVerify("secret", append(body, ' '), signature))
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	payloads := make(chan *internal.WebhookPayload, 10)
+
+	db, err := initDatabase()
+	assert.Nil(t, err)
+	ctx := context.TODO()
+	receiver := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		if !internal.WebhookVerify("secret", body, request.Header.Get(internal.WebhookHeaderSignature)) {
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		payload := &internal.WebhookPayload{}
+		if err := json.Unmarshal(body, payload); err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		payloads <- payload
+		writer.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+	unreachable := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unreachable.Close()
+	subscription, err := internal.WebhookSubscriptionCreate(db, &internal.WebhookSubscription{
+		URL:        receiver.URL,
+		EventTypes: []string{"employee.deleted"},
+		Secret:     "secret",
+	})
+	assert.Nil(t, err)
+	subscriptionFailed, err := internal.WebhookSubscriptionCreate(db, &internal.WebhookSubscription{
+		URL:        unreachable.URL,
+		EventTypes: []string{"employee.deleted"},
+		Secret:     "secret",
+	})
+	assert.Nil(t, err)
+	//deliver anything left over from other tests
+	worker := &internal.WebhookWorker{DB: db, MaxAttempts: 2, Backoff: time.Millisecond}
+	for delivered := 1; delivered > 0; {
+		delivered, err = worker.Deliver(ctx)
+		assert.Nil(t, err)
+	}
+	for len(payloads) > 0 {
+		<-payloads
+	}
+	//publishing the same message twice should only queue a single delivery
+	// per subscription and event types that weren't subscribed to are ignored
+	sequence, err := internal.ChangeSequence(db)
+	assert.Nil(t, err)
+	employeeID := internal.GenerateID()
+	publisher := internal.NewWebhookPublisher(db)
+	for _, message := range []*internal.OutboxMessage{
+		{Sequence: sequence + 1000, EntityType: "employee", EntityID: employeeID, Version: 1, ChangeType: internal.ChangeCreated, Payload: []byte("{}")},
+		{Sequence: sequence + 1001, EntityType: "employee", EntityID: employeeID, Version: 1, ChangeType: internal.ChangeDeleted, Payload: []byte("{}")},
+		{Sequence: sequence + 1001, EntityType: "employee", EntityID: employeeID, Version: 1, ChangeType: internal.ChangeDeleted, Payload: []byte("{}")},
+	} {
+		err = publisher.Publish(ctx, message)
+		assert.Nil(t, err)
+	}
+	delivered, err := worker.Deliver(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, delivered)
+	if assert.Len(t, payloads, 1) {
+		payload := <-payloads
+		assert.Equal(t, "employee.deleted", payload.EventType)
+		assert.Equal(t, employeeID, payload.EntityID)
+		assert.Equal(t, 1, payload.Version)
+	}
+	//the failed delivery should be retried, then dead lettered
+	time.Sleep(10 * time.Millisecond)
+	delivered, err = worker.Deliver(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, delivered)
+	deadLetters, err := internal.WebhookDeadLettersRead(db, subscriptionFailed.ID)
+	assert.Nil(t, err)
+	if assert.Len(t, deadLetters, 1) {
+		assert.Equal(t, 2, deadLetters[0].Attempts)
+		assert.Equal(t, sequence+1001, deadLetters[0].Sequence)
+		//publishing the message again shouldn't queue it again
+		err = publisher.Publish(ctx, &internal.OutboxMessage{Sequence: sequence + 1001, EntityType: "employee",
+			EntityID: employeeID, Version: 1, ChangeType: internal.ChangeDeleted, Payload: []byte("{}")})
+		assert.Nil(t, err)
+		time.Sleep(10 * time.Millisecond)
+		delivered, err = worker.Deliver(ctx)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, delivered)
+		deadLetters, err = internal.WebhookDeadLettersRead(db, subscriptionFailed.ID)
+		assert.Nil(t, err)
+		assert.Len(t, deadLetters, 1)
+		replayed, err := internal.WebhookReplay(db, deadLetters[0].ID)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(1), replayed)
+	}
+	deadLetters, err = internal.WebhookDeadLettersRead(db, subscriptionFailed.ID)
+	assert.Nil(t, err)
+	assert.Len(t, deadLetters, 0)
+	err = internal.WebhookSubscriptionDelete(db, subscriptionFailed.ID)
+	assert.Nil(t, err)
+	//workers running at once should each claim different deliveries, so
+	// a webhook is only sent once
+	err = publisher.Publish(ctx, &internal.OutboxMessage{Sequence: sequence + 1002, EntityType: "employee",
+		EntityID: employeeID, Version: 2, ChangeType: internal.ChangeDeleted, Payload: []byte("{}")})
+	assert.Nil(t, err)
+	var wg sync.WaitGroup
+	counts := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			delivered, err := (&internal.WebhookWorker{DB: db}).Deliver(ctx)
+			assert.Nil(t, err)
+			counts <- delivered
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, <-counts+<-counts)
+	assert.Len(t, payloads, 1)
+	//delivered webhooks should be purged once they're older than the retention
+	time.Sleep(2 * time.Second)
+	purged, err := internal.WebhookDeliveriesPurge(db, time.Second)
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, purged, int64(2))
+	err = internal.WebhookSubscriptionDelete(db, subscription.ID)
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestLocker(t *testing.T) {
+	db, err := initDatabase()
+	assert.Nil(t, err)
+	ctx := context.TODO()
+	locker := internal.NewLocker(db)
+	lockName := "test:" + internal.GenerateID()
+	lock, err := locker.Lock(ctx, lockName, 0)
+	assert.Nil(t, err)
+	held, err := lock.Held(ctx)
+	assert.Nil(t, err)
+	assert.True(t, held)
+	holder, err := locker.Holder(ctx, lockName)
+	assert.Nil(t, err)
+	assert.NotZero(t, holder)
+	//the lock shouldn't be acquired while it's held, either by timing out
+	// or by the context being cancelled
+	_, err = locker.Lock(ctx, lockName, 0)
+	assert.True(t, errors.Is(err, internal.ErrLockNotAcquired))
+	_, err = locker.Lock(ctx, lockName, 100*time.Millisecond)
+	assert.True(t, errors.Is(err, internal.ErrLockNotAcquired))
+	ctxTimeout, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	tStart := time.Now()
+	_, err = locker.Lock(ctxTimeout, lockName, 10*time.Second)
+	assert.NotNil(t, err)
+	assert.Less(t, int64(time.Since(tStart)), int64(5*time.Second))
+	//once released, the lock can be acquired again
+	err = lock.Release(ctx)
+	assert.Nil(t, err)
+	err = lock.Release(ctx)
+	assert.Nil(t, err)
+	holder, err = locker.Holder(ctx, lockName)
+	assert.Nil(t, err)
+	assert.Zero(t, holder)
+	err = locker.WithLock(ctx, lockName, time.Second, func(ctx context.Context) error {
+		holder, err := locker.Holder(ctx, lockName)
+		assert.Nil(t, err)
+		assert.NotZero(t, holder)
+		return nil
+	})
+	assert.Nil(t, err)
+	//a saga for an employee whose lock is held shouldn't be resumed
+	employee, err := internal.EmployeeCreate(db, &internal.Employee{
+		ID:           internal.GenerateID(),
+		EmailAddress: "saga.lock@mistersoftwaredeveloper.com",
+	}, emailOptions)
+	assert.Nil(t, err)
+	employees, timers, err := initSagaStores(db)
+	assert.Nil(t, err)
+	orchestrator := internal.NewSagaOrchestrator(db, internal.EmployeeDeleteSaga(employees, timers))
+	saga, err := orchestrator.Start(ctx, internal.SagaEmployeeDelete, &internal.EmployeeDeleteSagaData{
+		EmployeeID:  employee.ID,
+		TimerPolicy: internal.SagaTimersCascade,
+	})
+	assert.Nil(t, err)
+	lock, err = locker.Lock(ctx, internal.LockEmployee(employee.ID), 0)
+	assert.Nil(t, err)
+	sagas, _ := orchestrator.Resume(ctx)
+	for _, sagaResumed := range sagas {
+		assert.NotEqual(t, saga.ID, sagaResumed.ID)
+	}
+	sagaRead, err := internal.SagaRead(db, saga.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, internal.SagaRunning, sagaRead.State)
+	err = lock.Release(ctx)
+	assert.Nil(t, err)
+	_, _ = orchestrator.Resume(ctx)
+	sagaRead, err = internal.SagaRead(db, saga.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, internal.SagaCompleted, sagaRead.State)
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestLease(t *testing.T) {
+	db, err := initDatabase()
+	assert.Nil(t, err)
+	name := "test:" + internal.GenerateID()
+	//only one holder should acquire the lease
+	lease, err := internal.LeaseAcquire(db, name, "first", time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, "first", lease.Holder)
+	token := lease.Token
+	lease, err = internal.LeaseAcquire(db, name, "second", time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, "first", lease.Holder)
+	//renewing the lease shouldn't change the token
+	lease, err = internal.LeaseAcquire(db, name, "first", 100*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, token, lease.Token)
+	//once expired, the lease can be acquired by someone else and writes
+	// guarded by the previous token should be fenced
+	time.Sleep(200 * time.Millisecond)
+	lease, err = internal.LeaseAcquire(db, name, "second", time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, "second", lease.Holder)
+	assert.Equal(t, token+1, lease.Token)
+	err = internal.WithFence(context.TODO(), db, &internal.Fence{Name: name, Token: token}, func(tx internal.Tx) error {
+		return nil
+	})
+	assert.True(t, errors.Is(err, internal.ErrFenced))
+	err = internal.WithFence(context.TODO(), db, &internal.Fence{Name: name, Token: lease.Token}, func(tx internal.Tx) error {
+		return nil
+	})
+	assert.Nil(t, err)
+	//once released, the lease can be acquired immediately
+	err = internal.LeaseRelease(db, name, "second", lease.Token)
+	assert.Nil(t, err)
+	lease, err = internal.LeaseAcquire(db, name, "first", time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, "first", lease.Holder)
+	assert.Equal(t, token+2, lease.Token)
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestLeaderElection(t *testing.T) {
+	elected, demoted := make(chan *internal.Fence, 2), make(chan *internal.Fence, 2)
+
+	db, err := initDatabase()
+	assert.Nil(t, err)
+	name := "test:" + internal.GenerateID()
+	election := func(holder string) *internal.LeaderElection {
+		return &internal.LeaderElection{
+			DB:       db,
+			Name:     name,
+			Holder:   holder,
+			TTL:      time.Second,
+			Interval: 100 * time.Millisecond,
+			OnElected: func(ctx context.Context, fence *internal.Fence) {
+				elected <- fence
+				<-ctx.Done()
+			},
+			OnDemoted: func(fence *internal.Fence) {
+				demoted <- fence
+			},
+		}
+	}
+	ctxFirst, cancelFirst := context.WithCancel(context.TODO())
+	defer cancelFirst()
+	ctxSecond, cancelSecond := context.WithCancel(context.TODO())
+	defer cancelSecond()
+	errs := make(chan error, 2)
+	go func() { errs <- election("first").Run(ctxFirst) }()
+	var fence *internal.Fence
+	select {
+	case fence = <-elected:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "first wasn't elected")
+	}
+	go func() { errs <- election("second").Run(ctxSecond) }()
+	//the second shouldn't be elected until the first is demoted (and has
+	// released the lease)
+	select {
+	case <-elected:
+		assert.Fail(t, "second was elected while first was leader")
+	case <-time.After(500 * time.Millisecond):
+	}
+	cancelFirst()
+	select {
+	case fenceDemoted := <-demoted:
+		assert.Equal(t, fence, fenceDemoted)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "first wasn't demoted")
+	}
+	select {
+	case fenceSecond := <-elected:
+		if fence != nil {
+			assert.Greater(t, fenceSecond.Token, fence.Token)
+		}
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "second wasn't elected")
+	}
+	cancelSecond()
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, context.Canceled, <-errs)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestXA(t *testing.T) {
+	db, err := internal.Initialize(configuration)
+	assert.Nil(t, err)
+	employeesConfig, timersConfig := *configuration, *configuration
+	employeesConfig.Database, timersConfig.Database = "bludgeon_employees", "bludgeon_timers"
+	employees, err := internal.Initialize(&employeesConfig)
+	assert.Nil(t, err)
+	timers, err := internal.Initialize(&timersConfig)
+	assert.Nil(t, err)
+	databases := map[string]*sql.DB{"employees": employees, "timers": timers}
+	newEmployee := func() *internal.Employee {
+		return &internal.Employee{
+			ID:           internal.GenerateID(),
+			FirstName:    "Antonio",
+			LastName:     "Alexander",
+			EmailAddress: internal.GenerateID() + "@mistersoftwaredeveloper.com",
+		}
+	}
+	newTimer := func() *internal.Timer {
+		return &internal.Timer{ID: internal.GenerateID(), Start: time.Now().UnixNano()}
+	}
+	//the employee and timer should both be created
+	coordinator := internal.NewXACoordinator(db)
+	employee, timer := newEmployee(), newTimer()
+	_, err = coordinator.XAEmployeeTimerCreate(context.TODO(), employees, timers, employee, timer, emailOptions)
+	assert.Nil(t, err)
+	_, err = internal.EmployeeRead(employees, employee.ID)
+	assert.Nil(t, err)
+	timerRead, err := internal.NewSplitTimerStore(timers, nil, "").TimerRead(timer.ID)
+	assert.Nil(t, err)
+	if assert.NotNil(t, timerRead) {
+		assert.Equal(t, employee.ID, timerRead.EmployeeID)
+	}
+	//if a branch fails, neither should be created
+	employee = newEmployee()
+	_, err = coordinator.Execute(context.TODO(), &internal.XABranch{
+		Name: "employees",
+		DB:   employees,
+		Fn: func(db internal.Queryer) error {
+			_, err := internal.EmployeeCreate(db, employee, emailOptions)
+			return err
+		},
+	}, &internal.XABranch{
+		Name: "timers",
+		DB:   timers,
+		Fn: func(db internal.Queryer) error {
+			return errors.New("timer not created")
+		},
+	})
+	assert.NotNil(t, err)
+	_, err = internal.EmployeeRead(employees, employee.ID)
+	assert.NotNil(t, err)
+	//if the coordinator crashes after the decision, the transaction should
+	// be in doubt until it's recovered (and committed)
+	coordinator.CrashAfter = internal.XACrashAfterDecision
+	employee, timer = newEmployee(), newTimer()
+	gtrid, err := coordinator.XAEmployeeTimerCreate(context.TODO(), employees, timers, employee, timer, emailOptions)
+	assert.Equal(t, internal.ErrXACrash, err)
+	inDoubt, err := coordinator.Recover(context.TODO(), databases, time.Nanosecond, false)
+	assert.Nil(t, err)
+	var branches int
+	for _, branch := range inDoubt {
+		if branch.ID == gtrid {
+			assert.Equal(t, internal.XACommit, branch.Decision)
+			branches++
+		}
+	}
+	assert.Equal(t, 2, branches)
+	_, err = coordinator.Recover(context.TODO(), databases, time.Nanosecond, true)
+	assert.Nil(t, err)
+	_, err = internal.EmployeeRead(employees, employee.ID)
+	assert.Nil(t, err)
+	_, err = internal.NewSplitTimerStore(timers, nil, "").TimerRead(timer.ID)
+	assert.Nil(t, err)
+	//if the coordinator crashes before the decision, the transaction should
+	// be rolled back when it's recovered
+	coordinator.CrashAfter = internal.XACrashAfterPrepare
+	employee, timer = newEmployee(), newTimer()
+	_, err = coordinator.XAEmployeeTimerCreate(context.TODO(), employees, timers, employee, timer, emailOptions)
+	assert.Equal(t, internal.ErrXACrash, err)
+	_, err = coordinator.Recover(context.TODO(), databases, time.Nanosecond, true)
+	assert.Nil(t, err)
+	_, err = internal.EmployeeRead(employees, employee.ID)
+	assert.NotNil(t, err)
+	for _, db := range []*sql.DB{employees, timers, db} {
+		err = db.Close()
+		assert.Nil(t, err)
+	}
+}
+
+func TestEmployeeReservation(t *testing.T) {
+	db, err := internal.Initialize(configuration)
+	assert.Nil(t, err)
+	employee, err := internal.EmployeeCreate(db, &internal.Employee{
+		ID:           internal.GenerateID(),
+		EmailAddress: internal.GenerateID() + "@mistersoftwaredeveloper.com",
+	}, emailOptions)
+	assert.Nil(t, err)
+	//while reserved, the employee can't be deleted
+	reservationID := internal.GenerateID()
+	reservation, err := internal.EmployeeReserve(db, employee.ID, reservationID, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, internal.ReservationTried, reservation.State)
+	err = internal.EmployeeDelete(db, &internal.Employee{ID: employee.ID}, emailOptions)
+	assert.True(t, errors.Is(err, internal.ErrEmployeeReserved))
+	//nor marked as pending delete, so the employee delete saga fails before
+	// any of its timers are changed
+	err = internal.EmployeePendingDelete(db, employee.ID, true)
+	assert.True(t, errors.Is(err, internal.ErrEmployeeReserved))
+	//trying again with the same id should return the same reservation
+	reservationAgain, err := internal.EmployeeReserve(db, employee.ID, reservationID, time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, reservation, reservationAgain)
+	//once confirmed, it can't be cancelled and the employee can be deleted
+	reservation, err = internal.ReservationConfirm(db, employee.ID, reservationID)
+	assert.Nil(t, err)
+	assert.Equal(t, internal.ReservationConfirmed, reservation.State)
+	_, err = internal.ReservationConfirm(db, employee.ID, reservationID)
+	assert.Nil(t, err)
+	_, err = internal.ReservationCancel(db, employee.ID, reservationID)
+	assert.True(t, errors.Is(err, internal.ErrReservationExpired))
+	//an unconfirmed reservation should expire on its own
+	reservationID = internal.GenerateID()
+	_, err = internal.EmployeeReserve(db, employee.ID, reservationID, 100*time.Millisecond)
+	assert.Nil(t, err)
+	time.Sleep(200 * time.Millisecond)
+	_, err = internal.ReservationConfirm(db, employee.ID, reservationID)
+	assert.True(t, errors.Is(err, internal.ErrReservationExpired))
+	reservation, err = internal.ReservationCancel(db, employee.ID, reservationID)
+	assert.Nil(t, err)
+	assert.Equal(t, internal.ReservationCancelled, reservation.State)
+	err = internal.EmployeeDelete(db, &internal.Employee{ID: employee.ID}, emailOptions)
+	assert.Nil(t, err)
+	//a deleted employee can't be reserved
+	_, err = internal.EmployeeReserve(db, employee.ID, internal.GenerateID(), time.Minute)
+	assert.True(t, internal.IsEmployeeDeleted(err))
+	_, err = internal.ReservationsExpire(db)
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestReservedTimerStore(t *testing.T) {
+	employeesConfig, timersConfig := *configuration, *configuration
+	employeesConfig.Database, timersConfig.Database = "bludgeon_employees", "bludgeon_timers"
+	employees, err := internal.Initialize(&employeesConfig)
+	assert.Nil(t, err)
+	timers, err := internal.Initialize(&timersConfig)
+	assert.Nil(t, err)
+	employeeStore, err := internal.NewEmployeeStore(employees, "", emailOptions)
+	assert.Nil(t, err)
+	server := httptest.NewServer(internal.NewEmployeeService(employeeStore))
+	defer server.Close()
+	client := internal.NewEmployeeClient(server.URL, server.Client())
+	store := internal.NewReservedTimerStore(internal.NewSplitTimerStore(timers, nil, ""), client, time.Minute)
+	employee, err := client.EmployeeCreate(&internal.Employee{
+		ID:           internal.GenerateID(),
+		EmailAddress: internal.GenerateID() + "@mistersoftwaredeveloper.com",
+	})
+	assert.Nil(t, err)
+	//the timer should be created and the reservation confirmed, so the
+	// employee can still be deleted
+	timer, err := store.TimerCreate(&internal.Timer{
+		ID:         internal.GenerateID(),
+		Start:      time.Now().UnixNano(),
+		EmployeeID: employee.ID,
+	})
+	assert.Nil(t, err)
+	if assert.NotNil(t, timer) {
+		assert.Equal(t, employee.ID, timer.EmployeeID)
+	}
+	//while reserved (e.g., by another timer being started), the employee
+	// can't be deleted through the service
+	reservation, err := client.EmployeeReserve(employee.ID, internal.GenerateID(), time.Minute)
+	assert.Nil(t, err)
+	err = client.EmployeeDelete(&internal.Employee{ID: employee.ID})
+	assert.NotNil(t, err)
+	_, err = client.ReservationCancel(employee.ID, reservation.ID)
+	assert.Nil(t, err)
+	err = client.EmployeeDelete(&internal.Employee{ID: employee.ID})
+	assert.Nil(t, err)
+	//a timer can't be created for an employee that can't be reserved
+	_, err = store.TimerCreate(&internal.Timer{
+		ID:         internal.GenerateID(),
+		Start:      time.Now().UnixNano(),
+		EmployeeID: employee.ID,
+	})
+	assert.NotNil(t, err)
+	for _, db := range []*sql.DB{employees, timers} {
+		err = db.Close()
+		assert.Nil(t, err)
+	}
+}
+
+func TestSplitEmployeeDeleteSaga(t *testing.T) {
+	employeesConfig, timersConfig := *configuration, *configuration
+	employeesConfig.Database, timersConfig.Database = "bludgeon_employees", "bludgeon_timers"
+	employees, err := internal.Initialize(&employeesConfig)
+	assert.Nil(t, err)
+	timers, err := internal.Initialize(&timersConfig)
+	assert.Nil(t, err)
+	employeeStore, err := internal.NewEmployeeStore(employees, "", emailOptions)
+	assert.Nil(t, err)
+	employeeServer := httptest.NewServer(internal.NewEmployeeService(employeeStore))
+	defer employeeServer.Close()
+	employeeClient := internal.NewEmployeeClient(employeeServer.URL, employeeServer.Client())
+	timerServer := httptest.NewServer(internal.NewTimerService(internal.NewSplitTimerStore(timers,
+		internal.NewHTTPEmployeeLookup(employeeClient), "")))
+	defer timerServer.Close()
+	timerClient := internal.NewTimerClient(timerServer.URL, timerServer.Client())
+	//the saga is journaled with the employees, but only uses the services
+	orchestrator := internal.NewSagaOrchestrator(employees, internal.Sagas(employeeClient, timerClient)...)
+	employeeCreate := func() (*internal.Employee, []*internal.Timer) {
+		var timersCreated []*internal.Timer
+
+		employee, err := employeeClient.EmployeeCreate(&internal.Employee{
+			ID:           internal.GenerateID(),
+			EmailAddress: internal.GenerateID() + "@mistersoftwaredeveloper.com",
+		})
+		assert.Nil(t, err)
+		for i := 0; i < 2; i++ {
+			timer, err := timerClient.TimerCreate(&internal.Timer{
+				ID:         internal.GenerateID(),
+				Start:      time.Now().UnixNano(),
+				EmployeeID: employee.ID,
+			})
+			assert.Nil(t, err)
+			timersCreated = append(timersCreated, timer)
+		}
+		return employee, timersCreated
+	}
+	//orphaning the timers across the services should stop them and leave
+	// them for an employee that's been deleted
+	employee, timersOrphaned := employeeCreate()
+	saga, err := orchestrator.Execute(context.TODO(), internal.SagaEmployeeDelete, &internal.EmployeeDeleteSagaData{
+		EmployeeID:  employee.ID,
+		TimerPolicy: internal.SagaTimersOrphan,
+	})
+	assert.Nil(t, err)
+	if assert.NotNil(t, saga) {
+		assert.Equal(t, internal.SagaCompleted, saga.State)
+	}
+	_, err = employeeClient.EmployeeRead(employee.ID)
+	assert.True(t, internal.IsEmployeeDeleted(err))
+	for _, timer := range timersOrphaned {
+		timerRead, err := timerClient.TimerRead(timer.ID)
+		assert.Nil(t, err)
+		if assert.NotNil(t, timerRead) {
+			assert.Equal(t, employee.ID, timerRead.EmployeeID)
+			assert.True(t, timerRead.Completed)
+		}
+	}
+	//a timer can't be created for the deleted employee, the tombstone is
+	// returned across both services
+	_, err = timerClient.TimerCreate(&internal.Timer{
+		ID:         internal.GenerateID(),
+		Start:      time.Now().UnixNano(),
+		EmployeeID: employee.ID,
+	})
+	assert.True(t, internal.IsEmployeeDeleted(err))
+	//cascading should delete the timers along with the employee
+	employee, _ = employeeCreate()
+	saga, err = orchestrator.Execute(context.TODO(), internal.SagaEmployeeDelete, &internal.EmployeeDeleteSagaData{
+		EmployeeID:  employee.ID,
+		TimerPolicy: internal.SagaTimersCascade,
+	})
+	assert.Nil(t, err)
+	if assert.NotNil(t, saga) {
+		assert.Equal(t, internal.SagaCompleted, saga.State)
+	}
+	timersRead, err := timerClient.TimersRead(employee.ID)
+	assert.Nil(t, err)
+	assert.Len(t, timersRead, 0)
+	//clean-up
+	for _, timer := range timersOrphaned {
+		err = timerClient.TimerDelete(timer.ID)
+		assert.Nil(t, err)
+	}
+	for _, db := range []*sql.DB{employees, timers} {
+		err = db.Close()
+		assert.Nil(t, err)
+	}
+}
+
+func TestSagaRecover(t *testing.T) {
+	var attempts int
+	var compensated []string
+
+	db, err := internal.Initialize(configuration)
+	assert.Nil(t, err)
+	employeeCreate := func() *internal.Employee {
+		employee, err := internal.EmployeeCreate(db, &internal.Employee{
+			ID:           internal.GenerateID(),
+			FirstName:    "Saga",
+			EmailAddress: internal.GenerateID() + "@mistersoftwaredeveloper.com",
+		}, emailOptions)
+		assert.Nil(t, err)
+		return employee
+	}
+	survivor, duplicate, other := employeeCreate(), employeeCreate(), employeeCreate()
+	var timerIDs []string
+	for i := 0; i < 2; i++ {
+		timer, err := internal.TimerCreate(db, &internal.Timer{
+			ID:         internal.GenerateID(),
+			Start:      time.Now().UnixNano(),
+			EmployeeID: duplicate.ID,
+		})
+		assert.Nil(t, err)
+		timerIDs = append(timerIDs, timer.ID)
+	}
+	//KIM: the second step "crashes" (the goroutine exits without the outcome
+	// being journaled) the first time it's executed
+	step := func(name string) *internal.SagaStep {
+		return &internal.SagaStep{
+			Name: name,
+			Action: func(ctx context.Context, saga *internal.Saga) error {
+				return saga.DataWrite(name)
+			},
+			Compensate: func(ctx context.Context, saga *internal.Saga) error {
+				compensated = append(compensated, name)
+				return nil
+			},
+		}
+	}
+	crash := &internal.SagaStep{
+		Name: "crash",
+		Action: func(ctx context.Context, saga *internal.Saga) error {
+			if attempts++; attempts == 1 {
+				runtime.Goexit()
+			}
+			return nil
+		},
+	}
+	fail := &internal.SagaStep{
+		Name: "fail",
+		Action: func(ctx context.Context, saga *internal.Saga) error {
+			return errors.New("failed")
+		},
+	}
+	employees, timers, err := initSagaStores(db)
+	assert.Nil(t, err)
+	definitions := append(internal.Sagas(employees, timers),
+		&internal.SagaDefinition{Name: "test-fail", Steps: []*internal.SagaStep{step("first"), fail}},
+		&internal.SagaDefinition{Name: "test-roll-forward", Steps: []*internal.SagaStep{step("first"), crash},
+			Recovery: internal.SagaRecoverRollForward},
+		&internal.SagaDefinition{Name: "test-compensate", Steps: []*internal.SagaStep{step("first"), crash},
+			Recovery: internal.SagaRecoverCompensate},
+	)
+	orchestrator := internal.NewSagaOrchestrator(db, definitions...)
+	//merge the duplicate into the survivor, its timers should be moved
+	saga, err := orchestrator.Execute(context.TODO(), internal.SagaEmployeeMerge, &internal.EmployeeMergeSagaData{
+		SurvivorID:  survivor.ID,
+		DuplicateID: duplicate.ID,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, internal.SagaCompleted, saga.State)
+	for _, timerID := range timerIDs {
+		timer, err := internal.TimerRead(db, timerID)
+		assert.Nil(t, err)
+		assert.Equal(t, survivor.ID, timer.EmployeeID)
+	}
+	employee, err := internal.EmployeeRead(db, duplicate.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, survivor.ID, employee.ID)
+	//every step should be journaled before and after it's executed
+	entries, err := internal.SagaJournalRead(db, saga.ID)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 6)
+	//reassign a single timer in bulk
+	_, err = orchestrator.Execute(context.TODO(), internal.SagaTimersReassign, &internal.TimersReassignSagaData{
+		FromEmployeeID: survivor.ID,
+		ToEmployeeID:   other.ID,
+		TimerIDs:       timerIDs[:1],
+	})
+	assert.Nil(t, err)
+	timer, err := internal.TimerRead(db, timerIDs[0])
+	assert.Nil(t, err)
+	assert.Equal(t, other.ID, timer.EmployeeID)
+	timer, err = internal.TimerRead(db, timerIDs[1])
+	assert.Nil(t, err)
+	assert.Equal(t, survivor.ID, timer.EmployeeID)
+	//delete the survivor along with its timers
+	_, err = orchestrator.Execute(context.TODO(), internal.SagaEmployeeDelete, &internal.EmployeeDeleteSagaData{
+		EmployeeID:  survivor.ID,
+		TimerPolicy: internal.SagaTimersCascade,
+	})
+	assert.Nil(t, err)
+	_, err = internal.TimerRead(db, timerIDs[1])
+	assert.NotNil(t, err)
+	_, err = internal.EmployeeRead(db, survivor.ID)
+	assert.NotNil(t, err)
+	//if a step fails, the steps that were started should be compensated
+	saga, err = orchestrator.Execute(context.TODO(), "test-fail", nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, internal.SagaCompensated, saga.State)
+	assert.Equal(t, []string{"first"}, compensated)
+	//if the process crashes while running, resuming should roll the saga
+	// forward or compensate it according to its definition
+	for _, name := range []string{"test-roll-forward", "test-compensate"} {
+		attempts, compensated = 0, nil
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			orchestrator.Execute(context.TODO(), name, nil)
+		}()
+		<-done
+		//KIM: resuming returns an error for the saga that's compensated
+		sagas, _ := orchestrator.Resume(context.TODO())
+		var recovered *internal.Saga
+		for _, saga := range sagas {
+			if saga.Name == name {
+				recovered = saga
+			}
+		}
+		if !assert.NotNil(t, recovered) {
+			continue
+		}
+		switch name {
+		case "test-roll-forward":
+			assert.Equal(t, internal.SagaCompleted, recovered.State)
+			assert.Equal(t, 2, attempts)
+			assert.Empty(t, compensated)
+		case "test-compensate":
+			assert.Equal(t, internal.SagaCompensated, recovered.State)
+			assert.Equal(t, 1, attempts)
+			assert.Equal(t, []string{"first"}, compensated)
+		}
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+}
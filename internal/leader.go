@@ -0,0 +1,241 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//these are the names of the leases used by the background workers
+const (
+	LeaseBackground string = "background"
+)
+
+//these are the defaults for leader election if not provided
+const (
+	defaultLeaseTTL time.Duration = 15 * time.Second
+)
+
+//ErrFenced is returned by a guarded write when its fencing token isn't
+// the current token of the lease (i.e., leadership has moved on)
+var ErrFenced = errors.New("fencing token is stale")
+
+//Lease describes who holds a lease and until when, the token is incremented
+// every time the lease changes hands (but not when it's renewed) such that
+// it can be used to fence writes made by a holder that's lost its lease
+type Lease struct {
+	Name      string `json:"name"`
+	Holder    string `json:"holder"`
+	Token     int64  `json:"token"`
+	ExpiresAt int64  `json:"expires_at"`
+	Version   int    `json:"version"`
+}
+
+//leaseRead will read the lease (creating it if it doesn't exist), it also
+// returns whether or not the lease has expired according to the clock of
+// the database so that clock skew between holders doesn't matter
+func leaseRead(db Queryer, name string) (*Lease, bool, error) {
+	var expired bool
+
+	query := fmt.Sprintf("INSERT IGNORE INTO %s (name) VALUES (?)", tableLease)
+	if _, err := db.Exec(query, name); err != nil {
+		return nil, false, err
+	}
+	query = fmt.Sprintf(`SELECT name, holder, token, FLOOR(UNIX_TIMESTAMP(expires_at)), version,
+		expires_at <= NOW(6) FROM %s WHERE name=?`, tableLease)
+	lease := &Lease{}
+	if err := db.QueryRow(query, name).Scan(&lease.Name, &lease.Holder, &lease.Token,
+		&lease.ExpiresAt, &lease.Version, &expired); err != nil {
+		return nil, false, err
+	}
+	return lease, expired, nil
+}
+
+//LeaseRead can be used to read the current state of a lease
+func LeaseRead(db Queryer, name string) (*Lease, error) {
+	lease, _, err := leaseRead(db, name)
+	return lease, err
+}
+
+//LeaseAcquire will attempt to acquire (or renew) the lease for holder, it
+// returns the lease (which may be held by someone else); like the other
+// mutations, it's a version check, if two holders attempt to acquire an
+// expired lease at the same time, only one of them will succeed
+func LeaseAcquire(db Queryer, name, holder string, ttl time.Duration) (*Lease, error) {
+	if holder == "" {
+		return nil, errors.New("holder is empty")
+	}
+	if ttl <= 0 {
+		ttl = defaultLeaseTTL
+	}
+	lease, expired, err := leaseRead(db, name)
+	if err != nil {
+		return nil, err
+	}
+	token := lease.Token
+	switch {
+	default:
+		return lease, nil
+	case lease.Holder == holder && !expired:
+	case lease.Holder == "" || expired:
+		token++
+	}
+	query := fmt.Sprintf(`UPDATE %s SET holder=?, token=?, expires_at=NOW(6) + INTERVAL ? MICROSECOND, version=version+1
+		WHERE name=? AND version=?`, tableLease)
+	if _, err := db.Exec(query, holder, token, int64(ttl/time.Microsecond), name, lease.Version); err != nil {
+		return nil, err
+	}
+	//KIM: if no rows were affected, someone else acquired (or renewed) the
+	// lease in the meantime, either way the lease is read again to find out
+	// who holds it
+	return LeaseRead(db, name)
+}
+
+//LeaseRelease can be used to give up a lease before it expires, it's only
+// released if it's still held by holder with the given token
+func LeaseRelease(db Queryer, name, holder string, token int64) error {
+	query := fmt.Sprintf(`UPDATE %s SET holder='', expires_at=NOW(6), version=version+1
+		WHERE name=? AND holder=? AND token=?`, tableLease)
+	_, err := db.Exec(query, name, holder, token)
+	return err
+}
+
+//Fence describes the lease (and token) that a guarded write was made under
+type Fence struct {
+	Name  string
+	Token int64
+}
+
+//Check will verify that the token is still the current token of the lease,
+// it must be called within the same transaction as the guarded write; the
+// lease is read with a shared lock so it can't change hands until the
+// transaction commits; if the token is stale, ErrFenced is returned
+func (f *Fence) Check(db Queryer) error {
+	var token int64
+
+	query := fmt.Sprintf("SELECT token FROM %s WHERE name=? LOCK IN SHARE MODE", tableLease)
+	if err := db.QueryRow(query, f.Name).Scan(&token); err != nil {
+		if err == sql.ErrNoRows {
+			return errors.Errorf("lease with name, \"%s\", not found locally", f.Name)
+		}
+		return err
+	}
+	if token != f.Token {
+		return errors.Wrapf(ErrFenced, "lease \"%s\" is at token %d not %d", f.Name, token, f.Token)
+	}
+	return nil
+}
+
+//WithFence can be used to execute fn within a unit of work that's guarded by
+// the fence, the fence is checked before fn is executed
+func WithFence(ctx context.Context, db *sql.DB, fence *Fence, fn func(tx Tx) error) error {
+	return WithTx(ctx, db, func(tx Tx) error {
+		if err := fence.Check(tx); err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+}
+
+//LeaderElection can be used to ensure that only one instance runs a given
+// job (e.g., the outbox relay) at a time; the holder that acquires the lease
+// is elected and renews the lease until it's demoted (or the context is done)
+type LeaderElection struct {
+	DB        *sql.DB                                 //database containing the leases
+	Name      string                                  //name of the lease
+	Holder    string                                  //unique id of this instance
+	TTL       time.Duration                           //how long the lease is valid for without being renewed
+	Interval  time.Duration                           //interval to renew (or attempt to acquire) the lease, defaults to a third of the ttl
+	OnElected func(ctx context.Context, fence *Fence) //executed in its own goroutine when elected, ctx is cancelled when demoted
+	OnDemoted func(fence *Fence)                      //executed once OnElected has returned after being demoted
+}
+
+//leadership describes the term of an elected holder
+type leadership struct {
+	fence   *Fence
+	cancel  context.CancelFunc
+	done    chan struct{}
+	renewed time.Time
+}
+
+//elect will execute OnElected in its own goroutine with a context that's
+// cancelled when demoted
+func (l *LeaderElection) elect(ctx context.Context, token int64, renewed time.Time) *leadership {
+	elected, cancel := context.WithCancel(ctx)
+	term := &leadership{
+		fence:   &Fence{Name: l.Name, Token: token},
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		renewed: renewed,
+	}
+	go func() {
+		defer close(term.done)
+		if l.OnElected != nil {
+			l.OnElected(elected, term.fence)
+		}
+	}()
+	return term
+}
+
+//demote will cancel the context given to OnElected and wait for it to
+// return before executing OnDemoted
+func (l *LeaderElection) demote(term *leadership) {
+	term.cancel()
+	<-term.done
+	if l.OnDemoted != nil {
+		l.OnDemoted(term.fence)
+	}
+}
+
+//Run will participate in the election until the context is done, if it's
+// elected when the context is done, the lease is released; if the lease
+// can't be renewed before it would've expired, it's demoted rather than
+// risk two leaders
+func (l *LeaderElection) Run(ctx context.Context) error {
+	var term *leadership
+
+	ttl, interval := l.TTL, l.Interval
+	if ttl <= 0 {
+		ttl = defaultLeaseTTL
+	}
+	if interval <= 0 {
+		interval = ttl / 3
+	}
+	for {
+		//KIM: the time is recorded before attempting to renew, the lease
+		// expires ttl after the database received the request, which is
+		// at least ttl after this time
+		attempted := time.Now()
+		lease, err := LeaseAcquire(l.DB, l.Name, l.Holder, ttl)
+		switch {
+		case err != nil:
+			if term != nil && time.Since(term.renewed) >= ttl {
+				l.demote(term)
+				term = nil
+			}
+		case lease.Holder != l.Holder || (term != nil && lease.Token != term.fence.Token):
+			if term != nil {
+				l.demote(term)
+				term = nil
+			}
+		case term == nil:
+			term = l.elect(ctx, lease.Token, attempted)
+		default:
+			term.renewed = attempted
+		}
+		select {
+		case <-ctx.Done():
+			if term != nil {
+				l.demote(term)
+				if err := LeaseRelease(l.DB, l.Name, l.Holder, term.fence.Token); err != nil {
+					return err
+				}
+			}
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
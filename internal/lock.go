@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//these are the names of the locks used for named critical sections
+const (
+	LockImport string = "import"
+)
+
+//lockNameMax is the maximum length of a lock name, mysql doesn't allow
+// names longer than 64 characters (mariadb does, but they shouldn't be)
+const lockNameMax int = 64
+
+//ErrLockNotAcquired is returned when a lock can't be acquired within
+// the timeout (i.e., it's held by someone else)
+var ErrLockNotAcquired = errors.New("lock not acquired")
+
+//LockEmployee returns the name of the lock for a given employee, it can be
+// used for critical sections that span more than one transaction (e.g.,
+// only one saga running for a given employee)
+func LockEmployee(employeeID string) string {
+	return "employee:" + employeeID
+}
+
+//LockSaga returns the name of the lock for a given saga, it's held while
+// the saga is run so it isn't resumed at the same time
+func LockSaga(sagaID string) string {
+	return "saga:" + sagaID
+}
+
+//Locker can be used to acquire named (advisory) locks using GET_LOCK, unlike
+// row locks, they aren't associated with a transaction, they're held by the
+// connection until they're released or the connection is closed; they're
+// only advisory, so they only protect code that also acquires the lock
+type Locker struct {
+	db *sql.DB
+}
+
+//NewLocker can be used to create a locker for the given database, each lock
+// that's held uses a connection from the pool
+func NewLocker(db *sql.DB) *Locker {
+	return &Locker{db: db}
+}
+
+//Lock can be used to acquire the named lock, waiting up to timeout (zero
+// doesn't wait) or until the context is done; if the lock isn't acquired
+// within the timeout, ErrLockNotAcquired is returned
+func (l *Locker) Lock(ctx context.Context, name string, timeout time.Duration) (*Lock, error) {
+	var acquired sql.NullInt64
+
+	if name == "" || len(name) > lockNameMax {
+		return nil, errors.Errorf("invalid lock name: \"%s\"", name)
+	}
+	if timeout < 0 {
+		timeout = 0
+	}
+	//KIM: the lock is held by the connection rather than a transaction, so a
+	// dedicated connection is taken from the pool for the lifetime of the lock
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	//KIM: if the context is cancelled while waiting, the driver closes the
+	// connection, which releases the lock if it was acquired in the meantime
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", name,
+		timeout.Seconds()).Scan(&acquired); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !acquired.Valid || acquired.Int64 != 1 {
+		conn.Close()
+		return nil, errors.Wrapf(ErrLockNotAcquired, "lock \"%s\"", name)
+	}
+	return &Lock{
+		name: name,
+		conn: conn,
+	}, nil
+}
+
+//Holder returns the connection id of the connection that holds the named
+// lock, if the lock isn't held, zero is returned
+func (l *Locker) Holder(ctx context.Context, name string) (int64, error) {
+	var holder sql.NullInt64
+
+	if err := l.db.QueryRowContext(ctx, "SELECT IS_USED_LOCK(?)", name).Scan(&holder); err != nil {
+		return 0, err
+	}
+	return holder.Int64, nil
+}
+
+//WithLock can be used to execute fn while holding the named lock, the lock
+// is released once fn returns
+func (l *Locker) WithLock(ctx context.Context, name string, timeout time.Duration, fn func(ctx context.Context) error) error {
+	lock, err := l.Lock(ctx, name, timeout)
+	if err != nil {
+		return err
+	}
+	errFn := fn(ctx)
+	//KIM: the lock is released with a new context, if ctx is done, the
+	// lock still has to be released
+	if err := lock.Release(context.Background()); err != nil && errFn == nil {
+		return err
+	}
+	return errFn
+}
+
+//Lock describes a named lock that's held, it must be released
+type Lock struct {
+	mutex sync.Mutex
+	name  string
+	conn  *sql.Conn
+}
+
+//Name returns the name of the lock
+func (l *Lock) Name() string {
+	return l.name
+}
+
+//Held returns true if the lock is still held, the lock is lost if its
+// connection is lost (e.g., the database restarts) so a long running
+// critical section should check that it still holds the lock
+func (l *Lock) Held(ctx context.Context) (bool, error) {
+	var held sql.NullBool
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.conn == nil {
+		return false, nil
+	}
+	if err := l.conn.QueryRowContext(ctx, "SELECT IS_USED_LOCK(?) = CONNECTION_ID()",
+		l.name).Scan(&held); err != nil {
+		return false, err
+	}
+	return held.Valid && held.Bool, nil
+}
+
+//Release will release the lock and return its connection to the pool,
+// releasing a lock more than once has no effect; if the lock was lost
+// before it was released, an error is returned
+func (l *Lock) Release(ctx context.Context) error {
+	var released sql.NullInt64
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.conn == nil {
+		return nil
+	}
+	conn := l.conn
+	l.conn = nil
+	if err := conn.QueryRowContext(ctx, "SELECT RELEASE_LOCK(?)", l.name).Scan(&released); err != nil {
+		//KIM: if the lock can't be released, the connection is discarded rather
+		// than returned to the pool, closing it releases the lock
+		connDiscard(conn)
+		return err
+	}
+	conn.Close()
+	if !released.Valid || released.Int64 != 1 {
+		return errors.Errorf("lock \"%s\" was no longer held", l.name)
+	}
+	return nil
+}
+
+//connDiscard will close the connection without returning it to the pool,
+// anything held by the connection (e.g., locks or transactions) is lost
+func connDiscard(conn *sql.Conn) {
+	conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+	conn.Close()
+}
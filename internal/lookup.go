@@ -0,0 +1,293 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//these are the policies for when the employee of a timer can't be
+// verified (e.g., the employee service is unreachable)
+const (
+	EmployeeLookupReject        string = "reject"
+	EmployeeLookupAcceptAndFlag string = "accept-and-flag"
+	EmployeeLookupQueue         string = "queue"
+)
+
+//defaultEmployeeLookupTTL is how long a cached lookup is valid for
+// if a ttl isn't provided
+const defaultEmployeeLookupTTL time.Duration = time.Minute
+
+//EmployeeLookup provides an interface to verify that an employee exists when
+// the employee can't be referenced with a foreign key (e.g., in split mode);
+// if the employee doesn't exist, it returns false without an error, unless it's
+// known to have been deleted (an EmployeeDeletedError); any other error means
+// that it's unknown whether or not the employee exists (e.g., the employee
+// service is unreachable)
+type EmployeeLookup interface {
+	EmployeeExists(employeeID string) (bool, error)
+}
+
+//LocalEmployeeLookup looks up employees in a database containing the
+// employee table (e.g., when employees and timers share a database)
+type LocalEmployeeLookup struct {
+	db Queryer
+}
+
+//NewLocalEmployeeLookup can be used to create a lookup for the employee
+// table in the given database
+func NewLocalEmployeeLookup(db Queryer) *LocalEmployeeLookup {
+	return &LocalEmployeeLookup{db: db}
+}
+
+//EmployeeExists returns true if the employee exists, employees pending
+// delete are treated as if they don't exist; if the employee has a tombstone,
+// an EmployeeDeletedError is returned
+func (l *LocalEmployeeLookup) EmployeeExists(employeeID string) (bool, error) {
+	var n int
+
+	query := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE uuid=? AND pending_delete=FALSE", tableEmployee)
+	if err := l.db.QueryRow(query, idArg(employeeID)).Scan(&n); err != nil {
+		return false, err
+	}
+	if n > 0 {
+		return true, nil
+	}
+	switch tombstone, err := EmployeeTombstoneRead(l.db, employeeID); {
+	case err == nil:
+		return false, &EmployeeDeletedError{*tombstone}
+	case err != sql.ErrNoRows:
+		return false, err
+	}
+	return false, nil
+}
+
+//HTTPEmployeeLookup looks up employees using the employee service
+type HTTPEmployeeLookup struct {
+	client *EmployeeClient
+}
+
+//NewHTTPEmployeeLookup can be used to create a lookup for the employee
+// service using the given client
+func NewHTTPEmployeeLookup(client *EmployeeClient) *HTTPEmployeeLookup {
+	return &HTTPEmployeeLookup{client: client}
+}
+
+//EmployeeExists returns true if the employee service can read the employee,
+// false if it responds with not found, if the employee has been deleted (gone),
+// an EmployeeDeletedError is returned and an error otherwise
+func (h *HTTPEmployeeLookup) EmployeeExists(employeeID string) (bool, error) {
+	var errStatus *httpStatusError
+
+	_, err := h.client.EmployeeRead(employeeID)
+	switch {
+	case err == nil:
+		return true, nil
+	case IsEmployeeDeleted(err):
+		return false, err
+	case errors.As(err, &errStatus) && errStatus.status == http.StatusNotFound:
+		return false, nil
+	}
+	return false, errors.Wrap(err, "unable to lookup employee")
+}
+
+//CachedEmployeeLookup caches the employees that exist for a ttl, employees
+// that don't exist aren't cached since they may be created at any moment;
+// the cache means that a deleted employee may be seen as existing for up
+// to the ttl, which is the same window the outbox relay would have
+type CachedEmployeeLookup struct {
+	lookup EmployeeLookup
+	cache  Cache
+	ttl    time.Duration
+}
+
+//NewCachedEmployeeLookup can be used to cache the given lookup, if cache is
+// nil, an LRU with a capacity of 1024 is used, if ttl is less than or equal
+// to zero, a ttl of one minute is used
+func NewCachedEmployeeLookup(lookup EmployeeLookup, cache Cache, ttl time.Duration) *CachedEmployeeLookup {
+	if cache == nil {
+		cache = NewLRU(1024)
+	}
+	if ttl <= 0 {
+		ttl = defaultEmployeeLookupTTL
+	}
+	return &CachedEmployeeLookup{
+		lookup: lookup,
+		cache:  cache,
+		ttl:    ttl,
+	}
+}
+
+//EmployeeExists returns true if the employee was found within the ttl,
+// otherwise the lookup is used
+func (c *CachedEmployeeLookup) EmployeeExists(employeeID string) (bool, error) {
+	var expires int64
+
+	key := fmt.Sprintf("%s:exists:%s", tableEmployee, employeeID)
+	if bytes, ok := c.cache.Read(key); ok {
+		if err := json.Unmarshal(bytes, &expires); err == nil && time.Now().UnixNano() < expires {
+			return true, nil
+		}
+		c.cache.Delete(key)
+	}
+	exists, err := c.lookup.EmployeeExists(employeeID)
+	if err != nil || !exists {
+		return exists, err
+	}
+	if bytes, err := json.Marshal(time.Now().Add(c.ttl).UnixNano()); err == nil {
+		c.cache.Write(key, bytes)
+	}
+	return true, nil
+}
+
+//NewEmployeeLookupPolicy will validate the policy, if empty, the
+// policy is reject
+func NewEmployeeLookupPolicy(policy string) (string, error) {
+	switch policy = strings.ToLower(policy); policy {
+	default:
+		return "", errors.Errorf("unsupported employee lookup policy: \"%s\"", policy)
+	case "":
+		return EmployeeLookupReject, nil
+	case EmployeeLookupReject, EmployeeLookupAcceptAndFlag, EmployeeLookupQueue:
+		return policy, nil
+	}
+}
+
+//employeeVerify will verify that the employee exists, it returns whether or
+// not the employee was verified; if the employee can't be verified and the
+// policy isn't reject, the timer is accepted (but not verified)
+func (s *SplitTimerStore) employeeVerify(employeeID string) (bool, error) {
+	if s.lookup == nil {
+		return true, nil
+	}
+	exists, err := s.lookup.EmployeeExists(employeeID)
+	switch {
+	case err == nil && exists:
+		return true, nil
+	case err == nil:
+		return false, errors.Errorf("employee with id, \"%s\", not found", employeeID)
+	case IsEmployeeDeleted(err):
+		//KIM: the employee service answered, so a deleted employee is
+		// rejected regardless of the policy
+		return false, err
+	case s.policy == EmployeeLookupAcceptAndFlag, s.policy == EmployeeLookupQueue:
+		return false, nil
+	}
+	return false, err
+}
+
+//employeeVerified will record whether or not the employee of the timer has
+// been verified, if it hasn't and the policy is queue, the timer is queued
+func (s *SplitTimerStore) employeeVerified(db Queryer, timerID int64, employeeID string, verified bool) error {
+	query := fmt.Sprintf("UPDATE %s SET employee_verified=? WHERE id=?", tableTimer)
+	if _, err := db.Exec(query, verified, timerID); err != nil {
+		return err
+	}
+	query = fmt.Sprintf("DELETE FROM %s WHERE timer_id=?", tableEmployeeVerification)
+	if _, err := db.Exec(query, timerID); err != nil {
+		return err
+	}
+	if verified || s.policy != EmployeeLookupQueue {
+		return nil
+	}
+	query = fmt.Sprintf("INSERT INTO %s (timer_id, employee_uuid) VALUES (?, ?)", tableEmployeeVerification)
+	_, err := db.Exec(query, timerID, idArg(employeeID))
+	return err
+}
+
+//TimersUnverified can be used to read the timers whose employee hasn't been
+// verified (i.e., accepted while the employee service was unreachable or
+// queued and found not to exist)
+func (s *SplitTimerStore) TimersUnverified() ([]*Timer, error) {
+	rows, err := s.db.Query(splitTimerSelect("employee_verified=FALSE ORDER BY id"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var timers []*Timer
+	for rows.Next() {
+		timer, err := timerScan(rows)
+		if err != nil {
+			return nil, err
+		}
+		timers = append(timers, timer)
+	}
+	return timers, rows.Err()
+}
+
+//EmployeeVerification describes the outcome of verifying the queued timers
+type EmployeeVerification struct {
+	Verified    int      `json:"verified"`
+	NotFound    []string `json:"not_found,omitempty"`
+	Unreachable int      `json:"unreachable"`
+}
+
+//EmployeesVerify will verify the employees of the queued timers; timers whose
+// employee exists are verified and timers whose employee doesn't exist are
+// removed from the queue (but remain flagged, they're returned so that a human
+// or a saga can decide what to do with them); if the lookup fails, the timer
+// stays queued
+func (s *SplitTimerStore) EmployeesVerify(ctx context.Context) (*EmployeeVerification, error) {
+	type queued struct {
+		timerID    int64
+		timerUUID  string
+		employeeID string
+	}
+	var timers []queued
+
+	if s.lookup == nil {
+		return nil, errors.New("employee lookup not configured")
+	}
+	query := fmt.Sprintf(`SELECT q.timer_id, t.uuid, q.employee_uuid FROM %s q JOIN %s t ON q.timer_id=t.id
+		ORDER BY q.id`, tableEmployeeVerification, tableTimer)
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var timer queued
+
+		if err := rows.Scan(&timer.timerID, idScan(&timer.timerUUID), idScan(&timer.employeeID)); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		timers = append(timers, timer)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	verification := &EmployeeVerification{}
+	for _, timer := range timers {
+		if err := ctx.Err(); err != nil {
+			return verification, err
+		}
+		exists, err := s.lookup.EmployeeExists(timer.employeeID)
+		if err != nil {
+			verification.Unreachable++
+			continue
+		}
+		//KIM: the employee is only updated if the timer is still assigned to
+		// the same employee, otherwise it was re-queued by the reassign
+		query := fmt.Sprintf(`DELETE FROM %s WHERE timer_id=? AND employee_uuid=?`, tableEmployeeVerification)
+		if _, err := s.db.Exec(query, timer.timerID, idArg(timer.employeeID)); err != nil {
+			return verification, err
+		}
+		if !exists {
+			verification.NotFound = append(verification.NotFound, timer.timerUUID)
+			continue
+		}
+		query = fmt.Sprintf("UPDATE %s SET employee_verified=TRUE WHERE id=? AND employee_uuid=?", tableTimer)
+		if _, err := s.db.Exec(query, timer.timerID, idArg(timer.employeeID)); err != nil {
+			return verification, err
+		}
+		verification.Verified++
+	}
+	return verification, nil
+}
@@ -9,11 +9,11 @@ import (
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
 )
 
-func initialize(envs map[string]string) (*sql.DB, error) {
+func initialize(config *Configuration) (*sql.DB, error) {
 	fmt.Println("Attempting to initialize and ping the database")
-	config := ConfigFromEnv(envs)
 	db, err := Initialize(config)
 	if err != nil {
 		return nil, err
@@ -26,7 +26,7 @@ func initialize(envs map[string]string) (*sql.DB, error) {
 	return db, nil
 }
 
-func employeeConcurrentCreate(db *sql.DB) error {
+func employeeConcurrentCreate(db *sql.DB, options EmailOptions) error {
 	const (
 		firstName    string = "Antonio"
 		lastName     string = "Alexander"
@@ -49,10 +49,10 @@ func employeeConcurrentCreate(db *sql.DB) error {
 	if err := TimerDelete(db, ""); err != nil {
 		return err
 	}
-	if err := EmployeeDelete(db, nil); err != nil {
+	if err := EmployeeDelete(db, nil, options); err != nil {
 		return err
 	}
-	employee, err := EmployeeCreate(db, employee)
+	employee, err := EmployeeCreate(db, employee, options)
 	if err != nil {
 		return err
 	}
@@ -68,7 +68,7 @@ func employeeConcurrentCreate(db *sql.DB) error {
 	}
 	bytes, _ = json.MarshalIndent(employee, "  ", " ")
 	fmt.Printf("  Attempting to create the same employee, but with a different ID: \n\n  %s\n\n", string(bytes))
-	employee, err = EmployeeCreate(db, employee)
+	employee, err = EmployeeCreate(db, employee, options)
 	if err != nil {
 		return err
 	}
@@ -77,7 +77,7 @@ func employeeConcurrentCreate(db *sql.DB) error {
 	return nil
 }
 
-func employeeConcurrentWrite(db *sql.DB) error {
+func employeeConcurrentWrite(db *sql.DB, options EmailOptions) error {
 	const (
 		firstName    string = "Teddy"
 		lastName     string = "Perkins"
@@ -96,20 +96,21 @@ func employeeConcurrentWrite(db *sql.DB) error {
 		//KIM: version is effectively ignored/read-only
 		// Version:      0,
 	}
-	if err := EmployeeDelete(db, nil); err != nil {
+	if err := EmployeeDelete(db, nil, options); err != nil {
 		return err
 	}
-	employee, err := EmployeeCreate(db, employee)
+	employee, err := EmployeeCreate(db, employee, options)
 	if err != nil {
 		return err
 	}
 	fmt.Printf("  Attempt to mutate the employee by maintaining the latest version of %d\n", employee.Version)
 	mutatedEmployee, err := EmployeeWrite(db, &Employee{
-		ID:        employee.ID,
-		FirstName: "Theodore",
-		LastName:  "Perkins",
-		Version:   employee.Version,
-	})
+		ID:           employee.ID,
+		FirstName:    "Theodore",
+		LastName:     "Perkins",
+		EmailAddress: employee.EmailAddress,
+		Version:      employee.Version,
+	}, options)
 	if err != nil {
 		return err
 	}
@@ -117,11 +118,12 @@ func employeeConcurrentWrite(db *sql.DB) error {
 	fmt.Printf("  Notice that this employee mutation was successful:  \n\n  %s\n\n", string(bytes))
 	fmt.Printf("  Attempt to mutate the employee again, but use the older version %d rather than the new version %d\n", employee.Version, mutatedEmployee.Version)
 	_, err = EmployeeWrite(db, &Employee{
-		ID:        employee.ID,
-		FirstName: "Theodore",
-		LastName:  "Perkins",
-		Version:   employee.Version,
-	})
+		ID:           employee.ID,
+		FirstName:    "Theodore",
+		LastName:     "Perkins",
+		EmailAddress: employee.EmailAddress,
+		Version:      employee.Version,
+	}, options)
 	if err == nil {
 		fmt.Println("\n!! an error was expected but didn't occur")
 		return nil
@@ -131,7 +133,7 @@ func employeeConcurrentWrite(db *sql.DB) error {
 	return nil
 }
 
-func employeeConcurrentMutations(db *sql.DB) error {
+func employeeConcurrentMutations(db *sql.DB, options EmailOptions) error {
 	const (
 		firstName    string = "Antonio"
 		lastName     string = "Alexander"
@@ -150,7 +152,7 @@ func employeeConcurrentMutations(db *sql.DB) error {
 		//KIM: version is effectively ignored/read-only
 		// Version:      0,
 	}
-	employee, err := EmployeeCreate(db, employee)
+	employee, err := EmployeeCreate(db, employee, options)
 	if err != nil {
 		return err
 	}
@@ -206,7 +208,7 @@ func employeeConcurrentMutations(db *sql.DB) error {
 							fmt.Printf("  >Routine %d, experienced error reading: %s\n", n, err.Error())
 							continue
 						}
-						_, err = EmployeeWrite(db, employee)
+						_, err = EmployeeWrite(db, employee, options)
 						if err != nil {
 							writeFailures++
 						}
@@ -221,7 +223,7 @@ func employeeConcurrentMutations(db *sql.DB) error {
 	return nil
 }
 
-func concurrencyTables(db *sql.DB) error {
+func concurrencyTables(db *sql.DB, options EmailOptions) error {
 	const (
 		firstName    string = "Antonio"
 		lastName     string = "Alexander"
@@ -240,7 +242,7 @@ func concurrencyTables(db *sql.DB) error {
 		EmailAddress: emailAddress,
 		//KIM: version is effectively ignored/read-only
 		// Version:      0,
-	})
+	}, options)
 	if err != nil {
 		return err
 	}
@@ -270,26 +272,84 @@ func concurrencyTables(db *sql.DB) error {
 	return nil
 }
 
-func Main(pwd string, args []string, envs map[string]string, osSignal chan os.Signal) error {
-	db, err := initialize(envs)
-	if err != nil {
+func example(db *sql.DB, options EmailOptions) error {
+	if err := employeeConcurrentCreate(db, options); err != nil {
 		return err
 	}
-	if err := employeeConcurrentCreate(db); err != nil {
+	if err := employeeConcurrentWrite(db, options); err != nil {
 		return err
 	}
-	if err := employeeConcurrentWrite(db); err != nil {
+	if err := employeeConcurrentMutations(db, options); err != nil {
 		return err
 	}
-	if err := employeeConcurrentMutations(db); err != nil {
+	return concurrencyTables(db, options)
+}
+
+func Main(pwd string, args []string, envs map[string]string, osSignal chan os.Signal) error {
+	command := commandExample
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+	config := ConfigFromEnv(envs)
+	idGenerator, err := NewIDGenerator(config.IDGenerator)
+	if err != nil {
 		return err
 	}
-	if err := concurrencyTables(db); err != nil {
+	IDGeneration = IDOptions{
+		Generator: idGenerator,
+		Binary:    config.IDBinary,
+	}
+	db, err := initialize(config)
+	if err != nil {
 		return err
 	}
+	switch command {
+	default:
+		err = errors.Errorf("unsupported command: \"%s\"", command)
+	case commandExample:
+		err = example(db, config.EmailOptions())
+	case commandVerifySchema:
+		err = verifySchema(db, config, args)
+	case commandAudit:
+		err = audit(db, config, args)
+	case commandOutboxRelay:
+		err = outboxRelay(db, args, osSignal)
+	case commandChanges:
+		err = changes(db, args)
+	case commandRebuild:
+		err = rebuildProjection(db, config, args)
+	case commandSagaDelete:
+		err = sagaEmployeeDelete(db, config, args)
+	case commandSagaMerge:
+		err = sagaEmployeeMerge(db, config, args)
+	case commandSagaReassign:
+		err = sagaTimersReassign(db, config, args)
+	case commandSagaResume:
+		err = sagaResume(db, config, args)
+	case commandEmployees:
+		err = employeeService(db, config, osSignal)
+	case commandTimers:
+		err = timerService(db, config, osSignal)
+	case commandVerify:
+		err = employeeVerify(db, config)
+	case commandPurge:
+		err = tombstonePurge(db, config, args)
+	case commandSubscribe:
+		err = webhookSubscribe(db, args)
+	case commandWebhooks:
+		err = webhookDeliver(db, args, osSignal)
+	case commandReplay:
+		err = webhookReplay(db, args)
+	case commandBackground:
+		err = background(db, config, args, osSignal)
+	case commandXAExample:
+		err = xaExample(db, config, args)
+	case commandXARecover:
+		err = xaRecover(db, config, args)
+	}
 	fmt.Println("Closing the database")
 	if err := db.Close(); err != nil {
 		fmt.Printf(" Error occured while closing the database: \"%s\"\n", err.Error())
 	}
-	return nil
+	return err
 }
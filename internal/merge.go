@@ -0,0 +1,230 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//MergeRule describes how a single field is combined when
+// merging a duplicate employee into a survivor
+type MergeRule string
+
+//these are the rules that can be used to merge fields
+const (
+	MergeRuleSurvivor  MergeRule = "survivor"  //always keep the survivor's value
+	MergeRuleDuplicate MergeRule = "duplicate" //always use the duplicate's value
+	MergeRuleNonEmpty  MergeRule = "non_empty" //keep the survivor's value unless it's empty
+)
+
+//MergeRules describes how each field is combined when merging
+// a duplicate employee into a survivor
+type MergeRules struct {
+	FirstName    MergeRule `json:"first_name"`
+	LastName     MergeRule `json:"last_name"`
+	EmailAddress MergeRule `json:"email_address"`
+}
+
+//MergeRulesDefault will fill in empty names from the duplicate
+// and keep the survivor's email address
+var MergeRulesDefault = MergeRules{
+	FirstName:    MergeRuleNonEmpty,
+	LastName:     MergeRuleNonEmpty,
+	EmailAddress: MergeRuleSurvivor,
+}
+
+func (m MergeRule) merge(survivor, duplicate string) (string, error) {
+	switch m {
+	default:
+		return "", errors.Errorf("unsupported merge rule: \"%s\"", m)
+	case MergeRuleSurvivor, "":
+		return survivor, nil
+	case MergeRuleDuplicate:
+		return duplicate, nil
+	case MergeRuleNonEmpty:
+		if strings.TrimSpace(survivor) == "" {
+			return duplicate, nil
+		}
+		return survivor, nil
+	}
+}
+
+//EmployeeMerge can be used to merge a duplicate employee into a survivor; all of the
+// duplicate's timers are moved to the survivor, the fields are combined according to
+// the rules and the duplicate is deleted, leaving a redirect such that reads of the
+// duplicate's uuid will resolve to the survivor. It will return an error if either
+// version isn't the current version or if the survivor is archived (or pending
+// delete); the merged email address is normalized with options
+func EmployeeMerge(db Queryer, survivorUUID string, survivorVersion int, duplicateUUID string, duplicateVersion int, rules *MergeRules, options EmailOptions) (*Employee, error) {
+
+	var survivorID, duplicateID int64
+	var survivor, duplicate *Employee
+	var survivorPendingDelete bool
+
+	if survivorUUID == duplicateUUID {
+		return nil, errors.New("an employee can't be merged with itself")
+	}
+	if rules == nil {
+		rules = &MergeRulesDefault
+	}
+	tx, err := txBegin(db)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	//KIM: both rows are locked in order of their id so that concurrent
+	// merges of the same employees can't deadlock
+	query := fmt.Sprintf(`SELECT id, uuid, first_name, last_name, email_address, archived, pending_delete, version
+		FROM %s WHERE uuid IN (?, ?) ORDER BY id FOR UPDATE`, tableEmployee)
+	rows, err := tx.Query(query, idArg(survivorUUID), idArg(duplicateUUID))
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id int64
+		var pendingDelete bool
+
+		employee := &Employee{}
+		if err := rows.Scan(&id, idScan(&employee.ID), &employee.FirstName, &employee.LastName,
+			&employee.EmailAddress, &employee.Archived, &pendingDelete, &employee.Version); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		switch employee.ID {
+		case survivorUUID:
+			survivorID, survivor, survivorPendingDelete = id, employee, pendingDelete
+		case duplicateUUID:
+			duplicateID, duplicate = id, employee
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	switch {
+	case survivor == nil:
+		return nil, errors.Errorf("employee with id, \"%s\", not found locally", survivorUUID)
+	case duplicate == nil:
+		return nil, errors.Errorf("employee with id, \"%s\", not found locally", duplicateUUID)
+	case survivor.Version != survivorVersion:
+		return nil, errors.Errorf("version mismatch, employee \"%s\" is at version %d not %d",
+			survivorUUID, survivor.Version, survivorVersion)
+	case duplicate.Version != duplicateVersion:
+		return nil, errors.Errorf("version mismatch, employee \"%s\" is at version %d not %d",
+			duplicateUUID, duplicate.Version, duplicateVersion)
+	//KIM: the duplicate's timers are moved to the survivor, so the survivor
+	// has to be able to take timers, just like the target of TimerReassign
+	case survivor.Archived:
+		return nil, errors.Errorf("employee with id, \"%s\", is archived", survivorUUID)
+	case survivorPendingDelete:
+		return nil, errors.Errorf("employee with id, \"%s\", is pending delete", survivorUUID)
+	}
+	if err := employeesEventSourced(tx, survivor.ID, duplicate.ID); err != nil {
+		return nil, err
+	}
+	merged := &Employee{ID: survivor.ID}
+	if merged.FirstName, err = rules.FirstName.merge(survivor.FirstName, duplicate.FirstName); err != nil {
+		return nil, err
+	}
+	if merged.LastName, err = rules.LastName.merge(survivor.LastName, duplicate.LastName); err != nil {
+		return nil, err
+	}
+	if merged.EmailAddress, err = rules.EmailAddress.merge(survivor.EmailAddress, duplicate.EmailAddress); err != nil {
+		return nil, err
+	}
+	emailAddress, emailAddressNormalized, err := EmailNormalize(merged.EmailAddress, options)
+	if err != nil {
+		return nil, err
+	}
+	//move the duplicate's timers to the survivor, recording the change
+	// in ownership in each timer's history
+	timerIDs, err := employeeTimerIDs(tx, duplicateID)
+	if err != nil {
+		return nil, err
+	}
+	query = fmt.Sprintf(`INSERT INTO %s (timer_id, version, previous_employee_uuid, employee_uuid)
+		SELECT id, version+1, ?, ? FROM %s WHERE employee_id=?`, tableTimerHistory, tableTimer)
+	if _, err := tx.Exec(query, duplicate.ID, survivor.ID, duplicateID); err != nil {
+		return nil, err
+	}
+	query = fmt.Sprintf("UPDATE %s SET employee_id=?, version=version+1 WHERE employee_id=?", tableTimer)
+	if _, err := tx.Exec(query, survivorID, duplicateID); err != nil {
+		return nil, err
+	}
+	//re-point any redirects to the duplicate (from previous merges), delete
+	// the duplicate and redirect its uuid to the survivor
+	query = fmt.Sprintf("UPDATE %s SET employee_id=? WHERE employee_id=?", tableEmployeeRedirect)
+	if _, err := tx.Exec(query, survivorID, duplicateID); err != nil {
+		return nil, err
+	}
+	query = fmt.Sprintf("DELETE FROM %s WHERE id=? AND version=?", tableEmployee)
+	result, err := tx.Exec(query, duplicateID, duplicateVersion)
+	if err != nil {
+		return nil, err
+	}
+	if err := RowsAffected(result, "no rows affected, version mismatch or non-existent employee"); err != nil {
+		return nil, err
+	}
+	query = fmt.Sprintf("INSERT INTO %s (uuid, employee_id) VALUES (?, ?)", tableEmployeeRedirect)
+	if _, err := tx.Exec(query, duplicate.ID, survivorID); err != nil {
+		return nil, err
+	}
+	//KIM: the survivor is updated last since it may take the duplicate's
+	// email address which is unique and only available once it's deleted
+	query = fmt.Sprintf(`UPDATE %s SET first_name=?, last_name=?, email_address=?, email_address_normalized=?, version=version+1
+		WHERE id=? AND version=?`, tableEmployee)
+	result, err = tx.Exec(query, merged.FirstName, merged.LastName, emailAddress, emailAddressNormalized,
+		survivorID, survivorVersion)
+	if err != nil {
+		return nil, err
+	}
+	if err := RowsAffected(result, "no rows affected, version mismatch or non-existent employee"); err != nil {
+		return nil, err
+	}
+	employee, err := employeeScan(tx.QueryRow(employeeSelect("id=?"), survivorID))
+	if err != nil {
+		return nil, err
+	}
+	for _, timerID := range timerIDs {
+		timer, err := timerScan(tx.QueryRow(timerSelect("t.id=?"), timerID))
+		if err != nil {
+			return nil, err
+		}
+		if err := outboxWrite(tx, tableTimer, timer.ID, timer.Version, ChangeUpdated, timer); err != nil {
+			return nil, err
+		}
+	}
+	if err := outboxWrite(tx, tableEmployee, duplicate.ID, duplicate.Version, ChangeDeleted, duplicate); err != nil {
+		return nil, err
+	}
+	if err := outboxWrite(tx, tableEmployee, employee.ID, employee.Version, ChangeUpdated, employee); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return employee, nil
+}
+
+//employeeTimerIDs returns the ids of the timers for the given employee,
+// the timers are locked until the end of the transaction
+func employeeTimerIDs(db Queryer, employeeID int64) ([]int64, error) {
+	var timerIDs []int64
+
+	query := fmt.Sprintf("SELECT id FROM %s WHERE employee_id=? FOR UPDATE", tableTimer)
+	rows, err := db.Query(query, employeeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var timerID int64
+
+		if err := rows.Scan(&timerID); err != nil {
+			return nil, err
+		}
+		timerIDs = append(timerIDs, timerID)
+	}
+	return timerIDs, rows.Err()
+}
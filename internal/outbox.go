@@ -0,0 +1,325 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//these are the types of changes recorded in the outbox
+const (
+	ChangeCreated string = "created"
+	ChangeUpdated string = "updated"
+	ChangeDeleted string = "deleted"
+)
+
+//these are the defaults for the outbox relay if not provided
+const (
+	defaultOutboxBatchSize int           = 100
+	defaultOutboxInterval  time.Duration = time.Second
+)
+
+//OutboxMessage describes a single change to an employee or timer, it's
+// written to the outbox within the same transaction as the change
+type OutboxMessage struct {
+	ID         int64           `json:"id"`
+	Sequence   int64           `json:"sequence"`
+	EntityType string          `json:"entity_type"`
+	EntityID   string          `json:"entity_id"`
+	Version    int             `json:"version"`
+	ChangeType string          `json:"change_type"`
+	Payload    json.RawMessage `json:"payload"`
+	CreatedAt  int64           `json:"created_at"`
+}
+
+//Publisher describes how outbox messages are published, a message may be
+// published more than once (e.g., if the relay stops after publishing but
+// before marking the message as delivered) so consumers should be idempotent
+// (e.g., by ignoring versions older than what they've already seen)
+type Publisher interface {
+	Publish(ctx context.Context, message *OutboxMessage) error
+}
+
+//outboxWrite will write a change to the outbox, it must be called within
+// the same transaction as the change
+func outboxWrite(db Queryer, entityType, entityID string, version int, changeType string, payload interface{}) error {
+	bytes, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	sequence, err := changeSequenceNext(db)
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf(`INSERT INTO %s (sequence, entity_type, entity_uuid, version, change_type, payload)
+		VALUES (?, ?, ?, ?, ?, ?)`, tableOutbox)
+	_, err = db.Exec(query, sequence, entityType, entityID, version, changeType, bytes)
+	return err
+}
+
+//changeSequenceNext will increment the change sequence and return its value,
+// the counter's row stays locked until the transaction commits or rolls back:
+// transactions are assigned sequences in the order they commit and a rolled
+// back transaction also rolls back its increment, so there are no gaps
+func changeSequenceNext(db Queryer) (int64, error) {
+	query := fmt.Sprintf("UPDATE %s SET sequence=LAST_INSERT_ID(sequence+1) WHERE id=1", tableChangeSequence)
+	result, err := db.Exec(query)
+	if err != nil {
+		return 0, err
+	}
+	if err := RowsAffected(result, "no rows affected, change sequence not initialized"); err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+//ChangeSequence returns the sequence of the most recently committed change,
+// it can be used by a new consumer to start reading changes from now
+func ChangeSequence(db Queryer) (int64, error) {
+	var sequence int64
+
+	query := fmt.Sprintf("SELECT sequence FROM %s WHERE id=1", tableChangeSequence)
+	if err := db.QueryRow(query).Scan(&sequence); err != nil {
+		return 0, err
+	}
+	return sequence, nil
+}
+
+//ChangesSince can be used to read the changes (in order) with a sequence greater
+// than after, up to limit changes; since sequences are assigned in commit order
+// without gaps, the sequence of the last change can be used as after to read the
+// next page without ever skipping a committed change
+func ChangesSince(db Queryer, after int64, limit int) ([]*OutboxMessage, error) {
+	var messages []*OutboxMessage
+
+	if limit <= 0 {
+		limit = defaultOutboxBatchSize
+	}
+	rows, err := db.Query(outboxSelect("sequence>? ORDER BY sequence LIMIT ?"), after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		message, err := outboxScan(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
+
+//outboxSelect returns a query to select the columns of an outbox
+// message with the given where clause
+func outboxSelect(where string) string {
+	return fmt.Sprintf(`SELECT id, sequence, entity_type, entity_uuid, version, change_type, payload, UNIX_TIMESTAMP(created_at)
+		FROM %s WHERE %s`, tableOutbox, where)
+}
+
+//outboxScan can be used to scan a row selected with outboxSelect
+func outboxScan(row interface {
+	Scan(dest ...interface{}) error
+}) (*OutboxMessage, error) {
+	var payload []byte
+
+	message := &OutboxMessage{}
+	if err := row.Scan(&message.ID, &message.Sequence, &message.EntityType, &message.EntityID,
+		&message.Version, &message.ChangeType, &payload, &message.CreatedAt); err != nil {
+		return nil, err
+	}
+	message.Payload = payload
+	return message, nil
+}
+
+//outboxChangeType returns created for the first version of an entity
+// and updated for every subsequent version (e.g., an upsert)
+func outboxChangeType(version int) string {
+	if version <= 1 {
+		return ChangeCreated
+	}
+	return ChangeUpdated
+}
+
+//OutboxRelay can be used to publish the messages in the outbox in order, at
+// least once; only one relay should be running per database since the order
+// is only guaranteed within a single relay
+type OutboxRelay struct {
+	DB        *sql.DB       //database containing the outbox
+	Publisher Publisher     //publisher to publish messages to
+	BatchSize int           //maximum number of messages to publish per transaction
+	Interval  time.Duration //interval to poll the outbox when it's empty
+	Fence     *Fence        //if provided, messages are only published while the fence is current
+}
+
+//Deliver will publish a single batch of undelivered messages in order and
+// mark them as delivered, it returns the number of messages delivered; if
+// publishing fails, the messages published so far are marked as delivered
+// and the error is returned
+func (o *OutboxRelay) Deliver(ctx context.Context) (int, error) {
+	var messages []*OutboxMessage
+	var delivered int
+
+	batchSize := o.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultOutboxBatchSize
+	}
+	tx, err := o.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	//KIM: the lease is read with a shared lock, so it can't change hands
+	// until this batch is published and marked as delivered
+	if o.Fence != nil {
+		if err := o.Fence.Check(tx); err != nil {
+			return 0, err
+		}
+	}
+	//KIM: the rows are locked so that if more than one relay is running,
+	// they'll take turns rather than publish the same messages out of order
+	query := outboxSelect("delivered_at IS NULL ORDER BY sequence LIMIT ? FOR UPDATE")
+	rows, err := tx.QueryContext(ctx, query, batchSize)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		message, err := outboxScan(rows)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		messages = append(messages, message)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	var errPublish error
+	for _, message := range messages {
+		if errPublish = o.Publisher.Publish(ctx, message); errPublish != nil {
+			break
+		}
+		delivered++
+	}
+	if delivered > 0 {
+		//KIM: only the messages that were published are marked as delivered,
+		// a range (e.g., sequence<=?) would also match a message that was
+		// committed after the batch was read, marking it as delivered without
+		// ever publishing it
+		args := make([]interface{}, 0, delivered)
+		for _, message := range messages[:delivered] {
+			args = append(args, message.ID)
+		}
+		query = fmt.Sprintf("UPDATE %s SET delivered_at=CURRENT_TIMESTAMP WHERE id IN (?%s)",
+			tableOutbox, strings.Repeat(", ?", delivered-1))
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return 0, err
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, err
+		}
+	}
+	return delivered, errPublish
+}
+
+//Run will deliver messages until the context is cancelled, when the outbox
+// is empty (or publishing fails), it'll wait for the interval before polling
+// again; it returns the error that caused the context to be cancelled
+func (o *OutboxRelay) Run(ctx context.Context) error {
+	interval := o.Interval
+	if interval <= 0 {
+		interval = defaultOutboxInterval
+	}
+	for {
+		delivered, err := o.Deliver(ctx)
+		if err == nil && delivered > 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+//WriterPublisher publishes messages as lines of JSON to a writer
+// (e.g., os.Stdout)
+type WriterPublisher struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+//NewWriterPublisher can be used to create a publisher that writes
+// to the given writer
+func NewWriterPublisher(writer io.Writer) *WriterPublisher {
+	return &WriterPublisher{writer: writer}
+}
+
+//Publish will write the message as a single line of JSON
+func (w *WriterPublisher) Publish(ctx context.Context, message *OutboxMessage) error {
+	bytes, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	_, err = w.writer.Write(append(bytes, '\n'))
+	return err
+}
+
+//FilePublisher publishes messages as lines of JSON appended to a file
+type FilePublisher struct {
+	*WriterPublisher
+	file *os.File
+}
+
+//NewFilePublisher can be used to create a publisher that appends to
+// the given file, the file is created if it doesn't exist
+func NewFilePublisher(path string) (*FilePublisher, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FilePublisher{
+		WriterPublisher: NewWriterPublisher(file),
+		file:            file,
+	}, nil
+}
+
+//Publish will append the message to the file, it's synced before
+// returning so the message isn't marked as delivered until it's durable
+func (f *FilePublisher) Publish(ctx context.Context, message *OutboxMessage) error {
+	if err := f.WriterPublisher.Publish(ctx, message); err != nil {
+		return err
+	}
+	return f.file.Sync()
+}
+
+//Close will close the file
+func (f *FilePublisher) Close() error {
+	return f.file.Close()
+}
+
+//ChannelPublisher publishes messages to an in-process channel
+type ChannelPublisher chan *OutboxMessage
+
+//Publish will send the message to the channel, blocking until it's
+// received or the context is cancelled
+func (c ChannelPublisher) Publish(ctx context.Context, message *OutboxMessage) error {
+	select {
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "unable to publish message")
+	case c <- message:
+		return nil
+	}
+}
@@ -0,0 +1,289 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//these are the states of a reservation, a reservation that's tried is
+// only active until it expires
+const (
+	ReservationTried     string = "tried"
+	ReservationConfirmed string = "confirmed"
+	ReservationCancelled string = "cancelled"
+)
+
+//defaultReservationTTL is how long a reservation is held if a ttl
+// isn't provided
+const defaultReservationTTL time.Duration = 30 * time.Second
+
+//these are the errors returned when a reservation can't be confirmed (or
+// cancelled) and when an employee can't be deleted because it's reserved
+var (
+	ErrReservationExpired = errors.New("reservation expired")
+	ErrEmployeeReserved   = errors.New("employee is reserved")
+)
+
+//EmployeeReservation describes a time-limited hold on an employee, while it's
+// tried (and hasn't expired) the employee can't be deleted; it's confirmed
+// once the operation it was placed for has completed or cancelled if it failed
+type EmployeeReservation struct {
+	ID         string `json:"id"`
+	EmployeeID string `json:"employee_id"`
+	State      string `json:"state"`
+	ExpiresAt  int64  `json:"expires_at"`
+}
+
+//EmployeeReserver provides an interface to reserve an employee from another
+// service (try), then confirm or cancel the reservation; each operation is
+// idempotent so it can be retried with the same reservation id
+type EmployeeReserver interface {
+	EmployeeReserve(employeeID, reservationID string, ttl time.Duration) (*EmployeeReservation, error)
+	ReservationConfirm(employeeID, reservationID string) (*EmployeeReservation, error)
+	ReservationCancel(employeeID, reservationID string) (*EmployeeReservation, error)
+}
+
+//reservationRead will read the reservation with the given lock, whether it's
+// expired is determined by the clock of the database
+func reservationRead(db Queryer, employeeID, reservationID, lock string) (*EmployeeReservation, error) {
+	var expired bool
+
+	query := fmt.Sprintf(`SELECT uuid, employee_uuid, state, FLOOR(UNIX_TIMESTAMP(expires_at)), expires_at <= NOW(6)
+		FROM %s WHERE uuid=? AND employee_uuid=? %s`, tableEmployeeReservation, lock)
+	reservation := &EmployeeReservation{}
+	if err := db.QueryRow(query, reservationID, employeeID).Scan(&reservation.ID, &reservation.EmployeeID,
+		&reservation.State, &reservation.ExpiresAt, &expired); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorf("reservation with id, \"%s\", not found", reservationID)
+		}
+		return nil, err
+	}
+	//KIM: an expired reservation that hasn't been confirmed is as good as
+	// cancelled, whether or not ReservationsExpire has caught up with it
+	if expired && reservation.State == ReservationTried {
+		reservation.State = ReservationCancelled
+	}
+	return reservation, nil
+}
+
+//ReservationRead can be used to read a reservation
+func ReservationRead(db Queryer, employeeID, reservationID string) (*EmployeeReservation, error) {
+	return reservationRead(db, employeeID, reservationID, "")
+}
+
+//EmployeeReserve can be used to place a reservation (try) on an employee for
+// up to ttl, the employee is read with a shared lock so it can't be deleted
+// (or marked as pending delete) until the reservation has been written; if
+// the reservation already exists, it's returned as is
+func EmployeeReserve(db Queryer, employeeID, reservationID string, ttl time.Duration) (*EmployeeReservation, error) {
+	var pendingDelete bool
+
+	if reservationID == "" {
+		return nil, errors.New("reservation id is empty")
+	}
+	if ttl <= 0 {
+		ttl = defaultReservationTTL
+	}
+	tx, err := txBegin(db)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	query := fmt.Sprintf("SELECT pending_delete FROM %s WHERE uuid=? LOCK IN SHARE MODE", tableEmployee)
+	if err := tx.QueryRow(query, idArg(employeeID)).Scan(&pendingDelete); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, employeeNotFound(tx, employeeID, "LOCK IN SHARE MODE")
+		}
+		return nil, err
+	}
+	if pendingDelete {
+		return nil, errors.Errorf("employee with id, \"%s\", is pending delete", employeeID)
+	}
+	query = fmt.Sprintf(`INSERT IGNORE INTO %s (uuid, employee_uuid, state, expires_at)
+		VALUES (?, ?, ?, NOW(6) + INTERVAL ? MICROSECOND)`, tableEmployeeReservation)
+	if _, err := tx.Exec(query, reservationID, employeeID, ReservationTried,
+		int64(ttl/time.Microsecond)); err != nil {
+		return nil, err
+	}
+	reservation, err := reservationRead(tx, employeeID, reservationID, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return reservation, nil
+}
+
+//reservationComplete will move a tried reservation that hasn't expired to
+// the given state, if the reservation is already in that state, it's returned
+// as is; otherwise, ErrReservationExpired is returned
+func reservationComplete(db Queryer, employeeID, reservationID, state string) (*EmployeeReservation, error) {
+	tx, err := txBegin(db)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	reservation, err := reservationRead(tx, employeeID, reservationID, "FOR UPDATE")
+	if err != nil {
+		return nil, err
+	}
+	switch reservation.State {
+	case state:
+		return reservation, nil
+	case ReservationTried:
+	default:
+		return nil, errors.Wrapf(ErrReservationExpired, "reservation with id, \"%s\", is %s",
+			reservationID, reservation.State)
+	}
+	query := fmt.Sprintf("UPDATE %s SET state=? WHERE uuid=?", tableEmployeeReservation)
+	if _, err := tx.Exec(query, state, reservationID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	reservation.State = state
+	return reservation, nil
+}
+
+//ReservationConfirm can be used to confirm a reservation once the operation
+// it was placed for has completed, the hold on the employee is released; a
+// reservation that has expired (or been cancelled) can't be confirmed
+func ReservationConfirm(db Queryer, employeeID, reservationID string) (*EmployeeReservation, error) {
+	return reservationComplete(db, employeeID, reservationID, ReservationConfirmed)
+}
+
+//ReservationCancel can be used to cancel a reservation if the operation it
+// was placed for failed, the hold on the employee is released; cancelling an
+// expired reservation has no effect, but a confirmed one can't be cancelled
+func ReservationCancel(db Queryer, employeeID, reservationID string) (*EmployeeReservation, error) {
+	return reservationComplete(db, employeeID, reservationID, ReservationCancelled)
+}
+
+//ReservationsExpire can be used to cancel the reservations that have expired,
+// reservations expire on their own, so this only keeps the table tidy; it
+// returns the number of reservations cancelled
+func ReservationsExpire(db Queryer) (int64, error) {
+	query := fmt.Sprintf("UPDATE %s SET state=? WHERE state=? AND expires_at <= NOW(6)", tableEmployeeReservation)
+	result, err := db.Exec(query, ReservationCancelled, ReservationTried)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+//employeesReserved returns ErrEmployeeReserved if any of the employees have
+// an active reservation, it must be called after the employees have been
+// locked (e.g., FOR UPDATE) within the same transaction as the delete
+func employeesReserved(db Queryer, employeeIDs ...string) error {
+	var reservationID, employeeID string
+
+	args := []interface{}{ReservationTried}
+	for _, employeeID := range employeeIDs {
+		args = append(args, employeeID)
+	}
+	//KIM: the reservations are read with a lock so a reservation committed
+	// while waiting for the employee's lock is seen
+	query := fmt.Sprintf(`SELECT uuid, employee_uuid FROM %s
+		WHERE state=? AND expires_at > NOW(6) AND employee_uuid IN (?%s) LIMIT 1 LOCK IN SHARE MODE`,
+		tableEmployeeReservation, strings.Repeat(", ?", len(employeeIDs)-1))
+	switch err := db.QueryRow(query, args...).Scan(&reservationID, &employeeID); {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		return err
+	}
+	return errors.Wrapf(ErrEmployeeReserved, "employee with id, \"%s\", has reservation \"%s\"",
+		employeeID, reservationID)
+}
+
+//employeeIDs returns the ids of the given employees
+func employeeIDs(employees []*Employee) []string {
+	ids := make([]string, 0, len(employees))
+	for _, employee := range employees {
+		ids = append(ids, employee.ID)
+	}
+	return ids
+}
+
+//LocalEmployeeReserver reserves employees in a database containing the
+// employee table (e.g., the employee service)
+type LocalEmployeeReserver struct {
+	db Queryer
+}
+
+//NewLocalEmployeeReserver can be used to create a reserver for the
+// employee table in the given database
+func NewLocalEmployeeReserver(db Queryer) *LocalEmployeeReserver {
+	return &LocalEmployeeReserver{db: db}
+}
+
+func (l *LocalEmployeeReserver) EmployeeReserve(employeeID, reservationID string, ttl time.Duration) (*EmployeeReservation, error) {
+	return EmployeeReserve(l.db, employeeID, reservationID, ttl)
+}
+
+func (l *LocalEmployeeReserver) ReservationConfirm(employeeID, reservationID string) (*EmployeeReservation, error) {
+	return ReservationConfirm(l.db, employeeID, reservationID)
+}
+
+func (l *LocalEmployeeReserver) ReservationCancel(employeeID, reservationID string) (*EmployeeReservation, error) {
+	return ReservationCancel(l.db, employeeID, reservationID)
+}
+
+//ReservedTimerStore creates timers with try-confirm-cancel: the employee is
+// reserved (try), the timer is created, then the reservation is confirmed; if
+// the timer can't be created, the reservation is cancelled; the employee can't
+// be deleted between the reservation and the confirmation
+type ReservedTimerStore struct {
+	*SplitTimerStore
+	reserver EmployeeReserver
+	ttl      time.Duration
+}
+
+//NewReservedTimerStore can be used to create timers in store with
+// reservations placed using reserver for up to ttl
+func NewReservedTimerStore(store *SplitTimerStore, reserver EmployeeReserver, ttl time.Duration) *ReservedTimerStore {
+	if ttl <= 0 {
+		ttl = defaultReservationTTL
+	}
+	return &ReservedTimerStore{
+		SplitTimerStore: store,
+		reserver:        reserver,
+		ttl:             ttl,
+	}
+}
+
+//TimerCreate can be used to create a timer once its employee has been
+// reserved, if the reservation can't be confirmed (e.g., it expired before
+// the timer was created), the timer is deleted (compensated)
+func (r *ReservedTimerStore) TimerCreate(timer *Timer) (*Timer, error) {
+	if timer == nil {
+		return nil, errors.New("timer is nil")
+	}
+	reservationID := GenerateID()
+	if _, err := r.reserver.EmployeeReserve(timer.EmployeeID, reservationID, r.ttl); err != nil {
+		return nil, errors.Wrap(err, "unable to reserve employee")
+	}
+	timerCreated, err := r.SplitTimerStore.TimerCreate(timer)
+	if err != nil {
+		//KIM: if the reservation can't be cancelled, it'll expire
+		r.reserver.ReservationCancel(timer.EmployeeID, reservationID)
+		return nil, err
+	}
+	if _, err := r.reserver.ReservationConfirm(timer.EmployeeID, reservationID); err != nil {
+		//KIM: once the reservation has expired, the employee may have been
+		// deleted, so the timer can't be kept; if the confirmation was lost
+		// rather than refused, the timer is deleted even though the employee
+		// still exists, which is safe (if unfortunate)
+		if errDelete := r.SplitTimerStore.TimerDelete(timerCreated.ID); errDelete != nil {
+			return nil, errors.Wrapf(err, "unable to delete timer \"%s\": %s", timerCreated.ID, errDelete)
+		}
+		return nil, errors.Wrap(err, "unable to confirm reservation")
+	}
+	return timerCreated, nil
+}
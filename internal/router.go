@@ -0,0 +1,306 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+//sessionDeleted is recorded as the version of an entity that was deleted
+// within the session, since no replica can have a newer version, reads
+// will always go to the primary
+const sessionDeleted int = math.MaxInt32
+
+//sessionMaxVersions is the maximum number of versions a session records,
+// once exceeded, the versions of an entity type are compacted into a single
+// wildcard so the token can't grow without limit
+const sessionMaxVersions int = 256
+
+//Session records the last version written for each entity such that reads
+// can guarantee that the session sees its own writes, it can be serialized
+// as a token and provided with subsequent requests
+type Session struct {
+	mutex    sync.RWMutex
+	versions map[string]int
+}
+
+//NewSession can be used to create an empty session
+func NewSession() *Session {
+	return &Session{versions: make(map[string]int)}
+}
+
+//SessionFromToken can be used to create a session from a token
+// previously created with Token()
+func SessionFromToken(token string) (*Session, error) {
+	session := NewSession()
+	if token == "" {
+		return session, nil
+	}
+	bytes, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed session token")
+	}
+	if err := json.Unmarshal(bytes, &session.versions); err != nil {
+		return nil, errors.Wrap(err, "malformed session token")
+	}
+	return session, nil
+}
+
+//Token can be used to serialize the session
+func (s *Session) Token() (string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	bytes, err := json.Marshal(s.versions)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+//Version returns the last version written by this session for
+// the given entity, it'll return 0 if the session hasn't written it; if
+// the session has written all entities of the type (e.g., deleted them),
+// that version is returned unless the entity was written afterwards
+func (s *Session) Version(entityType, id string) int {
+	if s == nil {
+		return 0
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	//KIM: recording a wildcard removes the versions recorded before it, so
+	// the version of an entity is always newer than the wildcard; since
+	// replication is applied in commit order, a replica with that version
+	// has also applied whatever the wildcard recorded
+	if version, ok := s.versions[entityType+":"+id]; ok {
+		return version
+	}
+	return s.versions[entityType+":*"]
+}
+
+func (s *Session) record(entityType, id string, version int) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if id == "" {
+		s.wildcard(entityType, version)
+		return
+	}
+	key := entityType + ":" + id
+	if version > s.versions[key] {
+		s.versions[key] = version
+	}
+	if len(s.versions) > sessionMaxVersions {
+		s.wildcard(entityType, sessionDeleted)
+	}
+}
+
+//wildcard will record the version for every entity of the type, replacing
+// the versions recorded for individual entities; it must be called with the
+// lock held
+func (s *Session) wildcard(entityType string, version int) {
+	prefix := entityType + ":"
+	for key := range s.versions {
+		if strings.HasPrefix(key, prefix) {
+			delete(s.versions, key)
+		}
+	}
+	s.versions[prefix+"*"] = version
+}
+
+//Router can be used to send writes to the primary and reads to
+// replicas, reads will fall back to the primary if the replica
+// has an older version than the session has written
+type Router struct {
+	primary  *sql.DB
+	replicas []*sql.DB
+	email    EmailOptions
+	next     uint32
+}
+
+//NewRouter can be used to create a router for the given primary
+// and replicas, if no replicas are provided all reads go to the
+// primary; email addresses are normalized with options
+func NewRouter(primary *sql.DB, options EmailOptions, replicas ...*sql.DB) *Router {
+	return &Router{
+		primary:  primary,
+		replicas: replicas,
+		email:    options,
+	}
+}
+
+//InitializeRouter can be used to create a router using the primary and
+// replicas described by the configuration
+func InitializeRouter(config *Configuration) (*Router, error) {
+	var replicas []*sql.DB
+
+	primary, err := Initialize(config)
+	if err != nil {
+		return nil, err
+	}
+	for _, replicaConfig := range config.ReplicaConfigs() {
+		replica, err := Initialize(replicaConfig)
+		if err != nil {
+			primary.Close()
+			for _, replica := range replicas {
+				replica.Close()
+			}
+			return nil, err
+		}
+		replicas = append(replicas, replica)
+	}
+	return NewRouter(primary, config.EmailOptions(), replicas...), nil
+}
+
+//Primary returns the primary database, it can be used to
+// begin a unit of work
+func (r *Router) Primary() *sql.DB {
+	return r.primary
+}
+
+//Close will close the primary and all replicas
+func (r *Router) Close() error {
+	err := r.primary.Close()
+	for _, replica := range r.replicas {
+		if errClose := replica.Close(); errClose != nil && err == nil {
+			err = errClose
+		}
+	}
+	return err
+}
+
+func (r *Router) replica() *sql.DB {
+	if len(r.replicas) == 0 {
+		return nil
+	}
+	n := atomic.AddUint32(&r.next, 1)
+	return r.replicas[n%uint32(len(r.replicas))]
+}
+
+//EmployeeCreate will create the employee on the primary and record
+// the version within the session
+func (r *Router) EmployeeCreate(session *Session, employee *Employee) (*Employee, error) {
+	employee, err := EmployeeCreate(r.primary, employee, r.email)
+	if err != nil {
+		return nil, err
+	}
+	session.record(tableEmployee, employee.ID, employee.Version)
+	return employee, nil
+}
+
+//EmployeeWrite will mutate the employee on the primary and record
+// the version within the session
+func (r *Router) EmployeeWrite(session *Session, employee *Employee) (*Employee, error) {
+	employee, err := EmployeeWrite(r.primary, employee, r.email)
+	if err != nil {
+		return nil, err
+	}
+	session.record(tableEmployee, employee.ID, employee.Version)
+	return employee, nil
+}
+
+//EmployeeDelete will delete the employee on the primary, subsequent
+// reads of the employee within the session will go to the primary
+func (r *Router) EmployeeDelete(session *Session, employee *Employee) error {
+	if err := EmployeeDelete(r.primary, employee, r.email); err != nil {
+		return err
+	}
+	if employee == nil {
+		session.record(tableEmployee, "", sessionDeleted)
+		return nil
+	}
+	session.record(tableEmployee, employee.ID, sessionDeleted)
+	return nil
+}
+
+//EmployeeMerge will merge the duplicate into the survivor on the primary,
+// subsequent reads of the duplicate and of timers within the session will
+// go to the primary
+func (r *Router) EmployeeMerge(session *Session, survivorID string, survivorVersion int, duplicateID string, duplicateVersion int, rules *MergeRules) (*Employee, error) {
+	employee, err := EmployeeMerge(r.primary, survivorID, survivorVersion, duplicateID, duplicateVersion, rules, r.email)
+	if err != nil {
+		return nil, err
+	}
+	session.record(tableEmployee, employee.ID, employee.Version)
+	session.record(tableEmployee, duplicateID, sessionDeleted)
+	session.record(tableTimer, "", sessionDeleted)
+	return employee, nil
+}
+
+//EmployeeRead will attempt to read the employee from a replica, if the
+// replica's version is older than what the session has written (or the
+// read fails), the employee will be read from the primary
+func (r *Router) EmployeeRead(session *Session, employeeID string) (*Employee, error) {
+	version := session.Version(tableEmployee, employeeID)
+	if replica := r.replica(); replica != nil && version != sessionDeleted {
+		employee, err := EmployeeRead(replica, employeeID)
+		if err == nil && employee.Version >= version {
+			return employee, nil
+		}
+	}
+	return EmployeeRead(r.primary, employeeID)
+}
+
+//TimerCreate will create the timer on the primary and record
+// the version within the session
+func (r *Router) TimerCreate(session *Session, timer *Timer) (*Timer, error) {
+	timer, err := TimerCreate(r.primary, timer)
+	if err != nil {
+		return nil, err
+	}
+	session.record(tableTimer, timer.ID, timer.Version)
+	return timer, nil
+}
+
+//TimerWrite will mutate the timer on the primary and record
+// the version within the session
+func (r *Router) TimerWrite(session *Session, timer *Timer) (*Timer, error) {
+	timer, err := TimerWrite(r.primary, timer)
+	if err != nil {
+		return nil, err
+	}
+	session.record(tableTimer, timer.ID, timer.Version)
+	return timer, nil
+}
+
+//TimerReassign will assign the timer to a different employee on the
+// primary and record the version within the session
+func (r *Router) TimerReassign(session *Session, timerID string, timerVersion int, employeeID string) (*Timer, error) {
+	timer, err := TimerReassign(r.primary, timerID, timerVersion, employeeID)
+	if err != nil {
+		return nil, err
+	}
+	session.record(tableTimer, timer.ID, timer.Version)
+	return timer, nil
+}
+
+//TimerDelete will delete the timer on the primary, subsequent
+// reads of the timer within the session will go to the primary
+func (r *Router) TimerDelete(session *Session, timerID string) error {
+	if err := TimerDelete(r.primary, timerID); err != nil {
+		return err
+	}
+	session.record(tableTimer, timerID, sessionDeleted)
+	return nil
+}
+
+//TimerRead will attempt to read the timer from a replica, if the
+// replica's version is older than what the session has written (or the
+// read fails), the timer will be read from the primary
+func (r *Router) TimerRead(session *Session, timerID string) (*Timer, error) {
+	version := session.Version(tableTimer, timerID)
+	if replica := r.replica(); replica != nil && version != sessionDeleted {
+		timer, err := TimerRead(replica, timerID)
+		if err == nil && timer.Version >= version {
+			return timer, nil
+		}
+	}
+	return TimerRead(r.primary, timerID)
+}
@@ -0,0 +1,990 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//these are the states of a saga, running and compensating sagas are
+// in progress and will be resumed
+const (
+	SagaRunning      string = "running"
+	SagaCompensating string = "compensating"
+	SagaCompleted    string = "completed"
+	SagaCompensated  string = "compensated"
+)
+
+//these are the phases of a step recorded in the journal
+const (
+	SagaPhaseAction     string = "action"
+	SagaPhaseCompensate string = "compensate"
+)
+
+//these are the states of a step recorded in the journal, a step is
+// journaled as started before it's executed and as completed (or failed)
+// once it's executed
+const (
+	SagaStepStarted   string = "started"
+	SagaStepCompleted string = "completed"
+	SagaStepFailed    string = "failed"
+)
+
+//these are the policies for resuming a saga that was running when the
+// process crashed, it's either rolled forward (the step in progress is
+// executed again) or compensated
+const (
+	SagaRecoverRollForward string = "roll-forward"
+	SagaRecoverCompensate  string = "compensate"
+)
+
+//these are the policies for the timers of an employee being deleted
+const (
+	SagaTimersCascade string = "cascade"
+	SagaTimersOrphan  string = "orphan"
+)
+
+//these are the names of the sagas for multi-entity operations
+const (
+	SagaEmployeeDelete string = "employee-delete"
+	SagaEmployeeMerge  string = "employee-merge"
+	SagaTimersReassign string = "timers-reassign"
+)
+
+//defaultSagaLockTimeout is how long executing a saga waits for another
+// saga holding the same lock to complete
+const defaultSagaLockTimeout time.Duration = 10 * time.Second
+
+//Saga describes the durable state of a single execution of a saga, it's
+// written to the saga table after every step such that it can be resumed
+type Saga struct {
+	ID      string          `json:"id"`
+	Name    string          `json:"name"`
+	State   string          `json:"state"`
+	Step    int             `json:"step"`
+	Data    json.RawMessage `json:"data"`
+	Error   string          `json:"error,omitempty"`
+	Version int             `json:"version"`
+}
+
+//DataRead can be used to unmarshal the data of the saga into v
+func (s *Saga) DataRead(v interface{}) error {
+	return json.Unmarshal(s.Data, v)
+}
+
+//DataWrite can be used to replace the data of the saga with v, it's
+// written to the saga table once the step returns
+func (s *Saga) DataWrite(v interface{}) error {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.Data = bytes
+	return nil
+}
+
+//SagaStep describes a single step of a saga; a step may be executed again
+// if the process crashes after it's journaled as started but before it's
+// journaled as completed, so both the action and its compensation must be
+// idempotent; a step without a compensation (e.g., the last step) is skipped
+// when compensating
+type SagaStep struct {
+	Name       string
+	Action     func(ctx context.Context, saga *Saga) error
+	Compensate func(ctx context.Context, saga *Saga) error
+}
+
+//SagaDefinition describes the steps of a saga, the steps are executed in
+// order and compensated in reverse order; if Lock is provided, it returns the
+// name of a lock that's held while the saga runs (e.g., such that only one
+// saga runs for a given employee at a time); Recovery is how the saga is
+// resumed if it was running when the process crashed, if it's empty, it's
+// rolled forward
+type SagaDefinition struct {
+	Name     string
+	Steps    []*SagaStep
+	Lock     func(saga *Saga) (string, error)
+	Recovery string
+}
+
+//SagaJournalEntry describes a single entry in the journal of a saga
+type SagaJournalEntry struct {
+	ID        int64  `json:"id"`
+	Step      int    `json:"step"`
+	StepName  string `json:"step_name"`
+	Phase     string `json:"phase"`
+	State     string `json:"state"`
+	Error     string `json:"error,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+//SagaOrchestrator can be used to execute (and resume) sagas, the state of
+// each saga and its journal are stored in the given database; while a saga
+// is being run, its lock is held so it isn't resumed at the same time
+type SagaOrchestrator struct {
+	db          *sql.DB
+	locker      *Locker
+	definitions map[string]*SagaDefinition
+}
+
+//NewSagaOrchestrator can be used to create an orchestrator for the given
+// saga definitions, the saga and journal tables are stored in db
+func NewSagaOrchestrator(db *sql.DB, definitions ...*SagaDefinition) *SagaOrchestrator {
+	o := &SagaOrchestrator{
+		db:          db,
+		locker:      NewLocker(db),
+		definitions: make(map[string]*SagaDefinition),
+	}
+	for _, definition := range definitions {
+		o.definitions[definition.Name] = definition
+	}
+	return o
+}
+
+//sagaSelect returns a query to select the columns of a saga with the
+// given where clause
+func sagaSelect(where string) string {
+	return fmt.Sprintf(`SELECT uuid, name, state, step, data, error, version
+		FROM %s WHERE %s`, tableSaga, where)
+}
+
+//sagaScan can be used to scan a row selected with sagaSelect
+func sagaScan(row interface {
+	Scan(dest ...interface{}) error
+}) (*Saga, error) {
+	var data []byte
+
+	saga := &Saga{}
+	if err := row.Scan(&saga.ID, &saga.Name, &saga.State, &saga.Step,
+		&data, &saga.Error, &saga.Version); err != nil {
+		return nil, err
+	}
+	saga.Data = data
+	return saga, nil
+}
+
+//SagaRead can be used to read the state of a given saga
+func SagaRead(db Queryer, sagaID string) (*Saga, error) {
+	saga, err := sagaScan(db.QueryRow(sagaSelect("uuid=?"), sagaID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorf("saga with id, \"%s\", not found locally", sagaID)
+		}
+		return nil, err
+	}
+	return saga, nil
+}
+
+//SagasIncomplete can be used to read the sagas that are running or
+// compensating, some of them may be in progress rather than interrupted
+func SagasIncomplete(db Queryer) ([]*Saga, error) {
+	var sagas []*Saga
+
+	rows, err := db.Query(sagaSelect("state IN (?, ?) ORDER BY id"), SagaRunning, SagaCompensating)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		saga, err := sagaScan(rows)
+		if err != nil {
+			return nil, err
+		}
+		sagas = append(sagas, saga)
+	}
+	return sagas, rows.Err()
+}
+
+//SagaJournalRead can be used to read the journal of a saga in the order
+// it was written
+func SagaJournalRead(db Queryer, sagaID string) ([]*SagaJournalEntry, error) {
+	var entries []*SagaJournalEntry
+
+	query := fmt.Sprintf(`SELECT j.id, j.step, j.step_name, j.phase, j.state, j.error, FLOOR(UNIX_TIMESTAMP(j.created_at))
+		FROM %s j JOIN %s s ON j.saga_id=s.id WHERE s.uuid=? ORDER BY j.id`, tableSagaJournal, tableSaga)
+	rows, err := db.Query(query, sagaID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		entry := &SagaJournalEntry{}
+		if err := rows.Scan(&entry.ID, &entry.Step, &entry.StepName, &entry.Phase,
+			&entry.State, &entry.Error, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+//sagaStarted will read the journal of the saga to find the steps whose
+// action has been started
+func sagaStarted(db Queryer, sagaID string) (map[int]bool, error) {
+	entries, err := SagaJournalRead(db, sagaID)
+	if err != nil {
+		return nil, err
+	}
+	started := make(map[int]bool)
+	for _, entry := range entries {
+		if entry.Phase == SagaPhaseAction && entry.State == SagaStepStarted {
+			started[entry.Step] = true
+		}
+	}
+	return started, nil
+}
+
+//sagaJournalWrite will append an entry to the journal of the saga
+func sagaJournalWrite(db Queryer, saga *Saga, entry *SagaJournalEntry) error {
+	query := fmt.Sprintf(`INSERT INTO %s (saga_id, step, step_name, phase, state, error)
+		SELECT id, ?, ?, ?, ?, ? FROM %s WHERE uuid=?`, tableSagaJournal, tableSaga)
+	result, err := db.Exec(query, entry.Step, entry.StepName, entry.Phase, entry.State,
+		entry.Error, saga.ID)
+	if err != nil {
+		return err
+	}
+	return RowsAffected(result, "no rows affected, non-existent saga")
+}
+
+//sagaWrite will write the state of the saga along with an entry in its
+// journal (if provided) within a single transaction, it will return an error
+// if the saga isn't at the expected version (e.g., if it's being resumed by
+// more than one orchestrator)
+func sagaWrite(db Queryer, saga *Saga, entry *SagaJournalEntry) error {
+	tx, err := txBegin(db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if entry != nil {
+		if err := sagaJournalWrite(tx, saga, entry); err != nil {
+			return err
+		}
+	}
+	query := fmt.Sprintf(`UPDATE %s SET state=?, step=?, data=?, error=?, version=version+1
+		WHERE uuid=? AND version=?`, tableSaga)
+	result, err := tx.Exec(query, saga.State, saga.Step, []byte(saga.Data), saga.Error, saga.ID, saga.Version)
+	if err != nil {
+		return err
+	}
+	if err := RowsAffected(result, "no rows affected, version mismatch or non-existent saga"); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	saga.Version++
+	return nil
+}
+
+//sagaNew returns a new saga with the given data, it isn't recorded
+func (o *SagaOrchestrator) sagaNew(name string, data interface{}) (*Saga, error) {
+	if _, ok := o.definitions[name]; !ok {
+		return nil, errors.Errorf("unsupported saga: \"%s\"", name)
+	}
+	saga := &Saga{
+		ID:      GenerateID(),
+		Name:    name,
+		State:   SagaRunning,
+		Version: 1,
+	}
+	if err := saga.DataWrite(data); err != nil {
+		return nil, err
+	}
+	return saga, nil
+}
+
+//sagaCreate will durably record a new saga
+func (o *SagaOrchestrator) sagaCreate(ctx context.Context, saga *Saga) error {
+	query := fmt.Sprintf(`INSERT INTO %s (uuid, name, state, step, data, version)
+		VALUES (?, ?, ?, ?, ?, ?)`, tableSaga)
+	_, err := o.db.ExecContext(ctx, query, saga.ID, saga.Name, saga.State,
+		saga.Step, []byte(saga.Data), saga.Version)
+	return err
+}
+
+//lock will acquire the lock of the saga itself without waiting and the lock
+// of its definition (if it has one) waiting up to timeout, the returned
+// function releases them
+func (o *SagaOrchestrator) lock(ctx context.Context, saga *Saga, timeout time.Duration) (func(), error) {
+	definition, ok := o.definitions[saga.Name]
+	if !ok {
+		return nil, errors.Errorf("unsupported saga: \"%s\"", saga.Name)
+	}
+	lockSaga, err := o.locker.Lock(ctx, LockSaga(saga.ID), 0)
+	if err != nil {
+		return nil, err
+	}
+	if definition.Lock == nil {
+		return func() { lockSaga.Release(context.Background()) }, nil
+	}
+	name, err := definition.Lock(saga)
+	if err != nil {
+		lockSaga.Release(context.Background())
+		return nil, err
+	}
+	lock, err := o.locker.Lock(ctx, name, timeout)
+	if err != nil {
+		lockSaga.Release(context.Background())
+		return nil, err
+	}
+	return func() {
+		lock.Release(context.Background())
+		lockSaga.Release(context.Background())
+	}, nil
+}
+
+//Start will durably record a new saga with the given data without executing
+// it, the saga will be executed by Resume
+func (o *SagaOrchestrator) Start(ctx context.Context, name string, data interface{}) (*Saga, error) {
+	saga, err := o.sagaNew(name, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.sagaCreate(ctx, saga); err != nil {
+		return nil, err
+	}
+	return saga, nil
+}
+
+//Execute will durably record a new saga and execute it, if a step fails, the
+// steps that were started are compensated in reverse order and the error is
+// returned along with the compensated saga; if a compensation fails, the saga
+// is left compensating (to be resumed) and that error is returned instead; if
+// the saga has a lock that can't be acquired, the saga isn't recorded and
+// ErrLockNotAcquired is returned
+func (o *SagaOrchestrator) Execute(ctx context.Context, name string, data interface{}) (*Saga, error) {
+	saga, err := o.sagaNew(name, data)
+	if err != nil {
+		return nil, err
+	}
+	//KIM: the locks are acquired before the saga is recorded, so Resume can
+	// never mistake a saga that's just been created for one that was
+	// interrupted
+	release, err := o.lock(ctx, saga, defaultSagaLockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if err := o.sagaCreate(ctx, saga); err != nil {
+		return nil, err
+	}
+	return saga, o.run(ctx, saga, make(map[int]bool))
+}
+
+//Resume will continue every saga that's in progress (e.g., after a crash),
+// compensating sagas continue compensating and running sagas are rolled
+// forward or compensated according to their definition; sagas whose lock is
+// held (i.e., they're being run by another orchestrator) are skipped; it
+// returns the resumed sagas and the first error encountered
+func (o *SagaOrchestrator) Resume(ctx context.Context) ([]*Saga, error) {
+	var resumed []*Saga
+	var errResume error
+
+	sagas, err := SagasIncomplete(o.db)
+	if err != nil {
+		return nil, err
+	}
+	for _, saga := range sagas {
+		sagaResumed, err := o.resume(ctx, saga)
+		if sagaResumed != nil {
+			resumed = append(resumed, sagaResumed)
+		}
+		if err != nil && errResume == nil {
+			errResume = errors.Wrapf(err, "saga with id, \"%s\"", saga.ID)
+		}
+	}
+	return resumed, errResume
+}
+
+//resume will run a single saga if its locks can be acquired without waiting,
+// the saga is read again once the locks are acquired since it may have been
+// run to completion in the meantime; if the saga isn't resumed, nil is
+// returned
+func (o *SagaOrchestrator) resume(ctx context.Context, saga *Saga) (*Saga, error) {
+	release, err := o.lock(ctx, saga, 0)
+	if err != nil {
+		if errors.Cause(err) == ErrLockNotAcquired {
+			return nil, nil
+		}
+		return saga, err
+	}
+	defer release()
+	if saga, err = SagaRead(o.db, saga.ID); err != nil {
+		return nil, err
+	}
+	if saga.State != SagaRunning && saga.State != SagaCompensating {
+		return nil, nil
+	}
+	started, err := sagaStarted(o.db, saga.ID)
+	if err != nil {
+		return saga, err
+	}
+	if saga.State == SagaRunning && o.definitions[saga.Name].Recovery == SagaRecoverCompensate {
+		saga.State, saga.Error = SagaCompensating, "recovered: interrupted while running"
+		if err := sagaWrite(o.db, saga, nil); err != nil {
+			return saga, err
+		}
+	}
+	return saga, o.run(ctx, saga, started)
+}
+
+//run will execute the remaining steps of the saga, each step is journaled
+// before it's executed and the outcome is journaled (along with the state of
+// the saga) once it's executed, so a crash only repeats the step in progress;
+// started holds the steps whose action has been started
+func (o *SagaOrchestrator) run(ctx context.Context, saga *Saga, started map[int]bool) error {
+	definition, ok := o.definitions[saga.Name]
+	if !ok {
+		return errors.Errorf("unsupported saga: \"%s\"", saga.Name)
+	}
+	for saga.State == SagaRunning {
+		if saga.Step >= len(definition.Steps) {
+			saga.State = SagaCompleted
+			return sagaWrite(o.db, saga, nil)
+		}
+		step := definition.Steps[saga.Step]
+		entry := &SagaJournalEntry{
+			Step:     saga.Step,
+			StepName: step.Name,
+			Phase:    SagaPhaseAction,
+			State:    SagaStepStarted,
+		}
+		if err := sagaJournalWrite(o.db, saga, entry); err != nil {
+			return err
+		}
+		started[saga.Step] = true
+		entry.State = SagaStepCompleted
+		if err := step.Action(ctx, saga); err != nil {
+			//KIM: the step that failed may have partially completed, so
+			// compensation starts with the step that failed; this is safe
+			// since compensations are idempotent
+			entry.State, entry.Error = SagaStepFailed, err.Error()
+			saga.State, saga.Error = SagaCompensating, fmt.Sprintf("%s: %s", step.Name, err)
+		} else {
+			saga.Step++
+		}
+		if err := sagaWrite(o.db, saga, entry); err != nil {
+			return err
+		}
+	}
+	for saga.State == SagaCompensating {
+		if saga.Step < 0 {
+			saga.State = SagaCompensated
+			if err := sagaWrite(o.db, saga, nil); err != nil {
+				return err
+			}
+			return errors.Errorf("saga compensated, %s", saga.Error)
+		}
+		//KIM: a saga interrupted after its last step (but before it was
+		// completed) starts compensating with its last step
+		if saga.Step >= len(definition.Steps) {
+			saga.Step = len(definition.Steps) - 1
+		}
+		var entry *SagaJournalEntry
+		step := definition.Steps[saga.Step]
+		//KIM: steps whose action was never started (according to the journal)
+		// have nothing to compensate
+		if step.Compensate != nil && started[saga.Step] {
+			entry = &SagaJournalEntry{
+				Step:     saga.Step,
+				StepName: step.Name,
+				Phase:    SagaPhaseCompensate,
+				State:    SagaStepStarted,
+			}
+			if err := sagaJournalWrite(o.db, saga, entry); err != nil {
+				return err
+			}
+			if err := step.Compensate(ctx, saga); err != nil {
+				entry.State, entry.Error = SagaStepFailed, err.Error()
+				if errJournal := sagaJournalWrite(o.db, saga, entry); errJournal != nil {
+					return errors.Wrap(err, errJournal.Error())
+				}
+				return errors.Wrapf(err, "unable to compensate %s", step.Name)
+			}
+			entry.State = SagaStepCompleted
+		}
+		saga.Step--
+		if err := sagaWrite(o.db, saga, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//sagaTimers is implemented by the data of the sagas that change the timers
+// of an employee, the timers are recorded before they're changed such that
+// the later steps (and their compensations) use the recorded timers rather
+// than reading them again
+type sagaTimers interface {
+	//timersOf returns the employee whose timers are changed and (optionally)
+	// which of its timers are changed
+	timersOf() (employeeID string, timerIDs []string)
+	//timersTo returns the employee the timers are reassigned to
+	timersTo() string
+	//timersRecorded returns the recorded timers
+	timersRecorded() *[]*Timer
+}
+
+//EmployeeDeleteSagaData is the data for the employee delete saga, the timers
+// of the employee are recorded before they're changed so that they can be
+// compensated
+type EmployeeDeleteSagaData struct {
+	EmployeeID  string   `json:"employee_id"`
+	TimerPolicy string   `json:"timer_policy"`
+	Timers      []*Timer `json:"timers,omitempty"`
+}
+
+//timersOf returns the employee being deleted, all of its timers are recorded
+func (d *EmployeeDeleteSagaData) timersOf() (string, []string) {
+	return d.EmployeeID, nil
+}
+
+func (d *EmployeeDeleteSagaData) timersTo() string {
+	return ""
+}
+
+func (d *EmployeeDeleteSagaData) timersRecorded() *[]*Timer {
+	return &d.Timers
+}
+
+//EmployeeMergeSagaData is the data for the employee merge saga, the timers
+// of the duplicate are recorded before they're reassigned to the survivor
+type EmployeeMergeSagaData struct {
+	SurvivorID  string      `json:"survivor_id"`
+	DuplicateID string      `json:"duplicate_id"`
+	Rules       *MergeRules `json:"rules,omitempty"`
+	Timers      []*Timer    `json:"timers,omitempty"`
+}
+
+//timersOf returns the duplicate, all of its timers are reassigned
+func (d *EmployeeMergeSagaData) timersOf() (string, []string) {
+	return d.DuplicateID, nil
+}
+
+func (d *EmployeeMergeSagaData) timersTo() string {
+	return d.SurvivorID
+}
+
+func (d *EmployeeMergeSagaData) timersRecorded() *[]*Timer {
+	return &d.Timers
+}
+
+//TimersReassignSagaData is the data for the bulk reassign saga, if timer
+// ids aren't provided, all of the timers of from are reassigned
+type TimersReassignSagaData struct {
+	FromEmployeeID string   `json:"from_employee_id"`
+	ToEmployeeID   string   `json:"to_employee_id"`
+	TimerIDs       []string `json:"timer_ids,omitempty"`
+	Timers         []*Timer `json:"timers,omitempty"`
+}
+
+//timersOf returns the employee the timers are reassigned from
+func (d *TimersReassignSagaData) timersOf() (string, []string) {
+	return d.FromEmployeeID, d.TimerIDs
+}
+
+func (d *TimersReassignSagaData) timersTo() string {
+	return d.ToEmployeeID
+}
+
+func (d *TimersReassignSagaData) timersRecorded() *[]*Timer {
+	return &d.Timers
+}
+
+//SagaEmployeeStore is the store the sagas change employees with, in addition
+// to EmployeeStore, it can mark an employee as pending delete and delete an
+// employee on behalf of an actor (the saga)
+type SagaEmployeeStore interface {
+	EmployeeStore
+	EmployeePendingDelete(employeeID string, pendingDelete bool) error
+	EmployeeDeleteBy(employee *Employee, actor string) error
+}
+
+//SagaEmployeeMerger is implemented by employee stores that can merge two
+// employees, the merge saga is only available for those stores
+type SagaEmployeeMerger interface {
+	SagaEmployeeStore
+	EmployeeMerge(survivorID string, survivorVersion int, duplicateID string, duplicateVersion int, rules *MergeRules) (*Employee, error)
+}
+
+//SagaTimerStore is the store the sagas change timers with, in addition to
+// TimerStore, it can read the timers of an employee, complete (or un-complete)
+// a timer and restore a deleted timer
+type SagaTimerStore interface {
+	TimerStore
+	TimersRead(employeeID string) ([]*Timer, error)
+	TimerComplete(timerID string, finish int64, completed bool) error
+	TimerRestore(timer *Timer) error
+}
+
+//sagaTimersSnapshot returns a step that records the timers of an employee
+// in the data of the saga as they were before they're changed; data returns
+// an empty value of the saga's data
+func sagaTimersSnapshot(timers SagaTimerStore, data func() sagaTimers) *SagaStep {
+	return &SagaStep{
+		Name: "snapshot-timers",
+		Action: func(ctx context.Context, saga *Saga) error {
+			d := data()
+			if err := saga.DataRead(d); err != nil {
+				return err
+			}
+			//KIM: the timers are recorded in their own step, so the snapshot
+			// is durable before any timer is changed; if the process crashes
+			// while they're being changed, the compensation still knows
+			// about the timers that have already been changed
+			employeeID, timerIDs := d.timersOf()
+			recorded, err := sagaTimersRead(timers, employeeID, timerIDs)
+			if err != nil {
+				return err
+			}
+			*d.timersRecorded() = recorded
+			return saga.DataWrite(d)
+		},
+	}
+}
+
+//sagaTimersReassignStep returns a step that reassigns the recorded timers to
+// the target employee, it's compensated by reassigning each timer that's still
+// assigned to the target back to the employee it was recorded with
+func sagaTimersReassignStep(timers SagaTimerStore, data func() sagaTimers) *SagaStep {
+	return &SagaStep{
+		Name: "reassign-timers",
+		Action: func(ctx context.Context, saga *Saga) error {
+			d := data()
+			if err := saga.DataRead(d); err != nil {
+				return err
+			}
+			return timersReassign(timers, *d.timersRecorded(), d.timersTo())
+		},
+		Compensate: func(ctx context.Context, saga *Saga) error {
+			d := data()
+			if err := saga.DataRead(d); err != nil {
+				return err
+			}
+			for _, timer := range *d.timersRecorded() {
+				//KIM: only the timers this step reassigned are put back, a timer
+				// that's been reassigned by someone else since is left alone
+				current, err := sagaTimerRead(timers, timer.ID)
+				if err != nil {
+					return err
+				}
+				if current == nil || current.EmployeeID != d.timersTo() {
+					continue
+				}
+				if _, err := timers.TimerReassign(timer.ID, current.Version, timer.EmployeeID); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+}
+
+//EmployeeDeleteSaga returns the definition of the saga that deletes an employee
+// stored in employees and its timers stored in timers (which may be stored in
+// the same database or by different services); the employee is marked as pending
+// delete (such that timers can't be created for or assigned to it), then its
+// timers are recorded and deleted (cascade) or stopped (orphan) and finally the
+// employee is deleted; timers can only be orphaned if they aren't stored with
+// the employees; if it's interrupted, it's rolled forward
+func EmployeeDeleteSaga(employees SagaEmployeeStore, timers SagaTimerStore) *SagaDefinition {
+	data := func() sagaTimers { return &EmployeeDeleteSagaData{} }
+	return &SagaDefinition{
+		Name:     SagaEmployeeDelete,
+		Recovery: SagaRecoverRollForward,
+		Lock: func(saga *Saga) (string, error) {
+			data := &EmployeeDeleteSagaData{}
+			if err := saga.DataRead(data); err != nil {
+				return "", err
+			}
+			return LockEmployee(data.EmployeeID), nil
+		},
+		Steps: []*SagaStep{
+			{
+				Name: "mark-pending-delete",
+				Action: func(ctx context.Context, saga *Saga) error {
+					data := &EmployeeDeleteSagaData{}
+					if err := saga.DataRead(data); err != nil {
+						return err
+					}
+					//KIM: if the timers reference the employee table (i.e., they
+					// share a database), the foreign key would prevent the employee
+					// from being deleted once its timers are orphaned
+					if _, shared := timers.(*sharedTimerStore); shared && data.TimerPolicy == SagaTimersOrphan {
+						return errors.New("timers can only be orphaned if they aren't stored with the employees")
+					}
+					return employees.EmployeePendingDelete(data.EmployeeID, true)
+				},
+				Compensate: func(ctx context.Context, saga *Saga) error {
+					data := &EmployeeDeleteSagaData{}
+					if err := saga.DataRead(data); err != nil {
+						return err
+					}
+					return employees.EmployeePendingDelete(data.EmployeeID, false)
+				},
+			},
+			sagaTimersSnapshot(timers, data),
+			{
+				Name: "timers",
+				Action: func(ctx context.Context, saga *Saga) error {
+					data := &EmployeeDeleteSagaData{}
+					if err := saga.DataRead(data); err != nil {
+						return err
+					}
+					return sagaTimersRemove(timers, data)
+				},
+				Compensate: func(ctx context.Context, saga *Saga) error {
+					data := &EmployeeDeleteSagaData{}
+					if err := saga.DataRead(data); err != nil {
+						return err
+					}
+					return sagaTimersRestore(timers, data)
+				},
+			},
+			{
+				Name: "finalize",
+				Action: func(ctx context.Context, saga *Saga) error {
+					data := &EmployeeDeleteSagaData{}
+					if err := saga.DataRead(data); err != nil {
+						return err
+					}
+					//KIM: the employee is only matched by its uuid, so there's no
+					// email address to normalize
+					return employees.EmployeeDeleteBy(&Employee{ID: data.EmployeeID}, "saga:"+saga.ID)
+				},
+			},
+		},
+	}
+}
+
+//EmployeeMergeSaga returns the definition of the saga that merges a duplicate
+// employee stored in employees into a survivor, the duplicate's timers stored in
+// timers are reassigned one at a time before the employees are merged; if it's
+// interrupted, it's rolled forward
+func EmployeeMergeSaga(employees SagaEmployeeMerger, timers SagaTimerStore) *SagaDefinition {
+	data := func() sagaTimers { return &EmployeeMergeSagaData{} }
+	return &SagaDefinition{
+		Name:     SagaEmployeeMerge,
+		Recovery: SagaRecoverRollForward,
+		Steps: []*SagaStep{
+			sagaTimersSnapshot(timers, data),
+			sagaTimersReassignStep(timers, data),
+			{
+				Name: "merge",
+				Action: func(ctx context.Context, saga *Saga) error {
+					data := &EmployeeMergeSagaData{}
+					if err := saga.DataRead(data); err != nil {
+						return err
+					}
+					survivor, err := employees.EmployeeRead(data.SurvivorID)
+					if err != nil {
+						return err
+					}
+					//KIM: once merged, reading the duplicate resolves to the survivor
+					duplicate, err := employees.EmployeeRead(data.DuplicateID)
+					if err != nil {
+						return err
+					}
+					if duplicate.ID == survivor.ID {
+						return nil
+					}
+					_, err = employees.EmployeeMerge(survivor.ID, survivor.Version, duplicate.ID,
+						duplicate.Version, data.Rules)
+					return err
+				},
+			},
+		},
+	}
+}
+
+//TimersReassignSaga returns the definition of the saga that reassigns timers
+// (stored in timers) from one employee to another in bulk; if it's interrupted,
+// it's compensated (the timers reassigned so far are put back)
+func TimersReassignSaga(timers SagaTimerStore) *SagaDefinition {
+	data := func() sagaTimers { return &TimersReassignSagaData{} }
+	return &SagaDefinition{
+		Name:     SagaTimersReassign,
+		Recovery: SagaRecoverCompensate,
+		Steps: []*SagaStep{
+			sagaTimersSnapshot(timers, data),
+			sagaTimersReassignStep(timers, data),
+		},
+	}
+}
+
+//Sagas returns the definitions of every saga for the given employee and
+// timer stores, the merge saga is only included if employees can merge
+func Sagas(employees SagaEmployeeStore, timers SagaTimerStore) []*SagaDefinition {
+	definitions := []*SagaDefinition{
+		EmployeeDeleteSaga(employees, timers),
+		TimersReassignSaga(timers),
+	}
+	if merger, ok := employees.(SagaEmployeeMerger); ok {
+		definitions = append(definitions, EmployeeMergeSaga(merger, timers))
+	}
+	return definitions
+}
+
+//EmployeePendingDelete will mark (or unmark) the employee as pending delete,
+// it's idempotent: if the employee is already in the given state (or doesn't
+// exist when unmarking) nothing is done; an employee with an active
+// reservation can't be marked
+func EmployeePendingDelete(db Queryer, employeeUUID string, pendingDelete bool) error {
+	var current bool
+
+	tx, err := txBegin(db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := employeesEventSourced(tx, employeeUUID); err != nil {
+		return err
+	}
+	query := fmt.Sprintf("SELECT pending_delete FROM %s WHERE uuid=? FOR UPDATE", tableEmployee)
+	switch err := tx.QueryRow(query, idArg(employeeUUID)).Scan(&current); {
+	case err == sql.ErrNoRows:
+		//KIM: the employee has to exist to be marked, but it may have been
+		// deleted by the time a compensation is executed
+		if pendingDelete {
+			return errors.Errorf("employee with id, \"%s\", not found locally", employeeUUID)
+		}
+		return nil
+	case err != nil:
+		return err
+	}
+	if current == pendingDelete {
+		return nil
+	}
+	//KIM: the employee is locked, so a reservation can't be placed until this
+	// transaction commits; checking the reservations here (rather than only
+	// when the employee is deleted) fails the saga before any timer is changed
+	if pendingDelete {
+		if err := employeesReserved(tx, employeeUUID); err != nil {
+			return err
+		}
+	}
+	query = fmt.Sprintf("UPDATE %s SET pending_delete=?, version=version+1 WHERE uuid=?", tableEmployee)
+	if _, err := tx.Exec(query, pendingDelete, idArg(employeeUUID)); err != nil {
+		return err
+	}
+	employee, err := employeeScan(tx.QueryRow(employeeSelect("uuid=?"), idArg(employeeUUID)))
+	if err != nil {
+		return err
+	}
+	if err := outboxWrite(tx, tableEmployee, employee.ID, employee.Version, ChangeUpdated, employee); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+//sagaTimersRead will read the timers of the given employee, if timer ids
+// are provided, only those timers are read
+func sagaTimersRead(timers SagaTimerStore, employeeID string, timerIDs []string) ([]*Timer, error) {
+	var recorded []*Timer
+
+	include := make(map[string]bool)
+	for _, timerID := range timerIDs {
+		include[timerID] = true
+	}
+	read, err := timers.TimersRead(employeeID)
+	if err != nil {
+		return nil, err
+	}
+	for _, timer := range read {
+		if len(include) == 0 || include[timer.ID] {
+			recorded = append(recorded, timer)
+		}
+	}
+	return recorded, nil
+}
+
+//sagaTimerRead will read a timer, if it doesn't exist, nil is returned
+func sagaTimerRead(timers SagaTimerStore, timerID string) (*Timer, error) {
+	timer, err := timers.TimerRead(timerID)
+	if err != nil {
+		//KIM: the stores (and the timer service) only describe a missing
+		// timer with the message of the error
+		if strings.Contains(err.Error(), "not found") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return timer, nil
+}
+
+//timersReassign will reassign the recorded timers to the given employee,
+// timers that are already assigned to the employee are skipped; if a timer has
+// been assigned to someone else since it was recorded, it fails
+func timersReassign(timers SagaTimerStore, recorded []*Timer, employeeID string) error {
+	for _, timer := range recorded {
+		current, err := sagaTimerRead(timers, timer.ID)
+		switch {
+		case err != nil:
+			return err
+		case current == nil, current.EmployeeID == employeeID:
+			continue
+		case current.EmployeeID != timer.EmployeeID:
+			return errors.Errorf("timer with id, \"%s\", was reassigned to \"%s\"", timer.ID, current.EmployeeID)
+		}
+		if _, err := timers.TimerReassign(timer.ID, current.Version, employeeID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//sagaTimersRemove will delete (cascade) or stop (orphan) the recorded timers
+// of the employee being deleted; since timers already deleted or stopped are
+// left as is, it's idempotent
+func sagaTimersRemove(timers SagaTimerStore, data *EmployeeDeleteSagaData) error {
+	switch data.TimerPolicy {
+	default:
+		return errors.Errorf("unsupported timer policy: \"%s\"", data.TimerPolicy)
+	case SagaTimersCascade, "":
+		for _, timer := range data.Timers {
+			if err := timers.TimerDelete(timer.ID); err != nil {
+				return err
+			}
+		}
+	case SagaTimersOrphan:
+		//KIM: orphaned timers are stopped so they don't keep running for an
+		// employee that no longer exists
+		for _, timer := range data.Timers {
+			if timer.Completed {
+				continue
+			}
+			if err := timers.TimerComplete(timer.ID, time.Now().UnixNano(), true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//sagaTimersRestore will re-create the recorded timers that were deleted
+// (cascade) or restart the recorded timers that were stopped (orphan), timers
+// that already exist (or are already running) are left as is
+func sagaTimersRestore(timers SagaTimerStore, data *EmployeeDeleteSagaData) error {
+	for _, timer := range data.Timers {
+		switch data.TimerPolicy {
+		case SagaTimersCascade, "":
+			if err := timers.TimerRestore(timer); err != nil {
+				return err
+			}
+		case SagaTimersOrphan:
+			if timer.Completed {
+				continue
+			}
+			if err := timers.TimerComplete(timer.ID, timer.Finish, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
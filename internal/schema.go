@@ -0,0 +1,658 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+//these are the different kinds of schema violations
+const (
+	SchemaViolationMissing string = "missing"
+	SchemaViolationAltered string = "altered"
+)
+
+//SchemaViolation describes a single difference between the schema
+// the code depends on and the schema that's actually deployed
+type SchemaViolation struct {
+	Table    string `json:"table"`
+	Object   string `json:"object"`
+	Kind     string `json:"kind"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual,omitempty"`
+}
+
+func (s SchemaViolation) String() string {
+	if s.Actual == "" {
+		return fmt.Sprintf("%s.%s is %s, expected %s", s.Table, s.Object, s.Kind, s.Expected)
+	}
+	return fmt.Sprintf("%s.%s is %s, expected %s, found %s", s.Table, s.Object, s.Kind, s.Expected, s.Actual)
+}
+
+type schemaColumn struct {
+	name          string
+	dataTypes     []string
+	nullable      bool
+	columnDefault string //empty means the default isn't checked
+	id            bool   //if ids are stored as binary, the column must be binary
+}
+
+type schemaUnique struct {
+	columns   []string
+	minPrefix int //zero means no prefix is allowed
+}
+
+type schemaForeignKey struct {
+	column           string
+	referencedTable  string
+	referencedColumn string
+	deleteRules      []string
+}
+
+type schemaTable struct {
+	name        string
+	engine      string
+	columns     []schemaColumn
+	uniques     []schemaUnique
+	foreignKeys []schemaForeignKey
+}
+
+type schemaIndex struct {
+	unique    bool
+	columns   []string
+	subParts  []sql.NullInt64
+	tableName string
+}
+
+//KIM: this only describes the parts of the schema that the upsert
+// and version-check semantics depend on, it's not a full description
+// of each table
+var schemaExpected = []schemaTable{
+	{
+		name:   tableEmployee,
+		engine: "InnoDB",
+		columns: []schemaColumn{
+			{name: "id", dataTypes: []string{"bigint"}},
+			{name: "uuid", dataTypes: []string{"text", "tinytext", "varchar", "char"}, id: true},
+			{name: "email_address", dataTypes: []string{"text", "tinytext", "varchar"}},
+			{name: "email_address_normalized", dataTypes: []string{"varchar"}},
+			{name: "pending_delete", dataTypes: []string{"tinyint"}},
+			{name: "version", dataTypes: []string{"int", "bigint"}, columnDefault: "1"},
+		},
+		uniques: []schemaUnique{
+			{columns: []string{"uuid"}, minPrefix: 36},
+			{columns: []string{"email_address"}},
+			{columns: []string{"email_address_normalized"}},
+		},
+	},
+	{
+		name:   tableTimer,
+		engine: "InnoDB",
+		columns: []schemaColumn{
+			{name: "id", dataTypes: []string{"bigint"}},
+			{name: "uuid", dataTypes: []string{"text", "tinytext", "varchar", "char"}, id: true},
+			{name: "version", dataTypes: []string{"int", "bigint"}, columnDefault: "1"},
+			{name: "employee_id", dataTypes: []string{"bigint"}},
+		},
+		uniques: []schemaUnique{
+			{columns: []string{"uuid"}, minPrefix: 36},
+		},
+		foreignKeys: []schemaForeignKey{
+			{
+				column:           "employee_id",
+				referencedTable:  tableEmployee,
+				referencedColumn: "id",
+				deleteRules:      []string{"RESTRICT", "NO ACTION"},
+			},
+		},
+	},
+	{
+		name:   tableTimerHistory,
+		engine: "InnoDB",
+		columns: []schemaColumn{
+			{name: "timer_id", dataTypes: []string{"bigint"}},
+			{name: "version", dataTypes: []string{"int", "bigint"}},
+		},
+		uniques: []schemaUnique{
+			{columns: []string{"timer_id", "version"}},
+		},
+		foreignKeys: []schemaForeignKey{
+			{
+				column:           "timer_id",
+				referencedTable:  tableTimer,
+				referencedColumn: "id",
+				deleteRules:      []string{"CASCADE"},
+			},
+		},
+	},
+	{
+		name:   tableEmployeeRedirect,
+		engine: "InnoDB",
+		columns: []schemaColumn{
+			{name: "uuid", dataTypes: []string{"varchar", "char"}},
+			{name: "employee_id", dataTypes: []string{"bigint"}},
+		},
+		uniques: []schemaUnique{
+			{columns: []string{"uuid"}},
+		},
+		foreignKeys: []schemaForeignKey{
+			{
+				column:           "employee_id",
+				referencedTable:  tableEmployee,
+				referencedColumn: "id",
+				deleteRules:      []string{"CASCADE"},
+			},
+		},
+	},
+	{
+		name:   tableEmployeeDirectory,
+		engine: "InnoDB",
+		columns: []schemaColumn{
+			{name: "email_address_normalized", dataTypes: []string{"varchar"}},
+			{name: "uuid", dataTypes: []string{"varchar", "char"}},
+			{name: "shard", dataTypes: []string{"int", "bigint"}},
+		},
+		uniques: []schemaUnique{
+			{columns: []string{"email_address_normalized"}},
+		},
+	},
+	{
+		name:   tableOutbox,
+		engine: "InnoDB",
+		columns: []schemaColumn{
+			{name: "id", dataTypes: []string{"bigint"}},
+			{name: "sequence", dataTypes: []string{"bigint"}},
+			{name: "entity_uuid", dataTypes: []string{"varchar", "char"}},
+			{name: "version", dataTypes: []string{"int", "bigint"}},
+			{name: "delivered_at", dataTypes: []string{"timestamp", "datetime"}, nullable: true},
+		},
+		uniques: []schemaUnique{
+			{columns: []string{"sequence"}},
+		},
+	},
+	{
+		name:   tableChangeSequence,
+		engine: "InnoDB",
+		columns: []schemaColumn{
+			{name: "id", dataTypes: []string{"int", "bigint"}},
+			{name: "sequence", dataTypes: []string{"bigint"}},
+		},
+	},
+	{
+		name:   tableEmployeeEvent,
+		engine: "InnoDB",
+		columns: []schemaColumn{
+			{name: "id", dataTypes: []string{"bigint"}},
+			{name: "stream_uuid", dataTypes: []string{"varchar", "char"}},
+			{name: "stream_version", dataTypes: []string{"int", "bigint"}},
+			{name: "event_type", dataTypes: []string{"varchar"}},
+		},
+		uniques: []schemaUnique{
+			{columns: []string{"stream_uuid", "stream_version"}},
+		},
+	},
+	{
+		name:   tableSaga,
+		engine: "InnoDB",
+		columns: []schemaColumn{
+			{name: "id", dataTypes: []string{"bigint"}},
+			{name: "uuid", dataTypes: []string{"varchar", "char"}},
+			{name: "state", dataTypes: []string{"varchar"}},
+			{name: "step", dataTypes: []string{"int"}},
+			{name: "version", dataTypes: []string{"int", "bigint"}},
+		},
+		uniques: []schemaUnique{
+			{columns: []string{"uuid"}},
+		},
+	},
+	{
+		name:   tableSagaJournal,
+		engine: "InnoDB",
+		columns: []schemaColumn{
+			{name: "saga_id", dataTypes: []string{"bigint"}},
+			{name: "step", dataTypes: []string{"int"}},
+			{name: "created_at", dataTypes: []string{"timestamp", "datetime"}},
+		},
+		foreignKeys: []schemaForeignKey{
+			{
+				column:           "saga_id",
+				referencedTable:  tableSaga,
+				referencedColumn: "id",
+				deleteRules:      []string{"CASCADE"},
+			},
+		},
+	},
+	{
+		name:   tableEmployeeTombstone,
+		engine: "InnoDB",
+		columns: []schemaColumn{
+			{name: "uuid", dataTypes: []string{"varchar", "char"}},
+			{name: "deleted_at", dataTypes: []string{"timestamp", "datetime"}},
+			{name: "deleted_by", dataTypes: []string{"varchar"}},
+		},
+		uniques: []schemaUnique{
+			{columns: []string{"uuid"}},
+		},
+	},
+	{
+		name:   tableWebhookSubscription,
+		engine: "InnoDB",
+		columns: []schemaColumn{
+			{name: "id", dataTypes: []string{"bigint"}},
+			{name: "uuid", dataTypes: []string{"varchar", "char"}},
+		},
+		uniques: []schemaUnique{
+			{columns: []string{"uuid"}},
+		},
+	},
+	{
+		name:   tableWebhookDelivery,
+		engine: "InnoDB",
+		columns: []schemaColumn{
+			{name: "subscription_id", dataTypes: []string{"bigint"}},
+			{name: "sequence", dataTypes: []string{"bigint"}},
+			{name: "next_attempt_at", dataTypes: []string{"timestamp", "datetime"}},
+			{name: "delivered_at", dataTypes: []string{"timestamp", "datetime"}, nullable: true},
+			{name: "dead_at", dataTypes: []string{"timestamp", "datetime"}, nullable: true},
+			{name: "claim", dataTypes: []string{"varchar"}},
+		},
+		uniques: []schemaUnique{
+			{columns: []string{"subscription_id", "sequence"}},
+		},
+		foreignKeys: []schemaForeignKey{
+			{
+				column:           "subscription_id",
+				referencedTable:  tableWebhookSubscription,
+				referencedColumn: "id",
+				deleteRules:      []string{"CASCADE"},
+			},
+		},
+	},
+	{
+		name:   tableLease,
+		engine: "InnoDB",
+		columns: []schemaColumn{
+			{name: "name", dataTypes: []string{"varchar", "char"}},
+			{name: "token", dataTypes: []string{"bigint"}},
+			{name: "expires_at", dataTypes: []string{"timestamp", "datetime"}},
+			{name: "version", dataTypes: []string{"int", "bigint"}, columnDefault: "1"},
+		},
+	},
+	{
+		name:   tableWebhookDeadLetter,
+		engine: "InnoDB",
+		columns: []schemaColumn{
+			{name: "subscription_id", dataTypes: []string{"bigint"}},
+			{name: "sequence", dataTypes: []string{"bigint"}},
+		},
+		foreignKeys: []schemaForeignKey{
+			{
+				column:           "subscription_id",
+				referencedTable:  tableWebhookSubscription,
+				referencedColumn: "id",
+				deleteRules:      []string{"CASCADE"},
+			},
+		},
+	},
+	{
+		name:   tableXADecision,
+		engine: "InnoDB",
+		columns: []schemaColumn{
+			{name: "gtrid", dataTypes: []string{"varchar", "char"}},
+			{name: "state", dataTypes: []string{"varchar", "char"}},
+			{name: "created_at", dataTypes: []string{"timestamp", "datetime"}},
+		},
+		uniques: []schemaUnique{
+			{columns: []string{"gtrid"}},
+		},
+	},
+	{
+		name:   tableEmployeeReservation,
+		engine: "InnoDB",
+		columns: []schemaColumn{
+			{name: "uuid", dataTypes: []string{"varchar", "char"}},
+			{name: "employee_uuid", dataTypes: []string{"varchar", "char"}},
+			{name: "state", dataTypes: []string{"varchar", "char"}},
+			{name: "expires_at", dataTypes: []string{"timestamp", "datetime"}},
+		},
+		uniques: []schemaUnique{
+			{columns: []string{"uuid"}},
+		},
+	},
+}
+
+//SchemaVerify can be used to compare the constraints, indexes, engines and
+// column types within information_schema against what the code depends on,
+// it'll return a violation for everything that's missing or altered
+func SchemaVerify(db interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}, database string) ([]SchemaViolation, error) {
+
+	var violations []SchemaViolation
+
+	engines, err := schemaEngines(db, database)
+	if err != nil {
+		return nil, err
+	}
+	columns, err := schemaColumns(db, database)
+	if err != nil {
+		return nil, err
+	}
+	indexes, err := schemaIndexes(db, database)
+	if err != nil {
+		return nil, err
+	}
+	foreignKeys, err := schemaForeignKeys(db, database)
+	if err != nil {
+		return nil, err
+	}
+	for _, table := range schemaExpected {
+		engine, ok := engines[table.name]
+		if !ok {
+			violations = append(violations, SchemaViolation{
+				Table:    table.name,
+				Object:   "table",
+				Kind:     SchemaViolationMissing,
+				Expected: "table with engine " + table.engine,
+			})
+			continue
+		}
+		if !strings.EqualFold(engine, table.engine) {
+			violations = append(violations, SchemaViolation{
+				Table:    table.name,
+				Object:   "engine",
+				Kind:     SchemaViolationAltered,
+				Expected: table.engine,
+				Actual:   engine,
+			})
+		}
+		violations = append(violations, schemaVerifyColumns(table, columns[table.name])...)
+		violations = append(violations, schemaVerifyUniques(table, indexes)...)
+		violations = append(violations, schemaVerifyForeignKeys(table, foreignKeys[table.name])...)
+	}
+	return violations, nil
+}
+
+func schemaVerifyColumns(table schemaTable, columns map[string]schemaColumn) []SchemaViolation {
+	var violations []SchemaViolation
+
+	for _, expected := range table.columns {
+		if expected.id && IDGeneration.Binary {
+			expected.dataTypes = []string{"binary"}
+		}
+		actual, ok := columns[expected.name]
+		if !ok {
+			violations = append(violations, SchemaViolation{
+				Table:    table.name,
+				Object:   expected.name,
+				Kind:     SchemaViolationMissing,
+				Expected: "column of type " + strings.Join(expected.dataTypes, "|"),
+			})
+			continue
+		}
+		if !stringsContain(expected.dataTypes, actual.dataTypes[0]) {
+			violations = append(violations, SchemaViolation{
+				Table:    table.name,
+				Object:   expected.name,
+				Kind:     SchemaViolationAltered,
+				Expected: "type " + strings.Join(expected.dataTypes, "|"),
+				Actual:   "type " + actual.dataTypes[0],
+			})
+		}
+		if actual.nullable && !expected.nullable {
+			violations = append(violations, SchemaViolation{
+				Table:    table.name,
+				Object:   expected.name,
+				Kind:     SchemaViolationAltered,
+				Expected: "NOT NULL",
+				Actual:   "NULL",
+			})
+		}
+		if expected.columnDefault != "" && strings.Trim(actual.columnDefault, "'") != expected.columnDefault {
+			violations = append(violations, SchemaViolation{
+				Table:    table.name,
+				Object:   expected.name,
+				Kind:     SchemaViolationAltered,
+				Expected: "DEFAULT " + expected.columnDefault,
+				Actual:   "DEFAULT " + actual.columnDefault,
+			})
+		}
+	}
+	return violations
+}
+
+func schemaVerifyUniques(table schemaTable, indexes map[string]*schemaIndex) []SchemaViolation {
+	var violations []SchemaViolation
+
+	for _, expected := range table.uniques {
+		var found, foundNonUnique *schemaIndex
+
+		object := "UNIQUE(" + strings.Join(expected.columns, ", ") + ")"
+		for _, index := range indexes {
+			if index.tableName != table.name || !stringsEqual(index.columns, expected.columns) {
+				continue
+			}
+			if !index.unique {
+				foundNonUnique = index
+				continue
+			}
+			found = index
+			break
+		}
+		switch {
+		case found == nil && foundNonUnique != nil:
+			violations = append(violations, SchemaViolation{
+				Table:    table.name,
+				Object:   object,
+				Kind:     SchemaViolationAltered,
+				Expected: "unique index",
+				Actual:   "non-unique index",
+			})
+			continue
+		case found == nil:
+			violations = append(violations, SchemaViolation{
+				Table:    table.name,
+				Object:   object,
+				Kind:     SchemaViolationMissing,
+				Expected: "unique index",
+			})
+			continue
+		}
+		for i, subPart := range found.subParts {
+			if !subPart.Valid {
+				continue
+			}
+			if expected.minPrefix == 0 || subPart.Int64 < int64(expected.minPrefix) {
+				violations = append(violations, SchemaViolation{
+					Table:    table.name,
+					Object:   object,
+					Kind:     SchemaViolationAltered,
+					Expected: fmt.Sprintf("unique on at least %d characters of %s", expected.minPrefix, found.columns[i]),
+					Actual:   fmt.Sprintf("unique on a prefix of %d characters", subPart.Int64),
+				})
+			}
+		}
+	}
+	return violations
+}
+
+func schemaVerifyForeignKeys(table schemaTable, foreignKeys []schemaForeignKey) []SchemaViolation {
+	var violations []SchemaViolation
+
+	for _, expected := range table.foreignKeys {
+		var found *schemaForeignKey
+
+		object := fmt.Sprintf("FOREIGN KEY(%s)", expected.column)
+		reference := fmt.Sprintf("%s(%s)", expected.referencedTable, expected.referencedColumn)
+		for i := range foreignKeys {
+			if foreignKeys[i].column == expected.column {
+				found = &foreignKeys[i]
+				break
+			}
+		}
+		if found == nil {
+			violations = append(violations, SchemaViolation{
+				Table:    table.name,
+				Object:   object,
+				Kind:     SchemaViolationMissing,
+				Expected: "REFERENCES " + reference,
+			})
+			continue
+		}
+		if actual := fmt.Sprintf("%s(%s)", found.referencedTable, found.referencedColumn); actual != reference {
+			violations = append(violations, SchemaViolation{
+				Table:    table.name,
+				Object:   object,
+				Kind:     SchemaViolationAltered,
+				Expected: "REFERENCES " + reference,
+				Actual:   "REFERENCES " + actual,
+			})
+		}
+		if !stringsContain(expected.deleteRules, found.deleteRules[0]) {
+			violations = append(violations, SchemaViolation{
+				Table:    table.name,
+				Object:   object,
+				Kind:     SchemaViolationAltered,
+				Expected: "ON DELETE " + strings.Join(expected.deleteRules, "|"),
+				Actual:   "ON DELETE " + found.deleteRules[0],
+			})
+		}
+	}
+	return violations
+}
+
+func schemaEngines(db interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}, database string) (map[string]string, error) {
+
+	rows, err := db.Query(`SELECT TABLE_NAME, COALESCE(ENGINE, '') FROM information_schema.TABLES
+		WHERE TABLE_SCHEMA=?`, database)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	engines := make(map[string]string)
+	for rows.Next() {
+		var tableName, engine string
+
+		if err := rows.Scan(&tableName, &engine); err != nil {
+			return nil, err
+		}
+		engines[tableName] = engine
+	}
+	return engines, rows.Err()
+}
+
+func schemaColumns(db interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}, database string) (map[string]map[string]schemaColumn, error) {
+
+	rows, err := db.Query(`SELECT TABLE_NAME, COLUMN_NAME, DATA_TYPE, IS_NULLABLE, COALESCE(COLUMN_DEFAULT, '')
+		FROM information_schema.COLUMNS WHERE TABLE_SCHEMA=?`, database)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := make(map[string]map[string]schemaColumn)
+	for rows.Next() {
+		var tableName, columnName, dataType, isNullable, columnDefault string
+
+		if err := rows.Scan(&tableName, &columnName, &dataType, &isNullable, &columnDefault); err != nil {
+			return nil, err
+		}
+		if _, ok := columns[tableName]; !ok {
+			columns[tableName] = make(map[string]schemaColumn)
+		}
+		columns[tableName][columnName] = schemaColumn{
+			name:          columnName,
+			dataTypes:     []string{strings.ToLower(dataType)},
+			nullable:      isNullable == "YES",
+			columnDefault: columnDefault,
+		}
+	}
+	return columns, rows.Err()
+}
+
+func schemaIndexes(db interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}, database string) (map[string]*schemaIndex, error) {
+
+	rows, err := db.Query(`SELECT TABLE_NAME, INDEX_NAME, NON_UNIQUE, COLUMN_NAME, SUB_PART
+		FROM information_schema.STATISTICS WHERE TABLE_SCHEMA=?
+		ORDER BY TABLE_NAME, INDEX_NAME, SEQ_IN_INDEX`, database)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	indexes := make(map[string]*schemaIndex)
+	for rows.Next() {
+		var tableName, indexName, columnName string
+		var nonUnique int
+		var subPart sql.NullInt64
+
+		if err := rows.Scan(&tableName, &indexName, &nonUnique, &columnName, &subPart); err != nil {
+			return nil, err
+		}
+		key := tableName + "." + indexName
+		index, ok := indexes[key]
+		if !ok {
+			index = &schemaIndex{
+				tableName: tableName,
+				unique:    nonUnique == 0,
+			}
+			indexes[key] = index
+		}
+		index.columns = append(index.columns, columnName)
+		index.subParts = append(index.subParts, subPart)
+	}
+	return indexes, rows.Err()
+}
+
+func schemaForeignKeys(db interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}, database string) (map[string][]schemaForeignKey, error) {
+
+	rows, err := db.Query(`SELECT k.TABLE_NAME, k.COLUMN_NAME, k.REFERENCED_TABLE_NAME, k.REFERENCED_COLUMN_NAME, r.DELETE_RULE
+		FROM information_schema.KEY_COLUMN_USAGE k
+		JOIN information_schema.REFERENTIAL_CONSTRAINTS r
+			ON r.CONSTRAINT_SCHEMA=k.CONSTRAINT_SCHEMA AND r.CONSTRAINT_NAME=k.CONSTRAINT_NAME AND r.TABLE_NAME=k.TABLE_NAME
+		WHERE k.TABLE_SCHEMA=? AND k.REFERENCED_TABLE_NAME IS NOT NULL`, database)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	foreignKeys := make(map[string][]schemaForeignKey)
+	for rows.Next() {
+		var tableName, deleteRule string
+		var foreignKey schemaForeignKey
+
+		if err := rows.Scan(&tableName, &foreignKey.column, &foreignKey.referencedTable,
+			&foreignKey.referencedColumn, &deleteRule); err != nil {
+			return nil, err
+		}
+		foreignKey.deleteRules = []string{deleteRule}
+		foreignKeys[tableName] = append(foreignKeys[tableName], foreignKey)
+	}
+	return foreignKeys, rows.Err()
+}
+
+func stringsContain(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
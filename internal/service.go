@@ -0,0 +1,606 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//these are the routes of the employee and timer services
+const (
+	routeEmployees     string = "/employees"
+	routeTimers        string = "/timers"
+	routeTimerEmployee string = "/employee"
+
+	routeEmployeeReservations  string = "/reservations"
+	routeEmployeePendingDelete string = "/pending-delete"
+	routeTimerCompleted        string = "/completed"
+	routeTimerRestore          string = "/restore"
+)
+
+//defaultHTTPTimeout is the timeout of the clients if an http client
+// isn't provided
+const defaultHTTPTimeout time.Duration = 10 * time.Second
+
+//httpError is the body of every unsuccessful response, if the error is
+// an EmployeeDeletedError, its tombstone is included so the clients can
+// return the same error
+type httpError struct {
+	Error     string             `json:"error"`
+	Tombstone *EmployeeTombstone `json:"tombstone,omitempty"`
+}
+
+//httpStatusError is returned by the clients when the service responds
+// with an error, the message is the error returned by the service
+type httpStatusError struct {
+	status  int
+	message string
+}
+
+func (h *httpStatusError) Error() string {
+	return h.message
+}
+
+//employeeReserveRequest is the body of a request to reserve an employee
+type employeeReserveRequest struct {
+	ID  string        `json:"id"`
+	TTL time.Duration `json:"ttl"`
+}
+
+//employeePendingDeleteRequest is the body of a request to mark (or unmark)
+// an employee as pending delete
+type employeePendingDeleteRequest struct {
+	PendingDelete bool `json:"pending_delete"`
+}
+
+//timerReassignRequest is the body of a request to reassign a timer
+type timerReassignRequest struct {
+	EmployeeID string `json:"employee_id"`
+	Version    int    `json:"version"`
+}
+
+//timerCompleteRequest is the body of a request to complete (or un-complete)
+// a timer
+type timerCompleteRequest struct {
+	Finish    int64 `json:"finish"`
+	Completed bool  `json:"completed"`
+}
+
+//httpStatus returns the status code for the given error, other than a
+// deleted employee, the errors aren't typed, so the status is determined
+// from the message
+func httpStatus(err error) int {
+	switch message := err.Error(); {
+	default:
+		return http.StatusInternalServerError
+	case IsEmployeeDeleted(err):
+		return http.StatusGone
+	case errors.Is(err, ErrEmployeeReserved), errors.Is(err, ErrReservationExpired),
+		errors.Is(err, ErrEmployeeEventSourced):
+		return http.StatusConflict
+	case strings.Contains(message, "not found"):
+		return http.StatusNotFound
+	case strings.Contains(message, "version mismatch"):
+		return http.StatusConflict
+	}
+}
+
+//httpWrite will write the given item as JSON, if err is non-nil,
+// the error is written instead
+func httpWrite(writer http.ResponseWriter, status int, item interface{}, err error) {
+	if err != nil {
+		var errDeleted *EmployeeDeletedError
+
+		if status == http.StatusOK || status == http.StatusNoContent {
+			status = httpStatus(err)
+		}
+		errHTTP := &httpError{Error: err.Error()}
+		if errors.As(err, &errDeleted) {
+			errHTTP.Tombstone = &errDeleted.EmployeeTombstone
+		}
+		item = errHTTP
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	if item != nil {
+		json.NewEncoder(writer).Encode(item)
+	}
+}
+
+//httpID returns the id following the given prefix (e.g., /employees/{id}),
+// and whatever follows the id
+func httpID(path, prefix string) (id, rest string) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, prefix), "/")
+	if i := strings.Index(path, "/"); i >= 0 {
+		return path[:i], path[i:]
+	}
+	return path, ""
+}
+
+//EmployeeService exposes an employee store over HTTP, it's one half of
+// split mode (the timer service being the other)
+type EmployeeService struct {
+	store EmployeeStore
+}
+
+//NewEmployeeService can be used to create an employee service for the
+// given store
+func NewEmployeeService(store EmployeeStore) *EmployeeService {
+	return &EmployeeService{store: store}
+}
+
+//ServeHTTP will route the request to the employee store:
+//  POST /employees (create), GET /employees/{id} (read),
+//  PUT /employees/{id} (write), DELETE /employees[/{id}] (delete)
+// if the store can reserve employees (e.g., it's stored locally):
+//  POST /employees/{id}/reservations (try), PUT /employees/{id}/reservations/{id} (confirm),
+//  DELETE /employees/{id}/reservations/{id} (cancel)
+// if the store can be used by the sagas (e.g., it's stored locally):
+//  PUT /employees/{id}/pending-delete (mark), DELETE /employees/{id}?actor= (delete by)
+func (e *EmployeeService) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	employeeID, rest := httpID(request.URL.Path, routeEmployees)
+	if employeeID != "" && strings.HasPrefix(rest, routeEmployeeReservations) {
+		e.serveReservations(writer, request, employeeID, rest)
+		return
+	}
+	store, saga := e.store.(SagaEmployeeStore)
+	switch {
+	default:
+		httpWrite(writer, http.StatusMethodNotAllowed, nil,
+			errors.Errorf("unsupported method: %s", request.Method))
+	case request.Method == http.MethodPost && employeeID == "":
+		employee := &Employee{}
+		if err := json.NewDecoder(request.Body).Decode(employee); err != nil {
+			httpWrite(writer, http.StatusBadRequest, nil, err)
+			return
+		}
+		employee, err := e.store.EmployeeCreate(employee)
+		httpWrite(writer, http.StatusOK, employee, err)
+	case request.Method == http.MethodGet && employeeID != "":
+		employee, err := e.store.EmployeeRead(employeeID)
+		httpWrite(writer, http.StatusOK, employee, err)
+	case request.Method == http.MethodPut && employeeID != "" && rest == routeEmployeePendingDelete:
+		if !saga {
+			httpWrite(writer, http.StatusMethodNotAllowed, nil, errors.New("employees can't be marked as pending delete"))
+			return
+		}
+		pendingDelete := &employeePendingDeleteRequest{}
+		if err := json.NewDecoder(request.Body).Decode(pendingDelete); err != nil {
+			httpWrite(writer, http.StatusBadRequest, nil, err)
+			return
+		}
+		err := store.EmployeePendingDelete(employeeID, pendingDelete.PendingDelete)
+		httpWrite(writer, http.StatusNoContent, nil, err)
+	case request.Method == http.MethodPut && employeeID != "":
+		employee := &Employee{}
+		if err := json.NewDecoder(request.Body).Decode(employee); err != nil {
+			httpWrite(writer, http.StatusBadRequest, nil, err)
+			return
+		}
+		employee.ID = employeeID
+		employee, err := e.store.EmployeeWrite(employee)
+		httpWrite(writer, http.StatusOK, employee, err)
+	case request.Method == http.MethodDelete:
+		var employee *Employee
+
+		if employeeID != "" {
+			employee = &Employee{
+				ID:           employeeID,
+				EmailAddress: request.URL.Query().Get("email_address"),
+			}
+		}
+		if actor := request.URL.Query().Get("actor"); actor != "" && employee != nil {
+			if !saga {
+				httpWrite(writer, http.StatusMethodNotAllowed, nil, errors.New("employees can't be deleted by an actor"))
+				return
+			}
+			err := store.EmployeeDeleteBy(employee, actor)
+			httpWrite(writer, http.StatusNoContent, nil, err)
+			return
+		}
+		err := e.store.EmployeeDelete(employee)
+		httpWrite(writer, http.StatusNoContent, nil, err)
+	}
+}
+
+//serveReservations will route a request for the reservations of an employee
+// to the store, if it can reserve employees
+func (e *EmployeeService) serveReservations(writer http.ResponseWriter, request *http.Request, employeeID, rest string) {
+	reserver, ok := e.store.(EmployeeReserver)
+	if !ok {
+		httpWrite(writer, http.StatusMethodNotAllowed, nil, errors.New("employees can't be reserved"))
+		return
+	}
+	reservationID, _ := httpID(rest, routeEmployeeReservations)
+	switch {
+	default:
+		httpWrite(writer, http.StatusMethodNotAllowed, nil,
+			errors.Errorf("unsupported method: %s", request.Method))
+	case request.Method == http.MethodPost && reservationID == "":
+		reserve := &employeeReserveRequest{}
+		if err := json.NewDecoder(request.Body).Decode(reserve); err != nil {
+			httpWrite(writer, http.StatusBadRequest, nil, err)
+			return
+		}
+		reservation, err := reserver.EmployeeReserve(employeeID, reserve.ID, reserve.TTL)
+		httpWrite(writer, http.StatusOK, reservation, err)
+	case request.Method == http.MethodPut && reservationID != "":
+		reservation, err := reserver.ReservationConfirm(employeeID, reservationID)
+		httpWrite(writer, http.StatusOK, reservation, err)
+	case request.Method == http.MethodDelete && reservationID != "":
+		reservation, err := reserver.ReservationCancel(employeeID, reservationID)
+		httpWrite(writer, http.StatusOK, reservation, err)
+	}
+}
+
+//TimerService exposes a timer store over HTTP, it's one half of split
+// mode (the employee service being the other)
+type TimerService struct {
+	store TimerStore
+}
+
+//NewTimerService can be used to create a timer service for the given
+// store, if the store can read the timers of an employee (e.g., the
+// SplitTimerStore), they can be listed
+func NewTimerService(store TimerStore) *TimerService {
+	return &TimerService{store: store}
+}
+
+//ServeHTTP will route the request to the timer store:
+//  POST /timers (create), GET /timers/{id} (read), GET /timers?employee_id= (list),
+//  PUT /timers/{id} (write), PUT /timers/{id}/employee (reassign),
+//  DELETE /timers[/{id}] (delete)
+// if the store can be used by the sagas (e.g., the SplitTimerStore):
+//  PUT /timers/{id}/completed (complete), POST /timers/{id}/restore (restore)
+func (t *TimerService) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	timerID, rest := httpID(request.URL.Path, routeTimers)
+	store, saga := t.store.(SagaTimerStore)
+	switch {
+	default:
+		httpWrite(writer, http.StatusMethodNotAllowed, nil,
+			errors.Errorf("unsupported method: %s", request.Method))
+	case request.Method == http.MethodPost && timerID == "":
+		timer := &Timer{}
+		if err := json.NewDecoder(request.Body).Decode(timer); err != nil {
+			httpWrite(writer, http.StatusBadRequest, nil, err)
+			return
+		}
+		timer, err := t.store.TimerCreate(timer)
+		httpWrite(writer, http.StatusOK, timer, err)
+	case request.Method == http.MethodPost && timerID != "" && rest == routeTimerRestore:
+		if !saga {
+			httpWrite(writer, http.StatusMethodNotAllowed, nil, errors.New("timers can't be restored"))
+			return
+		}
+		timer := &Timer{}
+		if err := json.NewDecoder(request.Body).Decode(timer); err != nil {
+			httpWrite(writer, http.StatusBadRequest, nil, err)
+			return
+		}
+		timer.ID = timerID
+		err := store.TimerRestore(timer)
+		httpWrite(writer, http.StatusNoContent, nil, err)
+	case request.Method == http.MethodPut && timerID != "" && rest == routeTimerCompleted:
+		if !saga {
+			httpWrite(writer, http.StatusMethodNotAllowed, nil, errors.New("timers can't be completed"))
+			return
+		}
+		complete := &timerCompleteRequest{}
+		if err := json.NewDecoder(request.Body).Decode(complete); err != nil {
+			httpWrite(writer, http.StatusBadRequest, nil, err)
+			return
+		}
+		err := store.TimerComplete(timerID, complete.Finish, complete.Completed)
+		httpWrite(writer, http.StatusNoContent, nil, err)
+	case request.Method == http.MethodGet && timerID == "":
+		store, ok := t.store.(interface {
+			TimersRead(employeeID string) ([]*Timer, error)
+		})
+		if !ok {
+			httpWrite(writer, http.StatusMethodNotAllowed, nil, errors.New("timers can't be listed"))
+			return
+		}
+		timers, err := store.TimersRead(request.URL.Query().Get("employee_id"))
+		if timers == nil {
+			timers = []*Timer{}
+		}
+		httpWrite(writer, http.StatusOK, timers, err)
+	case request.Method == http.MethodGet:
+		timer, err := t.store.TimerRead(timerID)
+		httpWrite(writer, http.StatusOK, timer, err)
+	case request.Method == http.MethodPut && timerID != "" && rest == routeTimerEmployee:
+		reassign := &timerReassignRequest{}
+		if err := json.NewDecoder(request.Body).Decode(reassign); err != nil {
+			httpWrite(writer, http.StatusBadRequest, nil, err)
+			return
+		}
+		timer, err := t.store.TimerReassign(timerID, reassign.Version, reassign.EmployeeID)
+		httpWrite(writer, http.StatusOK, timer, err)
+	case request.Method == http.MethodPut && timerID != "" && rest == "":
+		timer := &Timer{}
+		if err := json.NewDecoder(request.Body).Decode(timer); err != nil {
+			httpWrite(writer, http.StatusBadRequest, nil, err)
+			return
+		}
+		timer.ID = timerID
+		timer, err := t.store.TimerWrite(timer)
+		httpWrite(writer, http.StatusOK, timer, err)
+	case request.Method == http.MethodDelete:
+		err := t.store.TimerDelete(timerID)
+		httpWrite(writer, http.StatusNoContent, nil, err)
+	}
+}
+
+//httpClient is the common implementation of the employee and timer
+// clients, it sends JSON and decodes either the item or the error
+type httpClient struct {
+	address string
+	client  *http.Client
+}
+
+func newHTTPClient(address string, client *http.Client) httpClient {
+	if client == nil {
+		client = &http.Client{Timeout: defaultHTTPTimeout}
+	}
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	return httpClient{
+		address: strings.TrimSuffix(address, "/"),
+		client:  client,
+	}
+}
+
+//do will send the request with item as its body (if non-nil) and decode
+// the response into response (if non-nil)
+func (h *httpClient) do(method, path string, item, response interface{}) error {
+	var body io.Reader
+
+	if item != nil {
+		data, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	request, err := http.NewRequest(method, h.address+path, body)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	resp, err := h.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		errResponse := &httpError{}
+		if err := json.NewDecoder(resp.Body).Decode(errResponse); err != nil || errResponse.Error == "" {
+			return errors.Errorf("unexpected status code: %d", resp.StatusCode)
+		}
+		if resp.StatusCode == http.StatusGone && errResponse.Tombstone != nil {
+			return &EmployeeDeletedError{*errResponse.Tombstone}
+		}
+		return &httpStatusError{status: resp.StatusCode, message: errResponse.Error}
+	}
+	if response == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+//EmployeeClient can be used to access an employee service, it implements
+// EmployeeStore so it can be used wherever an employee store is used
+type EmployeeClient struct {
+	httpClient
+}
+
+//NewEmployeeClient can be used to create a client for the employee service
+// at the given address (e.g., localhost:8080), if client is nil, a client
+// with a default timeout is used
+func NewEmployeeClient(address string, client *http.Client) *EmployeeClient {
+	return &EmployeeClient{newHTTPClient(address, client)}
+}
+
+//EmployeeCreate can be used to create (or upsert) an employee
+func (e *EmployeeClient) EmployeeCreate(employee *Employee) (*Employee, error) {
+	if employee == nil {
+		return nil, errors.New("employee is nil")
+	}
+	employeeCreated := &Employee{}
+	if err := e.do(http.MethodPost, routeEmployees, employee, employeeCreated); err != nil {
+		return nil, err
+	}
+	return employeeCreated, nil
+}
+
+//EmployeeWrite can be used to mutate an existing employee
+func (e *EmployeeClient) EmployeeWrite(employee *Employee) (*Employee, error) {
+	if employee == nil {
+		return nil, errors.New("employee is nil")
+	}
+	employeeWritten := &Employee{}
+	if err := e.do(http.MethodPut, routeEmployees+"/"+url.PathEscape(employee.ID),
+		employee, employeeWritten); err != nil {
+		return nil, err
+	}
+	return employeeWritten, nil
+}
+
+//EmployeeDelete can be used to delete a specific employee or all employees
+func (e *EmployeeClient) EmployeeDelete(employee *Employee) error {
+	if employee == nil {
+		return e.do(http.MethodDelete, routeEmployees, nil, nil)
+	}
+	path := routeEmployees + "/" + url.PathEscape(employee.ID)
+	if employee.EmailAddress != "" {
+		path += "?email_address=" + url.QueryEscape(employee.EmailAddress)
+	}
+	return e.do(http.MethodDelete, path, nil, nil)
+}
+
+//EmployeeRead can be used to read a given employee
+func (e *EmployeeClient) EmployeeRead(employeeID string) (*Employee, error) {
+	employee := &Employee{}
+	if err := e.do(http.MethodGet, routeEmployees+"/"+url.PathEscape(employeeID), nil, employee); err != nil {
+		return nil, err
+	}
+	return employee, nil
+}
+
+//EmployeePendingDelete can be used to mark (or unmark) an employee as
+// pending delete
+func (e *EmployeeClient) EmployeePendingDelete(employeeID string, pendingDelete bool) error {
+	return e.do(http.MethodPut, routeEmployees+"/"+url.PathEscape(employeeID)+routeEmployeePendingDelete,
+		&employeePendingDeleteRequest{PendingDelete: pendingDelete}, nil)
+}
+
+//EmployeeDeleteBy can be used to delete a specific employee on behalf of
+// the given actor
+func (e *EmployeeClient) EmployeeDeleteBy(employee *Employee, actor string) error {
+	if employee == nil {
+		return errors.New("employee is nil")
+	}
+	path := routeEmployees + "/" + url.PathEscape(employee.ID) + "?actor=" + url.QueryEscape(actor)
+	if employee.EmailAddress != "" {
+		path += "&email_address=" + url.QueryEscape(employee.EmailAddress)
+	}
+	return e.do(http.MethodDelete, path, nil, nil)
+}
+
+//employeeReservationsPath returns the path of the reservations of an employee
+// (or of a specific reservation)
+func employeeReservationsPath(employeeID, reservationID string) string {
+	path := routeEmployees + "/" + url.PathEscape(employeeID) + routeEmployeeReservations
+	if reservationID != "" {
+		path += "/" + url.PathEscape(reservationID)
+	}
+	return path
+}
+
+//EmployeeReserve can be used to reserve an employee for up to ttl
+func (e *EmployeeClient) EmployeeReserve(employeeID, reservationID string, ttl time.Duration) (*EmployeeReservation, error) {
+	reservation := &EmployeeReservation{}
+	if err := e.do(http.MethodPost, employeeReservationsPath(employeeID, ""),
+		&employeeReserveRequest{ID: reservationID, TTL: ttl}, reservation); err != nil {
+		return nil, err
+	}
+	return reservation, nil
+}
+
+//ReservationConfirm can be used to confirm the reservation of an employee
+func (e *EmployeeClient) ReservationConfirm(employeeID, reservationID string) (*EmployeeReservation, error) {
+	reservation := &EmployeeReservation{}
+	if err := e.do(http.MethodPut, employeeReservationsPath(employeeID, reservationID), nil, reservation); err != nil {
+		return nil, err
+	}
+	return reservation, nil
+}
+
+//ReservationCancel can be used to cancel the reservation of an employee
+func (e *EmployeeClient) ReservationCancel(employeeID, reservationID string) (*EmployeeReservation, error) {
+	reservation := &EmployeeReservation{}
+	if err := e.do(http.MethodDelete, employeeReservationsPath(employeeID, reservationID), nil, reservation); err != nil {
+		return nil, err
+	}
+	return reservation, nil
+}
+
+//TimerClient can be used to access a timer service, it implements
+// TimerStore so it can be used wherever a timer store is used
+type TimerClient struct {
+	httpClient
+}
+
+//NewTimerClient can be used to create a client for the timer service
+// at the given address (e.g., localhost:8081), if client is nil, a client
+// with a default timeout is used
+func NewTimerClient(address string, client *http.Client) *TimerClient {
+	return &TimerClient{newHTTPClient(address, client)}
+}
+
+//TimerCreate can be used to create a timer
+func (t *TimerClient) TimerCreate(timer *Timer) (*Timer, error) {
+	if timer == nil {
+		return nil, errors.New("timer is nil")
+	}
+	timerCreated := &Timer{}
+	if err := t.do(http.MethodPost, routeTimers, timer, timerCreated); err != nil {
+		return nil, err
+	}
+	return timerCreated, nil
+}
+
+//TimerRead can be used to read a given timer
+func (t *TimerClient) TimerRead(timerID string) (*Timer, error) {
+	timer := &Timer{}
+	if err := t.do(http.MethodGet, routeTimers+"/"+url.PathEscape(timerID), nil, timer); err != nil {
+		return nil, err
+	}
+	return timer, nil
+}
+
+//TimersRead can be used to read the timers of a given employee (or all
+// timers if employeeID is empty)
+func (t *TimerClient) TimersRead(employeeID string) ([]*Timer, error) {
+	var timers []*Timer
+
+	path := fmt.Sprintf("%s?employee_id=%s", routeTimers, url.QueryEscape(employeeID))
+	if err := t.do(http.MethodGet, path, nil, &timers); err != nil {
+		return nil, err
+	}
+	return timers, nil
+}
+
+//TimerWrite can be used to mutate an existing timer
+func (t *TimerClient) TimerWrite(timer *Timer) (*Timer, error) {
+	if timer == nil {
+		return nil, errors.New("timer is nil")
+	}
+	timerWritten := &Timer{}
+	if err := t.do(http.MethodPut, routeTimers+"/"+url.PathEscape(timer.ID), timer, timerWritten); err != nil {
+		return nil, err
+	}
+	return timerWritten, nil
+}
+
+//TimerReassign can be used to assign an existing timer to a different employee
+func (t *TimerClient) TimerReassign(timerID string, timerVersion int, employeeID string) (*Timer, error) {
+	timer := &Timer{}
+	if err := t.do(http.MethodPut, routeTimers+"/"+url.PathEscape(timerID)+routeTimerEmployee,
+		&timerReassignRequest{EmployeeID: employeeID, Version: timerVersion}, timer); err != nil {
+		return nil, err
+	}
+	return timer, nil
+}
+
+//TimerDelete can be used to delete one or all timers
+func (t *TimerClient) TimerDelete(timerID string) error {
+	path := routeTimers
+	if timerID != "" {
+		path += "/" + url.PathEscape(timerID)
+	}
+	return t.do(http.MethodDelete, path, nil, nil)
+}
+
+//TimerComplete can be used to complete (or un-complete) a timer with the
+// given finish
+func (t *TimerClient) TimerComplete(timerID string, finish int64, completed bool) error {
+	return t.do(http.MethodPut, routeTimers+"/"+url.PathEscape(timerID)+routeTimerCompleted,
+		&timerCompleteRequest{Finish: finish, Completed: completed}, nil)
+}
+
+//TimerRestore can be used to re-create a deleted timer as it was
+func (t *TimerClient) TimerRestore(timer *Timer) error {
+	if timer == nil {
+		return errors.New("timer is nil")
+	}
+	return t.do(http.MethodPost, routeTimers+"/"+url.PathEscape(timer.ID)+routeTimerRestore, timer, nil)
+}
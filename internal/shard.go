@@ -0,0 +1,353 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+//ShardedStore can be used to spread employees across multiple databases, each
+// employee (and all of its timers) is stored on the shard chosen by a stable
+// hash of its uuid such that operations for a single employee are single shard
+// transactions that keep the foreign key guarantees; since a unique index can't
+// span databases, email addresses are claimed in a global directory table
+type ShardedStore struct {
+	directory *sql.DB
+	shards    []*sql.DB
+	email     EmailOptions
+}
+
+//NewShardedStore can be used to create a sharded store, the directory holds
+// the email to shard directory, if no shards are provided, the directory is
+// also used as the only shard; email addresses are normalized with options
+func NewShardedStore(directory *sql.DB, options EmailOptions, shards ...*sql.DB) *ShardedStore {
+	if len(shards) == 0 {
+		shards = []*sql.DB{directory}
+	}
+	return &ShardedStore{
+		directory: directory,
+		shards:    shards,
+		email:     options,
+	}
+}
+
+//InitializeShardedStore can be used to create a sharded store using the
+// primary (for the directory) and shards described by the configuration
+func InitializeShardedStore(config *Configuration) (*ShardedStore, error) {
+	var shards []*sql.DB
+
+	directory, err := Initialize(config)
+	if err != nil {
+		return nil, err
+	}
+	for _, shardConfig := range config.ShardConfigs() {
+		shard, err := Initialize(shardConfig)
+		if err != nil {
+			directory.Close()
+			for _, shard := range shards {
+				shard.Close()
+			}
+			return nil, err
+		}
+		shards = append(shards, shard)
+	}
+	return NewShardedStore(directory, config.EmailOptions(), shards...), nil
+}
+
+//Close will close the directory and all shards
+func (s *ShardedStore) Close() error {
+	err := s.directory.Close()
+	for _, shard := range s.shards {
+		if shard == s.directory {
+			continue
+		}
+		if errClose := shard.Close(); errClose != nil && err == nil {
+			err = errClose
+		}
+	}
+	return err
+}
+
+//ShardFor returns the index of the shard for the given employee uuid out
+// of n shards, the hash is stable so the same uuid always maps to the same
+// shard as long as the number of shards doesn't change
+func ShardFor(employeeID string, n int) int {
+	if n <= 1 {
+		return 0
+	}
+	return int(crc32.ChecksumIEEE([]byte(strings.ToLower(employeeID))) % uint32(n))
+}
+
+//Shard returns the database for the given employee uuid
+func (s *ShardedStore) Shard(employeeID string) *sql.DB {
+	return s.shards[ShardFor(employeeID, len(s.shards))]
+}
+
+//WithShard can be used to execute fn within a unit of work on the shard of
+// the given employee, it can be used to compose operations for one employee
+// (and its timers) within a single transaction
+func (s *ShardedStore) WithShard(ctx context.Context, employeeID string, fn func(tx Tx) error) error {
+	return WithTx(ctx, s.Shard(employeeID), fn)
+}
+
+//directoryClaim will attempt to claim the normalized email address for the
+// given uuid; it returns the uuid that owns the claim and whether or not this
+// call created the claim
+func (s *ShardedStore) directoryClaim(employeeID, emailAddressNormalized string) (string, bool, error) {
+	var owner string
+
+	query := fmt.Sprintf(`INSERT IGNORE INTO %s (email_address_normalized, uuid, shard)
+		VALUES (?, ?, ?)`, tableEmployeeDirectory)
+	result, err := s.directory.Exec(query, emailAddressNormalized, employeeID, ShardFor(employeeID, len(s.shards)))
+	if err != nil {
+		return "", false, err
+	}
+	n, _ := result.RowsAffected()
+	query = fmt.Sprintf("SELECT uuid FROM %s WHERE email_address_normalized=?", tableEmployeeDirectory)
+	if err := s.directory.QueryRow(query, emailAddressNormalized).Scan(&owner); err != nil {
+		return "", false, err
+	}
+	return owner, n > 0, nil
+}
+
+//directoryRelease will release the claim of the email address by the given uuid
+func (s *ShardedStore) directoryRelease(employeeID, emailAddressNormalized string) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE uuid=? AND email_address_normalized=?", tableEmployeeDirectory)
+	_, err := s.directory.Exec(query, employeeID, emailAddressNormalized)
+	return err
+}
+
+//directoryReleaseExcept will release all claims by the given uuid except
+// for the given email address (if empty, all claims are released)
+func (s *ShardedStore) directoryReleaseExcept(employeeID, emailAddressNormalized string) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE uuid=? AND email_address_normalized<>?", tableEmployeeDirectory)
+	_, err := s.directory.Exec(query, employeeID, emailAddressNormalized)
+	return err
+}
+
+//EmployeeCreate will claim the employee's email address in the directory and
+// create the employee on its shard; if the email address has already been
+// claimed, the employee that owns it is upserted (and returned) instead
+func (s *ShardedStore) EmployeeCreate(employee *Employee) (*Employee, error) {
+	if employee == nil {
+		return nil, errors.New("employee is nil")
+	}
+	_, emailAddressNormalized, err := EmailNormalize(employee.EmailAddress, s.email)
+	if err != nil {
+		return nil, err
+	}
+	//KIM: the directory is claimed first so that concurrent creates on
+	// different shards converge on the same uuid (and the same shard)
+	owner, claimed, err := s.directoryClaim(employee.ID, emailAddressNormalized)
+	if err != nil {
+		return nil, err
+	}
+	employeeCreate := *employee
+	employeeCreate.ID = owner
+	employeeCreated, err := EmployeeCreate(s.Shard(owner), &employeeCreate, s.email)
+	if err != nil {
+		if claimed {
+			//KIM: the claim is released so the email address isn't held by an
+			// employee that doesn't exist, if the release fails, subsequent
+			// creates with the same email address resolve to the same uuid
+			s.directoryRelease(owner, emailAddressNormalized)
+		}
+		return nil, err
+	}
+	return employeeCreated, nil
+}
+
+//EmployeeWrite will mutate the employee on its shard, if the email address
+// changed, the new email address is claimed before the write and the old
+// one is released after it
+func (s *ShardedStore) EmployeeWrite(employee *Employee) (*Employee, error) {
+	if employee == nil {
+		return nil, errors.New("employee is nil")
+	}
+	_, emailAddressNormalized, err := EmailNormalize(employee.EmailAddress, s.email)
+	if err != nil {
+		return nil, err
+	}
+	owner, claimed, err := s.directoryClaim(employee.ID, emailAddressNormalized)
+	if err != nil {
+		return nil, err
+	}
+	if owner != employee.ID {
+		return nil, errors.Errorf("email address, \"%s\", belongs to employee with id, \"%s\"",
+			employee.EmailAddress, owner)
+	}
+	employeeWritten, err := EmployeeWrite(s.Shard(employee.ID), employee, s.email)
+	if err != nil {
+		if claimed {
+			s.directoryRelease(employee.ID, emailAddressNormalized)
+		}
+		return nil, err
+	}
+	if err := s.directoryReleaseExcept(employee.ID, emailAddressNormalized); err != nil {
+		return nil, err
+	}
+	return employeeWritten, nil
+}
+
+//EmployeeDelete will delete the employee from its shard and release its
+// email address, if employee is nil, all employees on all shards are deleted;
+// if the employee's uuid isn't provided, it'll be found via the directory
+func (s *ShardedStore) EmployeeDelete(employee *Employee) error {
+	if employee == nil {
+		for _, shard := range s.shards {
+			if err := EmployeeDelete(shard, nil, s.email); err != nil {
+				return err
+			}
+		}
+		_, err := s.directory.Exec(fmt.Sprintf("DELETE FROM %s", tableEmployeeDirectory))
+		return err
+	}
+	//KIM: EmployeeDelete also deletes the employee with the same email
+	// address, that employee may be on a different shard, so its uuid is
+	// found via the directory
+	employeeIDs := []string{employee.ID}
+	if _, emailAddressNormalized, err := EmailNormalize(employee.EmailAddress, s.email); err == nil {
+		var owner string
+
+		query := fmt.Sprintf("SELECT uuid FROM %s WHERE email_address_normalized=?", tableEmployeeDirectory)
+		switch err := s.directory.QueryRow(query, emailAddressNormalized).Scan(&owner); {
+		default:
+			return err
+		case err == sql.ErrNoRows:
+		case err == nil && owner != employee.ID:
+			employeeIDs = append(employeeIDs, owner)
+		}
+	}
+	for _, employeeID := range employeeIDs {
+		if employeeID == "" {
+			continue
+		}
+		if err := s.employeeDelete(employeeID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ShardedStore) employeeDelete(employeeID string) error {
+	if err := EmployeeDelete(s.Shard(employeeID), &Employee{ID: employeeID}, s.email); err != nil {
+		return err
+	}
+	return s.directoryReleaseExcept(employeeID, "")
+}
+
+//EmployeeRead will read the employee from its shard
+func (s *ShardedStore) EmployeeRead(employeeID string) (*Employee, error) {
+	return EmployeeRead(s.Shard(employeeID), employeeID)
+}
+
+//EmployeesRead will read the employees from every shard (concurrently),
+// the employees are sorted by their uuid
+func (s *ShardedStore) EmployeesRead() ([]*Employee, error) {
+	var wg sync.WaitGroup
+
+	results := make([][]*Employee, len(s.shards))
+	errs := make([]error, len(s.shards))
+	for i, shard := range s.shards {
+		wg.Add(1)
+		go func(i int, shard *sql.DB) {
+			defer wg.Done()
+			results[i], errs[i] = EmployeesRead(shard)
+		}(i, shard)
+	}
+	wg.Wait()
+	var employees []*Employee
+	for i := range s.shards {
+		if errs[i] != nil {
+			return nil, errors.Wrapf(errs[i], "shard %d", i)
+		}
+		employees = append(employees, results[i]...)
+	}
+	sort.Slice(employees, func(i, j int) bool {
+		return employees[i].ID < employees[j].ID
+	})
+	return employees, nil
+}
+
+//TimerCreate will create the timer on the shard of its employee
+func (s *ShardedStore) TimerCreate(timer *Timer) (*Timer, error) {
+	if timer == nil {
+		return nil, errors.New("timer is nil")
+	}
+	return TimerCreate(s.Shard(timer.EmployeeID), timer)
+}
+
+//timerShard will find the shard of the given timer, if the employee's
+// uuid is known, that shard is used, otherwise every shard is searched
+func (s *ShardedStore) timerShard(timerID, employeeID string) (*sql.DB, *Timer, error) {
+	if employeeID != "" {
+		shard := s.Shard(employeeID)
+		timer, err := TimerRead(shard, timerID)
+		if err != nil {
+			return nil, nil, err
+		}
+		return shard, timer, nil
+	}
+	for _, shard := range s.shards {
+		timer, err := timerScan(shard.QueryRow(timerSelect("t.uuid=?"), idArg(timerID)))
+		switch {
+		case err == nil:
+			return shard, timer, nil
+		case err != sql.ErrNoRows:
+			return nil, nil, err
+		}
+	}
+	return nil, nil, errors.Errorf("timer with id, \"%s\", not found locally", timerID)
+}
+
+//TimerRead will read the timer, since its shard isn't known from its uuid,
+// every shard is searched
+func (s *ShardedStore) TimerRead(timerID string) (*Timer, error) {
+	_, timer, err := s.timerShard(timerID, "")
+	return timer, err
+}
+
+//TimerWrite will mutate the timer on the shard of its employee, if the
+// employee's uuid isn't provided, every shard is searched
+func (s *ShardedStore) TimerWrite(timer *Timer) (*Timer, error) {
+	if timer == nil {
+		return nil, errors.New("timer is nil")
+	}
+	shard, _, err := s.timerShard(timer.ID, timer.EmployeeID)
+	if err != nil {
+		return nil, err
+	}
+	return TimerWrite(shard, timer)
+}
+
+//TimerReassign will assign the timer to a different employee, it will return
+// an error if the employee is on a different shard since the timer can't
+// reference an employee in a different database
+func (s *ShardedStore) TimerReassign(timerID string, timerVersion int, employeeID string) (*Timer, error) {
+	shard, _, err := s.timerShard(timerID, "")
+	if err != nil {
+		return nil, err
+	}
+	if shard != s.Shard(employeeID) {
+		return nil, errors.Errorf("employee with id, \"%s\", is on a different shard than timer with id, \"%s\"",
+			employeeID, timerID)
+	}
+	return TimerReassign(shard, timerID, timerVersion, employeeID)
+}
+
+//TimerDelete will delete the timer from every shard, if timerID is
+// empty, all timers on all shards are deleted
+func (s *ShardedStore) TimerDelete(timerID string) error {
+	for _, shard := range s.shards {
+		if err := TimerDelete(shard, timerID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
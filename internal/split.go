@@ -0,0 +1,329 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+//SplitTimerStore stores timers in their own database (i.e., split from the
+// employees), rather than a foreign key to the employee table, each timer
+// holds the uuid of its employee; nothing in the timer database can ensure
+// that the employee exists, so if a lookup is provided, it's used to verify
+// the employee when timers are created or reassigned
+type SplitTimerStore struct {
+	db     Queryer
+	lookup EmployeeLookup
+	policy string
+}
+
+//NewSplitTimerStore can be used to create a timer store for a database
+// created with bludgeon_timers.sql, if lookup is nil, employees aren't
+// verified; the policy determines what's done when the lookup fails
+func NewSplitTimerStore(db Queryer, lookup EmployeeLookup, policy string) *SplitTimerStore {
+	if policy == "" {
+		policy = EmployeeLookupReject
+	}
+	return &SplitTimerStore{
+		db:     db,
+		lookup: lookup,
+		policy: policy,
+	}
+}
+
+//splitTimerSelect returns a query to select the columns of a timer with the
+// given where clause, the columns are in the same order as timerSelect so
+// the rows can be scanned with timerScan
+func splitTimerSelect(where string) string {
+	return fmt.Sprintf(`SELECT uuid, start, finish, comment, completed, employee_uuid, version
+		FROM %s WHERE %s`, tableTimer, where)
+}
+
+//TimerCreate can be used to create a timer, if the timer already exists
+// it'll return that timer and update its comment; it will return an error
+// if the timer already exists for a different employee
+func (s *SplitTimerStore) TimerCreate(timer *Timer) (*Timer, error) {
+	var timerID int64
+	var employeeID string
+
+	if timer == nil {
+		return nil, errors.New("timer is nil")
+	}
+	//KIM: the employee is verified outside of the transaction since it
+	// may be a request to another service
+	verified, err := s.employeeVerify(timer.EmployeeID)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := txBegin(s.db)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	query := fmt.Sprintf(`INSERT INTO %s (uuid, start, comment, employee_uuid)
+		VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			comment=?, version=version+1
+		RETURNING
+			id, employee_uuid;`,
+		tableTimer)
+	args := []interface{}{
+		idArg(timer.ID), timer.Start, timer.Comment, idArg(timer.EmployeeID), timer.Comment,
+	}
+	if err := tx.QueryRow(query, args...).Scan(&timerID, idScan(&employeeID)); err != nil {
+		return nil, err
+	}
+	if employeeID != timer.EmployeeID {
+		return nil, errors.Errorf("timer with id, \"%s\", belongs to another employee, it must be reassigned", timer.ID)
+	}
+	if err := s.employeeVerified(tx, timerID, timer.EmployeeID, verified); err != nil {
+		return nil, err
+	}
+	if timer, err = timerScan(tx.QueryRow(splitTimerSelect("id=?"), timerID)); err != nil {
+		return nil, err
+	}
+	if err := outboxWrite(tx, tableTimer, timer.ID, timer.Version, outboxChangeType(timer.Version), timer); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return timer, nil
+}
+
+//TimerRead can be used to read a given timer
+func (s *SplitTimerStore) TimerRead(timerID string) (*Timer, error) {
+	timer, err := timerScan(s.db.QueryRow(splitTimerSelect("uuid=?"), idArg(timerID)))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorf("timer with id, \"%s\", not found locally", timerID)
+		}
+		return nil, err
+	}
+	return timer, nil
+}
+
+//TimersRead can be used to read the timers of a given employee (or all
+// timers if employeeID is empty)
+func (s *SplitTimerStore) TimersRead(employeeID string) ([]*Timer, error) {
+	var args []interface{}
+
+	where := "1=1 ORDER BY id"
+	if employeeID != "" {
+		where, args = "employee_uuid=? ORDER BY id", []interface{}{idArg(employeeID)}
+	}
+	rows, err := s.db.Query(splitTimerSelect(where), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var timers []*Timer
+	for rows.Next() {
+		timer, err := timerScan(rows)
+		if err != nil {
+			return nil, err
+		}
+		timers = append(timers, timer)
+	}
+	return timers, rows.Err()
+}
+
+//TimerWrite can be used to mutate an existing timer
+func (s *SplitTimerStore) TimerWrite(timer *Timer) (*Timer, error) {
+	if timer == nil {
+		return nil, errors.New("timer is nil")
+	}
+	tx, err := txBegin(s.db)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	query := fmt.Sprintf(`UPDATE %s SET comment=?, version=?
+		WHERE uuid=? AND version=?`, tableTimer)
+	result, err := tx.Exec(query, timer.Comment, timer.Version+1, idArg(timer.ID), timer.Version)
+	if err != nil {
+		return nil, err
+	}
+	if err := RowsAffected(result, "no rows affected, version mismatch or non-existent timer"); err != nil {
+		return nil, err
+	}
+	row := tx.QueryRow(splitTimerSelect("uuid=? AND version=?"), idArg(timer.ID), timer.Version+1)
+	if timer, err = timerScan(row); err != nil {
+		return nil, err
+	}
+	if err := outboxWrite(tx, tableTimer, timer.ID, timer.Version, ChangeUpdated, timer); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return timer, nil
+}
+
+//TimerReassign can be used to assign an existing timer to a different employee,
+// it will return an error if the provided version isn't the current version; the
+// previous owner is recorded in the timer's history
+func (s *SplitTimerStore) TimerReassign(timerID string, timerVersion int, employeeID string) (*Timer, error) {
+	var id int64
+	var currentVersion int
+	var previousEmployeeID string
+
+	verified, err := s.employeeVerify(employeeID)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := txBegin(s.db)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	query := fmt.Sprintf("SELECT id, version, employee_uuid FROM %s WHERE uuid=? FOR UPDATE", tableTimer)
+	if err := tx.QueryRow(query, idArg(timerID)).Scan(&id, &currentVersion,
+		idScan(&previousEmployeeID)); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorf("timer with id, \"%s\", not found locally", timerID)
+		}
+		return nil, err
+	}
+	if currentVersion != timerVersion {
+		return nil, errors.Errorf("version mismatch, timer is at version %d not %d", currentVersion, timerVersion)
+	}
+	if previousEmployeeID == employeeID {
+		return nil, errors.Errorf("timer with id, \"%s\", is already assigned to employee with id, \"%s\"",
+			timerID, employeeID)
+	}
+	query = fmt.Sprintf("UPDATE %s SET employee_uuid=?, version=version+1 WHERE id=? AND version=?", tableTimer)
+	result, err := tx.Exec(query, idArg(employeeID), id, timerVersion)
+	if err != nil {
+		return nil, err
+	}
+	if err := RowsAffected(result, "no rows affected, version mismatch or non-existent timer"); err != nil {
+		return nil, err
+	}
+	query = fmt.Sprintf(`INSERT INTO %s (timer_id, version, previous_employee_uuid, employee_uuid)
+		VALUES (?, ?, ?, ?)`, tableTimerHistory)
+	if _, err := tx.Exec(query, id, timerVersion+1, previousEmployeeID, employeeID); err != nil {
+		return nil, err
+	}
+	if err := s.employeeVerified(tx, id, employeeID, verified); err != nil {
+		return nil, err
+	}
+	timer, err := timerScan(tx.QueryRow(splitTimerSelect("id=?"), id))
+	if err != nil {
+		return nil, err
+	}
+	if err := outboxWrite(tx, tableTimer, timer.ID, timer.Version, ChangeUpdated, timer); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return timer, nil
+}
+
+//TimerComplete can be used to complete (or un-complete) the timer with the
+// given finish, if the timer is already in the given state (or doesn't exist)
+// nothing is done
+func (s *SplitTimerStore) TimerComplete(timerID string, finish int64, completed bool) error {
+	tx, err := txBegin(s.db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	query := fmt.Sprintf(`UPDATE %s SET finish=?, completed=?, version=version+1
+		WHERE uuid=? AND completed<>?`, tableTimer)
+	result, err := tx.Exec(query, finish, completed, idArg(timerID), completed)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n <= 0 {
+		return nil
+	}
+	timer, err := timerScan(tx.QueryRow(splitTimerSelect("uuid=?"), idArg(timerID)))
+	if err != nil {
+		return err
+	}
+	if err := outboxWrite(tx, tableTimer, timer.ID, timer.Version, ChangeUpdated, timer); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+//TimerRestore can be used to re-create a deleted timer as it was (rather
+// than as a new timer), if the timer already exists, nothing is done; the
+// employee isn't verified since the timer existed for it before
+func (s *SplitTimerStore) TimerRestore(timer *Timer) error {
+	var timerID int64
+
+	if timer == nil {
+		return errors.New("timer is nil")
+	}
+	tx, err := txBegin(s.db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	query := fmt.Sprintf(`INSERT IGNORE INTO %s (uuid, start, finish, comment, completed, version, employee_uuid)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`, tableTimer)
+	result, err := tx.Exec(query, idArg(timer.ID), timer.Start, timer.Finish, timer.Comment,
+		timer.Completed, timer.Version+1, idArg(timer.EmployeeID))
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n <= 0 {
+		return tx.Commit()
+	}
+	if timerID, err = result.LastInsertId(); err != nil {
+		return err
+	}
+	if timer, err = timerScan(tx.QueryRow(splitTimerSelect("id=?"), timerID)); err != nil {
+		return err
+	}
+	if err := outboxWrite(tx, tableTimer, timer.ID, timer.Version, ChangeCreated, timer); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+//TimerDelete can be used to delete one or all timers
+func (s *SplitTimerStore) TimerDelete(timerID string) error {
+	var timers []*Timer
+	var args []interface{}
+
+	where := "1=1"
+	if timerID != "" {
+		where, args = "uuid=?", []interface{}{idArg(timerID)}
+	}
+	tx, err := txBegin(s.db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(splitTimerSelect(where+" FOR UPDATE"), args...)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		timer, err := timerScan(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		timers = append(timers, timer)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	query := fmt.Sprintf("DELETE from %s WHERE %s", tableTimer, where)
+	if _, err := tx.Exec(query, args...); err != nil {
+		return err
+	}
+	for _, timer := range timers {
+		if err := outboxWrite(tx, tableTimer, timer.ID, timer.Version, ChangeDeleted, timer); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -15,82 +15,209 @@ func Initialize(config *Configuration) (*sql.DB, error) {
 	return sql.Open("mysql", dataSourceName)
 }
 
+//employeeSelect returns a query to select the columns of an
+// employee with the given where clause
+func employeeSelect(where string) string {
+	return fmt.Sprintf(`SELECT uuid, first_name, last_name, email_address, archived, version
+		FROM %s WHERE %s`, tableEmployee, where)
+}
+
+//employeeScan can be used to scan a row selected with employeeSelect
+func employeeScan(row interface {
+	Scan(dest ...interface{}) error
+}) (*Employee, error) {
+	employee := &Employee{}
+	if err := row.Scan(
+		idScan(&employee.ID),
+		&employee.FirstName,
+		&employee.LastName,
+		&employee.EmailAddress,
+		&employee.Archived,
+		&employee.Version,
+	); err != nil {
+		return nil, err
+	}
+	return employee, nil
+}
+
+//timerSelect returns a query to select the columns of a timer with the given
+// where clause, the employee's uuid is selected rather than its id
+func timerSelect(where string) string {
+	return fmt.Sprintf(`SELECT t.uuid, t.start, t.finish, t.comment, t.completed, COALESCE(e.uuid, ''), t.version
+		FROM %s t LEFT JOIN %s e ON t.employee_id=e.id WHERE %s`, tableTimer, tableEmployee, where)
+}
+
+//timerScan can be used to scan a row selected with timerSelect
+func timerScan(row interface {
+	Scan(dest ...interface{}) error
+}) (*Timer, error) {
+	timer := &Timer{}
+	if err := row.Scan(
+		idScan(&timer.ID),
+		&timer.Start,
+		&timer.Finish,
+		&timer.Comment,
+		&timer.Completed,
+		idScan(&timer.EmployeeID),
+		&timer.Version,
+	); err != nil {
+		return nil, err
+	}
+	return timer, nil
+}
+
 //EmployeeCreate can be used to upsert an employee, if the employee exists
 // via its candidate keys, it'll return that employee rather than
-// create its own
-func EmployeeCreate(db interface {
-	QueryRow(query string, args ...interface{}) *sql.Row
-}, employee *Employee) (*Employee, error) {
+// create its own; the email address is normalized with options
+func EmployeeCreate(db Queryer, employee *Employee, options EmailOptions) (*Employee, error) {
 
 	if employee == nil {
 		return nil, errors.New("employee is nil")
 	}
-	query := fmt.Sprintf(`INSERT INTO %s (uuid, first_name, last_name, email_address) 
-			VALUES (?, ?, ?, ?) 
+	emailAddress, emailAddressNormalized, err := EmailNormalize(employee.EmailAddress, options)
+	if err != nil {
+		return nil, err
+	}
+	//KIM: the normalized email address is the alternate key, so creates
+	// that only differ by casing/whitespace will converge on the same row
+	query := fmt.Sprintf(`INSERT INTO %s (uuid, first_name, last_name, email_address, email_address_normalized) 
+			VALUES (?, ?, ?, ?, ?) 
 		ON DUPLICATE KEY UPDATE 
 			first_name=?, last_name=?, version=version+1
 		RETURNING 
-			uuid, first_name, last_name, email_address, version;`,
+			uuid, first_name, last_name, email_address, archived, version;`,
 		tableEmployee)
 	args := []interface{}{
-		employee.ID, employee.FirstName, employee.LastName, employee.EmailAddress, employee.FirstName, employee.LastName,
+		idArg(employee.ID), employee.FirstName, employee.LastName, emailAddress, emailAddressNormalized, employee.FirstName, employee.LastName,
 	}
-	row := db.QueryRow(query, args...)
-	if row.Err() != nil {
-		return nil, row.Err()
+	employeeID := employee.ID
+	tx, err := txBegin(db)
+	if err != nil {
+		return nil, err
 	}
-	employee = &Employee{}
-	if err := row.Scan(
-		&employee.ID,
-		&employee.FirstName,
-		&employee.LastName,
-		&employee.EmailAddress,
-		&employee.Version,
-	); err != nil {
+	defer tx.Rollback()
+	if employee, err = employeeScan(tx.QueryRow(query, args...)); err != nil {
+		return nil, err
+	}
+	//KIM: the tombstone is checked after the insert, if the employee is being
+	// deleted concurrently, the insert waits on its lock so the locking read
+	// will see the tombstone once the delete has committed
+	switch tombstone, err := employeeTombstoneRead(tx, employeeID, "LOCK IN SHARE MODE"); {
+	case err == nil:
+		return nil, &EmployeeDeletedError{*tombstone}
+	case err != sql.ErrNoRows:
+		return nil, err
+	}
+	if err := outboxWrite(tx, tableEmployee, employee.ID, employee.Version,
+		outboxChangeType(employee.Version), employee); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
 		return nil, err
 	}
 	return employee, nil
 }
 
 //EmployeeDelete can be used to delete a specific employee or
-// all employees
-func EmployeeDelete(db interface {
-	Exec(query string, args ...interface{}) (sql.Result, error)
-}, employee *Employee) error {
+// all employees, an employee is matched by its uuid or its email
+// address (normalized with options)
+func EmployeeDelete(db Queryer, employee *Employee, options EmailOptions) error {
+	return EmployeeDeleteBy(db, employee, "", options)
+}
 
-	var args []interface{}
-	var query string
+//EmployeeDeleteBy can be used to delete a specific employee or all employees,
+// a tombstone is written for each deleted employee recording the actor that
+// deleted it
+func EmployeeDeleteBy(db Queryer, employee *Employee, actor string, options EmailOptions) error {
+	where, args := employeeDeleteWhere(employee, options)
+	tx, err := txBegin(db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	//KIM: the employees are read (and locked) before they're deleted
+	// so that what's deleted can be written to the outbox
+	employees, err := employeesLocked(tx, where, args...)
+	if err != nil {
+		return err
+	}
+	//KIM: the employees are locked, so a reservation can't be placed until
+	// this transaction commits (or rolls back)
+	if len(employees) > 0 {
+		if err := employeesReserved(tx, employeeIDs(employees)...); err != nil {
+			return err
+		}
+	}
+	query := fmt.Sprintf("DELETE from %s WHERE %s", tableEmployee, where)
+	if _, err := tx.Exec(query, args...); err != nil {
+		return err
+	}
+	for _, employee := range employees {
+		if err := employeeTombstoneWrite(tx, employee, actor); err != nil {
+			return err
+		}
+		if err := outboxWrite(tx, tableEmployee, employee.ID, employee.Version, ChangeDeleted, employee); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
 
+//employeeDeleteWhere returns the where clause (and its arguments) for the
+// employees deleted by EmployeeDelete: the employee with the uuid or the same
+// normalized email address (or all employees if employee is nil)
+func employeeDeleteWhere(employee *Employee, options EmailOptions) (string, []interface{}) {
 	if employee == nil {
-		query = fmt.Sprintf("DELETE from %s", tableEmployee)
-	} else {
-		query = fmt.Sprintf("DELETE from %s WHERE uuid=? OR email_address=?", tableEmployee)
-		args = []interface{}{employee.ID, employee.EmailAddress}
+		return "1=1", nil
 	}
-	if _, err := db.Exec(query, args...); err != nil {
-		return err
+	if _, emailAddressNormalized, err := EmailNormalize(employee.EmailAddress, options); err == nil {
+		return "uuid=? OR email_address_normalized=?", []interface{}{idArg(employee.ID), emailAddressNormalized}
+	}
+	return "uuid=?", []interface{}{idArg(employee.ID)}
+}
+
+//employeesLocked will read (and lock) the employees with the given where
+// clause, it should be called within a transaction
+func employeesLocked(db Queryer, where string, args ...interface{}) ([]*Employee, error) {
+	var employees []*Employee
+
+	rows, err := db.Query(employeeSelect(where+" FOR UPDATE"), args...)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	defer rows.Close()
+	for rows.Next() {
+		employee, err := employeeScan(rows)
+		if err != nil {
+			return nil, err
+		}
+		employees = append(employees, employee)
+	}
+	return employees, rows.Err()
 }
 
 //EmployeeWrite can be used to mutate an existing employee, it will return an error
-// if the provided version for employee isn't the current version
-func EmployeeWrite(db interface {
-	Begin() (*sql.Tx, error)
-}, employee *Employee) (*Employee, error) {
+// if the provided version for employee isn't the current version; the email
+// address is normalized with options
+func EmployeeWrite(db Queryer, employee *Employee, options EmailOptions) (*Employee, error) {
 
 	if employee == nil {
 		return nil, errors.New("employee is nil")
 	}
-	tx, err := db.Begin()
+	emailAddress, emailAddressNormalized, err := EmailNormalize(employee.EmailAddress, options)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := txBegin(db)
 	if err != nil {
 		return nil, err
 	}
 	defer tx.Rollback()
-	query := fmt.Sprintf(`UPDATE %s SET first_name=?, last_name=?, email_address=?, version=version+1 WHERE uuid=? and version=?`,
+	query := fmt.Sprintf(`UPDATE %s SET first_name=?, last_name=?, email_address=?, email_address_normalized=?, version=version+1
+		WHERE uuid=? and version=?`,
 		tableEmployee)
 	args := []interface{}{
-		employee.FirstName, employee.LastName, employee.EmailAddress, employee.ID, employee.Version,
+		employee.FirstName, employee.LastName, emailAddress, emailAddressNormalized, idArg(employee.ID), employee.Version,
 	}
 	result, err := tx.Exec(query, args...)
 	if err != nil {
@@ -99,17 +226,12 @@ func EmployeeWrite(db interface {
 	if err := RowsAffected(result, "no rows affected, version mismatch or non-existent employee"); err != nil {
 		return nil, err
 	}
-	query = fmt.Sprintf("SELECT uuid, first_name, last_name, email_address, version FROM %s WHERE uuid=? AND version=?", tableEmployee)
-	args = []interface{}{employee.ID, employee.Version + 1}
-	row := tx.QueryRow(query, args...)
-	employee = &Employee{}
-	if err := row.Scan(
-		&employee.ID,
-		&employee.FirstName,
-		&employee.LastName,
-		&employee.EmailAddress,
-		&employee.Version,
-	); err != nil {
+	args = []interface{}{idArg(employee.ID), employee.Version + 1}
+	row := tx.QueryRow(employeeSelect("uuid=? AND version=?"), args...)
+	if employee, err = employeeScan(row); err != nil {
+		return nil, err
+	}
+	if err := outboxWrite(tx, tableEmployee, employee.ID, employee.Version, ChangeUpdated, employee); err != nil {
 		return nil, err
 	}
 	if err := tx.Commit(); err != nil {
@@ -118,31 +240,134 @@ func EmployeeWrite(db interface {
 	return employee, nil
 }
 
-func EmployeeRead(db interface {
-	Begin() (*sql.Tx, error)
-}, employeeUUID string) (*Employee, error) {
+//EmployeeArchive can be used to archive (or un-archive) an existing employee, archived
+// employees can't be assigned timers; it will return an error if the provided version
+// isn't the current version
+func EmployeeArchive(db Queryer, employeeUUID string, version int, archived bool) (*Employee, error) {
 
-	tx, err := db.Begin()
+	tx, err := txBegin(db)
 	if err != nil {
 		return nil, err
 	}
 	defer tx.Rollback()
-	query := fmt.Sprintf(`SELECT uuid, first_name, last_name, email_address, version
-		FROM %s WHERE uuid=?`, tableEmployee)
-	row := tx.QueryRow(query, employeeUUID)
-	employee := &Employee{}
-	if err = row.Scan(
-		&employee.ID,
-		&employee.FirstName,
-		&employee.LastName,
-		&employee.EmailAddress,
-		&employee.Version,
-	); err != nil {
+	if err := employeesEventSourced(tx, employeeUUID); err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf(`UPDATE %s SET archived=?, version=version+1 WHERE uuid=? AND version=?`,
+		tableEmployee)
+	result, err := tx.Exec(query, archived, idArg(employeeUUID), version)
+	if err != nil {
+		return nil, err
+	}
+	if err := RowsAffected(result, "no rows affected, version mismatch or non-existent employee"); err != nil {
+		return nil, err
+	}
+	employee, err := employeeScan(tx.QueryRow(employeeSelect("uuid=? AND version=?"), idArg(employeeUUID), version+1))
+	if err != nil {
+		return nil, err
+	}
+	if err := outboxWrite(tx, tableEmployee, employee.ID, employee.Version, ChangeUpdated, employee); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return employee, nil
+}
+
+//EmployeeRead can be used to read a given employee
+func EmployeeRead(db Queryer, employeeUUID string) (*Employee, error) {
+
+	tx, err := txBegin(db)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	row := tx.QueryRow(employeeSelect("uuid=?"), idArg(employeeUUID))
+	employee, err := employeeScan(row)
+	if err == sql.ErrNoRows {
+		employee, err = employeeRedirect(tx, employeeUUID)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, employeeNotFound(tx, employeeUUID, "")
+		}
+		return nil, err
+	}
+	if err = tx.Rollback(); err != nil {
+		return nil, err
+	}
+	return employee, nil
+}
+
+//EmployeesRead can be used to read all employees
+func EmployeesRead(db Queryer) ([]*Employee, error) {
+	rows, err := db.Query(employeeSelect("1=1 ORDER BY id"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var employees []*Employee
+	for rows.Next() {
+		employee, err := employeeScan(rows)
+		if err != nil {
+			return nil, err
+		}
+		employees = append(employees, employee)
+	}
+	return employees, rows.Err()
+}
+
+//employeeRedirect can be used to read the employee a merged (duplicate)
+// employee was redirected to, it'll return sql.ErrNoRows if there's no
+// redirect for the uuid
+func employeeRedirect(db Queryer, employeeUUID string) (*Employee, error) {
+
+	var employeeID int64
+
+	query := fmt.Sprintf("SELECT employee_id FROM %s WHERE uuid=?", tableEmployeeRedirect)
+	if err := db.QueryRow(query, employeeUUID).Scan(&employeeID); err != nil {
+		return nil, err
+	}
+	return employeeScan(db.QueryRow(employeeSelect("id=?"), employeeID))
+}
+
+//EmployeeReadIfChanged can be used to read an employee only if its current
+// version is different from the provided version, if the version is the
+// same, ErrNotModified will be returned rather than the employee
+func EmployeeReadIfChanged(db Queryer, employeeUUID string, version int) (*Employee, error) {
+
+	var employeeID int64
+	var currentVersion int
+
+	//KIM: both queries are done within the same transaction so that the
+	// employee we read is at least as new as the version we compared
+	tx, err := txBegin(db)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	query := fmt.Sprintf("SELECT id, version FROM %s WHERE uuid=?", tableEmployee)
+	err = tx.QueryRow(query, idArg(employeeUUID)).Scan(&employeeID, &currentVersion)
+	if err == sql.ErrNoRows {
+		query = fmt.Sprintf(`SELECT e.id, e.version FROM %s r JOIN %s e ON r.employee_id=e.id
+			WHERE r.uuid=?`, tableEmployeeRedirect, tableEmployee)
+		err = tx.QueryRow(query, employeeUUID).Scan(&employeeID, &currentVersion)
+	}
+	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, errors.Errorf("employee with id, \"%s\", not found locally", employeeUUID)
+			return nil, employeeNotFound(tx, employeeUUID, "")
 		}
 		return nil, err
 	}
+	if currentVersion == version {
+		return nil, ErrNotModified
+	}
+	row := tx.QueryRow(employeeSelect("id=?"), employeeID)
+	employee, err := employeeScan(row)
+	if err != nil {
+		return nil, err
+	}
 	if err = tx.Rollback(); err != nil {
 		return nil, err
 	}
@@ -150,12 +375,13 @@ func EmployeeRead(db interface {
 }
 
 //TimerCreate can be used to create a timer, if the timer already exists
-// it'll return that timer and update that timer
-func TimerCreate(db interface {
-	Begin() (*sql.Tx, error)
-}, timer *Timer) (*Timer, error) {
+// it'll return that timer and update its comment; it will return an error
+// if the employee is archived (or pending delete) or if the timer already
+// exists for a different employee
+func TimerCreate(db Queryer, timer *Timer) (*Timer, error) {
 
-	var employeeID int
+	var employeeID, timerID, timerEmployeeID int64
+	var archived, pendingDelete bool
 
 	//REVIEW: it's a bit neater to do this with subqueries, but the
 	// interaction between parameters and sub-queries is a bit strange
@@ -163,36 +389,51 @@ func TimerCreate(db interface {
 	if timer == nil {
 		return nil, errors.New("timer is nil")
 	}
-	tx, err := db.Begin()
+	tx, err := txBegin(db)
 	if err != nil {
 		return nil, err
 	}
 	defer tx.Rollback()
-	query := fmt.Sprintf("SELECT id from %s WHERE uuid=?", tableEmployee)
-	args := []interface{}{timer.EmployeeID}
+	//KIM: the shared lock ensures that the employee can't be marked as
+	// pending delete (e.g., by a saga) until this transaction commits
+	query := fmt.Sprintf("SELECT id, archived, pending_delete from %s WHERE uuid=? LOCK IN SHARE MODE", tableEmployee)
+	args := []interface{}{idArg(timer.EmployeeID)}
 	row := tx.QueryRow(query, args...)
-	if err := row.Scan(&employeeID); err != nil {
+	if err := row.Scan(&employeeID, &archived, &pendingDelete); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, employeeNotFound(tx, timer.EmployeeID, "LOCK IN SHARE MODE")
+		}
 		return nil, err
 	}
+	if archived {
+		return nil, errors.Errorf("employee with id, \"%s\", is archived", timer.EmployeeID)
+	}
+	if pendingDelete {
+		return nil, errors.Errorf("employee with id, \"%s\", is pending delete", timer.EmployeeID)
+	}
+	//KIM: the owner of an existing timer isn't updated, changing the owner
+	// has to go through TimerReassign so it's version checked and recorded
+	// in the timer's history
 	query = fmt.Sprintf(`INSERT INTO %s (uuid, start, comment, employee_id)
 		VALUES (?, ?, ?, ?)
 		ON DUPLICATE KEY UPDATE
-			comment=?, employee_id=?, version=version+1
+			comment=?, version=version+1
 		RETURNING
-			uuid, start, comment, employee_id, version;`,
+			id, employee_id;`,
 		tableTimer)
 	args = []interface{}{
-		timer.ID, timer.Start, timer.Comment, employeeID, timer.Comment, employeeID,
+		idArg(timer.ID), timer.Start, timer.Comment, employeeID, timer.Comment,
 	}
-	row = tx.QueryRow(query, args...)
-	timer = &Timer{}
-	if err := row.Scan(
-		&timer.ID,
-		&timer.Start,
-		&timer.Comment,
-		&timer.EmployeeID,
-		&timer.Version,
-	); err != nil {
+	if err := tx.QueryRow(query, args...).Scan(&timerID, &timerEmployeeID); err != nil {
+		return nil, err
+	}
+	if timerEmployeeID != employeeID {
+		return nil, errors.Errorf("timer with id, \"%s\", belongs to another employee, it must be reassigned", timer.ID)
+	}
+	if timer, err = timerScan(tx.QueryRow(timerSelect("t.id=?"), timerID)); err != nil {
+		return nil, err
+	}
+	if err := outboxWrite(tx, tableTimer, timer.ID, timer.Version, outboxChangeType(timer.Version), timer); err != nil {
 		return nil, err
 	}
 	if err = tx.Commit(); err != nil {
@@ -202,28 +443,15 @@ func TimerCreate(db interface {
 }
 
 //TimerRead can be used to read a given timer
-func TimerRead(db interface {
-	Begin() (*sql.Tx, error)
-}, timerUUID string) (*Timer, error) {
+func TimerRead(db Queryer, timerUUID string) (*Timer, error) {
 
-	tx, err := db.Begin()
+	tx, err := txBegin(db)
 	if err != nil {
 		return nil, err
 	}
 	defer tx.Rollback()
-	query := fmt.Sprintf(`SELECT uuid, start, finish, comment, completed, employee_id, version
-		FROM %s WHERE uuid=?`, tableTimer)
-	row := tx.QueryRow(query, timerUUID)
-	timer := &Timer{}
-	if err = row.Scan(
-		&timer.ID,
-		&timer.Start,
-		&timer.Finish,
-		&timer.Comment,
-		&timer.Completed,
-		&timer.EmployeeID,
-		&timer.Version,
-	); err != nil {
+	timer, err := timerScan(tx.QueryRow(timerSelect("t.uuid=?"), idArg(timerUUID)))
+	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, errors.Errorf("timer with id, \"%s\", not found locally", timerUUID)
 		}
@@ -235,15 +463,45 @@ func TimerRead(db interface {
 	return timer, nil
 }
 
+//TimerReadIfChanged can be used to read a timer only if its current
+// version is different from the provided version, if the version is the
+// same, ErrNotModified will be returned rather than the timer
+func TimerReadIfChanged(db Queryer, timerUUID string, version int) (*Timer, error) {
+
+	var currentVersion int
+
+	tx, err := txBegin(db)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	query := fmt.Sprintf("SELECT version FROM %s WHERE uuid=?", tableTimer)
+	if err := tx.QueryRow(query, idArg(timerUUID)).Scan(&currentVersion); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorf("timer with id, \"%s\", not found locally", timerUUID)
+		}
+		return nil, err
+	}
+	if currentVersion == version {
+		return nil, ErrNotModified
+	}
+	timer, err := timerScan(tx.QueryRow(timerSelect("t.uuid=?"), idArg(timerUUID)))
+	if err != nil {
+		return nil, err
+	}
+	if err = tx.Rollback(); err != nil {
+		return nil, err
+	}
+	return timer, nil
+}
+
 //TimerWrite can be used to mutate an existing timer
-func TimerWrite(db interface {
-	Begin() (*sql.Tx, error)
-}, timer *Timer) (*Timer, error) {
+func TimerWrite(db Queryer, timer *Timer) (*Timer, error) {
 
 	if timer == nil {
 		return nil, errors.New("timer is nil")
 	}
-	tx, err := db.Begin()
+	tx, err := txBegin(db)
 	if err != nil {
 		return nil, err
 	}
@@ -251,27 +509,20 @@ func TimerWrite(db interface {
 	query := fmt.Sprintf(`UPDATE %s SET comment=?, version=?
 		WHERE uuid=? AND version=?`, tableTimer)
 	args := []interface{}{
-		timer.Comment, timer.Version + 1, timer.ID, timer.Version,
+		timer.Comment, timer.Version + 1, idArg(timer.ID), timer.Version,
 	}
-	result, err := tx.Exec(query, args)
+	result, err := tx.Exec(query, args...)
 	if err != nil {
 		return nil, err
 	}
 	if err := RowsAffected(result, "no rows affected, version mismatch or non-existent timer"); err != nil {
 		return nil, err
 	}
-	query = fmt.Sprintf(`SELECT uuid, timer_start, timer_finish, timer_comment, timer_completed
-		FROM %s WHERE uuid = ?`,
-		tableTimer)
-	row := tx.QueryRow(query, timer.ID)
-	timer = &Timer{}
-	if err = row.Scan(
-		&timer.ID,
-		&timer.Start,
-		&timer.Finish,
-		&timer.Comment,
-		&timer.Completed,
-	); err != nil {
+	row := tx.QueryRow(timerSelect("t.uuid=? AND t.version=?"), idArg(timer.ID), timer.Version+1)
+	if timer, err = timerScan(row); err != nil {
+		return nil, err
+	}
+	if err := outboxWrite(tx, tableTimer, timer.ID, timer.Version, ChangeUpdated, timer); err != nil {
 		return nil, err
 	}
 	if err = tx.Commit(); err != nil {
@@ -280,22 +531,286 @@ func TimerWrite(db interface {
 	return timer, nil
 }
 
+//TimerReassign can be used to assign an existing timer to a different employee, it
+// will return an error if the provided version isn't the current version or if the
+// employee doesn't exist or is archived; the previous owner is recorded in the
+// timer's history
+func TimerReassign(db Queryer, timerUUID string, timerVersion int, employeeUUID string) (*Timer, error) {
+
+	var timerID, previousEmployeeID, employeeID int64
+	var currentVersion int
+	var previousEmployeeUUID string
+	var archived, pendingDelete bool
+
+	tx, err := txBegin(db)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	//KIM: the timer is locked first (and always before the employee) so
+	// that concurrent reassignments of the same timer are serialized
+	query := fmt.Sprintf(`SELECT t.id, t.version, t.employee_id, COALESCE(e.uuid, '')
+		FROM %s t LEFT JOIN %s e ON t.employee_id=e.id WHERE t.uuid=? FOR UPDATE`,
+		tableTimer, tableEmployee)
+	if err := tx.QueryRow(query, idArg(timerUUID)).Scan(&timerID, &currentVersion,
+		&previousEmployeeID, idScan(&previousEmployeeUUID)); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorf("timer with id, \"%s\", not found locally", timerUUID)
+		}
+		return nil, err
+	}
+	if currentVersion != timerVersion {
+		return nil, errors.Errorf("version mismatch, timer is at version %d not %d", currentVersion, timerVersion)
+	}
+	//KIM: the shared lock ensures that the employee can't be deleted or
+	// archived until this transaction commits, the foreign key would
+	// prevent the delete, but not the archive
+	query = fmt.Sprintf("SELECT id, archived, pending_delete FROM %s WHERE uuid=? LOCK IN SHARE MODE", tableEmployee)
+	if err := tx.QueryRow(query, idArg(employeeUUID)).Scan(&employeeID, &archived, &pendingDelete); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, employeeNotFound(tx, employeeUUID, "LOCK IN SHARE MODE")
+		}
+		return nil, err
+	}
+	if archived {
+		return nil, errors.Errorf("employee with id, \"%s\", is archived", employeeUUID)
+	}
+	if pendingDelete {
+		return nil, errors.Errorf("employee with id, \"%s\", is pending delete", employeeUUID)
+	}
+	if employeeID == previousEmployeeID {
+		return nil, errors.Errorf("timer with id, \"%s\", is already assigned to employee with id, \"%s\"",
+			timerUUID, employeeUUID)
+	}
+	query = fmt.Sprintf("UPDATE %s SET employee_id=?, version=version+1 WHERE id=? AND version=?", tableTimer)
+	result, err := tx.Exec(query, employeeID, timerID, timerVersion)
+	if err != nil {
+		return nil, err
+	}
+	if err := RowsAffected(result, "no rows affected, version mismatch or non-existent timer"); err != nil {
+		return nil, err
+	}
+	query = fmt.Sprintf(`INSERT INTO %s (timer_id, version, previous_employee_uuid, employee_uuid)
+		VALUES (?, ?, ?, ?)`, tableTimerHistory)
+	if _, err := tx.Exec(query, timerID, timerVersion+1, previousEmployeeUUID, employeeUUID); err != nil {
+		return nil, err
+	}
+	timer, err := timerScan(tx.QueryRow(timerSelect("t.id=?"), timerID))
+	if err != nil {
+		return nil, err
+	}
+	if err := outboxWrite(tx, tableTimer, timer.ID, timer.Version, ChangeUpdated, timer); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return timer, nil
+}
+
+//TimerHistoryRead can be used to read the ownership history of a
+// given timer, ordered from oldest to newest
+func TimerHistoryRead(db Queryer, timerUUID string) ([]*TimerHistory, error) {
+	query := fmt.Sprintf(`SELECT t.uuid, h.version, h.previous_employee_uuid, h.employee_uuid, UNIX_TIMESTAMP(h.changed_at)
+		FROM %s h JOIN %s t ON h.timer_id=t.id WHERE t.uuid=? ORDER BY h.version`,
+		tableTimerHistory, tableTimer)
+	rows, err := db.Query(query, idArg(timerUUID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var histories []*TimerHistory
+	for rows.Next() {
+		history := &TimerHistory{}
+		if err := rows.Scan(
+			idScan(&history.TimerID),
+			&history.Version,
+			&history.PreviousEmployeeID,
+			&history.EmployeeID,
+			&history.ChangedAt,
+		); err != nil {
+			return nil, err
+		}
+		histories = append(histories, history)
+	}
+	return histories, rows.Err()
+}
+
 //TimerDelete can be used to delete one or all timers
-func TimerDelete(db interface {
-	Exec(query string, args ...interface{}) (sql.Result, error)
-}, timerID string) error {
+func TimerDelete(db Queryer, timerID string) error {
 
+	var timers []*Timer
 	var args []interface{}
-	var query string
 
-	if timerID == "" {
-		query = fmt.Sprintf("DELETE from %s", tableTimer)
-	} else {
-		query = fmt.Sprintf("DELETE from %s WHERE uuid=?", tableTimer)
-		args = []interface{}{timerID}
+	where, whereSelect := "1=1", "1=1"
+	if timerID != "" {
+		where, whereSelect, args = "uuid=?", "t.uuid=?", []interface{}{idArg(timerID)}
+	}
+	tx, err := txBegin(db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	//KIM: the timers are locked separately from being read since a locking
+	// read of timerSelect would also lock the employee
+	query := fmt.Sprintf("SELECT id FROM %s WHERE %s FOR UPDATE", tableTimer, where)
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	rows.Close()
+	if rows, err = tx.Query(timerSelect(whereSelect), args...); err != nil {
+		return err
+	}
+	for rows.Next() {
+		timer, err := timerScan(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		timers = append(timers, timer)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	query = fmt.Sprintf("DELETE from %s WHERE %s", tableTimer, where)
+	if _, err := tx.Exec(query, args...); err != nil {
+		return err
+	}
+	for _, timer := range timers {
+		if err := outboxWrite(tx, tableTimer, timer.ID, timer.Version, ChangeDeleted, timer); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+//TimersRead can be used to read the timers of a given employee (or all
+// timers if employeeID is empty)
+func TimersRead(db Queryer, employeeUUID string) ([]*Timer, error) {
+	var args []interface{}
+
+	where := "1=1 ORDER BY t.id"
+	if employeeUUID != "" {
+		where, args = "e.uuid=? ORDER BY t.id", []interface{}{idArg(employeeUUID)}
+	}
+	rows, err := db.Query(timerSelect(where), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var timers []*Timer
+	for rows.Next() {
+		timer, err := timerScan(rows)
+		if err != nil {
+			return nil, err
+		}
+		timers = append(timers, timer)
+	}
+	return timers, rows.Err()
+}
+
+//TimerComplete can be used to complete (or un-complete) the timer with the
+// given finish, if the timer is already in the given state (or doesn't exist)
+// nothing is done
+func TimerComplete(db Queryer, timerUUID string, finish int64, completed bool) error {
+	tx, err := txBegin(db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	query := fmt.Sprintf(`UPDATE %s SET finish=?, completed=?, version=version+1
+		WHERE uuid=? AND completed<>?`, tableTimer)
+	result, err := tx.Exec(query, finish, completed, idArg(timerUUID), completed)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n <= 0 {
+		return nil
+	}
+	timer, err := timerScan(tx.QueryRow(timerSelect("t.uuid=?"), idArg(timerUUID)))
+	if err != nil {
+		return err
+	}
+	if err := outboxWrite(tx, tableTimer, timer.ID, timer.Version, ChangeUpdated, timer); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+//TimerRestore can be used to re-create a deleted timer as it was (rather
+// than as a new timer), if the timer already exists, nothing is done
+func TimerRestore(db Queryer, timer *Timer) error {
+	var timerID int64
+
+	tx, err := txBegin(db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	query := fmt.Sprintf(`INSERT IGNORE INTO %s (uuid, start, finish, comment, completed, version, employee_id)
+		SELECT ?, ?, ?, ?, ?, ?, id FROM %s WHERE uuid=?`, tableTimer, tableEmployee)
+	result, err := tx.Exec(query, idArg(timer.ID), timer.Start, timer.Finish, timer.Comment,
+		timer.Completed, timer.Version+1, idArg(timer.EmployeeID))
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n <= 0 {
+		return tx.Commit()
+	}
+	if timerID, err = result.LastInsertId(); err != nil {
+		return err
+	}
+	if timer, err = timerScan(tx.QueryRow(timerSelect("t.id=?"), timerID)); err != nil {
+		return err
 	}
-	if _, err := db.Exec(query, args...); err != nil {
+	if err := outboxWrite(tx, tableTimer, timer.ID, timer.Version, ChangeCreated, timer); err != nil {
 		return err
 	}
-	return nil
+	return tx.Commit()
+}
+
+//sharedTimerStore stores timers in the same database as the employees (i.e.,
+// with a foreign key to the employee table) using the timer functions
+type sharedTimerStore struct {
+	db Queryer
+}
+
+//NewTimerStore can be used to create a timer store for a database created
+// with bludgeon_mysql.sql, the timers are stored with the employees
+func NewTimerStore(db Queryer) SagaTimerStore {
+	return &sharedTimerStore{db: db}
+}
+
+func (s *sharedTimerStore) TimerCreate(timer *Timer) (*Timer, error) {
+	return TimerCreate(s.db, timer)
+}
+
+func (s *sharedTimerStore) TimerRead(timerID string) (*Timer, error) {
+	return TimerRead(s.db, timerID)
+}
+
+func (s *sharedTimerStore) TimersRead(employeeID string) ([]*Timer, error) {
+	return TimersRead(s.db, employeeID)
+}
+
+func (s *sharedTimerStore) TimerWrite(timer *Timer) (*Timer, error) {
+	return TimerWrite(s.db, timer)
+}
+
+func (s *sharedTimerStore) TimerReassign(timerID string, timerVersion int, employeeID string) (*Timer, error) {
+	return TimerReassign(s.db, timerID, timerVersion, employeeID)
+}
+
+func (s *sharedTimerStore) TimerComplete(timerID string, finish int64, completed bool) error {
+	return TimerComplete(s.db, timerID, finish, completed)
+}
+
+func (s *sharedTimerStore) TimerRestore(timer *Timer) error {
+	return TimerRestore(s.db, timer)
+}
+
+func (s *sharedTimerStore) TimerDelete(timerID string) error {
+	return TimerDelete(s.db, timerID)
 }
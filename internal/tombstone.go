@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//defaultTombstoneRetention is how long tombstones are kept if a
+// retention isn't configured
+const defaultTombstoneRetention time.Duration = 30 * 24 * time.Hour
+
+//EmployeeTombstone records that an employee was deleted, when and by whom
+// such that a deleted employee can be told apart from one that never existed
+type EmployeeTombstone struct {
+	EmployeeID string `json:"employee_id"`
+	Version    int    `json:"version"`
+	DeletedAt  int64  `json:"deleted_at"`
+	DeletedBy  string `json:"deleted_by"`
+}
+
+//EmployeeDeletedError is returned when reading (or referencing) an employee
+// that has been deleted, it can be found with errors.As
+type EmployeeDeletedError struct {
+	EmployeeTombstone
+}
+
+func (e *EmployeeDeletedError) Error() string {
+	return fmt.Sprintf("employee with id, \"%s\", was deleted at %s by \"%s\"", e.EmployeeID,
+		time.Unix(e.DeletedAt, 0).UTC().Format(time.RFC3339), e.DeletedBy)
+}
+
+//IsEmployeeDeleted returns true if the error (or any error it wraps)
+// is an EmployeeDeletedError
+func IsEmployeeDeleted(err error) bool {
+	var errDeleted *EmployeeDeletedError
+
+	return errors.As(err, &errDeleted)
+}
+
+//employeeTombstoneWrite will write a tombstone for the employee, it must be
+// called within the same transaction as the delete; like the redirects, the
+// uuid is stored as text so tombstones survive converting ids to binary
+func employeeTombstoneWrite(db Queryer, employee *Employee, actor string) error {
+	query := fmt.Sprintf(`INSERT INTO %s (uuid, version, deleted_by) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE version=?, deleted_by=?, deleted_at=CURRENT_TIMESTAMP`, tableEmployeeTombstone)
+	_, err := db.Exec(query, employee.ID, employee.Version, actor, employee.Version, actor)
+	return err
+}
+
+//EmployeeTombstoneRead can be used to read the tombstone of a deleted employee,
+// it returns sql.ErrNoRows if the employee hasn't been deleted (or its
+// tombstone has been purged)
+func EmployeeTombstoneRead(db Queryer, employeeID string) (*EmployeeTombstone, error) {
+	return employeeTombstoneRead(db, employeeID, "")
+}
+
+//employeeTombstoneRead will read the tombstone with the given lock (e.g.,
+// LOCK IN SHARE MODE) to read the most recently committed tombstone
+func employeeTombstoneRead(db Queryer, employeeID, lock string) (*EmployeeTombstone, error) {
+	query := fmt.Sprintf(`SELECT uuid, version, UNIX_TIMESTAMP(deleted_at), deleted_by
+		FROM %s WHERE uuid=? %s`, tableEmployeeTombstone, lock)
+	tombstone := &EmployeeTombstone{}
+	if err := db.QueryRow(query, employeeID).Scan(&tombstone.EmployeeID,
+		&tombstone.Version, &tombstone.DeletedAt, &tombstone.DeletedBy); err != nil {
+		return nil, err
+	}
+	return tombstone, nil
+}
+
+//employeeNotFound returns the error for an employee that wasn't found, if
+// the employee has a tombstone, an EmployeeDeletedError is returned; operations
+// that reference the employee should read the tombstone with a lock
+func employeeNotFound(db Queryer, employeeID, lock string) error {
+	switch tombstone, err := employeeTombstoneRead(db, employeeID, lock); {
+	case err == nil:
+		return &EmployeeDeletedError{*tombstone}
+	case err != sql.ErrNoRows:
+		return err
+	}
+	return errors.Errorf("employee with id, \"%s\", not found locally", employeeID)
+}
+
+//EmployeeTombstonesPurge can be used to delete the tombstones older than the
+// retention, once purged, a deleted employee is indistinguishable from one that
+// never existed; it returns the number of tombstones purged
+func EmployeeTombstonesPurge(db Queryer, retention time.Duration) (int64, error) {
+	if retention <= 0 {
+		retention = defaultTombstoneRetention
+	}
+	query := fmt.Sprintf("DELETE FROM %s WHERE deleted_at < NOW() - INTERVAL ? SECOND", tableEmployeeTombstone)
+	result, err := db.Exec(query, int64(retention/time.Second))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
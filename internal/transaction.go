@@ -0,0 +1,208 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+)
+
+//these are the mysql error numbers that indicate the transaction was
+// rolled back (or should be) and can be attempted again
+const (
+	mysqlErrCheckRead       uint16 = 1020 //record has changed since last read
+	mysqlErrLockWaitTimeout uint16 = 1205
+	mysqlErrLockDeadlock    uint16 = 1213
+)
+
+//these are the defaults for the unit of work if not provided
+const (
+	defaultMaxAttempts int           = 5
+	defaultBackoff     time.Duration = 10 * time.Millisecond
+)
+
+//UnitOfWork can be used to execute multiple operations within a single
+// transaction, the transaction will be committed or rolled back as a
+// whole and attempted again in the event of a deadlock/serialization
+// failure
+type UnitOfWork struct {
+	DB          *sql.DB       //database to begin transactions with
+	MaxAttempts int           //maximum number of times to attempt the unit of work
+	Backoff     time.Duration //initial backoff between attempts, doubled on every attempt
+}
+
+//WithTx can be used to execute fn within a transaction using the default
+// unit of work configuration
+func WithTx(ctx context.Context, db *sql.DB, fn func(tx Tx) error) error {
+	return (&UnitOfWork{DB: db}).WithTx(ctx, fn)
+}
+
+//WithTx will begin a transaction and execute fn, if fn returns an error the
+// transaction is rolled back, otherwise it's committed; if the error is a
+// deadlock or serialization failure, fn will be executed again within a new
+// transaction so fn should not have side effects outside of the transaction
+func (u *UnitOfWork) WithTx(ctx context.Context, fn func(tx Tx) error) error {
+	maxAttempts, backoff := u.MaxAttempts, u.Backoff
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxAttempts
+	}
+	if backoff <= 0 {
+		backoff = defaultBackoff
+	}
+	for attempt := 1; ; attempt++ {
+		err := u.attempt(ctx, fn)
+		if err == nil {
+			return nil
+		}
+		if !errRetryable(err) || attempt >= maxAttempts {
+			return err
+		}
+		//KIM: jitter is added so that the transactions that deadlocked
+		// with each other don't attempt again at the same time
+		wait := backoff<<uint(attempt-1) + time.Duration(rand.Int63n(int64(backoff)))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (u *UnitOfWork) attempt(ctx context.Context, fn func(tx Tx) error) error {
+	sqlTx, err := u.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer sqlTx.Rollback()
+	if err := fn(&transaction{ctx: ctx, tx: sqlTx}); err != nil {
+		return err
+	}
+	return sqlTx.Commit()
+}
+
+//transaction is the implementation of Tx, it ensures that all
+// queries are executed with the unit of work's context
+type transaction struct {
+	ctx        context.Context
+	tx         *sql.Tx
+	savepoints int
+}
+
+func (t *transaction) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return t.tx.ExecContext(t.ctx, query, args...)
+}
+
+func (t *transaction) QueryRow(query string, args ...interface{}) *sql.Row {
+	return t.tx.QueryRowContext(t.ctx, query, args...)
+}
+
+func (t *transaction) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return t.tx.QueryContext(t.ctx, query, args...)
+}
+
+func (t *transaction) Savepoint(fn func(tx Tx) error) error {
+	//KIM: savepoints are named by a counter rather than depth so that
+	// sibling scopes never re-use (and overwrite) an existing savepoint
+	t.savepoints++
+	savepoint := fmt.Sprintf("savepoint_%d", t.savepoints)
+	if _, err := t.Exec("SAVEPOINT " + savepoint); err != nil {
+		return err
+	}
+	if err := fn(t); err != nil {
+		//KIM: if the transaction was rolled back (e.g., a deadlock), the
+		// savepoint went with it, so the error has to propagate to the unit
+		// of work; a lock wait timeout only rolls back the statement (unless
+		// innodb_rollback_on_timeout is set), so the savepoint still exists
+		if errRolledBack(err) {
+			return err
+		}
+		if _, errRollback := t.Exec("ROLLBACK TO SAVEPOINT " + savepoint); errRollback != nil {
+			return errors.Wrap(errRollback, err.Error())
+		}
+		return err
+	}
+	_, err := t.Exec("RELEASE SAVEPOINT " + savepoint)
+	return err
+}
+
+//txScope is used by functions that require a transaction, if they're given
+// a transaction it'll be used as is and commit/rollback are no-ops since the
+// owner of the transaction is responsible for committing or rolling back
+type txScope struct {
+	Queryer
+	tx *sql.Tx
+}
+
+func (t *txScope) Commit() error {
+	if t.tx == nil {
+		return nil
+	}
+	return t.tx.Commit()
+}
+
+func (t *txScope) Rollback() error {
+	if t.tx == nil {
+		return nil
+	}
+	return t.tx.Rollback()
+}
+
+//txOwned returns true if txBegin would begin a transaction for db rather
+// than use the transaction db already is
+func txOwned(db Queryer) bool {
+	_, ok := db.(interface {
+		Begin() (*sql.Tx, error)
+	})
+	return ok
+}
+
+//txBegin can be used to begin a transaction if db isn't already
+// a transaction
+func txBegin(db Queryer) (*txScope, error) {
+	beginner, ok := db.(interface {
+		Begin() (*sql.Tx, error)
+	})
+	if !ok {
+		return &txScope{Queryer: db}, nil
+	}
+	tx, err := beginner.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &txScope{Queryer: tx, tx: tx}, nil
+}
+
+//errRolledBack returns true if the error indicates that the database has
+// rolled back the entire transaction rather than just the statement
+func errRolledBack(err error) bool {
+	var mysqlErr *mysql.MySQLError
+
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	switch mysqlErr.Number {
+	case mysqlErrCheckRead, mysqlErrLockDeadlock:
+		return true
+	}
+	return false
+}
+
+//errRetryable returns true if the error indicates that the transaction
+// was (or should be) rolled back because of a deadlock, lock wait timeout
+// or serialization failure
+func errRetryable(err error) bool {
+	var mysqlErr *mysql.MySQLError
+
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	switch mysqlErr.Number {
+	case mysqlErrCheckRead, mysqlErrLockWaitTimeout, mysqlErrLockDeadlock:
+		return true
+	}
+	return false
+}
@@ -1,15 +1,43 @@
 package internal
 
-import "database/sql"
+import (
+	"database/sql"
+
+	"github.com/pkg/errors"
+)
 
 //KIM: these objects were copied from the project github.com/antonio-alexander/go-bludgeon
 // they have certainly been modified
 
 const (
-	tableTimer    string = "timer"
-	tableEmployee string = "employee"
+	tableTimer        string = "timer"
+	tableTimerHistory string = "timer_history"
+	tableEmployee     string = "employee"
+
+	tableEmployeeRedirect  string = "employee_redirect"
+	tableEmployeeDirectory string = "employee_directory"
+	tableOutbox            string = "outbox"
+	tableChangeSequence    string = "change_sequence"
+	tableEmployeeEvent     string = "employee_event"
+	tableSaga              string = "saga"
+	tableSagaJournal       string = "saga_journal"
+	tableEmployeeTombstone string = "employee_tombstone"
+
+	tableEmployeeReservation string = "employee_reservation"
+
+	tableWebhookSubscription string = "webhook_subscription"
+	tableWebhookDelivery     string = "webhook_delivery"
+	tableWebhookDeadLetter   string = "webhook_dead_letter"
+	tableLease               string = "lease"
+	tableXADecision          string = "xa_decision"
+
+	tableEmployeeVerification string = "employee_verification"
 )
 
+//ErrNotModified is returned when attempting to conditionally read
+// an object whose version hasn't changed
+var ErrNotModified = errors.New("not modified")
+
 // These variables are populated at build time
 // REFERENCE: https://www.digitalocean.com/community/tutorials/using-ldflags-to-set-version-information-for-go-applications
 // to find where the variables are...
@@ -26,6 +54,7 @@ type Employee struct {
 	FirstName    string `json:"first_name,omitempty"`
 	LastName     string `json:"last_name,omitempty"`
 	EmailAddress string `json:"email_address"`
+	Archived     bool   `json:"archived"`
 	Version      int    `json:"version"`
 	LastUpdated  int64  `json:"last_updated"`
 }
@@ -43,6 +72,56 @@ type Timer struct {
 	EmployeeID  string `json:"employee_id"`
 }
 
+//TimerHistory models a change in ownership of a given timer
+type TimerHistory struct {
+	TimerID            string `json:"timer_id"`
+	Version            int    `json:"version"`
+	PreviousEmployeeID string `json:"previous_employee_id"`
+	EmployeeID         string `json:"employee_id"`
+	ChangedAt          int64  `json:"changed_at"`
+}
+
+//Queryer provides an interface that's implemented by *sql.DB, *sql.Tx
+// and Tx, functions that accept a Queryer can be executed on their own
+// or as part of a larger transaction
+type Queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+//Tx provides an interface for a transaction shared between one or
+// more operations (a unit of work), it's committed or rolled back
+// as a whole by whoever created it
+type Tx interface {
+	Queryer
+
+	//Savepoint can be used to execute fn within a nested scope, if fn
+	// returns an error, everything done within the scope is rolled back
+	// but the transaction itself can continue
+	Savepoint(fn func(tx Tx) error) error
+}
+
+//EmployeeStore provides an interface for storing employees, it has the
+// same signatures as the employee functions so that different storage
+// modes (or decorators like caching) can be used interchangeably
+type EmployeeStore interface {
+	EmployeeCreate(employee *Employee) (*Employee, error)
+	EmployeeWrite(employee *Employee) (*Employee, error)
+	EmployeeDelete(employee *Employee) error
+	EmployeeRead(employeeID string) (*Employee, error)
+}
+
+//TimerStore provides an interface for storing timers, like EmployeeStore,
+// it has the same signatures as the timer functions
+type TimerStore interface {
+	TimerCreate(timer *Timer) (*Timer, error)
+	TimerRead(timerID string) (*Timer, error)
+	TimerWrite(timer *Timer) (*Timer, error)
+	TimerReassign(timerID string, timerVersion int, employeeID string) (*Timer, error)
+	TimerDelete(timerID string) error
+}
+
 //DB provides an interface that implements all functions required
 // by the DB
 type DB interface {
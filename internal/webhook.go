@@ -0,0 +1,550 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//these are the headers sent with every webhook
+const (
+	WebhookHeaderEvent     string = "X-Webhook-Event"
+	WebhookHeaderDelivery  string = "X-Webhook-Delivery"
+	WebhookHeaderSignature string = "X-Webhook-Signature"
+)
+
+//these are the defaults for the webhook worker if not provided
+const (
+	defaultWebhookBatchSize   int           = 100
+	defaultWebhookInterval    time.Duration = time.Second
+	defaultWebhookMaxAttempts int           = 8
+	defaultWebhookBackoff     time.Duration = time.Second
+	defaultWebhookMaxBackoff  time.Duration = time.Hour
+	defaultWebhookTimeout     time.Duration = 10 * time.Second
+	defaultWebhookLease       time.Duration = 15 * time.Minute
+	defaultWebhookRetention   time.Duration = 7 * 24 * time.Hour
+)
+
+//WebhookSubscription describes a url that's sent the changes with the given
+// event types (e.g., employee.deleted), each webhook is signed with the secret
+type WebhookSubscription struct {
+	ID         string   `json:"id"`
+	URL        string   `json:"url"`
+	EventTypes []string `json:"event_types"`
+	Secret     string   `json:"secret,omitempty"`
+	CreatedAt  int64    `json:"created_at"`
+}
+
+//WebhookPayload is the body of a webhook, it contains the uuid and version
+// of the entity such that receivers can ignore versions older than what
+// they've already seen (e.g., if a delivery is retried out of order)
+type WebhookPayload struct {
+	EventType  string          `json:"event_type"`
+	Sequence   int64           `json:"sequence"`
+	EntityType string          `json:"entity_type"`
+	EntityID   string          `json:"entity_id"`
+	Version    int             `json:"version"`
+	ChangeType string          `json:"change_type"`
+	Payload    json.RawMessage `json:"payload"`
+	CreatedAt  int64           `json:"created_at"`
+}
+
+//WebhookDeadLetter describes a webhook that couldn't be delivered within
+// the maximum number of attempts
+type WebhookDeadLetter struct {
+	ID             int64  `json:"id"`
+	SubscriptionID string `json:"subscription_id"`
+	Sequence       int64  `json:"sequence"`
+	EventType      string `json:"event_type"`
+	Attempts       int    `json:"attempts"`
+	LastError      string `json:"last_error"`
+	FailedAt       int64  `json:"failed_at"`
+}
+
+//WebhookEventType returns the event type of a change, it's the entity
+// type and change type separated by a period (e.g., employee.created)
+func WebhookEventType(entityType, changeType string) string {
+	return entityType + "." + changeType
+}
+
+//WebhookSign returns the signature of the body, it's the hex encoded
+// HMAC-SHA256 of the body using the secret prefixed by sha256=
+func WebhookSign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+//WebhookVerify can be used by receivers to verify the signature of a
+// webhook, the signatures are compared in constant time
+func WebhookVerify(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(WebhookSign(secret, body)), []byte(signature))
+}
+
+//WebhookSubscriptionCreate can be used to create a subscription, if the
+// secret is empty, a random secret is generated (and returned)
+func WebhookSubscriptionCreate(db Queryer, subscription *WebhookSubscription) (*WebhookSubscription, error) {
+	if subscription == nil {
+		return nil, errors.New("subscription is nil")
+	}
+	if subscription.URL == "" {
+		return nil, errors.New("subscription url is empty")
+	}
+	eventTypes := splitList(strings.Join(subscription.EventTypes, ","))
+	if len(eventTypes) == 0 {
+		return nil, errors.New("subscription has no event types")
+	}
+	secret := subscription.Secret
+	if secret == "" {
+		bytes := make([]byte, 32)
+		if _, err := rand.Read(bytes); err != nil {
+			return nil, err
+		}
+		secret = hex.EncodeToString(bytes)
+	}
+	id := subscription.ID
+	if id == "" {
+		id = GenerateID()
+	}
+	query := fmt.Sprintf(`INSERT INTO %s (uuid, url, event_types, secret) VALUES (?, ?, ?, ?)`,
+		tableWebhookSubscription)
+	if _, err := db.Exec(query, id, subscription.URL, strings.Join(eventTypes, ","), secret); err != nil {
+		return nil, err
+	}
+	return WebhookSubscriptionRead(db, id)
+}
+
+//webhookSubscriptionSelect returns a query to select the columns of a
+// subscription with the given where clause
+func webhookSubscriptionSelect(where string) string {
+	return fmt.Sprintf(`SELECT uuid, url, event_types, secret, UNIX_TIMESTAMP(created_at)
+		FROM %s WHERE %s`, tableWebhookSubscription, where)
+}
+
+//webhookSubscriptionScan can be used to scan a row selected with
+// webhookSubscriptionSelect
+func webhookSubscriptionScan(row interface {
+	Scan(dest ...interface{}) error
+}) (*WebhookSubscription, error) {
+	var eventTypes string
+
+	subscription := &WebhookSubscription{}
+	if err := row.Scan(&subscription.ID, &subscription.URL, &eventTypes,
+		&subscription.Secret, &subscription.CreatedAt); err != nil {
+		return nil, err
+	}
+	subscription.EventTypes = splitList(eventTypes)
+	return subscription, nil
+}
+
+//WebhookSubscriptionRead can be used to read a given subscription
+func WebhookSubscriptionRead(db Queryer, subscriptionID string) (*WebhookSubscription, error) {
+	subscription, err := webhookSubscriptionScan(db.QueryRow(webhookSubscriptionSelect("uuid=?"), subscriptionID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.Errorf("subscription with id, \"%s\", not found locally", subscriptionID)
+		}
+		return nil, err
+	}
+	return subscription, nil
+}
+
+//WebhookSubscriptionsRead can be used to read all subscriptions
+func WebhookSubscriptionsRead(db Queryer) ([]*WebhookSubscription, error) {
+	rows, err := db.Query(webhookSubscriptionSelect("1=1 ORDER BY id"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var subscriptions []*WebhookSubscription
+	for rows.Next() {
+		subscription, err := webhookSubscriptionScan(rows)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+	return subscriptions, rows.Err()
+}
+
+//WebhookSubscriptionDelete can be used to delete a subscription, its pending
+// deliveries and dead letters are also deleted
+func WebhookSubscriptionDelete(db Queryer, subscriptionID string) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE uuid=?", tableWebhookSubscription)
+	result, err := db.Exec(query, subscriptionID)
+	if err != nil {
+		return err
+	}
+	return RowsAffected(result, "no rows affected, non-existent subscription")
+}
+
+//WebhookPublisher is a publisher for the outbox relay, rather than sending
+// webhooks itself, it queues a delivery for each subscription interested in
+// the message; this way a slow (or unreachable) subscriber doesn't hold up
+// the relay (or the other subscribers)
+type WebhookPublisher struct {
+	db Queryer
+}
+
+//NewWebhookPublisher can be used to create a publisher that queues
+// deliveries in the given database
+func NewWebhookPublisher(db Queryer) *WebhookPublisher {
+	return &WebhookPublisher{db: db}
+}
+
+//Publish will queue a delivery of the message to each subscription that's
+// subscribed to its event type, since messages may be published more than
+// once, deliveries are unique by subscription and sequence
+func (w *WebhookPublisher) Publish(ctx context.Context, message *OutboxMessage) error {
+	eventType := WebhookEventType(message.EntityType, message.ChangeType)
+	bytes, err := json.Marshal(&WebhookPayload{
+		EventType:  eventType,
+		Sequence:   message.Sequence,
+		EntityType: message.EntityType,
+		EntityID:   message.EntityID,
+		Version:    message.Version,
+		ChangeType: message.ChangeType,
+		Payload:    message.Payload,
+		CreatedAt:  message.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	//KIM: event types are stored as a comma separated list, FIND_IN_SET
+	// can't use an index, but the number of subscriptions should be small
+	query := fmt.Sprintf(`INSERT IGNORE INTO %s (subscription_id, sequence, event_type, payload)
+		SELECT id, ?, ?, ? FROM %s WHERE FIND_IN_SET(?, event_types) > 0`,
+		tableWebhookDelivery, tableWebhookSubscription)
+	_, err = w.db.Exec(query, message.Sequence, eventType, bytes, eventType)
+	return err
+}
+
+//webhookDelivery describes a single queued webhook, the claim is the
+// token of the worker that's sending it
+type webhookDelivery struct {
+	id        int64
+	claim     string
+	url       string
+	secret    string
+	eventType string
+	attempts  int
+	payload   []byte
+}
+
+//WebhookWorker can be used to send the queued webhooks, webhooks are sent at
+// least once (e.g., if the worker stops after sending, but before recording
+// the delivery) and failed deliveries are retried with exponential backoff
+// until the maximum number of attempts, after which they're dead lettered;
+// more than one worker can run at once, each delivery is claimed by a single
+// worker for the lease
+type WebhookWorker struct {
+	DB          *sql.DB       //database containing the deliveries
+	Client      *http.Client  //client used to send webhooks
+	BatchSize   int           //maximum number of webhooks to send per poll
+	Interval    time.Duration //interval to poll for webhooks when there's nothing to send
+	MaxAttempts int           //maximum number of attempts before a webhook is dead lettered
+	Backoff     time.Duration //how long to wait before the first retry, doubled for each retry
+	MaxBackoff  time.Duration //maximum amount of time to wait before a retry
+	Lease       time.Duration //how long a claimed batch is held before another worker can claim it
+}
+
+//backoff returns how long to wait before the next attempt given the number
+// of attempts so far
+func (w *WebhookWorker) backoff(attempts int) time.Duration {
+	backoff, maxBackoff := w.Backoff, w.MaxBackoff
+	if backoff <= 0 {
+		backoff = defaultWebhookBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = defaultWebhookMaxBackoff
+	}
+	for i := 1; i < attempts && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		return maxBackoff
+	}
+	return backoff
+}
+
+//send will send a single webhook, any response other than a 2xx is
+// considered a failure
+func (w *WebhookWorker) send(ctx context.Context, delivery *webhookDelivery) error {
+	client := w.Client
+	if client == nil {
+		client = &http.Client{Timeout: defaultWebhookTimeout}
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.url, bytes.NewReader(delivery.payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(WebhookHeaderEvent, delivery.eventType)
+	request.Header.Set(WebhookHeaderDelivery, fmt.Sprint(delivery.id))
+	request.Header.Set(WebhookHeaderSignature, WebhookSign(delivery.secret, delivery.payload))
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return errors.Errorf("unexpected status code: %d", response.StatusCode)
+	}
+	return nil
+}
+
+//failed will record a failed attempt, if it was the last attempt, the
+// delivery is copied to the dead letter table and marked as dead; the
+// delivery is kept (rather than deleted) since it's what keeps a message
+// that's published again from being queued again
+func (w *WebhookWorker) failed(ctx context.Context, delivery *webhookDelivery, errSend error) error {
+	maxAttempts := w.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultWebhookMaxAttempts
+	}
+	attempts := delivery.attempts + 1
+	if attempts < maxAttempts {
+		query := fmt.Sprintf(`UPDATE %s SET attempts=?, last_error=?,
+			next_attempt_at=NOW(6) + INTERVAL ? MICROSECOND WHERE id=? AND claim=?`, tableWebhookDelivery)
+		_, err := w.DB.ExecContext(ctx, query, attempts, errSend.Error(),
+			int64(w.backoff(attempts)/time.Microsecond), delivery.id, delivery.claim)
+		return err
+	}
+	tx, err := w.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	query := fmt.Sprintf(`INSERT INTO %s (subscription_id, sequence, event_type, payload, attempts, last_error)
+		SELECT subscription_id, sequence, event_type, payload, ?, ? FROM %s WHERE id=? AND claim=?`,
+		tableWebhookDeadLetter, tableWebhookDelivery)
+	if _, err := tx.ExecContext(ctx, query, attempts, errSend.Error(), delivery.id, delivery.claim); err != nil {
+		return err
+	}
+	query = fmt.Sprintf(`UPDATE %s SET attempts=?, last_error=?, dead_at=NOW(6)
+		WHERE id=? AND claim=?`, tableWebhookDelivery)
+	if _, err := tx.ExecContext(ctx, query, attempts, errSend.Error(), delivery.id, delivery.claim); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+//claim will claim a batch of the webhooks that are due for the lease, a
+// claimed webhook isn't due again until the lease expires (e.g., if the
+// worker stops while sending), so other workers skip it; the claim is a
+// token that's checked whenever the delivery is updated, if the lease has
+// expired and another worker has claimed the webhook, the update is ignored
+func (w *WebhookWorker) claim(ctx context.Context) ([]*webhookDelivery, error) {
+	var deliveries []*webhookDelivery
+	var args []interface{}
+
+	batchSize, lease := w.BatchSize, w.Lease
+	if batchSize <= 0 {
+		batchSize = defaultWebhookBatchSize
+	}
+	if lease <= 0 {
+		lease = defaultWebhookLease
+	}
+	claim := GenerateID()
+	tx, err := w.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	//KIM: rows locked by another worker (that's claiming them) are skipped
+	// rather than waited for
+	query := fmt.Sprintf(`SELECT id FROM %s WHERE delivered_at IS NULL AND dead_at IS NULL
+		AND next_attempt_at <= NOW(6) ORDER BY next_attempt_at, id LIMIT ? FOR UPDATE SKIP LOCKED`, tableWebhookDelivery)
+	rows, err := tx.QueryContext(ctx, query, batchSize)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id int64
+
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		args = append(args, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, nil
+	}
+	query = fmt.Sprintf(`UPDATE %s SET claim=?, next_attempt_at=NOW(6) + INTERVAL ? MICROSECOND
+		WHERE id IN (?%s)`, tableWebhookDelivery, strings.Repeat(", ?", len(args)-1))
+	if _, err := tx.ExecContext(ctx, query, append([]interface{}{claim, int64(lease / time.Microsecond)}, args...)...); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	query = fmt.Sprintf(`SELECT d.id, d.claim, s.url, s.secret, d.event_type, d.attempts, d.payload
+		FROM %s d JOIN %s s ON d.subscription_id=s.id
+		WHERE d.claim=? AND d.delivered_at IS NULL AND d.dead_at IS NULL ORDER BY d.id`, tableWebhookDelivery, tableWebhookSubscription)
+	if rows, err = w.DB.QueryContext(ctx, query, claim); err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		delivery := &webhookDelivery{}
+		if err := rows.Scan(&delivery.id, &delivery.claim, &delivery.url, &delivery.secret,
+			&delivery.eventType, &delivery.attempts, &delivery.payload); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+//Deliver will claim and send a single batch of the webhooks that are due, it
+// returns the number of webhooks that were sent successfully; failed webhooks
+// are rescheduled (or dead lettered) rather than returned as an error
+func (w *WebhookWorker) Deliver(ctx context.Context) (int, error) {
+	var delivered int
+
+	deliveries, err := w.claim(ctx)
+	if err != nil {
+		return 0, err
+	}
+	//KIM: the webhooks are sent outside of a transaction, a transaction
+	// would hold its locks for as long as the slowest subscriber
+	for _, delivery := range deliveries {
+		if errSend := w.send(ctx, delivery); errSend != nil {
+			if err := w.failed(ctx, delivery, errSend); err != nil {
+				return delivered, err
+			}
+			continue
+		}
+		query := fmt.Sprintf(`UPDATE %s SET attempts=attempts+1, last_error="", delivered_at=NOW(6)
+			WHERE id=? AND claim=?`, tableWebhookDelivery)
+		if _, err := w.DB.ExecContext(ctx, query, delivery.id, delivery.claim); err != nil {
+			return delivered, err
+		}
+		delivered++
+	}
+	return delivered, nil
+}
+
+//WebhookDeliveriesPurge can be used to delete the deliveries that were
+// delivered longer ago than the retention; a message that's published again
+// after its delivery was purged is delivered again, so the retention should
+// be longer than the outbox relay could reasonably take to mark a message as
+// delivered; it returns the number of deliveries purged
+func WebhookDeliveriesPurge(db Queryer, retention time.Duration) (int64, error) {
+	if retention <= 0 {
+		retention = defaultWebhookRetention
+	}
+	query := fmt.Sprintf("DELETE FROM %s WHERE delivered_at < NOW() - INTERVAL ? SECOND", tableWebhookDelivery)
+	result, err := db.Exec(query, int64(retention/time.Second))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+//Run will send webhooks until the context is cancelled, when there's nothing
+// to send, it'll wait for the interval before polling again; it returns the
+// error that caused the context to be cancelled
+func (w *WebhookWorker) Run(ctx context.Context) error {
+	interval := w.Interval
+	if interval <= 0 {
+		interval = defaultWebhookInterval
+	}
+	for {
+		delivered, err := w.Deliver(ctx)
+		if err == nil && delivered > 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+//WebhookDeadLettersRead can be used to read the dead letters of a given
+// subscription (or all dead letters if subscriptionID is empty)
+func WebhookDeadLettersRead(db Queryer, subscriptionID string) ([]*WebhookDeadLetter, error) {
+	var args []interface{}
+
+	where := "1=1 ORDER BY l.id"
+	if subscriptionID != "" {
+		where, args = "s.uuid=? ORDER BY l.id", []interface{}{subscriptionID}
+	}
+	query := fmt.Sprintf(`SELECT l.id, s.uuid, l.sequence, l.event_type, l.attempts, l.last_error, UNIX_TIMESTAMP(l.failed_at)
+		FROM %s l JOIN %s s ON l.subscription_id=s.id WHERE %s`,
+		tableWebhookDeadLetter, tableWebhookSubscription, where)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var deadLetters []*WebhookDeadLetter
+	for rows.Next() {
+		deadLetter := &WebhookDeadLetter{}
+		if err := rows.Scan(&deadLetter.ID, &deadLetter.SubscriptionID, &deadLetter.Sequence,
+			&deadLetter.EventType, &deadLetter.Attempts, &deadLetter.LastError, &deadLetter.FailedAt); err != nil {
+			return nil, err
+		}
+		deadLetters = append(deadLetters, deadLetter)
+	}
+	return deadLetters, rows.Err()
+}
+
+//WebhookReplay can be used to queue the given dead letters (or all dead letters
+// if no ids are provided) to be delivered again, the number of attempts starts
+// over; it returns the number of dead letters replayed
+func WebhookReplay(db Queryer, deadLetterIDs ...int64) (int64, error) {
+	var args []interface{}
+
+	where := "1=1"
+	if len(deadLetterIDs) > 0 {
+		where = "id IN (?" + strings.Repeat(", ?", len(deadLetterIDs)-1) + ")"
+		for _, id := range deadLetterIDs {
+			args = append(args, id)
+		}
+	}
+	tx, err := txBegin(db)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	//KIM: a replayed delivery replaces the dead delivery of the same sequence,
+	// so it's queued again with its attempts starting over
+	query := fmt.Sprintf(`REPLACE INTO %s (subscription_id, sequence, event_type, payload)
+		SELECT subscription_id, sequence, event_type, payload FROM %s WHERE %s FOR UPDATE`,
+		tableWebhookDelivery, tableWebhookDeadLetter, where)
+	if _, err := tx.Exec(query, args...); err != nil {
+		return 0, err
+	}
+	query = fmt.Sprintf("DELETE FROM %s WHERE %s", tableWebhookDeadLetter, where)
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	replayed, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return replayed, nil
+}
@@ -0,0 +1,395 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//these are the states of a decision in the decision log, a transaction is
+// only committed once its decision is commit (the commit point)
+const (
+	XAPreparing string = "preparing"
+	XACommit    string = "commit"
+	XARollback  string = "rollback"
+	XACompleted string = "completed"
+)
+
+//these are the points at which the coordinator can be made to "crash" (i.e.,
+// stop and disconnect without finishing) to demonstrate recovery
+const (
+	XACrashAfterPrepare  string = "prepare"
+	XACrashAfterDecision string = "decision"
+)
+
+//defaultXARecoverAge is how old a decision must be before it's recovered,
+// it keeps recovery from resolving transactions that are still in progress
+const defaultXARecoverAge time.Duration = time.Minute
+
+//ErrXACrash is returned when the coordinator "crashes" on purpose
+var ErrXACrash = errors.New("coordinator crashed")
+
+//xaBranchName is used to validate branch names, the xid can't be a
+// placeholder so it's written into the statement as is
+var xaBranchName = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+//XABranch describes a branch of a global (XA) transaction, fn is executed
+// within the branch using a single connection of db
+type XABranch struct {
+	Name string
+	DB   *sql.DB
+	Fn   func(db Queryer) error
+}
+
+//XADecision describes a global transaction in the decision log
+type XADecision struct {
+	ID        string   `json:"id"`
+	State     string   `json:"state"`
+	Branches  []string `json:"branches"`
+	CreatedAt int64    `json:"created_at"`
+}
+
+//XACoordinator can be used to execute a global transaction across more than
+// one database with two-phase commit, its decisions are recorded in the
+// decision log (xa_decision) of db such that in-doubt transactions can be
+// resolved after a crash
+type XACoordinator struct {
+	db         *sql.DB
+	CrashAfter string //if set, the coordinator crashes after prepare or decision (for demonstration)
+}
+
+//NewXACoordinator can be used to create a coordinator whose decision log
+// is stored in db
+func NewXACoordinator(db *sql.DB) *XACoordinator {
+	return &XACoordinator{db: db}
+}
+
+//xaConn is the implementation of Queryer for a branch, every statement
+// of a branch must be executed on the same connection
+type xaConn struct {
+	ctx  context.Context
+	conn *sql.Conn
+}
+
+func (x *xaConn) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return x.conn.ExecContext(x.ctx, query, args...)
+}
+
+func (x *xaConn) QueryRow(query string, args ...interface{}) *sql.Row {
+	return x.conn.QueryRowContext(x.ctx, query, args...)
+}
+
+func (x *xaConn) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return x.conn.QueryContext(x.ctx, query, args...)
+}
+
+//xaID returns the xid of a branch, the global transaction id and the
+// branch qualifier
+func xaID(gtrid, branch string) string {
+	return fmt.Sprintf("'%s','%s'", gtrid, branch)
+}
+
+//xaDecisionWrite will move the decision from one state to another, like the
+// other mutations, it's a check and set: if the decision isn't in the from
+// state (e.g., it's already been decided), no rows are affected
+func xaDecisionWrite(ctx context.Context, db *sql.DB, gtrid, from, to string) error {
+	query := fmt.Sprintf("UPDATE %s SET state=? WHERE gtrid=? AND state=?", tableXADecision)
+	result, err := db.ExecContext(ctx, query, to, gtrid, from)
+	if err != nil {
+		return err
+	}
+	return RowsAffected(result, fmt.Sprintf("no rows affected, decision not %s", from))
+}
+
+//xaBranchState describes a branch that's in progress, a branch is finished
+// once it's been committed or rolled back
+type xaBranchState struct {
+	*XABranch
+	conn     *sql.Conn
+	prepared bool
+	finished bool
+}
+
+//rollback will roll back the branch, if it hasn't been prepared, it's
+// ended first
+func (b *xaBranchState) rollback(ctx context.Context, gtrid string) error {
+	xid := xaID(gtrid, b.Name)
+	if !b.prepared {
+		//KIM: if the branch failed, it may already be ended (or not even
+		// started) so the error is ignored, the rollback will tell
+		b.conn.ExecContext(ctx, "XA END "+xid)
+	}
+	if _, err := b.conn.ExecContext(ctx, "XA ROLLBACK "+xid); err != nil {
+		return err
+	}
+	b.finished = true
+	return nil
+}
+
+//commit will commit the branch
+func (b *xaBranchState) commit(ctx context.Context, gtrid string) error {
+	if _, err := b.conn.ExecContext(ctx, "XA COMMIT "+xaID(gtrid, b.Name)); err != nil {
+		return err
+	}
+	b.finished = true
+	return nil
+}
+
+//close will return the connection of the branch to the pool if it's been
+// finished, otherwise, the connection is discarded: it may still be in the
+// global transaction (or have a prepared branch) and the next user of the
+// connection would fail with XAER_RMFAIL or run within the transaction
+func (b *xaBranchState) close() {
+	if !b.finished {
+		connDiscard(b.conn)
+		return
+	}
+	b.conn.Close()
+}
+
+//Execute will execute the branches as a single global transaction, each
+// branch is prepared, the decision is recorded, then each branch is
+// committed; if any branch fails before the decision is recorded, every
+// branch is rolled back; it returns the id of the global transaction
+func (c *XACoordinator) Execute(ctx context.Context, branches ...*XABranch) (string, error) {
+	var states []*xaBranchState
+
+	gtrid := GenerateID()
+	names := make([]string, 0, len(branches))
+	for _, branch := range branches {
+		if !xaBranchName.MatchString(branch.Name) {
+			return "", errors.Errorf("invalid branch name: \"%s\"", branch.Name)
+		}
+		names = append(names, branch.Name)
+	}
+	bytes, err := json.Marshal(names)
+	if err != nil {
+		return "", err
+	}
+	//KIM: the decision is written before any branch is started, so every
+	// prepared branch has a decision that recovery can find
+	query := fmt.Sprintf("INSERT INTO %s (gtrid, state, branches) VALUES (?, ?, ?)", tableXADecision)
+	if _, err := c.db.ExecContext(ctx, query, gtrid, XAPreparing, bytes); err != nil {
+		return "", err
+	}
+	defer func() {
+		for _, state := range states {
+			state.close()
+		}
+	}()
+	abort := func(err error) (string, error) {
+		//KIM: the decision is written before the branches are rolled back, if
+		// it can't be written (e.g., the decision was commit after all), the
+		// branches are left to recovery
+		if errDecision := xaDecisionWrite(context.Background(), c.db, gtrid, XAPreparing, XARollback); errDecision != nil {
+			return gtrid, errors.Wrap(err, errDecision.Error())
+		}
+		//KIM: every branch is rolled back even if one of them can't be, the
+		// ones that can't are left to recovery
+		for _, state := range states {
+			if errRollback := state.rollback(context.Background(), gtrid); errRollback != nil {
+				err = errors.Wrapf(err, "unable to roll back branch \"%s\": %s", state.Name, errRollback)
+			}
+		}
+		return gtrid, err
+	}
+	//phase one: prepare
+	for _, branch := range branches {
+		conn, err := branch.DB.Conn(ctx)
+		if err != nil {
+			return abort(err)
+		}
+		state := &xaBranchState{XABranch: branch, conn: conn}
+		states = append(states, state)
+		xid := xaID(gtrid, branch.Name)
+		if _, err := conn.ExecContext(ctx, "XA START "+xid); err != nil {
+			return abort(err)
+		}
+		if err := branch.Fn(&xaConn{ctx: ctx, conn: conn}); err != nil {
+			return abort(errors.Wrapf(err, "branch \"%s\"", branch.Name))
+		}
+		if _, err := conn.ExecContext(ctx, "XA END "+xid); err != nil {
+			return abort(err)
+		}
+		if _, err := conn.ExecContext(ctx, "XA PREPARE "+xid); err != nil {
+			return abort(err)
+		}
+		state.prepared = true
+	}
+	//KIM: to crash, the coordinator returns without finishing the branches,
+	// their connections are discarded (disconnected) so the prepared branches
+	// are left in doubt until they're recovered
+	if c.CrashAfter == XACrashAfterPrepare {
+		return gtrid, ErrXACrash
+	}
+	//KIM: this is the commit point, once the decision is commit, the
+	// transaction will be committed (now or by recovery)
+	if err := xaDecisionWrite(ctx, c.db, gtrid, XAPreparing, XACommit); err != nil {
+		return abort(err)
+	}
+	if c.CrashAfter == XACrashAfterDecision {
+		return gtrid, ErrXACrash
+	}
+	//phase two: commit, every branch is committed even if one of them can't
+	// be, the ones that can't are left to recovery
+	var errCommit error
+	for _, state := range states {
+		if err := state.commit(context.Background(), gtrid); err != nil && errCommit == nil {
+			errCommit = errors.Wrapf(err, "transaction committed, but branch \"%s\" must be recovered", state.Name)
+		}
+	}
+	if errCommit != nil {
+		return gtrid, errCommit
+	}
+	if err := xaDecisionWrite(context.Background(), c.db, gtrid, XACommit, XACompleted); err != nil {
+		return gtrid, err
+	}
+	return gtrid, nil
+}
+
+//XAInDoubt describes a prepared branch that hasn't been committed or rolled
+// back, along with the decision for its global transaction
+type XAInDoubt struct {
+	ID       string `json:"id"`
+	Branch   string `json:"branch"`
+	Decision string `json:"decision"`
+}
+
+//xaInDoubtRead will read the prepared branches of db using XA RECOVER, the
+// data column is the global transaction id followed by the branch qualifier
+func xaInDoubtRead(ctx context.Context, db *sql.DB) ([]*XAInDoubt, error) {
+	rows, err := db.QueryContext(ctx, "XA RECOVER")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var inDoubt []*XAInDoubt
+	for rows.Next() {
+		var formatID, gtridLength, bqualLength int
+		var data string
+
+		if err := rows.Scan(&formatID, &gtridLength, &bqualLength, &data); err != nil {
+			return nil, err
+		}
+		if gtridLength+bqualLength > len(data) {
+			continue
+		}
+		inDoubt = append(inDoubt, &XAInDoubt{
+			ID:     data[:gtridLength],
+			Branch: data[gtridLength : gtridLength+bqualLength],
+		})
+	}
+	return inDoubt, rows.Err()
+}
+
+//xaDecisionRead can be used to read a decision, it returns sql.ErrNoRows
+// if the decision isn't older than age (or doesn't exist)
+func xaDecisionRead(ctx context.Context, db *sql.DB, gtrid string, age time.Duration) (*XADecision, error) {
+	var branches []byte
+
+	query := fmt.Sprintf(`SELECT gtrid, state, branches, UNIX_TIMESTAMP(created_at) FROM %s
+		WHERE gtrid=? AND created_at <= NOW() - INTERVAL ? SECOND`, tableXADecision)
+	decision := &XADecision{}
+	if err := db.QueryRowContext(ctx, query, gtrid, int64(age/time.Second)).Scan(&decision.ID,
+		&decision.State, &branches, &decision.CreatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(branches, &decision.Branches); err != nil {
+		return nil, err
+	}
+	return decision, nil
+}
+
+//Recover can be used to find (and resolve) the in-doubt branches of the
+// given databases (by name) after the coordinator has crashed; branches whose
+// decision is commit are committed, every other branch with a decision is
+// rolled back (presumed abort); branches without a decision (e.g., they belong
+// to another coordinator or are still in progress) are left alone; if resolve
+// is false, the in-doubt branches are only listed
+func (c *XACoordinator) Recover(ctx context.Context, databases map[string]*sql.DB, age time.Duration, resolve bool) ([]*XAInDoubt, error) {
+	var resolved []*XAInDoubt
+
+	if age <= 0 {
+		age = defaultXARecoverAge
+	}
+	seen := make(map[string]bool)
+	for database, db := range databases {
+		//KIM: XA RECOVER lists the prepared branches of the whole server, so if
+		// more than one database is on the same server, the branches of the
+		// other databases are resolved too (and won't be listed again)
+		inDoubt, err := xaInDoubtRead(ctx, db)
+		if err != nil {
+			return resolved, errors.Wrapf(err, "database \"%s\"", database)
+		}
+		for _, branch := range inDoubt {
+			xid := xaID(branch.ID, branch.Branch)
+			if seen[xid] {
+				continue
+			}
+			seen[xid] = true
+			decision, err := xaDecisionRead(ctx, c.db, branch.ID, age)
+			switch {
+			case err == sql.ErrNoRows:
+				continue
+			case err != nil:
+				return resolved, err
+			}
+			branch.Decision = decision.State
+			resolved = append(resolved, branch)
+			if !resolve {
+				continue
+			}
+			statement := "XA ROLLBACK "
+			if decision.State == XACommit || decision.State == XACompleted {
+				statement = "XA COMMIT "
+			}
+			if _, err := db.ExecContext(ctx, statement+xid); err != nil {
+				return resolved, errors.Wrapf(err, "database \"%s\"", database)
+			}
+		}
+	}
+	if !resolve {
+		return resolved, nil
+	}
+	//KIM: once the in-doubt branches of every database are resolved, the
+	// decisions that were left behind can be finished
+	query := fmt.Sprintf(`UPDATE %s SET state=? WHERE state=? AND created_at <= NOW() - INTERVAL ? SECOND`, tableXADecision)
+	if _, err := c.db.ExecContext(ctx, query, XACompleted, XACommit, int64(age/time.Second)); err != nil {
+		return resolved, err
+	}
+	if _, err := c.db.ExecContext(ctx, query, XARollback, XAPreparing, int64(age/time.Second)); err != nil {
+		return resolved, err
+	}
+	return resolved, nil
+}
+
+//XAEmployeeTimerCreate can be used to create an employee (in employees) and
+// a timer for that employee (in timers) atomically, it demonstrates two-phase
+// commit across the databases of the employee and timer services; the email
+// address is normalized with options
+func (c *XACoordinator) XAEmployeeTimerCreate(ctx context.Context, employees, timers *sql.DB, employee *Employee, timer *Timer, options EmailOptions) (string, error) {
+	return c.Execute(ctx, &XABranch{
+		Name: "employees",
+		DB:   employees,
+		Fn: func(db Queryer) error {
+			created, err := EmployeeCreate(db, employee, options)
+			if err != nil {
+				return err
+			}
+			timer.EmployeeID = created.ID
+			return nil
+		},
+	}, &XABranch{
+		Name: "timers",
+		DB:   timers,
+		Fn: func(db Queryer) error {
+			_, err := NewSplitTimerStore(db, nil, "").TimerCreate(timer)
+			return err
+		},
+	})
+}